@@ -0,0 +1,276 @@
+package sphinx
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// AttributionMaxHops is the maximum number of hops that can be
+	// attributed within an attributable error. Hops beyond this position
+	// can still report a failure, but won't be held accountable for
+	// corrupting it.
+	AttributionMaxHops = 20
+
+	// holdTimeSize is the size of a single hold time value within the
+	// attribution data.
+	holdTimeSize = 4
+
+	// attributionHMACSize is the size of the truncated HMACs within the
+	// attribution data.
+	attributionHMACSize = 4
+
+	// numAttributionHMACs is the total number of HMACs carried within the
+	// attribution data. Every hop adds AttributionMaxHops HMACs, one for
+	// each position it could have in the route, while the HMACs of the
+	// downstream hops for the positions that are no longer possible are
+	// dropped. This results in a triangle of 20 + 19 + ... + 1 HMACs.
+	numAttributionHMACs = AttributionMaxHops * (AttributionMaxHops + 1) / 2
+
+	// attributionDataLength is the length of the attribution data that
+	// follows the failure message of an attributable error.
+	attributionDataLength = AttributionMaxHops*holdTimeSize +
+		numAttributionHMACs*attributionHMACSize
+
+	// holdTimesLength is the length of the hold times section of the
+	// attribution data.
+	holdTimesLength = AttributionMaxHops * holdTimeSize
+)
+
+// errAttributableTrampoline is returned when an attributable error is to be
+// encrypted by a trampoline node.
+var errAttributableTrampoline = errors.New("attributable errors are not " +
+	"supported for trampoline onions")
+
+// attributionHMACOffset returns the offset of the HMAC within the HMACs
+// section of the attribution data that the hop hopsDownstream hops downstream
+// of the current hop computed for the given position of the current hop.
+func attributionHMACOffset(hopsDownstream, position int) int {
+	// The current hop owns the first AttributionMaxHops HMACs, while the
+	// hop k hops downstream owns AttributionMaxHops-k HMACs, covering the
+	// positions k and onwards of the current hop.
+	offset := hopsDownstream*AttributionMaxHops -
+		hopsDownstream*(hopsDownstream-1)/2
+
+	return holdTimesLength + (offset+position)*attributionHMACSize
+}
+
+// computeAttributionHMAC computes the HMAC of a hop at the given position in
+// the route. The HMAC covers the failure message, the hold times of the hop
+// and all of its downstream hops, along with the HMACs that the downstream
+// hops computed for their corresponding positions.
+func computeAttributionHMAC(sharedSecret *Hash256, message,
+	attribution []byte, position int) []byte {
+
+	umKey := generateKey("umext", sharedSecret)
+	h := hmac.New(sha256.New, umKey[:])
+	h.Write(message)
+
+	numHops := AttributionMaxHops - position
+	h.Write(attribution[:numHops*holdTimeSize])
+	for k := 1; k < numHops; k++ {
+		offset := attributionHMACOffset(k, position)
+		h.Write(attribution[offset : offset+attributionHMACSize])
+	}
+
+	return h.Sum(nil)[:attributionHMACSize]
+}
+
+// encryptAttributionData adds or strips a layer of encryption from the
+// attribution data using a cipher stream that is distinct from the one used
+// for the failure message.
+func encryptAttributionData(sharedSecret *Hash256, attribution []byte) []byte {
+	streamBytes := generateCipherStream(
+		generateKey("ammagext", sharedSecret), uint(len(attribution)),
+	)
+
+	encrypted := make([]byte, len(attribution))
+	xor(encrypted, attribution, streamBytes)
+
+	return encrypted
+}
+
+// shiftAttributionData returns a copy of the attribution data received from
+// the downstream hop with the hold time and HMACs of the current hop zeroed
+// out at the front. The downstream hops are now one position further from the
+// sender, so each of them loses the HMAC for the first position it was
+// responsible for, and the hop at the furthest position drops out entirely.
+func shiftAttributionData(downstream []byte) []byte {
+	attribution := make([]byte, attributionDataLength)
+	copy(
+		attribution[holdTimeSize:holdTimesLength],
+		downstream[:holdTimesLength-holdTimeSize],
+	)
+
+	for k := 0; k < AttributionMaxHops-1; k++ {
+		n := (AttributionMaxHops - k - 1) * attributionHMACSize
+		from := attributionHMACOffset(k, 1)
+		to := attributionHMACOffset(k+1, 0)
+		copy(attribution[to:to+n], downstream[from:from+n])
+	}
+
+	return attribution
+}
+
+// unshiftAttributionData reverses shiftAttributionData, restoring the layout
+// of the attribution data as it was produced by the downstream hop. The values
+// that were dropped by the shift are zeroed out, as they aren't needed to
+// verify the downstream hop at its actual position.
+func unshiftAttributionData(attribution []byte) []byte {
+	downstream := make([]byte, attributionDataLength)
+	copy(
+		downstream[:holdTimesLength-holdTimeSize],
+		attribution[holdTimeSize:holdTimesLength],
+	)
+
+	for k := 0; k < AttributionMaxHops-1; k++ {
+		n := (AttributionMaxHops - k - 1) * attributionHMACSize
+		from := attributionHMACOffset(k+1, 0)
+		to := attributionHMACOffset(k, 1)
+		copy(downstream[to:to+n], attribution[from:from+n])
+	}
+
+	return downstream
+}
+
+// EncryptAttributableError encrypts an attributable error, consisting of the
+// legacy error followed by the attribution data. If initial is true, data is
+// the plain failure message, to which the legacy HMAC and fresh attribution
+// data are added. Otherwise, data is an attributable error that was received
+// from the downstream hop.
+//
+// In either case, the hop records its holdTime, the time it held the HTLC,
+// in the attribution data, and adds its HMACs so that the sender can tell
+// which hop corrupted the error if it is tampered with further upstream.
+func (o *OnionErrorEncrypter) EncryptAttributableError(initial bool,
+	data []byte, holdTime uint32) ([]byte, error) {
+
+	if o.trampolineSecret != nil {
+		return nil, errAttributableTrampoline
+	}
+
+	var message, downstream []byte
+	if initial {
+		umKey := generateKey("um", &o.sharedSecret)
+		hash := hmac.New(sha256.New, umKey[:])
+		hash.Write(data)
+		message = append(hash.Sum(nil), data...)
+		downstream = make([]byte, attributionDataLength)
+	} else {
+		if len(data) < attributionDataLength {
+			return nil, fmt.Errorf("attributable error of %d "+
+				"bytes is too short", len(data))
+		}
+
+		split := len(data) - attributionDataLength
+		message, downstream = data[:split], data[split:]
+	}
+
+	// Make room for our own hold time and HMACs, and then fill them in,
+	// adding an HMAC for each position we could have in the route.
+	attribution := shiftAttributionData(downstream)
+	binary.BigEndian.PutUint32(attribution[:holdTimeSize], holdTime)
+	for position := 0; position < AttributionMaxHops; position++ {
+		offset := attributionHMACOffset(0, position)
+		copy(
+			attribution[offset:offset+attributionHMACSize],
+			computeAttributionHMAC(
+				&o.sharedSecret, message, attribution, position,
+			),
+		)
+	}
+
+	encrypted := onionEncrypt(&o.sharedSecret, message)
+	encrypted = append(
+		encrypted,
+		encryptAttributionData(&o.sharedSecret, attribution)...,
+	)
+
+	return encrypted, nil
+}
+
+// DecryptAttributableError decrypts an attributable error, which consists of
+// a legacy error followed by the attribution data. Unlike DecryptError, the
+// HMACs of each hop are verified along the way, along with the hold times
+// they reported.
+//
+// If the error was tampered with, the returned DecryptedError has Corrupted
+// set, and identifies the first hop whose HMAC didn't verify. Either way, the
+// HoldTimes of all hops up to the returned one are reported.
+func (o *OnionErrorDecrypter) DecryptAttributableError(encryptedData []byte) (
+	*DecryptedError, error) {
+
+	if len(encryptedData) < onionErrorLength+attributionDataLength {
+		return nil, fmt.Errorf("invalid attributable error length: "+
+			"expected at least %v got %v",
+			onionErrorLength+attributionDataLength,
+			len(encryptedData))
+	}
+
+	sharedSecrets, path := o.errorPath()
+
+	split := len(encryptedData) - attributionDataLength
+	message := encryptedData[:split]
+	attribution := encryptedData[split:]
+
+	var holdTimes []uint32
+	for i := range sharedSecrets {
+		sharedSecret := &sharedSecrets[i]
+		message = onionEncrypt(sharedSecret, message)
+		attribution = encryptAttributionData(sharedSecret, attribution)
+
+		// Hops beyond the maximum position can't be attributed, but
+		// may still be the origin of the failure.
+		if i < AttributionMaxHops {
+			offset := attributionHMACOffset(0, i)
+			expectedMac := computeAttributionHMAC(
+				sharedSecret, message, attribution, i,
+			)
+			if !hmac.Equal(
+				attribution[offset:offset+attributionHMACSize],
+				expectedMac,
+			) {
+
+				return &DecryptedError{
+					Sender:    path[i],
+					SenderIdx: i + 1,
+					HoldTimes: holdTimes,
+					Corrupted: true,
+				}, nil
+			}
+
+			holdTimes = append(
+				holdTimes,
+				binary.BigEndian.Uint32(
+					attribution[:holdTimeSize],
+				),
+			)
+		}
+
+		umKey := generateKey("um", sharedSecret)
+		h := hmac.New(sha256.New, umKey[:])
+		h.Write(message[sha256.Size:])
+		if hmac.Equal(h.Sum(nil), message[:sha256.Size]) {
+			msg := message[sha256.Size:]
+			failureLen, padLen := parseFailureLengths(msg)
+
+			return &DecryptedError{
+				Sender:        path[i],
+				SenderIdx:     i + 1,
+				Message:       msg,
+				FailureLength: failureLen,
+				PaddingLength: padLen,
+				HoldTimes:     holdTimes,
+			}, nil
+		}
+
+		// Before we can strip the layer of the next hop, we need to
+		// undo the shift this hop applied to the attribution data.
+		attribution = unshiftAttributionData(attribution)
+	}
+
+	return nil, errors.New("unable to retrieve onion failure")
+}
@@ -0,0 +1,196 @@
+package sphinx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"reflect"
+	"testing"
+
+	"github.com/brsuite/brond/btcec"
+)
+
+// attributableErrorTestCircuit creates a circuit of numHops random nodes,
+// along with the error encrypters of each of the hops.
+func attributableErrorTestCircuit(t *testing.T, numHops int) (*Circuit,
+	[]*OnionErrorEncrypter) {
+
+	paymentPath := make([]*btcec.PublicKey, numHops)
+	for i := range paymentPath {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		paymentPath[i] = privKey.PubKey()
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+
+	sharedSecrets := generateSharedSecrets(paymentPath, sessionKey)
+	encrypters := make([]*OnionErrorEncrypter, numHops)
+	for i := range encrypters {
+		encrypters[i] = &OnionErrorEncrypter{
+			sharedSecret: sharedSecrets[i],
+		}
+	}
+
+	return &Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath,
+	}, encrypters
+}
+
+// TestAttributableError tests that the sender of a payment can decrypt an
+// attributable error, and recover the hold times reported by each hop, no
+// matter the position of the failing hop.
+func TestAttributableError(t *testing.T) {
+	t.Parallel()
+
+	failureData := bytes.Repeat([]byte{'A'}, onionErrorLength-sha256.Size)
+
+	// The last test case exceeds the number of hops that can be
+	// attributed, so only the hold times of the first hops are reported.
+	for _, numHops := range []int{1, 5, AttributionMaxHops, NumMaxHops} {
+		circuit, encrypters := attributableErrorTestCircuit(t, numHops)
+
+		failingHop := numHops - 1
+		data, err := encrypters[failingHop].EncryptAttributableError(
+			true, failureData, uint32(failingHop),
+		)
+		if err != nil {
+			t.Fatalf("unable to encrypt error: %v", err)
+		}
+		for i := failingHop - 1; i >= 0; i-- {
+			data, err = encrypters[i].EncryptAttributableError(
+				false, data, uint32(i),
+			)
+			if err != nil {
+				t.Fatalf("unable to encrypt error: %v", err)
+			}
+		}
+
+		if len(data) != onionErrorLength+attributionDataLength {
+			t.Fatalf("unexpected error length: %d", len(data))
+		}
+
+		decrypted, err := NewOnionErrorDecrypter(circuit).
+			DecryptAttributableError(data)
+		if err != nil {
+			t.Fatalf("%d hops: unable to decrypt error: %v",
+				numHops, err)
+		}
+
+		if decrypted.Corrupted {
+			t.Fatalf("%d hops: error reported as corrupted",
+				numHops)
+		}
+		if decrypted.SenderIdx != numHops {
+			t.Fatalf("%d hops: expected sender %d, got %d", numHops,
+				numHops, decrypted.SenderIdx)
+		}
+		if !bytes.Equal(decrypted.Message, failureData) {
+			t.Fatalf("%d hops: error message mismatch", numHops)
+		}
+
+		numAttributed := numHops
+		if numAttributed > AttributionMaxHops {
+			numAttributed = AttributionMaxHops
+		}
+		expectedHoldTimes := make([]uint32, numAttributed)
+		for i := range expectedHoldTimes {
+			expectedHoldTimes[i] = uint32(i)
+		}
+		if !reflect.DeepEqual(decrypted.HoldTimes, expectedHoldTimes) {
+			t.Fatalf("%d hops: expected hold times %v, got %v",
+				numHops, expectedHoldTimes, decrypted.HoldTimes)
+		}
+	}
+}
+
+// TestAttributableErrorCorruption tests that the sender of a payment can
+// identify the hop that corrupted an attributable error.
+func TestAttributableErrorCorruption(t *testing.T) {
+	t.Parallel()
+
+	const (
+		numHops       = 5
+		corruptingHop = 2
+	)
+
+	circuit, encrypters := attributableErrorTestCircuit(t, numHops)
+	failureData := bytes.Repeat([]byte{'A'}, onionErrorLength-sha256.Size)
+
+	data, err := encrypters[numHops-1].EncryptAttributableError(
+		true, failureData, 100,
+	)
+	if err != nil {
+		t.Fatalf("unable to encrypt error: %v", err)
+	}
+	for i := numHops - 2; i >= 0; i-- {
+		data, err = encrypters[i].EncryptAttributableError(
+			false, data, 100,
+		)
+		if err != nil {
+			t.Fatalf("unable to encrypt error: %v", err)
+		}
+
+		// The corrupting hop flips a bit of the failure message after
+		// adding its own layer.
+		if i == corruptingHop {
+			data[100] ^= 0x01
+		}
+	}
+
+	decrypted, err := NewOnionErrorDecrypter(circuit).
+		DecryptAttributableError(data)
+	if err != nil {
+		t.Fatalf("unable to decrypt error: %v", err)
+	}
+
+	if !decrypted.Corrupted {
+		t.Fatalf("expected error to be reported as corrupted")
+	}
+	if decrypted.SenderIdx != corruptingHop+1 {
+		t.Fatalf("expected corrupting hop %d, got %d", corruptingHop+1,
+			decrypted.SenderIdx)
+	}
+	if !decrypted.Sender.IsEqual(circuit.PaymentPath[corruptingHop]) {
+		t.Fatalf("corrupting hop mismatch")
+	}
+	if len(decrypted.HoldTimes) != corruptingHop {
+		t.Fatalf("expected %d hold times, got %d", corruptingHop,
+			len(decrypted.HoldTimes))
+	}
+
+	// The legacy part of the error can still be decrypted on its own, as
+	// long as it isn't corrupted.
+	legacy, err := encrypters[0].EncryptAttributableError(
+		false, mustEncryptAttributable(t, encrypters[1], failureData),
+		100,
+	)
+	if err != nil {
+		t.Fatalf("unable to encrypt error: %v", err)
+	}
+	decrypted, err = NewOnionErrorDecrypter(circuit).DecryptError(
+		legacy[:onionErrorLength],
+	)
+	if err != nil {
+		t.Fatalf("unable to decrypt legacy error: %v", err)
+	}
+	if decrypted.SenderIdx != 2 {
+		t.Fatalf("expected sender 2, got %d", decrypted.SenderIdx)
+	}
+}
+
+// mustEncryptAttributable creates an initial attributable error using the
+// passed encrypter.
+func mustEncryptAttributable(t *testing.T, encrypter *OnionErrorEncrypter,
+	failureData []byte) []byte {
+
+	data, err := encrypter.EncryptAttributableError(true, failureData, 0)
+	if err != nil {
+		t.Fatalf("unable to encrypt error: %v", err)
+	}
+
+	return data
+}
@@ -26,12 +26,17 @@ type Batch struct {
 	// entries stores the set of all potential entries that might get
 	// written to the replay log. Some entries may be skipped after
 	// examining the on-disk content at the time of commit..
-	entries map[uint16]batchEntry
+	entries map[uint32]batchEntry
 
 	// replayCache is an in memory lookup-table, which stores the hash
 	// prefix of entries already added to this batch. This allows a quick
 	// mechanism for intra-batch duplicate detection.
 	replayCache map[HashPrefix]struct{}
+
+	// minExpiry is a lower bound of the expiry of the batch. It allows a
+	// batch imported from a snapshot, which holds no entries, to keep the
+	// expiry it had in the log it was exported from.
+	minExpiry uint32
 }
 
 // NewBatch initializes an object for constructing a set of entries to
@@ -42,7 +47,7 @@ func NewBatch(id []byte) *Batch {
 	return &Batch{
 		ID:          id,
 		ReplaySet:   NewReplaySet(),
-		entries:     make(map[uint16]batchEntry),
+		entries:     make(map[uint32]batchEntry),
 		replayCache: make(map[HashPrefix]struct{}),
 	}
 }
@@ -51,7 +56,7 @@ func NewBatch(id []byte) *Batch {
 // returns an error in the event that the batch was already committed to disk.
 // Decisions regarding whether or not a particular sequence number is a replay
 // is ultimately reported via the batch's ReplaySet after committing to disk.
-func (b *Batch) Put(seqNum uint16, hashPrefix *HashPrefix, cltv uint32) error {
+func (b *Batch) Put(seqNum uint32, hashPrefix *HashPrefix, cltv uint32) error {
 	// Abort if this batch was already written to disk.
 	if b.IsCommitted {
 		return ErrAlreadyCommitted
@@ -83,7 +88,7 @@ func (b *Batch) Put(seqNum uint16, hashPrefix *HashPrefix, cltv uint32) error {
 
 // ForEach iterates through each entry in the batch and calls the provided
 // function with the sequence number and entry contents as arguments.
-func (b *Batch) ForEach(fn func(seqNum uint16, hashPrefix *HashPrefix, cltv uint32) error) error {
+func (b *Batch) ForEach(fn func(seqNum uint32, hashPrefix *HashPrefix, cltv uint32) error) error {
 	for seqNum, entry := range b.entries {
 		if err := fn(seqNum, &entry.hashPrefix, entry.cltv); err != nil {
 			return err
@@ -92,6 +97,20 @@ func (b *Batch) ForEach(fn func(seqNum uint16, hashPrefix *HashPrefix, cltv uint
 	return nil
 }
 
+// expiry returns the highest CLTV of the entries of the batch, after which
+// the batch no longer needs to be kept to provide idempotence, as all of its
+// entries have expired.
+func (b *Batch) expiry() uint32 {
+	expiry := b.minExpiry
+	for _, entry := range b.entries {
+		if entry.cltv > expiry {
+			expiry = entry.cltv
+		}
+	}
+
+	return expiry
+}
+
 // batchEntry is a tuple of a secret's hash prefix and the corresponding CLTV at
 // which the onion blob from which the secret was derived expires.
 type batchEntry struct {
@@ -21,7 +21,10 @@ func BenchmarkPathPacketConstruction(b *testing.B) {
 		route        PaymentPath
 	)
 
-	for i := 0; i < NumMaxHops; i++ {
+	// The route is made of as many legacy payloads as fit within the
+	// routing info of the packet.
+	numHops := routingInfoSize / LegacyHopDataSize
+	for i := 0; i < numHops; i++ {
 		privKey, err := btcec.NewPrivateKey(btcec.S256())
 		if err != nil {
 			b.Fatalf("unable to generate key: %v", privKey)
@@ -86,10 +89,11 @@ func BenchmarkProcessPacket(b *testing.B) {
 		router := path[0]
 		router.log.Stop()
 		path[0] = &Router{
-			nodeID:   router.nodeID,
-			nodeAddr: router.nodeAddr,
-			onionKey: router.onionKey,
-			log:      NewMemoryReplayLog(),
+			nodeID:    router.nodeID,
+			nodeAddr:  router.nodeAddr,
+			onionKeys: router.onionKeys,
+			now:       router.now,
+			log:       NewMemoryReplayLog(),
 		}
 		path[0].log.Start()
 		b.StartTimer()
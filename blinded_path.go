@@ -0,0 +1,283 @@
+package sphinx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/brsuite/brond/btcec"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// HopInfo houses the real node ID of a hop within a route that is to be
+// blinded, along with the plain text data that should be encrypted for it.
+type HopInfo struct {
+	// NodePub is the real public key of the node.
+	NodePub *btcec.PublicKey
+
+	// PlainText is the unencrypted recipient data destined for the node.
+	PlainText []byte
+}
+
+// BlindedHop is a single hop within a blinded path, as seen by the sender of
+// a payment.
+type BlindedHop struct {
+	// BlindedNodePub is the blinded node ID of the hop. The sender should
+	// use it in place of the node's real public key when constructing the
+	// onion.
+	BlindedNodePub *btcec.PublicKey
+
+	// CipherText is the encrypted_recipient_data for the hop, which the
+	// sender includes in the hop's payload.
+	CipherText []byte
+}
+
+// BlindedPath is a route to a recipient that hides the identity of every node
+// but the introduction node, as well as the data each hop needs in order to
+// forward a payment.
+type BlindedPath struct {
+	// IntroductionPoint is the real node ID of the first hop of the
+	// blinded path.
+	IntroductionPoint *btcec.PublicKey
+
+	// BlindingPoint is the first blinding point of the path. It is handed
+	// to the introduction node within its payload.
+	BlindingPoint *btcec.PublicKey
+
+	// BlindedHops is the set of blinded hops that make up the path,
+	// starting with the introduction node.
+	BlindedHops []*BlindedHop
+}
+
+// Encode serializes the blinded path into the passed io.Writer, using the
+// blinded_path encoding of BOLT 04: the introduction node ID, the first
+// blinding point, the number of hops, and finally each blinded node ID
+// followed by its u16 length prefixed encrypted data.
+func (b *BlindedPath) Encode(w io.Writer) error {
+	if len(b.BlindedHops) == 0 || len(b.BlindedHops) > 255 {
+		return fmt.Errorf("invalid number of blinded hops: %d",
+			len(b.BlindedHops))
+	}
+
+	_, err := w.Write(b.IntroductionPoint.SerializeCompressed())
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(b.BlindingPoint.SerializeCompressed()); err != nil {
+		return err
+	}
+
+	if _, err := w.Write([]byte{uint8(len(b.BlindedHops))}); err != nil {
+		return err
+	}
+
+	for _, hop := range b.BlindedHops {
+		_, err := w.Write(hop.BlindedNodePub.SerializeCompressed())
+		if err != nil {
+			return err
+		}
+
+		if len(hop.CipherText) > 0xffff {
+			return fmt.Errorf("encrypted data of %d bytes too "+
+				"large", len(hop.CipherText))
+		}
+
+		var length [2]byte
+		binary.BigEndian.PutUint16(
+			length[:], uint16(len(hop.CipherText)),
+		)
+		if _, err := w.Write(length[:]); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(hop.CipherText); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Decode populates the blinded path from the serialized form written by
+// Encode.
+func (b *BlindedPath) Decode(r io.Reader) error {
+	var err error
+
+	b.IntroductionPoint, err = readPubKey(r)
+	if err != nil {
+		return err
+	}
+
+	b.BlindingPoint, err = readPubKey(r)
+	if err != nil {
+		return err
+	}
+
+	var numHops [1]byte
+	if _, err := io.ReadFull(r, numHops[:]); err != nil {
+		return err
+	}
+	if numHops[0] == 0 {
+		return errors.New("blinded path must contain at least one hop")
+	}
+
+	b.BlindedHops = make([]*BlindedHop, numHops[0])
+	for i := range b.BlindedHops {
+		blindedNodePub, err := readPubKey(r)
+		if err != nil {
+			return err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return err
+		}
+
+		cipherText := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(r, cipherText); err != nil {
+			return err
+		}
+
+		b.BlindedHops[i] = &BlindedHop{
+			BlindedNodePub: blindedNodePub,
+			CipherText:     cipherText,
+		}
+	}
+
+	return nil
+}
+
+// readPubKey reads a compressed public key from the passed io.Reader.
+func readPubKey(r io.Reader) (*btcec.PublicKey, error) {
+	var pubKey [btcec.PubKeyBytesLenCompressed]byte
+	if _, err := io.ReadFull(r, pubKey[:]); err != nil {
+		return nil, err
+	}
+
+	return btcec.ParsePubKey(pubKey[:], btcec.S256())
+}
+
+// BuildBlindedPath blinds the route described by paymentPath using the
+// passed session key. For each hop, the blinded node ID is derived as
+// HMAC256("blinded_node_id", ss_i) * N_i, and the plain text is encrypted
+// with ChaCha20-Poly1305 using the "rho" key derived from ss_i. The shared
+// secrets ss_i, along with the blinding points handed to each hop, follow the
+// exact same derivation that is used to construct an onion packet.
+func BuildBlindedPath(sessionKey *btcec.PrivateKey,
+	paymentPath []*HopInfo) (*BlindedPath, error) {
+
+	if len(paymentPath) == 0 {
+		return nil, errors.New("blinded path must contain at least " +
+			"one hop")
+	}
+
+	nodeKeys := make([]*btcec.PublicKey, len(paymentPath))
+	for i, hop := range paymentPath {
+		nodeKeys[i] = hop.NodePub
+	}
+	sharedSecrets := generateSharedSecrets(nodeKeys, sessionKey)
+
+	blindedHops := make([]*BlindedHop, len(paymentPath))
+	for i, hop := range paymentPath {
+		nodeIDTweak := generateKey("blinded_node_id", &sharedSecrets[i])
+		cipherText, err := encryptBlindedHopData(
+			&sharedSecrets[i], hop.PlainText,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		blindedHops[i] = &BlindedHop{
+			BlindedNodePub: blindGroupElement(
+				hop.NodePub, nodeIDTweak[:],
+			),
+			CipherText: cipherText,
+		}
+	}
+
+	return &BlindedPath{
+		IntroductionPoint: paymentPath[0].NodePub,
+		BlindingPoint:     sessionKey.PubKey(),
+		BlindedHops:       blindedHops,
+	}, nil
+}
+
+// encryptBlindedHopData encrypts the recipient data of a blinded hop. This is
+// the inverse of decryptBlindedHopData.
+func encryptBlindedHopData(blindingSecret *Hash256,
+	plainText []byte) ([]byte, error) {
+
+	rhoKey := generateKey("rho", blindingSecret)
+	aead, err := chacha20poly1305.New(rhoKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(nil, nonce[:], plainText, nil), nil
+}
+
+// AppendBlindedPath extends the payment path with the hops of the passed
+// blinded path. The introduction node is addressed using its real node ID,
+// while the remaining hops are addressed using their blinded node IDs. Each
+// hop receives a TLV payload carrying its encrypted recipient data, and the
+// introduction node additionally receives the blinding point. The optional
+// finalHopRecords is a TLV stream of extra records (such as the amount and
+// CLTV) that is merged into the payload of the final hop.
+func (p *PaymentPath) AppendBlindedPath(path *BlindedPath,
+	finalHopRecords []byte) error {
+
+	numHops := p.TrueRouteLength()
+	if numHops+len(path.BlindedHops) > NumMaxHops {
+		return fmt.Errorf("blinded path of %d hops exceeds the "+
+			"remaining %d hops of the payment path",
+			len(path.BlindedHops), NumMaxHops-numHops)
+	}
+
+	finalRecords, err := DecodeTLVStream(finalHopRecords)
+	if err != nil {
+		return err
+	}
+
+	// The route blinding records are populated by us, so the caller must
+	// not attempt to override them.
+	_, hasData := finalRecords[encryptedRecipientDataType]
+	_, hasPoint := finalRecords[currentBlindingPointType]
+	if hasData || hasPoint {
+		return errors.New("final hop records must not contain route " +
+			"blinding records")
+	}
+
+	for i, hop := range path.BlindedHops {
+		records := map[uint64][]byte{
+			encryptedRecipientDataType: hop.CipherText,
+		}
+		nodePub := hop.BlindedNodePub
+
+		if i == 0 {
+			records[currentBlindingPointType] =
+				path.BlindingPoint.SerializeCompressed()
+			nodePub = path.IntroductionPoint
+		}
+
+		if i == len(path.BlindedHops)-1 {
+			for recordType, value := range finalRecords {
+				records[recordType] = value
+			}
+		}
+
+		hopPayload, err := NewHopPayload(nil, EncodeTLVStream(records))
+		if err != nil {
+			return err
+		}
+
+		p[numHops+i] = OnionHop{
+			NodePub:    *nodePub,
+			HopPayload: hopPayload,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+package sphinx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/brsuite/brond/btcec"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// encryptedRecipientDataType is the TLV type of the hop payload record
+	// that carries the encrypted_recipient_data for a blinded hop.
+	encryptedRecipientDataType = 10
+
+	// currentBlindingPointType is the TLV type of the hop payload record
+	// that carries the current_blinding_point. It is only included in the
+	// payload of the introduction node of a blinded route.
+	currentBlindingPointType = 12
+)
+
+var (
+	// ErrMissingBlindingPoint is returned when a hop payload carries
+	// encrypted recipient data, but no blinding point was provided either
+	// by the caller or within the payload itself.
+	ErrMissingBlindingPoint = errors.New("encrypted recipient data " +
+		"present without a blinding point")
+
+	// ErrDuplicateBlindingPoint is returned when a blinding point is
+	// provided by the caller, and the hop payload also contains a
+	// current_blinding_point record.
+	ErrDuplicateBlindingPoint = errors.New("blinding point provided " +
+		"both externally and within the hop payload")
+
+	// ErrMissingRecipientData is returned when an onion is processed with
+	// a blinding point, but the hop payload doesn't contain any encrypted
+	// recipient data to be decrypted.
+	ErrMissingRecipientData = errors.New("blinding point provided " +
+		"without encrypted recipient data")
+)
+
+// ProcessOnionOpt is a functional option that can be used to modify how an
+// onion packet is processed.
+type ProcessOnionOpt func(*processOnionCfg)
+
+// processOnionCfg houses the set of optional arguments that can be passed in
+// when processing an onion packet.
+type processOnionCfg struct {
+	// blindingPoint is the route blinding point that was handed to us
+	// alongside the onion packet, for example in the update_add_htlc
+	// message.
+	blindingPoint *btcec.PublicKey
+
+	// replayValue, if set, is the value to be stored in the replay log
+	// alongside the hash prefix of an onion message. If nil, onion
+	// messages are processed without replay protection.
+	replayValue *uint32
+
+	// ctx is the context passed to the onion key of the router when
+	// performing ECDH.
+	ctx context.Context
+
+	// onionKey, if set, selects the onion key of the router to be used,
+	// rather than trying each of the active keys.
+	onionKey *btcec.PublicKey
+
+	// ecdhLatency accumulates the time spent deriving the shared secret
+	// of the onion, which is reported to the observer of the router.
+	ecdhLatency time.Duration
+}
+
+// newProcessOnionCfg applies the passed set of functional options to a fresh
+// processOnionCfg.
+func newProcessOnionCfg(opts []ProcessOnionOpt) *processOnionCfg {
+	cfg := &processOnionCfg{
+		ctx: context.Background(),
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
+// WithBlindingPoint is a functional option that signals that the onion packet
+// is destined for a hop within a blinded route. The passed blinding point
+// will be used to tweak the node's onion key before performing ECDH with the
+// packet's ephemeral key, and to decrypt the encrypted recipient data carried
+// within the hop payload.
+func WithBlindingPoint(point *btcec.PublicKey) ProcessOnionOpt {
+	return func(cfg *processOnionCfg) {
+		cfg.blindingPoint = point
+	}
+}
+
+// WithReplayProtection is a functional option that enables replay protection
+// when processing an onion message. As onion messages carry no CLTV, the
+// caller chooses the value (e.g. an expiry height) that is stored in the
+// router's replay log alongside the hash prefix of the message. Onion
+// payment packets are always checked against the replay log, so this option
+// has no effect on them.
+func WithReplayProtection(value uint32) ProcessOnionOpt {
+	return func(cfg *processOnionCfg) {
+		cfg.replayValue = &value
+	}
+}
+
+// WithContext is a functional option that sets the context to be passed to
+// the onion key of the router when performing ECDH. This allows calls to a
+// remote signer to be canceled, or bounded by a deadline.
+func WithContext(ctx context.Context) ProcessOnionOpt {
+	return func(cfg *processOnionCfg) {
+		cfg.ctx = ctx
+	}
+}
+
+// blindedOnionSharedSecret derives the shared secret for an onion packet that
+// was constructed using our blinded node ID rather than our real onion key.
+// The blinded private key of the node is k * HMAC256("blinded_node_id", ss),
+// where ss is the shared secret derived from the blinding point.
+func blindedOnionSharedSecret(dhKey, blindingPoint *btcec.PublicKey,
+	sharedSecretGen sharedSecretGenerator) (Hash256, error) {
+
+	blindingSecret, err := sharedSecretGen.generateSharedSecret(
+		blindingPoint,
+	)
+	if err != nil {
+		return Hash256{}, err
+	}
+
+	return tweakedOnionSharedSecret(dhKey, &blindingSecret, sharedSecretGen)
+}
+
+// tweakedOnionSharedSecret derives the shared secret for an onion packet sent
+// to our blinded node ID, given the already derived blinding shared secret.
+// Rather than computing the tweaked private key explicitly, we first tweak
+// the ephemeral key of the packet, and then perform the regular ECDH
+// operation with it.
+func tweakedOnionSharedSecret(dhKey *btcec.PublicKey, blindingSecret *Hash256,
+	sharedSecretGen sharedSecretGenerator) (Hash256, error) {
+
+	// Ensure that the public key is on our curve before tweaking it.
+	if !isOnCurve(dhKey) {
+		return Hash256{}, ErrInvalidOnionKey
+	}
+
+	nodeIDTweak := generateKey("blinded_node_id", blindingSecret)
+	tweakedDHKey := blindGroupElement(dhKey, nodeIDTweak[:])
+
+	return sharedSecretGen.generateSharedSecret(tweakedDHKey)
+}
+
+// decryptBlindedHopData decrypts the encrypted recipient data of a blinded
+// hop using ChaCha20-Poly1305, keyed by the "rho" key derived from the
+// blinding shared secret and a zero nonce.
+func decryptBlindedHopData(blindingSecret *Hash256,
+	cipherText []byte) ([]byte, error) {
+
+	rhoKey := generateKey("rho", blindingSecret)
+	aead, err := chacha20poly1305.New(rhoKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	plainText, err := aead.Open(nil, nonce[:], cipherText, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt recipient data: %v",
+			err)
+	}
+
+	return plainText, nil
+}
+
+// nextBlindingPoint derives the blinding point for the next hop in a blinded
+// route: E_{i+1} = SHA256(E_i || ss_i) * E_i.
+func nextBlindingPoint(blindingPoint *btcec.PublicKey,
+	blindingSecret *Hash256) *btcec.PublicKey {
+
+	blindingFactor := computeBlindingFactor(
+		blindingPoint, blindingSecret[:],
+	)
+
+	return blindGroupElement(blindingPoint, blindingFactor[:])
+}
+
+// processBlindedPayload inspects the TLV payload of a processed packet for
+// route blinding records. If the hop is part of a blinded route, the encrypted
+// recipient data is decrypted, and the blinding point for the next hop is
+// derived. The blindingPoint argument is the blinding point that was provided
+// by the caller, if any.
+func processBlindedPayload(packet *ProcessedPacket,
+	blindingPoint *btcec.PublicKey,
+	sharedSecretGen sharedSecretGenerator) error {
+
+	// Legacy payloads have no notion of route blinding, so a blinding
+	// point can't be paired with one.
+	if packet.Payload.Type != PayloadTLV {
+		if blindingPoint != nil {
+			return ErrMissingRecipientData
+		}
+
+		return nil
+	}
+
+	// The payload is opaque to the router, so if we weren't told that
+	// this hop is blinded, a payload that doesn't parse as a TLV payload
+	// is left for the higher layers to interpret.
+	payload, err := packet.ParsedPayload()
+	switch {
+	case err != nil && blindingPoint == nil:
+		return nil
+
+	case err != nil:
+		return err
+	}
+
+	// The introduction node of a blinded route learns its blinding point
+	// from its own payload rather than from the caller.
+	if payload.CurrentBlindingPoint != nil {
+		if blindingPoint != nil {
+			return ErrDuplicateBlindingPoint
+		}
+
+		blindingPoint = payload.CurrentBlindingPoint
+	}
+
+	cipherText := payload.EncryptedRecipientData
+	switch {
+	// This isn't a blinded hop at all, nothing left to do.
+	case cipherText == nil && blindingPoint == nil:
+		return nil
+
+	case cipherText == nil:
+		return ErrMissingRecipientData
+
+	case blindingPoint == nil:
+		return ErrMissingBlindingPoint
+	}
+
+	blindingSecret, err := sharedSecretGen.generateSharedSecret(
+		blindingPoint,
+	)
+	if err != nil {
+		return err
+	}
+
+	packet.RecipientData, err = decryptBlindedHopData(
+		&blindingSecret, cipherText,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Only hops that forward the packet need to hand a blinding point to
+	// the next hop.
+	if packet.Action == MoreHops {
+		packet.NextBlindingPoint = nextBlindingPoint(
+			blindingPoint, &blindingSecret,
+		)
+	}
+
+	return nil
+}
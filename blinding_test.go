@@ -0,0 +1,288 @@
+package sphinx
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/brsuite/brond/btcec"
+	"github.com/brsuite/brond/chaincfg"
+)
+
+// TestProcessBlindedRoute tests that a packet sent through a blinded route can
+// be processed by the introduction node, the intermediate blinded node and the
+// final recipient, each recovering their recipient data and the blinding point
+// of the next hop. The blinded path is preceded by a regular hop.
+func TestProcessBlindedRoute(t *testing.T) {
+	t.Parallel()
+
+	const (
+		numHops        = 4
+		numBlindedHops = 3
+	)
+
+	nodes := make([]*Router, numHops)
+	nodeKeys := make([]*btcec.PublicKey, numHops)
+	for i := 0; i < numHops; i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+
+		nodes[i] = NewRouter(
+			&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+			NewMemoryReplayLog(),
+		)
+		nodeKeys[i] = privKey.PubKey()
+
+		if err := nodes[i].Start(); err != nil {
+			t.Fatalf("unable to start router: %v", err)
+		}
+		defer nodes[i].Stop()
+	}
+
+	blindingKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'C'}, 32),
+	)
+	plainTexts := [][]byte{
+		nil, []byte("introduction"), []byte("intermediate"),
+		[]byte("recipient"),
+	}
+
+	hopInfos := make([]*HopInfo, numBlindedHops)
+	for i := 0; i < numBlindedHops; i++ {
+		hopInfos[i] = &HopInfo{
+			NodePub:   nodeKeys[i+1],
+			PlainText: plainTexts[i+1],
+		}
+	}
+	blindedPath, err := BuildBlindedPath(blindingKey, hopInfos)
+	if err != nil {
+		t.Fatalf("unable to build blinded path: %v", err)
+	}
+
+	if !blindedPath.IntroductionPoint.IsEqual(nodeKeys[1]) {
+		t.Fatalf("introduction point mismatch")
+	}
+	if !blindedPath.BlindingPoint.IsEqual(blindingKey.PubKey()) {
+		t.Fatalf("blinding point mismatch")
+	}
+
+	// The sender reaches the introduction node through a regular hop, and
+	// then appends the blinded path, including a set of final hop records.
+	var route PaymentPath
+	route[0] = OnionHop{
+		NodePub: *nodeKeys[0],
+		HopPayload: mustNewHopPayload(&HopData{
+			ForwardAmount: 1,
+			OutgoingCltv:  1,
+		}, nil),
+	}
+
+	finalRecords := map[uint64][]byte{2: {0x10}, 4: {0x20}}
+	err = route.AppendBlindedPath(
+		blindedPath, EncodeTLVStream(finalRecords),
+	)
+	if err != nil {
+		t.Fatalf("unable to append blinded path: %v", err)
+	}
+	if route.TrueRouteLength() != numHops {
+		t.Fatalf("expected %d hops, got %d", numHops,
+			route.TrueRouteLength())
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	pkt, err := NewOnionPacket(
+		&route, sessionKey, nil, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	// The blinding point for each hop is the public key of the blinding
+	// key, multiplied by all of the prior blinding factors.
+	sharedSecrets := generateSharedSecrets(nodeKeys[1:], blindingKey)
+	expectedPoints := make([]*btcec.PublicKey, numBlindedHops)
+	blindingScalar := new(big.Int).Set(blindingKey.D)
+	for i := 0; i < numBlindedHops; i++ {
+		expectedPoints[i] = blindBaseElement(blindingScalar.Bytes())
+
+		factor := computeBlindingFactor(
+			expectedPoints[i], sharedSecrets[i][:],
+		)
+		blindingScalar.Mul(blindingScalar, new(big.Int).SetBytes(factor[:]))
+		blindingScalar.Mod(blindingScalar, btcec.S256().N)
+	}
+
+	var blindingPoint *btcec.PublicKey
+	for i := 0; i < numHops; i++ {
+		var opts []ProcessOnionOpt
+		if blindingPoint != nil {
+			opts = append(opts, WithBlindingPoint(blindingPoint))
+
+			// Without the blinding point, the node uses its
+			// real onion key, which shouldn't match the HMAC.
+			_, err := nodes[i].ReconstructOnionPacket(pkt, nil)
+			if err != ErrInvalidOnionHMAC {
+				t.Fatalf("hop %d: expected ErrInvalidOnionHMAC, "+
+					"got %v", i, err)
+			}
+		}
+
+		processed, err := nodes[i].ProcessOnionPacket(
+			pkt, nil, uint32(i), opts...,
+		)
+		if err != nil {
+			t.Fatalf("hop %d: unable to process packet: %v", i, err)
+		}
+
+		if !bytes.Equal(processed.RecipientData, plainTexts[i]) {
+			t.Fatalf("hop %d: recipient data mismatch: "+
+				"expected %s, got %s", i, plainTexts[i],
+				processed.RecipientData)
+		}
+
+		if i == numHops-1 {
+			if processed.Action != ExitNode {
+				t.Fatalf("expected exit node, got %v",
+					processed.Action)
+			}
+			if processed.NextBlindingPoint != nil {
+				t.Fatalf("exit node shouldn't derive a " +
+					"next blinding point")
+			}
+
+			records, err := DecodeTLVStream(processed.Payload.Payload)
+			if err != nil {
+				t.Fatalf("unable to parse final payload: %v",
+					err)
+			}
+			for recordType, value := range finalRecords {
+				if !bytes.Equal(records[recordType], value) {
+					t.Fatalf("final record %d mismatch",
+						recordType)
+				}
+			}
+			break
+		}
+
+		if processed.Action != MoreHops {
+			t.Fatalf("hop %d: expected more hops, got %v", i,
+				processed.Action)
+		}
+
+		// The regular hop in front of the blinded path isn't told
+		// about the blinding point.
+		switch {
+		case i == 0 && processed.NextBlindingPoint != nil:
+			t.Fatalf("regular hop derived a blinding point")
+
+		case i > 0 && !processed.NextBlindingPoint.IsEqual(
+			expectedPoints[i],
+		):
+			t.Fatalf("hop %d: next blinding point mismatch", i)
+		}
+
+		pkt = processed.NextPacket
+		blindingPoint = processed.NextBlindingPoint
+	}
+}
+
+// TestProcessBlindedPayloadErrors asserts that inconsistent combinations of
+// blinding points and encrypted recipient data are rejected.
+func TestProcessBlindedPayloadErrors(t *testing.T) {
+	t.Parallel()
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	router := NewRouter(
+		&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(),
+	)
+
+	blindingKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	blindingPoint := blindingKey.PubKey()
+
+	tlvPacket := func(records map[uint64][]byte) *ProcessedPacket {
+		return &ProcessedPacket{
+			Action: ExitNode,
+			Payload: HopPayload{
+				Type:    PayloadTLV,
+				Payload: EncodeTLVStream(records),
+			},
+		}
+	}
+
+	testCases := []struct {
+		name          string
+		packet        *ProcessedPacket
+		blindingPoint *btcec.PublicKey
+		expectedErr   error
+	}{
+		{
+			name:   "not blinded",
+			packet: tlvPacket(map[uint64][]byte{2: {1}}),
+		},
+		{
+			name: "opaque payload",
+			packet: &ProcessedPacket{
+				Payload: HopPayload{
+					Type:    PayloadTLV,
+					Payload: []byte{0xff},
+				},
+			},
+		},
+		{
+			name: "data without blinding point",
+			packet: tlvPacket(map[uint64][]byte{
+				encryptedRecipientDataType: {1, 2, 3},
+			}),
+			expectedErr: ErrMissingBlindingPoint,
+		},
+		{
+			name:          "blinding point without data",
+			packet:        tlvPacket(map[uint64][]byte{2: {1}}),
+			blindingPoint: blindingPoint,
+			expectedErr:   ErrMissingRecipientData,
+		},
+		{
+			name: "legacy payload with blinding point",
+			packet: &ProcessedPacket{
+				Payload: HopPayload{Type: PayloadLegacy},
+			},
+			blindingPoint: blindingPoint,
+			expectedErr:   ErrMissingRecipientData,
+		},
+		{
+			name: "duplicate blinding point",
+			packet: tlvPacket(map[uint64][]byte{
+				encryptedRecipientDataType: {1, 2, 3},
+				currentBlindingPointType: blindingPoint.
+					SerializeCompressed(),
+			}),
+			blindingPoint: blindingPoint,
+			expectedErr:   ErrDuplicateBlindingPoint,
+		},
+	}
+
+	for _, testCase := range testCases {
+		err := processBlindedPayload(
+			testCase.packet, testCase.blindingPoint,
+			newSecretGenerator(
+				context.Background(), router.onionKeys[0].Key,
+			),
+		)
+		if err != testCase.expectedErr {
+			t.Fatalf("%s: expected error %v, got %v",
+				testCase.name, testCase.expectedErr, err)
+		}
+	}
+}
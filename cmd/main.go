@@ -134,7 +134,10 @@ func main() {
 
 		privkey, _ := btcec.PrivKeyFromBytes(btcec.S256(), binKey)
 		replayLog := sphinx.NewMemoryReplayLog()
-		s := sphinx.NewRouter(privkey, &chaincfg.TestNet3Params, replayLog)
+		s := sphinx.NewRouter(
+			&sphinx.PrivKeyECDH{PrivKey: privkey},
+			&chaincfg.TestNet3Params, replayLog,
+		)
 
 		replayLog.Start()
 		defer replayLog.Stop()
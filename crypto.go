@@ -2,13 +2,18 @@ package sphinx
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
+	"math/big"
 
 	"github.com/aead/chacha20"
 	"github.com/brsuite/brond/btcec"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 )
 
 const (
@@ -36,6 +41,25 @@ type DecryptedError struct {
 
 	// Message is the decrypted error message.
 	Message []byte
+
+	// FailureLength is the length of the failure message contained within
+	// the above Message, as indicated by its length prefix. It is zero if
+	// the Message isn't a well formed, padded failure message.
+	FailureLength int
+
+	// PaddingLength is the length of the padding that follows the failure
+	// message within the above Message.
+	PaddingLength int
+
+	// HoldTimes are the hold times reported by each hop of an
+	// attributable error, starting with the first hop of the path. Only
+	// the hops whose HMACs were verified are included.
+	HoldTimes []uint32
+
+	// Corrupted is set if an attributable error was tampered with along
+	// the way. In that case, Sender and SenderIdx identify the first hop
+	// whose HMAC couldn't be verified, and Message is nil.
+	Corrupted bool
 }
 
 // zeroHMAC is the special HMAC value that allows the final node to determine
@@ -106,8 +130,16 @@ func generateCipherStream(key [keyLen]byte, numBytes uint) []byte {
 func computeBlindingFactor(hopPubKey *btcec.PublicKey,
 	hopSharedSecret []byte) Hash256 {
 
+	return computeBlindingFactorBytes(
+		hopPubKey.SerializeCompressed(), hopSharedSecret,
+	)
+}
+
+// computeBlindingFactorBytes computes the blinding factor from the already
+// serialized public key of the hop.
+func computeBlindingFactorBytes(hopPubKey, hopSharedSecret []byte) Hash256 {
 	sha := sha256.New()
-	sha.Write(hopPubKey.SerializeCompressed())
+	sha.Write(hopPubKey)
 	sha.Write(hopSharedSecret)
 
 	var hash Hash256
@@ -117,53 +149,160 @@ func computeBlindingFactor(hopPubKey *btcec.PublicKey,
 
 // blindGroupElement blinds the group element P by performing scalar
 // multiplication of the group element by blindingFactor: blindingFactor * P.
+// The multiplication is performed in constant time, as the blinding factor is
+// derived from the shared secret of the hop.
 func blindGroupElement(hopPubKey *btcec.PublicKey, blindingFactor []byte) *btcec.PublicKey {
-	newX, newY := btcec.S256().ScalarMult(hopPubKey.X, hopPubKey.Y, blindingFactor[:])
-	return &btcec.PublicKey{btcec.S256(), newX, newY}
+	var k [32]byte
+	copy(k[32-len(blindingFactor):], blindingFactor)
+
+	x, y := scalarMultConstTime(hopPubKey, &k)
+
+	var xBytes, yBytes [32]byte
+	x.PutBytes(&xBytes)
+	y.PutBytes(&yBytes)
+
+	return &btcec.PublicKey{
+		Curve: btcec.S256(),
+		X:     new(big.Int).SetBytes(xBytes[:]),
+		Y:     new(big.Int).SetBytes(yBytes[:]),
+	}
 }
 
 // blindBaseElement blinds the groups's generator G by performing scalar base
 // multiplication using the blindingFactor: blindingFactor * G.
 func blindBaseElement(blindingFactor []byte) *btcec.PublicKey {
 	newX, newY := btcec.S256().ScalarBaseMult(blindingFactor)
-	return &btcec.PublicKey{btcec.S256(), newX, newY}
+	return &btcec.PublicKey{Curve: btcec.S256(), X: newX, Y: newY}
+}
+
+// pubKeyToJacobian converts the passed public key into Jacobian coordinates,
+// storing the result in the passed point.
+func pubKeyToJacobian(pubKey *btcec.PublicKey,
+	result *secp256k1.JacobianPoint) {
+
+	result.X.SetByteSlice(pubKey.X.Bytes())
+	result.Y.SetByteSlice(pubKey.Y.Bytes())
+	result.Z.SetInt(1)
+}
+
+// serializeJacobian serializes the passed point in compressed format. The
+// point is converted to affine coordinates in place.
+func serializeJacobian(p *secp256k1.JacobianPoint) []byte {
+	p.ToAffine()
+
+	b := make([]byte, 33)
+	b[0] = 0x02
+	if p.Y.IsOdd() {
+		b[0] = 0x03
+	}
+	p.X.PutBytesUnchecked(b[1:])
+
+	return b
+}
+
+// SingleKeyECDH is an abstraction of the onion key of a node, which is used to
+// perform ECDH with the ephemeral keys of incoming onions. It allows the onion
+// key to be kept outside of the process, for example within a remote signer
+// or a hardware device.
+type SingleKeyECDH interface {
+	// PubKey returns the public key of the onion key.
+	PubKey() *btcec.PublicKey
+
+	// ECDH performs ECDH between the onion key and the passed public key.
+	// The returned shared secret is the SHA256 of the resulting point,
+	// serialized in compressed format.
+	ECDH(ctx context.Context, pubKey *btcec.PublicKey) ([32]byte, error)
+}
+
+// PrivKeyECDH is an implementation of SingleKeyECDH backed by a private key
+// that is held in memory.
+type PrivKeyECDH struct {
+	// PrivKey is the private onion key of the node.
+	PrivKey *btcec.PrivateKey
+}
+
+// A compile time check to ensure PrivKeyECDH implements SingleKeyECDH.
+var _ SingleKeyECDH = (*PrivKeyECDH)(nil)
+
+// PubKey returns the public key of the onion key.
+//
+// NOTE: Part of the SingleKeyECDH interface.
+func (p *PrivKeyECDH) PubKey() *btcec.PublicKey {
+	return p.PrivKey.PubKey()
+}
+
+// ECDH performs ECDH between the onion key and the passed public key.
+//
+// NOTE: Part of the SingleKeyECDH interface.
+func (p *PrivKeyECDH) ECDH(_ context.Context,
+	pubKey *btcec.PublicKey) ([32]byte, error) {
+
+	return generateSharedSecret(pubKey, p.PrivKey), nil
 }
 
 // sharedSecretGenerator is an interface that abstracts away exactly *how* the
 // shared secret for each hop is generated.
-//
-// TODO(roasbef): rename?
 type sharedSecretGenerator interface {
 	// generateSharedSecret given a public key, generates a shared secret
 	// using private data of the underlying sharedSecretGenerator.
 	generateSharedSecret(dhKey *btcec.PublicKey) (Hash256, error)
 }
 
+// ecdhSecretGenerator is a sharedSecretGenerator that performs ECDH using one
+// of the onion keys of a router, within the context of a single call.
+type ecdhSecretGenerator struct {
+	ctx      context.Context
+	onionKey SingleKeyECDH
+}
+
 // generateSharedSecret generates the shared secret by given ephemeral key.
-func (r *Router) generateSharedSecret(dhKey *btcec.PublicKey) (Hash256, error) {
-	var sharedSecret Hash256
+func (g *ecdhSecretGenerator) generateSharedSecret(
+	dhKey *btcec.PublicKey) (Hash256, error) {
 
 	// Ensure that the public key is on our curve.
-	if !btcec.S256().IsOnCurve(dhKey.X, dhKey.Y) {
-		return sharedSecret, ErrInvalidOnionKey
+	if !isOnCurve(dhKey) {
+		return Hash256{}, ErrInvalidOnionKey
 	}
 
 	// Compute our shared secret.
-	sharedSecret = generateSharedSecret(dhKey, r.onionKey)
+	sharedSecret, err := g.onionKey.ECDH(g.ctx, dhKey)
+	if err != nil {
+		return Hash256{}, err
+	}
+
 	return sharedSecret, nil
 }
 
+// newSecretGenerator returns a sharedSecretGenerator that performs ECDH using
+// the passed onion key within the passed context.
+func newSecretGenerator(ctx context.Context,
+	onionKey SingleKeyECDH) sharedSecretGenerator {
+
+	return &ecdhSecretGenerator{
+		ctx:      ctx,
+		onionKey: onionKey,
+	}
+}
+
 // generateSharedSecret generates the shared secret for a particular hop. The
 // shared secret is generated by taking the group element contained in the
 // mix-header, and performing an ECDH operation with the node's long term onion
 // key. We then take the _entire_ point generated by the ECDH operation,
 // serialize that using a compressed format, then feed the raw bytes through a
-// single SHA256 invocation.  The resulting value is the shared secret.
+// single SHA256 invocation.  The resulting value is the shared secret. The
+// scalar multiplication is performed in constant time, so that the onion key
+// doesn't leak through the time taken to process onions.
 func generateSharedSecret(pub *btcec.PublicKey, priv *btcec.PrivateKey) Hash256 {
-	s := &btcec.PublicKey{}
-	s.X, s.Y = btcec.S256().ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	var k [32]byte
+	priv.D.FillBytes(k[:])
+
+	x, y := scalarMultConstTime(pub, &k)
+
+	var s [33]byte
+	s[0] = 0x02 | byte(y.IsOddBit())
+	x.PutBytesUnchecked(s[1:])
 
-	return sha256.Sum256(s.SerializeCompressed())
+	return sha256.Sum256(s[:])
 }
 
 // onionEncrypt obfuscates the data with compliance with BOLT#4. As we use a
@@ -179,10 +318,63 @@ func onionEncrypt(sharedSecret *Hash256, data []byte) []byte {
 	return p
 }
 
-// onionErrorLength is the expected length of the onion error message.
-// Including padding, all messages on the wire should be 256 bytes. We then add
-// the size of the sha256 HMAC as well.
-const onionErrorLength = 2 + 2 + 256 + sha256.Size
+// onionErrorLength is the minimum length of the onion error message.
+// Including padding, all messages on the wire should be at least 256 bytes. We
+// then add the size of the length prefixes of the failure message and the
+// padding, along with the size of the sha256 HMAC.
+const onionErrorLength = 2 + 2 + minFailureMessageLength + sha256.Size
+
+// minFailureMessageLength is the length that failure messages are padded to,
+// so that errors originating from different hops are indistinguishable. Longer
+// failure messages, e.g. those carrying TLV extensions, aren't padded.
+const minFailureMessageLength = 256
+
+// PadFailureMessage encodes the passed failure message as the body of an onion
+// error: the u16 length prefixed failure message, followed by the u16 length
+// prefixed zero padding that brings the failure message up to the minimum
+// length. The result can be passed to EncryptError.
+func PadFailureMessage(failure []byte) ([]byte, error) {
+	if len(failure) > math.MaxUint16 {
+		return nil, fmt.Errorf("failure message of %d bytes too "+
+			"large", len(failure))
+	}
+
+	var padLen int
+	if len(failure) < minFailureMessageLength {
+		padLen = minFailureMessageLength - len(failure)
+	}
+
+	body := make([]byte, 2+len(failure)+2+padLen)
+	binary.BigEndian.PutUint16(body[:2], uint16(len(failure)))
+	copy(body[2:], failure)
+	binary.BigEndian.PutUint16(
+		body[2+len(failure):2+len(failure)+2], uint16(padLen),
+	)
+
+	return body, nil
+}
+
+// parseFailureLengths extracts the length of the failure message and of the
+// padding from the body of an onion error. If the body isn't well formed,
+// zero lengths are returned, leaving it to the caller to interpret the raw
+// message.
+func parseFailureLengths(msg []byte) (int, int) {
+	if len(msg) < 2 {
+		return 0, 0
+	}
+
+	failureLen := int(binary.BigEndian.Uint16(msg[:2]))
+	if 2+failureLen+2 > len(msg) {
+		return 0, 0
+	}
+
+	padLen := int(binary.BigEndian.Uint16(msg[2+failureLen:]))
+	if 2+failureLen+2+padLen != len(msg) {
+		return 0, 0
+	}
+
+	return failureLen, padLen
+}
 
 // DecryptError attempts to decrypt the passed encrypted error response. The
 // onion failure is encrypted in backward manner, starting from the node where
@@ -194,16 +386,20 @@ func (o *OnionErrorDecrypter) DecryptError(encryptedData []byte) (
 	*DecryptedError, error) {
 
 	// Ensure the error message length is as expected.
-	if len(encryptedData) != onionErrorLength {
+	if len(encryptedData) < onionErrorLength {
 		return nil, fmt.Errorf("invalid error length: "+
-			"expected %v got %v", onionErrorLength,
+			"expected at least %v got %v", onionErrorLength,
 			len(encryptedData))
 	}
 
-	sharedSecrets := generateSharedSecrets(
-		o.circuit.PaymentPath,
-		o.circuit.SessionKey,
-	)
+	sharedSecrets, path := o.errorPath()
+
+	// A trampoline payment may span more hops than a regular one, in
+	// which case we'll have to iterate over all of them.
+	numHops := NumMaxHops
+	if len(sharedSecrets) > numHops {
+		numHops = len(sharedSecrets)
+	}
 
 	var (
 		sender      int
@@ -215,7 +411,7 @@ func (o *OnionErrorDecrypter) DecryptError(encryptedData []byte) (
 	// We'll iterate a constant amount of hops to ensure that we don't give
 	// away an timing information pertaining to the position in the route
 	// that the error emanated from.
-	for i := 0; i < NumMaxHops; i++ {
+	for i := 0; i < numHops; i++ {
 		var sharedSecret Hash256
 
 		// If we've already found the sender, then we'll use our dummy
@@ -258,10 +454,14 @@ func (o *OnionErrorDecrypter) DecryptError(encryptedData []byte) (
 		return nil, errors.New("unable to retrieve onion failure")
 	}
 
+	failureLen, padLen := parseFailureLengths(msg)
+
 	return &DecryptedError{
-		SenderIdx: sender,
-		Sender:    o.circuit.PaymentPath[sender-1],
-		Message:   msg,
+		SenderIdx:     sender,
+		Sender:        path[sender-1],
+		Message:       msg,
+		FailureLength: failureLen,
+		PaddingLength: padLen,
 	}, nil
 }
 
@@ -276,14 +476,33 @@ func (o *OnionErrorDecrypter) DecryptError(encryptedData []byte) (
 // The reason for using onion obfuscation is to not give
 // away to the nodes in the payment path the information about the exact
 // failure and its origin.
+//
+// If we're a trampoline node, the error is first encrypted using the shared
+// secret of the trampoline onion, and then using that of the outer onion. In
+// that case, the HMAC of an initial error is computed using the trampoline
+// secret, as the sender identifies us by our position in the trampoline route.
 func (o *OnionErrorEncrypter) EncryptError(initial bool, data []byte) []byte {
+	if o.trampolineSecret != nil {
+		data = encryptErrorLayer(o.trampolineSecret, initial, data)
+		return onionEncrypt(&o.sharedSecret, data)
+	}
+
+	return encryptErrorLayer(&o.sharedSecret, initial, data)
+}
+
+// encryptErrorLayer adds a single layer of encryption to an onion error using
+// the passed shared secret. If the error is initial, an HMAC is prepended to
+// it first.
+func encryptErrorLayer(sharedSecret *Hash256, initial bool,
+	data []byte) []byte {
+
 	if initial {
-		umKey := generateKey("um", &o.sharedSecret)
+		umKey := generateKey("um", sharedSecret)
 		hash := hmac.New(sha256.New, umKey[:])
 		hash.Write(data)
 		h := hash.Sum(nil)
 		data = append(h, data...)
 	}
 
-	return onionEncrypt(&o.sharedSecret, data)
+	return onionEncrypt(sharedSecret, data)
 }
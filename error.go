@@ -1,6 +1,10 @@
 package sphinx
 
-import "fmt"
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrReplayedPacket is an error returned when a packet is rejected
@@ -24,4 +28,143 @@ var (
 	// ErrLogEntryNotFound is an error returned when a packet lookup in a replay
 	// log fails because it is missing.
 	ErrLogEntryNotFound = fmt.Errorf("sphinx packet is not in log")
+
+	// ErrTxAborted is returned when a packet is added to, or a commit is
+	// attempted of, a transaction that was aborted.
+	ErrTxAborted = fmt.Errorf("transaction was aborted")
+
+	// ErrTxMissingCltv is returned when a packet without a CLTV is added
+	// to a transaction of a router that has a timed replay log, as the
+	// batch would only protect it until the next block.
+	ErrTxMissingCltv = fmt.Errorf("packet without cltv can't be added " +
+		"to transaction")
+
+	// ErrInvalidSeqNum is wrapped by the InvalidSeqNumError returned when a
+	// packet is added to a transaction using a sequence number that it
+	// can't hold.
+	ErrInvalidSeqNum = fmt.Errorf("invalid sequence number")
+)
+
+// The BADONION failure codes defined by BOLT 04, which are reported back to
+// the upstream node within a ProcessingError. The failure package defines its
+// codes for malformed onions from these.
+const (
+	// CodeInvalidOnionVersion is reported when the version byte of the
+	// onion is unknown.
+	CodeInvalidOnionVersion uint16 = 0xc004
+
+	// CodeInvalidOnionHMAC is reported when the HMAC of the onion doesn't
+	// match.
+	CodeInvalidOnionHMAC uint16 = 0xc005
+
+	// CodeInvalidOnionKey is reported when the ephemeral key of the onion
+	// is invalid.
+	CodeInvalidOnionKey uint16 = 0xc006
+
+	// CodeInvalidOnionBlinding is reported instead of any of the above
+	// when the onion was received as part of a blinded route, so that the
+	// position within the route isn't revealed.
+	CodeInvalidOnionBlinding uint16 = 0xc018
 )
+
+// ProcessingError is returned when an onion can't be processed because it is
+// malformed. As the node is unable to derive the shared secret needed to
+// encrypt an error, the failure is instead reported back to the upstream node
+// in the clear, using the failure code and the hash of the onion.
+type ProcessingError struct {
+	// Code is the BADONION failure code of the error.
+	Code uint16
+
+	// OnionHash is the SHA256 hash of the serialized onion packet.
+	OnionHash [sha256.Size]byte
+
+	// Err is the underlying error, which matches one of
+	// ErrInvalidOnionVersion, ErrInvalidOnionHMAC or ErrInvalidOnionKey
+	// using errors.Is.
+	Err error
+}
+
+// NewProcessingError returns a ProcessingError for the passed error, if it
+// signals a malformed onion. The rawOnion should contain the onion packet as
+// it was received from the upstream node. If err doesn't match any of
+// ErrInvalidOnionVersion, ErrInvalidOnionHMAC or ErrInvalidOnionKey using
+// errors.Is, or if it is a TrampolineError, nil is returned.
+func NewProcessingError(rawOnion []byte, err error) *ProcessingError {
+	// The errors of a trampoline onion are reported to the sender within
+	// an encrypted failure, as the outer onion itself is intact.
+	var trampolineErr *TrampolineError
+	if errors.As(err, &trampolineErr) {
+		return nil
+	}
+
+	var code uint16
+	switch {
+	case errors.Is(err, ErrInvalidOnionVersion):
+		code = CodeInvalidOnionVersion
+	case errors.Is(err, ErrInvalidOnionHMAC):
+		code = CodeInvalidOnionHMAC
+	case errors.Is(err, ErrInvalidOnionKey):
+		code = CodeInvalidOnionKey
+	default:
+		return nil
+	}
+
+	return &ProcessingError{
+		Code:      code,
+		OnionHash: sha256.Sum256(rawOnion),
+		Err:       err,
+	}
+}
+
+// Error returns a human readable description of the error.
+func (e *ProcessingError) Error() string {
+	return fmt.Sprintf("malformed onion (code 0x%04x): %v", e.Code, e.Err)
+}
+
+// Unwrap returns the underlying error, allowing it to be matched using
+// errors.Is.
+func (e *ProcessingError) Unwrap() error {
+	return e.Err
+}
+
+// TrampolineError is returned when the trampoline onion carried within the
+// payload of the final hop of the outer onion can't be processed. Unlike a
+// malformed outer onion, it must be reported to the sender within an encrypted
+// failure, so it never results in a ProcessingError.
+type TrampolineError struct {
+	// Err is the error encountered while processing the trampoline onion.
+	Err error
+}
+
+// Error returns a human readable description of the error.
+func (e *TrampolineError) Error() string {
+	return fmt.Sprintf("invalid trampoline onion: %v", e.Err)
+}
+
+// Unwrap returns the underlying error, allowing it to be matched using
+// errors.Is.
+func (e *TrampolineError) Unwrap() error {
+	return e.Err
+}
+
+// InvalidSeqNumError is returned when a packet is added to a transaction using
+// a sequence number above the maximum set by WithTxMaxSeqNum.
+type InvalidSeqNumError struct {
+	// SeqNum is the sequence number of the packet.
+	SeqNum uint32
+
+	// MaxSeqNum is the highest sequence number the transaction accepts.
+	MaxSeqNum uint32
+}
+
+// Error returns a human readable description of the error.
+func (e *InvalidSeqNumError) Error() string {
+	return fmt.Sprintf("%v: %d exceeds maximum of %d", ErrInvalidSeqNum,
+		e.SeqNum, e.MaxSeqNum)
+}
+
+// Unwrap returns ErrInvalidSeqNum, allowing the error to be matched using
+// errors.Is.
+func (e *InvalidSeqNumError) Unwrap() error {
+	return ErrInvalidSeqNum
+}
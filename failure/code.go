@@ -0,0 +1,136 @@
+// Package failure implements the BOLT 04 failure messages that are carried
+// within onion errors, on top of the error encryption of the sphinx package.
+package failure
+
+import (
+	"fmt"
+
+	sphinx "github.com/brsuite/lightning-onion"
+)
+
+// Code is the two byte failure code that starts every failure message. The
+// upper bits of the code are flags that describe how the failure should be
+// handled by the sender.
+type Code uint16
+
+const (
+	// FlagBadOnion signals that the onion could not be parsed by the
+	// node, so it couldn't encrypt the failure.
+	FlagBadOnion Code = 0x8000
+
+	// FlagPerm signals that the failure is permanent, so retrying the
+	// payment won't succeed.
+	FlagPerm Code = 0x4000
+
+	// FlagNode signals a failure of the node, rather than of a channel.
+	FlagNode Code = 0x2000
+
+	// FlagUpdate signals that the failure carries a channel_update.
+	FlagUpdate Code = 0x1000
+)
+
+// The failure codes defined by BOLT 04.
+const (
+	CodeInvalidRealm                          = FlagPerm | 1
+	CodeTemporaryNodeFailure                  = FlagNode | 2
+	CodePermanentNodeFailure                  = FlagPerm | FlagNode | 2
+	CodeRequiredNodeFeatureMissing            = FlagPerm | FlagNode | 3
+	CodeTemporaryChannelFailure               = FlagUpdate | 7
+	CodePermanentChannelFailure               = FlagPerm | 8
+	CodeRequiredChannelFeatureMissing         = FlagPerm | 9
+	CodeUnknownNextPeer                       = FlagPerm | 10
+	CodeAmountBelowMinimum                    = FlagUpdate | 11
+	CodeFeeInsufficient                       = FlagUpdate | 12
+	CodeIncorrectCltvExpiry                   = FlagUpdate | 13
+	CodeExpiryTooSoon                         = FlagUpdate | 14
+	CodeIncorrectOrUnknownPaymentDetails      = FlagPerm | 15
+	CodeFinalIncorrectCltvExpiry         Code = 18
+	CodeFinalIncorrectHtlcAmount         Code = 19
+	CodeChannelDisabled                       = FlagUpdate | 20
+	CodeExpiryTooFar                     Code = 21
+	CodeInvalidOnionPayload                   = FlagPerm | 22
+	CodeMPPTimeout                       Code = 23
+)
+
+// The BADONION failure codes of malformed onions, which are defined by the
+// sphinx package as it reports them within a sphinx.ProcessingError.
+const (
+	CodeInvalidOnionVersion  = Code(sphinx.CodeInvalidOnionVersion)
+	CodeInvalidOnionHmac     = Code(sphinx.CodeInvalidOnionHMAC)
+	CodeInvalidOnionKey      = Code(sphinx.CodeInvalidOnionKey)
+	CodeInvalidOnionBlinding = Code(sphinx.CodeInvalidOnionBlinding)
+)
+
+// IsBadOnion returns true if the BADONION flag is set.
+func (c Code) IsBadOnion() bool {
+	return c&FlagBadOnion != 0
+}
+
+// IsPerm returns true if the PERM flag is set.
+func (c Code) IsPerm() bool {
+	return c&FlagPerm != 0
+}
+
+// IsNode returns true if the NODE flag is set.
+func (c Code) IsNode() bool {
+	return c&FlagNode != 0
+}
+
+// IsUpdate returns true if the UPDATE flag is set.
+func (c Code) IsUpdate() bool {
+	return c&FlagUpdate != 0
+}
+
+// String returns a human readable name for the failure code.
+func (c Code) String() string {
+	switch c {
+	case CodeInvalidRealm:
+		return "InvalidRealm"
+	case CodeTemporaryNodeFailure:
+		return "TemporaryNodeFailure"
+	case CodePermanentNodeFailure:
+		return "PermanentNodeFailure"
+	case CodeRequiredNodeFeatureMissing:
+		return "RequiredNodeFeatureMissing"
+	case CodeInvalidOnionVersion:
+		return "InvalidOnionVersion"
+	case CodeInvalidOnionHmac:
+		return "InvalidOnionHmac"
+	case CodeInvalidOnionKey:
+		return "InvalidOnionKey"
+	case CodeTemporaryChannelFailure:
+		return "TemporaryChannelFailure"
+	case CodePermanentChannelFailure:
+		return "PermanentChannelFailure"
+	case CodeRequiredChannelFeatureMissing:
+		return "RequiredChannelFeatureMissing"
+	case CodeUnknownNextPeer:
+		return "UnknownNextPeer"
+	case CodeAmountBelowMinimum:
+		return "AmountBelowMinimum"
+	case CodeFeeInsufficient:
+		return "FeeInsufficient"
+	case CodeIncorrectCltvExpiry:
+		return "IncorrectCltvExpiry"
+	case CodeExpiryTooSoon:
+		return "ExpiryTooSoon"
+	case CodeIncorrectOrUnknownPaymentDetails:
+		return "IncorrectOrUnknownPaymentDetails"
+	case CodeFinalIncorrectCltvExpiry:
+		return "FinalIncorrectCltvExpiry"
+	case CodeFinalIncorrectHtlcAmount:
+		return "FinalIncorrectHtlcAmount"
+	case CodeChannelDisabled:
+		return "ChannelDisabled"
+	case CodeExpiryTooFar:
+		return "ExpiryTooFar"
+	case CodeInvalidOnionPayload:
+		return "InvalidOnionPayload"
+	case CodeMPPTimeout:
+		return "MPPTimeout"
+	case CodeInvalidOnionBlinding:
+		return "InvalidOnionBlinding"
+	default:
+		return fmt.Sprintf("<unknown code 0x%04x>", uint16(c))
+	}
+}
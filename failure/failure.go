@@ -0,0 +1,791 @@
+package failure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	sphinx "github.com/brsuite/lightning-onion"
+)
+
+var (
+	// ErrMalformedFailure is returned when the length prefixes of a
+	// padded failure message are inconsistent with its size.
+	ErrMalformedFailure = errors.New("malformed failure message")
+
+	// ErrNotBadOnion is returned when a malformed onion is reported with a
+	// failure code that lacks the BADONION flag.
+	ErrNotBadOnion = errors.New("failure code of malformed onion lacks " +
+		"BADONION flag")
+)
+
+// Failure is a BOLT 04 failure message. The Encode and Decode methods only
+// serialize the fields of the failure, the failure code itself is handled by
+// EncodeFailureMessage and DecodeFailureMessage.
+type Failure interface {
+	// Code returns the failure code of the failure.
+	Code() Code
+
+	// Encode writes the fields of the failure to the passed io.Writer.
+	Encode(w io.Writer) error
+
+	// Decode reads the fields of the failure from the passed io.Reader.
+	Decode(r io.Reader) error
+}
+
+// FailInvalidRealm is returned if the realm byte of the payload is unknown.
+type FailInvalidRealm struct{}
+
+// FailTemporaryNodeFailure is returned for a general temporary failure of the
+// processing node.
+type FailTemporaryNodeFailure struct{}
+
+// FailPermanentNodeFailure is returned for a general permanent failure of the
+// processing node.
+type FailPermanentNodeFailure struct{}
+
+// FailRequiredNodeFeatureMissing is returned if the processing node requires
+// features that aren't present in the onion.
+type FailRequiredNodeFeatureMissing struct{}
+
+// FailPermanentChannelFailure is returned for a general permanent failure of
+// the outgoing channel.
+type FailPermanentChannelFailure struct{}
+
+// FailRequiredChannelFeatureMissing is returned if the outgoing channel
+// requires features that aren't present in the onion.
+type FailRequiredChannelFeatureMissing struct{}
+
+// FailUnknownNextPeer is returned if the outgoing channel doesn't exist.
+type FailUnknownNextPeer struct{}
+
+// FailExpiryTooFar is returned if the CLTV expiry of the HTLC is too far in
+// the future.
+type FailExpiryTooFar struct{}
+
+// FailMPPTimeout is returned if the full amount of a multi-part payment
+// wasn't received in time.
+type FailMPPTimeout struct{}
+
+// FailInvalidOnionVersion is returned if the version byte of the onion is
+// unknown to the processing node.
+type FailInvalidOnionVersion struct {
+	// OnionSHA256 is the hash of the onion that couldn't be processed.
+	OnionSHA256 [32]byte
+}
+
+// FailInvalidOnionHmac is returned if the HMAC of the onion is invalid.
+type FailInvalidOnionHmac struct {
+	// OnionSHA256 is the hash of the onion that couldn't be processed.
+	OnionSHA256 [32]byte
+}
+
+// FailInvalidOnionKey is returned if the ephemeral key of the onion is
+// unparsable.
+type FailInvalidOnionKey struct {
+	// OnionSHA256 is the hash of the onion that couldn't be processed.
+	OnionSHA256 [32]byte
+}
+
+// FailInvalidOnionBlinding is returned by the hops of a blinded route when
+// they fail to process the onion, hiding the actual failure.
+type FailInvalidOnionBlinding struct {
+	// OnionSHA256 is the hash of the onion that couldn't be processed.
+	OnionSHA256 [32]byte
+}
+
+// FailTemporaryChannelFailure is returned if the outgoing channel is
+// temporarily unable to carry the HTLC.
+type FailTemporaryChannelFailure struct {
+	// Update is the serialized channel_update of the outgoing channel.
+	// It may be empty.
+	Update []byte
+}
+
+// FailAmountBelowMinimum is returned if the HTLC amount is below the minimum
+// of the outgoing channel.
+type FailAmountBelowMinimum struct {
+	// HtlcMsat is the amount of the incoming HTLC.
+	HtlcMsat uint64
+
+	// Update is the serialized channel_update of the outgoing channel.
+	Update []byte
+}
+
+// FailFeeInsufficient is returned if the fee paid by the HTLC is too low.
+type FailFeeInsufficient struct {
+	// HtlcMsat is the amount of the incoming HTLC.
+	HtlcMsat uint64
+
+	// Update is the serialized channel_update of the outgoing channel.
+	Update []byte
+}
+
+// FailIncorrectCltvExpiry is returned if the CLTV expiry of the incoming HTLC
+// doesn't leave enough room for the CLTV delta of the outgoing channel.
+type FailIncorrectCltvExpiry struct {
+	// CltvExpiry is the CLTV expiry of the incoming HTLC.
+	CltvExpiry uint32
+
+	// Update is the serialized channel_update of the outgoing channel.
+	Update []byte
+}
+
+// FailExpiryTooSoon is returned if the CLTV expiry of the HTLC is too close
+// to the current block height.
+type FailExpiryTooSoon struct {
+	// Update is the serialized channel_update of the outgoing channel.
+	Update []byte
+}
+
+// FailChannelDisabled is returned if the outgoing channel is disabled.
+type FailChannelDisabled struct {
+	// Flags are the disabled flags of the channel.
+	Flags uint16
+
+	// Update is the serialized channel_update of the outgoing channel.
+	Update []byte
+}
+
+// FailIncorrectOrUnknownPaymentDetails is returned by the final hop if the
+// payment hash is unknown, or the amount or CLTV expiry is incorrect.
+type FailIncorrectOrUnknownPaymentDetails struct {
+	// HtlcMsat is the amount of the incoming HTLC.
+	HtlcMsat uint64
+
+	// Height is the best known block height of the final hop.
+	Height uint32
+}
+
+// FailFinalIncorrectCltvExpiry is returned by the final hop if the CLTV
+// expiry of the HTLC doesn't match the one in the onion.
+type FailFinalIncorrectCltvExpiry struct {
+	// CltvExpiry is the CLTV expiry of the incoming HTLC.
+	CltvExpiry uint32
+}
+
+// FailFinalIncorrectHtlcAmount is returned by the final hop if the amount of
+// the HTLC doesn't match the one in the onion.
+type FailFinalIncorrectHtlcAmount struct {
+	// IncomingHTLCAmount is the amount of the incoming HTLC.
+	IncomingHTLCAmount uint64
+}
+
+// FailInvalidOnionPayload is returned if the payload of the onion couldn't be
+// parsed, or lacks a required field.
+type FailInvalidOnionPayload struct {
+	// Type is the TLV type that caused the failure.
+	Type uint64
+
+	// Offset is the byte offset within the payload of the failure.
+	Offset uint16
+}
+
+// FailUnknown is a failure with a code that isn't known to this package. Its
+// fields are kept as raw bytes.
+type FailUnknown struct {
+	// FailureCode is the code of the failure.
+	FailureCode Code
+
+	// Data holds the raw fields of the failure.
+	Data []byte
+}
+
+// Code returns the failure code of the failure.
+func (f *FailInvalidRealm) Code() Code { return CodeInvalidRealm }
+
+// Code returns the failure code of the failure.
+func (f *FailTemporaryNodeFailure) Code() Code {
+	return CodeTemporaryNodeFailure
+}
+
+// Code returns the failure code of the failure.
+func (f *FailPermanentNodeFailure) Code() Code {
+	return CodePermanentNodeFailure
+}
+
+// Code returns the failure code of the failure.
+func (f *FailRequiredNodeFeatureMissing) Code() Code {
+	return CodeRequiredNodeFeatureMissing
+}
+
+// Code returns the failure code of the failure.
+func (f *FailPermanentChannelFailure) Code() Code {
+	return CodePermanentChannelFailure
+}
+
+// Code returns the failure code of the failure.
+func (f *FailRequiredChannelFeatureMissing) Code() Code {
+	return CodeRequiredChannelFeatureMissing
+}
+
+// Code returns the failure code of the failure.
+func (f *FailUnknownNextPeer) Code() Code { return CodeUnknownNextPeer }
+
+// Code returns the failure code of the failure.
+func (f *FailExpiryTooFar) Code() Code { return CodeExpiryTooFar }
+
+// Code returns the failure code of the failure.
+func (f *FailMPPTimeout) Code() Code { return CodeMPPTimeout }
+
+// Code returns the failure code of the failure.
+func (f *FailInvalidOnionVersion) Code() Code { return CodeInvalidOnionVersion }
+
+// Code returns the failure code of the failure.
+func (f *FailInvalidOnionHmac) Code() Code { return CodeInvalidOnionHmac }
+
+// Code returns the failure code of the failure.
+func (f *FailInvalidOnionKey) Code() Code { return CodeInvalidOnionKey }
+
+// Code returns the failure code of the failure.
+func (f *FailInvalidOnionBlinding) Code() Code {
+	return CodeInvalidOnionBlinding
+}
+
+// Code returns the failure code of the failure.
+func (f *FailTemporaryChannelFailure) Code() Code {
+	return CodeTemporaryChannelFailure
+}
+
+// Code returns the failure code of the failure.
+func (f *FailAmountBelowMinimum) Code() Code { return CodeAmountBelowMinimum }
+
+// Code returns the failure code of the failure.
+func (f *FailFeeInsufficient) Code() Code { return CodeFeeInsufficient }
+
+// Code returns the failure code of the failure.
+func (f *FailIncorrectCltvExpiry) Code() Code { return CodeIncorrectCltvExpiry }
+
+// Code returns the failure code of the failure.
+func (f *FailExpiryTooSoon) Code() Code { return CodeExpiryTooSoon }
+
+// Code returns the failure code of the failure.
+func (f *FailChannelDisabled) Code() Code { return CodeChannelDisabled }
+
+// Code returns the failure code of the failure.
+func (f *FailIncorrectOrUnknownPaymentDetails) Code() Code {
+	return CodeIncorrectOrUnknownPaymentDetails
+}
+
+// Code returns the failure code of the failure.
+func (f *FailFinalIncorrectCltvExpiry) Code() Code {
+	return CodeFinalIncorrectCltvExpiry
+}
+
+// Code returns the failure code of the failure.
+func (f *FailFinalIncorrectHtlcAmount) Code() Code {
+	return CodeFinalIncorrectHtlcAmount
+}
+
+// Code returns the failure code of the failure.
+func (f *FailInvalidOnionPayload) Code() Code { return CodeInvalidOnionPayload }
+
+// Code returns the failure code of the failure.
+func (f *FailUnknown) Code() Code { return f.FailureCode }
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailInvalidRealm) Encode(w io.Writer) error { return nil }
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailInvalidRealm) Decode(r io.Reader) error { return nil }
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailTemporaryNodeFailure) Encode(w io.Writer) error { return nil }
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailTemporaryNodeFailure) Decode(r io.Reader) error { return nil }
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailPermanentNodeFailure) Encode(w io.Writer) error { return nil }
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailPermanentNodeFailure) Decode(r io.Reader) error { return nil }
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailRequiredNodeFeatureMissing) Encode(w io.Writer) error {
+	return nil
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailRequiredNodeFeatureMissing) Decode(r io.Reader) error {
+	return nil
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailPermanentChannelFailure) Encode(w io.Writer) error { return nil }
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailPermanentChannelFailure) Decode(r io.Reader) error { return nil }
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailRequiredChannelFeatureMissing) Encode(w io.Writer) error {
+	return nil
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailRequiredChannelFeatureMissing) Decode(r io.Reader) error {
+	return nil
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailUnknownNextPeer) Encode(w io.Writer) error { return nil }
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailUnknownNextPeer) Decode(r io.Reader) error { return nil }
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailExpiryTooFar) Encode(w io.Writer) error { return nil }
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailExpiryTooFar) Decode(r io.Reader) error { return nil }
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailMPPTimeout) Encode(w io.Writer) error { return nil }
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailMPPTimeout) Decode(r io.Reader) error { return nil }
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailInvalidOnionVersion) Encode(w io.Writer) error {
+	_, err := w.Write(f.OnionSHA256[:])
+	return err
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailInvalidOnionVersion) Decode(r io.Reader) error {
+	_, err := io.ReadFull(r, f.OnionSHA256[:])
+	return err
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailInvalidOnionHmac) Encode(w io.Writer) error {
+	_, err := w.Write(f.OnionSHA256[:])
+	return err
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailInvalidOnionHmac) Decode(r io.Reader) error {
+	_, err := io.ReadFull(r, f.OnionSHA256[:])
+	return err
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailInvalidOnionKey) Encode(w io.Writer) error {
+	_, err := w.Write(f.OnionSHA256[:])
+	return err
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailInvalidOnionKey) Decode(r io.Reader) error {
+	_, err := io.ReadFull(r, f.OnionSHA256[:])
+	return err
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailInvalidOnionBlinding) Encode(w io.Writer) error {
+	_, err := w.Write(f.OnionSHA256[:])
+	return err
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailInvalidOnionBlinding) Decode(r io.Reader) error {
+	_, err := io.ReadFull(r, f.OnionSHA256[:])
+	return err
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailTemporaryChannelFailure) Encode(w io.Writer) error {
+	return writeUpdate(w, f.Update)
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailTemporaryChannelFailure) Decode(r io.Reader) error {
+	var err error
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailAmountBelowMinimum) Encode(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, f.HtlcMsat); err != nil {
+		return err
+	}
+
+	return writeUpdate(w, f.Update)
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailAmountBelowMinimum) Decode(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &f.HtlcMsat); err != nil {
+		return err
+	}
+
+	var err error
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailFeeInsufficient) Encode(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, f.HtlcMsat); err != nil {
+		return err
+	}
+
+	return writeUpdate(w, f.Update)
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailFeeInsufficient) Decode(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &f.HtlcMsat); err != nil {
+		return err
+	}
+
+	var err error
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailIncorrectCltvExpiry) Encode(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, f.CltvExpiry); err != nil {
+		return err
+	}
+
+	return writeUpdate(w, f.Update)
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailIncorrectCltvExpiry) Decode(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &f.CltvExpiry); err != nil {
+		return err
+	}
+
+	var err error
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailExpiryTooSoon) Encode(w io.Writer) error {
+	return writeUpdate(w, f.Update)
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailExpiryTooSoon) Decode(r io.Reader) error {
+	var err error
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailChannelDisabled) Encode(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, f.Flags); err != nil {
+		return err
+	}
+
+	return writeUpdate(w, f.Update)
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailChannelDisabled) Decode(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &f.Flags); err != nil {
+		return err
+	}
+
+	var err error
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailIncorrectOrUnknownPaymentDetails) Encode(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, f.HtlcMsat); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, f.Height)
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailIncorrectOrUnknownPaymentDetails) Decode(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &f.HtlcMsat); err != nil {
+		return err
+	}
+
+	return binary.Read(r, binary.BigEndian, &f.Height)
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailFinalIncorrectCltvExpiry) Encode(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, f.CltvExpiry)
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailFinalIncorrectCltvExpiry) Decode(r io.Reader) error {
+	return binary.Read(r, binary.BigEndian, &f.CltvExpiry)
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailFinalIncorrectHtlcAmount) Encode(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, f.IncomingHTLCAmount)
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailFinalIncorrectHtlcAmount) Decode(r io.Reader) error {
+	return binary.Read(r, binary.BigEndian, &f.IncomingHTLCAmount)
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailInvalidOnionPayload) Encode(w io.Writer) error {
+	var b [8]byte
+	if err := sphinx.WriteVarInt(w, f.Type, &b); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, f.Offset)
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailInvalidOnionPayload) Decode(r io.Reader) error {
+	var (
+		b   [8]byte
+		err error
+	)
+	f.Type, err = sphinx.ReadVarInt(r, &b)
+	if err != nil {
+		return err
+	}
+
+	return binary.Read(r, binary.BigEndian, &f.Offset)
+}
+
+// Encode writes the fields of the failure to the passed io.Writer.
+func (f *FailUnknown) Encode(w io.Writer) error {
+	_, err := w.Write(f.Data)
+	return err
+}
+
+// Decode reads the fields of the failure from the passed io.Reader.
+func (f *FailUnknown) Decode(r io.Reader) error {
+	var err error
+	f.Data, err = io.ReadAll(r)
+	return err
+}
+
+// writeUpdate writes the u16 length prefixed channel_update to the passed
+// io.Writer.
+func writeUpdate(w io.Writer, update []byte) error {
+	if len(update) > 0xffff {
+		return fmt.Errorf("channel update of %d bytes too large",
+			len(update))
+	}
+
+	err := binary.Write(w, binary.BigEndian, uint16(len(update)))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(update)
+	return err
+}
+
+// readUpdate reads a u16 length prefixed channel_update from the passed
+// io.Reader.
+func readUpdate(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	update := make([]byte, length)
+	if _, err := io.ReadFull(r, update); err != nil {
+		return nil, err
+	}
+
+	return update, nil
+}
+
+// newFailure returns an empty failure of the type matching the passed code.
+func newFailure(code Code) Failure {
+	switch code {
+	case CodeInvalidRealm:
+		return &FailInvalidRealm{}
+	case CodeTemporaryNodeFailure:
+		return &FailTemporaryNodeFailure{}
+	case CodePermanentNodeFailure:
+		return &FailPermanentNodeFailure{}
+	case CodeRequiredNodeFeatureMissing:
+		return &FailRequiredNodeFeatureMissing{}
+	case CodeInvalidOnionVersion:
+		return &FailInvalidOnionVersion{}
+	case CodeInvalidOnionHmac:
+		return &FailInvalidOnionHmac{}
+	case CodeInvalidOnionKey:
+		return &FailInvalidOnionKey{}
+	case CodeTemporaryChannelFailure:
+		return &FailTemporaryChannelFailure{}
+	case CodePermanentChannelFailure:
+		return &FailPermanentChannelFailure{}
+	case CodeRequiredChannelFeatureMissing:
+		return &FailRequiredChannelFeatureMissing{}
+	case CodeUnknownNextPeer:
+		return &FailUnknownNextPeer{}
+	case CodeAmountBelowMinimum:
+		return &FailAmountBelowMinimum{}
+	case CodeFeeInsufficient:
+		return &FailFeeInsufficient{}
+	case CodeIncorrectCltvExpiry:
+		return &FailIncorrectCltvExpiry{}
+	case CodeExpiryTooSoon:
+		return &FailExpiryTooSoon{}
+	case CodeIncorrectOrUnknownPaymentDetails:
+		return &FailIncorrectOrUnknownPaymentDetails{}
+	case CodeFinalIncorrectCltvExpiry:
+		return &FailFinalIncorrectCltvExpiry{}
+	case CodeFinalIncorrectHtlcAmount:
+		return &FailFinalIncorrectHtlcAmount{}
+	case CodeChannelDisabled:
+		return &FailChannelDisabled{}
+	case CodeExpiryTooFar:
+		return &FailExpiryTooFar{}
+	case CodeInvalidOnionPayload:
+		return &FailInvalidOnionPayload{}
+	case CodeMPPTimeout:
+		return &FailMPPTimeout{}
+	case CodeInvalidOnionBlinding:
+		return &FailInvalidOnionBlinding{}
+	default:
+		return &FailUnknown{FailureCode: code}
+	}
+}
+
+// EncodeFailureMessage serializes the failure code followed by the fields of
+// the failure, without any length prefix or padding.
+func EncodeFailureMessage(f Failure) ([]byte, error) {
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.BigEndian, f.Code()); err != nil {
+		return nil, err
+	}
+
+	if err := f.Encode(&b); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// DecodeFailureMessage parses a failure message as serialized by
+// EncodeFailureMessage. Failures with an unknown code are returned as a
+// FailUnknown. Any bytes following the known fields of a failure, such as TLV
+// extensions, are ignored.
+func DecodeFailureMessage(b []byte) (Failure, error) {
+	r := bytes.NewReader(b)
+
+	var code Code
+	if err := binary.Read(r, binary.BigEndian, &code); err != nil {
+		return nil, err
+	}
+
+	f := newFailure(code)
+	if err := f.Decode(r); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// EncodeFailure serializes the failure as the body of an onion error,
+// including the mandatory length prefix and padding.
+func EncodeFailure(f Failure) ([]byte, error) {
+	msg, err := EncodeFailureMessage(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return sphinx.PadFailureMessage(msg)
+}
+
+// DecodeFailure parses the body of an onion error as serialized by
+// EncodeFailure.
+func DecodeFailure(body []byte) (Failure, error) {
+	if len(body) < 2 {
+		return nil, ErrMalformedFailure
+	}
+
+	failureLen := int(binary.BigEndian.Uint16(body[:2]))
+	if 2+failureLen+2 > len(body) {
+		return nil, ErrMalformedFailure
+	}
+
+	padLen := int(binary.BigEndian.Uint16(body[2+failureLen:]))
+	if 2+failureLen+2+padLen != len(body) {
+		return nil, ErrMalformedFailure
+	}
+
+	return DecodeFailureMessage(body[2 : 2+failureLen])
+}
+
+// EncryptFailure creates the initial onion error for the passed failure,
+// encrypted by the node at which the failure occurred.
+func EncryptFailure(encrypter *sphinx.OnionErrorEncrypter,
+	f Failure) ([]byte, error) {
+
+	body, err := EncodeFailure(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypter.EncryptError(true, body), nil
+}
+
+// FromDecryptedError parses the failure contained within an onion error that
+// was decrypted by the sender of the payment.
+func FromDecryptedError(decrypted *sphinx.DecryptedError) (Failure, error) {
+	return DecodeFailure(decrypted.Message)
+}
+
+// NewMalformedFailure returns the failure matching a malformed onion that was
+// reported by the downstream node, using the failure code and onion hash it
+// sent in the clear. The code must have the BADONION flag set.
+func NewMalformedFailure(code Code, onionHash [32]byte) (Failure, error) {
+	if !code.IsBadOnion() {
+		return nil, ErrNotBadOnion
+	}
+
+	switch code {
+	case CodeInvalidOnionVersion:
+		return &FailInvalidOnionVersion{OnionSHA256: onionHash}, nil
+	case CodeInvalidOnionHmac:
+		return &FailInvalidOnionHmac{OnionSHA256: onionHash}, nil
+	case CodeInvalidOnionKey:
+		return &FailInvalidOnionKey{OnionSHA256: onionHash}, nil
+	case CodeInvalidOnionBlinding:
+		return &FailInvalidOnionBlinding{OnionSHA256: onionHash}, nil
+	default:
+		return &FailUnknown{FailureCode: code, Data: onionHash[:]}, nil
+	}
+}
+
+// FromProcessingError returns the failure to report to the upstream node for
+// an onion that couldn't be processed.
+func FromProcessingError(procErr *sphinx.ProcessingError) (Failure, error) {
+	return NewMalformedFailure(Code(procErr.Code), procErr.OnionHash)
+}
+
+// EncryptMalformedFailure is used by the upstream node of the one that
+// couldn't process an onion, to turn the malformed onion it reported into a
+// regular failure. As the reporting node couldn't encrypt the failure itself,
+// the upstream node creates the initial encrypted failure on its behalf,
+// using its own encrypter.
+func EncryptMalformedFailure(encrypter *sphinx.OnionErrorEncrypter,
+	code Code, onionHash [32]byte) ([]byte, error) {
+
+	f, err := NewMalformedFailure(code, onionHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return EncryptFailure(encrypter, f)
+}
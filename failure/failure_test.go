@@ -0,0 +1,320 @@
+package failure
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/brsuite/brond/btcec"
+	"github.com/brsuite/brond/chaincfg"
+	sphinx "github.com/brsuite/lightning-onion"
+)
+
+var (
+	testOnionHash = [32]byte{1, 2, 3}
+	testUpdate    = bytes.Repeat([]byte{'U'}, 130)
+)
+
+// testFailures contains an instance of every failure known to the package.
+var testFailures = []Failure{
+	&FailInvalidRealm{},
+	&FailTemporaryNodeFailure{},
+	&FailPermanentNodeFailure{},
+	&FailRequiredNodeFeatureMissing{},
+	&FailInvalidOnionVersion{OnionSHA256: testOnionHash},
+	&FailInvalidOnionHmac{OnionSHA256: testOnionHash},
+	&FailInvalidOnionKey{OnionSHA256: testOnionHash},
+	&FailTemporaryChannelFailure{Update: testUpdate},
+	&FailPermanentChannelFailure{},
+	&FailRequiredChannelFeatureMissing{},
+	&FailUnknownNextPeer{},
+	&FailAmountBelowMinimum{HtlcMsat: 1000, Update: testUpdate},
+	&FailFeeInsufficient{HtlcMsat: 1000, Update: testUpdate},
+	&FailIncorrectCltvExpiry{CltvExpiry: 144, Update: testUpdate},
+	&FailExpiryTooSoon{Update: testUpdate},
+	&FailIncorrectOrUnknownPaymentDetails{HtlcMsat: 1000, Height: 700000},
+	&FailFinalIncorrectCltvExpiry{CltvExpiry: 144},
+	&FailFinalIncorrectHtlcAmount{IncomingHTLCAmount: 1000},
+	&FailChannelDisabled{Flags: 1, Update: testUpdate},
+	&FailExpiryTooFar{},
+	&FailInvalidOnionPayload{Type: 0x10000, Offset: 10},
+	&FailMPPTimeout{},
+	&FailInvalidOnionBlinding{OnionSHA256: testOnionHash},
+	&FailUnknown{FailureCode: FlagNode | 0x100, Data: []byte("data")},
+}
+
+// TestFailureEncodeDecode tests that every failure survives a round trip
+// through its encoding, both with and without padding.
+func TestFailureEncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	for _, f := range testFailures {
+		msg, err := EncodeFailureMessage(f)
+		if err != nil {
+			t.Fatalf("%v: unable to encode failure: %v", f.Code(),
+				err)
+		}
+
+		decoded, err := DecodeFailureMessage(msg)
+		if err != nil {
+			t.Fatalf("%v: unable to decode failure: %v", f.Code(),
+				err)
+		}
+		if !reflect.DeepEqual(decoded, f) {
+			t.Fatalf("%v: expected %v, got %v", f.Code(), f,
+				decoded)
+		}
+
+		body, err := EncodeFailure(f)
+		if err != nil {
+			t.Fatalf("%v: unable to encode failure: %v", f.Code(),
+				err)
+		}
+
+		decoded, err = DecodeFailure(body)
+		if err != nil {
+			t.Fatalf("%v: unable to decode failure: %v", f.Code(),
+				err)
+		}
+		if !reflect.DeepEqual(decoded, f) {
+			t.Fatalf("%v: expected %v, got %v", f.Code(), f,
+				decoded)
+		}
+	}
+}
+
+// TestDecodeFailureErrors asserts that failures with inconsistent length
+// prefixes are rejected.
+func TestDecodeFailureErrors(t *testing.T) {
+	t.Parallel()
+
+	body, err := EncodeFailure(&FailTemporaryNodeFailure{})
+	if err != nil {
+		t.Fatalf("unable to encode failure: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		body []byte
+	}{
+		{
+			name: "empty",
+			body: nil,
+		},
+		{
+			name: "truncated padding",
+			body: body[:len(body)-1],
+		},
+		{
+			name: "trailing bytes",
+			body: append(append([]byte{}, body...), 0),
+		},
+		{
+			name: "oversized failure length",
+			body: append([]byte{0xff, 0xff}, body[2:]...),
+		},
+	}
+
+	for _, testCase := range testCases {
+		_, err := DecodeFailure(testCase.body)
+		if !errors.Is(err, ErrMalformedFailure) {
+			t.Fatalf("%s: expected error %v, got %v", testCase.name,
+				ErrMalformedFailure, err)
+		}
+	}
+
+	// A failure that is too short for its fields is rejected as well.
+	_, err = DecodeFailureMessage([]byte{0x10, 0x07, 0x00, 0x05})
+	if err == nil {
+		t.Fatalf("expected truncated failure to be rejected")
+	}
+}
+
+// TestCodeFlags tests the flag predicates of the failure codes.
+func TestCodeFlags(t *testing.T) {
+	t.Parallel()
+
+	code := CodeInvalidOnionHmac
+	if !code.IsBadOnion() || !code.IsPerm() || code.IsNode() ||
+		code.IsUpdate() {
+
+		t.Fatalf("unexpected flags for %v", code)
+	}
+
+	code = CodeTemporaryChannelFailure
+	if code.IsBadOnion() || code.IsPerm() || code.IsNode() ||
+		!code.IsUpdate() {
+
+		t.Fatalf("unexpected flags for %v", code)
+	}
+
+	if CodePermanentNodeFailure.String() != "PermanentNodeFailure" {
+		t.Fatalf("unexpected name: %v", CodePermanentNodeFailure)
+	}
+}
+
+// TestEncryptFailure tests that a failure encrypted by a hop within a route
+// can be decrypted and parsed by the sender.
+func TestEncryptFailure(t *testing.T) {
+	t.Parallel()
+
+	const numHops = 3
+
+	var (
+		routers     [numHops]*sphinx.Router
+		paymentPath [numHops]*btcec.PublicKey
+	)
+	for i := range routers {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+
+		routers[i] = sphinx.NewRouter(
+			&sphinx.PrivKeyECDH{PrivKey: privKey},
+			&chaincfg.MainNetParams,
+			sphinx.NewMemoryReplayLog(),
+		)
+		if err := routers[i].Start(); err != nil {
+			t.Fatalf("unable to start router: %v", err)
+		}
+		defer routers[i].Stop()
+
+		paymentPath[i] = privKey.PubKey()
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	circuit := &sphinx.Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath[:],
+	}
+
+	// Route an onion through the hops, so that each of them can derive
+	// the shared secret used to encrypt errors.
+	var route sphinx.PaymentPath
+	for i, pub := range paymentPath {
+		route[i] = sphinx.OnionHop{
+			NodePub: *pub,
+			HopPayload: sphinx.HopPayload{
+				Type:    sphinx.PayloadTLV,
+				Payload: []byte{2, 1, 1},
+			},
+		}
+	}
+	pkt, err := sphinx.NewOnionPacket(
+		&route, sessionKey, nil, sphinx.DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	var encrypters [numHops]*sphinx.OnionErrorEncrypter
+	for i, router := range routers {
+		encrypters[i], err = sphinx.NewOnionErrorEncrypter(
+			router, pkt.EphemeralKey,
+		)
+		if err != nil {
+			t.Fatalf("unable to create encrypter: %v", err)
+		}
+
+		processed, err := router.ProcessOnionPacket(pkt, nil, 0)
+		if err != nil {
+			t.Fatalf("unable to process onion: %v", err)
+		}
+		pkt = processed.NextPacket
+	}
+
+	f := &FailFeeInsufficient{HtlcMsat: 1000, Update: testUpdate}
+	data, err := EncryptFailure(encrypters[numHops-1], f)
+	if err != nil {
+		t.Fatalf("unable to encrypt failure: %v", err)
+	}
+	for i := numHops - 2; i >= 0; i-- {
+		data = encrypters[i].EncryptError(false, data)
+	}
+
+	decrypted, err := sphinx.NewOnionErrorDecrypter(circuit).
+		DecryptError(data)
+	if err != nil {
+		t.Fatalf("unable to decrypt error: %v", err)
+	}
+	if decrypted.SenderIdx != numHops {
+		t.Fatalf("expected sender %d, got %d", numHops,
+			decrypted.SenderIdx)
+	}
+
+	decoded, err := FromDecryptedError(decrypted)
+	if err != nil {
+		t.Fatalf("unable to decode failure: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, f) {
+		t.Fatalf("expected %v, got %v", f, decoded)
+	}
+
+	// If the last hop reports a malformed onion instead, the failure is
+	// encrypted by its upstream node on its behalf.
+	data, err = EncryptMalformedFailure(
+		encrypters[numHops-2], CodeInvalidOnionKey, testOnionHash,
+	)
+	if err != nil {
+		t.Fatalf("unable to encrypt failure: %v", err)
+	}
+	for i := numHops - 3; i >= 0; i-- {
+		data = encrypters[i].EncryptError(false, data)
+	}
+
+	decrypted, err = sphinx.NewOnionErrorDecrypter(circuit).
+		DecryptError(data)
+	if err != nil {
+		t.Fatalf("unable to decrypt error: %v", err)
+	}
+	if decrypted.SenderIdx != numHops-1 {
+		t.Fatalf("expected sender %d, got %d", numHops-1,
+			decrypted.SenderIdx)
+	}
+
+	decoded, err = FromDecryptedError(decrypted)
+	if err != nil {
+		t.Fatalf("unable to decode failure: %v", err)
+	}
+	expected := &FailInvalidOnionKey{OnionSHA256: testOnionHash}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Fatalf("expected %v, got %v", expected, decoded)
+	}
+}
+
+// TestMalformedFailure tests the conversion of a malformed onion reported by
+// the downstream node into a failure.
+func TestMalformedFailure(t *testing.T) {
+	t.Parallel()
+
+	procErr := sphinx.NewProcessingError(
+		[]byte("onion"), sphinx.ErrInvalidOnionHMAC,
+	)
+	f, err := FromProcessingError(procErr)
+	if err != nil {
+		t.Fatalf("unable to convert processing error: %v", err)
+	}
+
+	expected := &FailInvalidOnionHmac{OnionSHA256: procErr.OnionHash}
+	if !reflect.DeepEqual(f, expected) {
+		t.Fatalf("expected %v, got %v", expected, f)
+	}
+
+	f, err = NewMalformedFailure(CodeInvalidOnionBlinding, testOnionHash)
+	if err != nil {
+		t.Fatalf("unable to create failure: %v", err)
+	}
+	if _, ok := f.(*FailInvalidOnionBlinding); !ok {
+		t.Fatalf("expected invalid onion blinding, got %v", f.Code())
+	}
+
+	// Only BADONION failures can be reported as malformed.
+	_, err = NewMalformedFailure(CodeTemporaryNodeFailure, testOnionHash)
+	if err != ErrNotBadOnion {
+		t.Fatalf("expected error %v, got %v", ErrNotBadOnion, err)
+	}
+}
@@ -0,0 +1,987 @@
+package sphinx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// fileReplayLogMagic is written at the start of the file of a
+	// FileReplayLog, and identifies the format of the records that follow.
+	fileReplayLogMagic = "SPHXRL\x00\x02"
+
+	// legacyFileReplayLogMagic identifies the files whose records lack a
+	// header checksum. They're still loaded, and rewritten in the current
+	// format on Start.
+	legacyFileReplayLogMagic = "SPHXRL\x00\x01"
+
+	// recordHeaderSize is the size of the header of a record, made up of
+	// its type and the length of its payload.
+	recordHeaderSize = 5
+
+	// recordHeaderChecksumSize is the size of the CRC-32C checksum that
+	// precedes each record within the file of a FileReplayLog, covering
+	// its header. It ensures that a record is only taken to be torn when
+	// the length it claims is intact.
+	recordHeaderChecksumSize = 4
+
+	// recordChecksumSize is the size of the CRC-32C checksum that follows
+	// the payload of a record, covering both its header and payload.
+	recordChecksumSize = 4
+
+	// maxRecordPayloadSize is the maximum size of the payload of a record.
+	// Each sequence number of a batch takes at most 28 bytes of its
+	// record, either as a 24-byte entry or a 4-byte replay, so this holds
+	// a batch of a transaction using every sequence number up to
+	// DefaultTxMaxSeqNum, along with an ID of the maximum length. Larger
+	// batches are rejected with ErrBatchTooLarge.
+	maxRecordPayloadSize = 1 << 25
+
+	// compactMinRecords is the number of records the file must hold before
+	// it is compacted automatically.
+	compactMinRecords = 1024
+
+	// compactRatio is the number of records the file must hold per live
+	// entry or batch before it is compacted automatically.
+	compactRatio = 2
+)
+
+// The types of the records stored within the file of a FileReplayLog.
+const (
+	// recordPut adds an entry to the log.
+	recordPut byte = 1
+
+	// recordDelete removes an entry from the log.
+	recordDelete byte = 2
+
+	// recordBatch adds the entries of a batch that weren't replays to the
+	// log, along with the replay set and expiry of the batch.
+	recordBatch byte = 3
+
+	// recordExpire removes the entries and batches that expired below a
+	// block height.
+	recordExpire byte = 4
+
+	// recordDeleteBatch removes a batch, along with the entries it added
+	// to the log.
+	recordDeleteBatch byte = 5
+)
+
+// ErrCorruptReplayLog is returned when the file of a FileReplayLog contains a
+// damaged record that isn't the last one, and so can't be the result of a torn
+// write.
+var ErrCorruptReplayLog = errors.New("replay log file is corrupt")
+
+// ErrBatchIDTooLong is returned when a batch with an ID longer than 65535
+// bytes is added to a FileReplayLog.
+var ErrBatchIDTooLong = errors.New("batch id too long")
+
+// ErrBatchTooLarge is returned when a batch is added to a FileReplayLog whose
+// record would exceed the maximum size of a record, and so couldn't be read
+// back.
+var ErrBatchTooLarge = errors.New("batch too large")
+
+// errTornRecord is returned when the last record of the file of a
+// FileReplayLog was torn by a crash while it was being written.
+var errTornRecord = errors.New("torn record")
+
+// crc32cTable is the table used to compute the checksums of the records.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileReplayLog is a ReplayLog implementation that persists all added sphinx
+// packets and processed batches to a single file, so that replay protection
+// survives restarts. The file is an append-only log of checksummed records,
+// which is replayed into memory on Start. Should the last write have been torn
+// by a crash, the damaged record is discarded. Once the file holds many more
+// records than there are live entries and batches, it is compacted by
+// rewriting the current state to a new file that atomically replaces it.
+type FileReplayLog struct {
+	// path is the location of the file backing the log.
+	path string
+
+	// mtx guards all of the fields below.
+	mtx sync.Mutex
+
+	// file is the open file backing the log, or nil if the log isn't
+	// started.
+	file *os.File
+
+	// size is the size of the file up to the end of the last record that
+	// was fully written.
+	size int64
+
+	// numRecords is the number of records held by the file.
+	numRecords int
+
+	batches      map[string]*ReplaySet
+	batchExpiry  map[string]uint32
+	batchEntries map[string][]HashPrefix
+	entries      map[HashPrefix]uint32
+}
+
+// NewFileReplayLog constructs a new FileReplayLog backed by the file at the
+// given path, which is created on Start if it doesn't exist yet.
+func NewFileReplayLog(path string) *FileReplayLog {
+	return &FileReplayLog{
+		path: path,
+	}
+}
+
+// Start opens the file backing the log, replaying its records into memory.
+func (rl *FileReplayLog) Start() error {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if rl.file != nil {
+		return errReplayLogAlreadyStarted
+	}
+
+	file, err := os.OpenFile(rl.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	rl.batches = make(map[string]*ReplaySet)
+	rl.batchExpiry = make(map[string]uint32)
+	rl.batchEntries = make(map[string][]HashPrefix)
+	rl.entries = make(map[HashPrefix]uint32)
+	rl.numRecords = 0
+
+	rl.file = file
+
+	// A file of the legacy format is rewritten right away, so that the
+	// records appended to it carry a header checksum.
+	legacy, err := rl.load(file)
+	if err == nil && legacy {
+		err = rl.compact()
+	}
+	if err != nil {
+		rl.file.Close()
+		rl.file = nil
+		rl.batches = nil
+		rl.batchExpiry = nil
+		rl.batchEntries = nil
+		rl.entries = nil
+		return err
+	}
+
+	return nil
+}
+
+// load replays the records of the passed file into memory, returning true if
+// the file is of the legacy format. A file that is empty, or only holds part of
+// the magic because its creation was torn, is initialized from scratch. A
+// damaged record at the end of the file is truncated, while one followed by
+// further records is reported as corrupt.
+func (rl *FileReplayLog) load(file *os.File) (bool, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return false, err
+	}
+
+	if len(data) < len(fileReplayLogMagic) &&
+		bytes.HasPrefix([]byte(fileReplayLogMagic), data) {
+
+		return false, rl.reset(file)
+	}
+
+	var legacy bool
+	switch {
+	case bytes.HasPrefix(data, []byte(fileReplayLogMagic)):
+	case bytes.HasPrefix(data, []byte(legacyFileReplayLogMagic)):
+		legacy = true
+	default:
+		return false, ErrCorruptReplayLog
+	}
+
+	offset := len(fileReplayLogMagic)
+	for offset < len(data) {
+		recordType, payload, n, err := decodeLogRecord(
+			data[offset:], !legacy,
+		)
+		if err == errTornRecord {
+			sphxLog.Warnf("Discarding torn record at offset %d of "+
+				"replay log %v", offset, rl.path)
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if err := rl.apply(recordType, payload); err != nil {
+			return false, err
+		}
+
+		offset += n
+		rl.numRecords++
+	}
+
+	if offset < len(data) {
+		if err := file.Truncate(int64(offset)); err != nil {
+			return false, err
+		}
+		if err := file.Sync(); err != nil {
+			return false, err
+		}
+	}
+
+	rl.size = int64(offset)
+	_, err = file.Seek(rl.size, io.SeekStart)
+
+	return legacy, err
+}
+
+// reset truncates the passed file, writing the magic anew.
+func (rl *FileReplayLog) reset(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.WriteAt([]byte(fileReplayLogMagic), 0); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	rl.size = int64(len(fileReplayLogMagic))
+	_, err := file.Seek(rl.size, io.SeekStart)
+
+	return err
+}
+
+// decodeLogRecord decodes the record of the file of a FileReplayLog at the
+// start of the passed slice, returning its type and payload along with the
+// number of bytes it occupies. The record is preceded by the checksum of its
+// header, unless the file is of the legacy format. If the record was torn by a
+// crash, which is only possible if it reaches the end of the slice,
+// errTornRecord is returned. Any other damaged record results in
+// ErrCorruptReplayLog.
+func decodeLogRecord(b []byte, headerChecksum bool) (byte, []byte, int,
+	error) {
+
+	record := b
+	if headerChecksum {
+		if len(b) < recordHeaderChecksumSize+recordHeaderSize {
+			return 0, nil, 0, errTornRecord
+		}
+
+		record = b[recordHeaderChecksumSize:]
+		checksum := binary.BigEndian.Uint32(b)
+		header := record[:recordHeaderSize]
+		if crc32.Checksum(header, crc32cTable) != checksum {
+			return 0, nil, 0, ErrCorruptReplayLog
+		}
+	} else if len(b) < recordHeaderSize {
+		return 0, nil, 0, errTornRecord
+	}
+
+	// The length is written in full along with the rest of the header, so
+	// a tear can't result in a length above the maximum.
+	payloadLen := binary.BigEndian.Uint32(record[1:recordHeaderSize])
+	if payloadLen > maxRecordPayloadSize {
+		return 0, nil, 0, ErrCorruptReplayLog
+	}
+
+	recordType, payload, n, ok := decodeRecord(record)
+	n += len(b) - len(record)
+	switch {
+	case ok:
+		return recordType, payload, n, nil
+
+	// Only the last record may have been torn, so any other damaged
+	// record means the file is corrupt.
+	case n < len(b):
+		return 0, nil, 0, ErrCorruptReplayLog
+
+	default:
+		return 0, nil, 0, errTornRecord
+	}
+}
+
+// decodeRecord decodes the record at the start of the passed slice, returning
+// its type and payload along with the number of bytes it occupies. If the
+// record is truncated or its checksum doesn't match, false is returned, along
+// with the number of bytes the record claims to occupy.
+func decodeRecord(b []byte) (byte, []byte, int, bool) {
+	if len(b) < recordHeaderSize {
+		return 0, nil, len(b), false
+	}
+
+	payloadLen := int(binary.BigEndian.Uint32(b[1:recordHeaderSize]))
+	if payloadLen > maxRecordPayloadSize {
+		return 0, nil, len(b), false
+	}
+
+	n := recordHeaderSize + payloadLen + recordChecksumSize
+	if len(b) < n {
+		return 0, nil, len(b), false
+	}
+
+	checksum := binary.BigEndian.Uint32(b[n-recordChecksumSize : n])
+	if crc32.Checksum(b[:n-recordChecksumSize], crc32cTable) != checksum {
+		return 0, nil, n, false
+	}
+
+	return b[0], b[recordHeaderSize : n-recordChecksumSize], n, true
+}
+
+// encodeRecord appends a record with the passed type and payload to b.
+func encodeRecord(b []byte, recordType byte, payload []byte) []byte {
+	start := len(b)
+
+	var header [recordHeaderSize]byte
+	header[0] = recordType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	b = append(b, header[:]...)
+	b = append(b, payload...)
+
+	var checksum [recordChecksumSize]byte
+	binary.BigEndian.PutUint32(
+		checksum[:], crc32.Checksum(b[start:], crc32cTable),
+	)
+
+	return append(b, checksum[:]...)
+}
+
+// encodeEntry returns the payload of a record adding or removing an entry.
+// The CLTV is omitted for removals.
+func encodeEntry(hashPrefix *HashPrefix, cltv *uint32) []byte {
+	if cltv == nil {
+		return append([]byte(nil), hashPrefix[:]...)
+	}
+
+	b := make([]byte, HashPrefixSize+4)
+	copy(b, hashPrefix[:])
+	binary.BigEndian.PutUint32(b[HashPrefixSize:], *cltv)
+
+	return b
+}
+
+// encodeBatch returns the payload of a record adding the passed entries of a
+// batch, along with its replay set and expiry.
+func encodeBatch(id []byte, expiry uint32, entries []batchEntry,
+	replays *ReplaySet) ([]byte, error) {
+
+	if len(id) > math.MaxUint16 {
+		return nil, ErrBatchIDTooLong
+	}
+
+	var b bytes.Buffer
+
+	var scratch [4]byte
+	binary.BigEndian.PutUint16(scratch[:2], uint16(len(id)))
+	b.Write(scratch[:2])
+	b.Write(id)
+
+	binary.BigEndian.PutUint32(scratch[:], expiry)
+	b.Write(scratch[:])
+
+	binary.BigEndian.PutUint32(scratch[:], uint32(len(entries)))
+	b.Write(scratch[:])
+	for _, entry := range entries {
+		b.Write(entry.hashPrefix[:])
+		binary.BigEndian.PutUint32(scratch[:], entry.cltv)
+		b.Write(scratch[:])
+	}
+
+	if err := replays.Encode(&b); err != nil {
+		return nil, err
+	}
+
+	if b.Len() > maxRecordPayloadSize {
+		return nil, ErrBatchTooLarge
+	}
+
+	return b.Bytes(), nil
+}
+
+// encodeBatchID returns the payload of a record deleting the batch with the
+// passed ID.
+func encodeBatchID(id []byte) ([]byte, error) {
+	if len(id) > math.MaxUint16 {
+		return nil, ErrBatchIDTooLong
+	}
+
+	b := make([]byte, 2+len(id))
+	binary.BigEndian.PutUint16(b, uint16(len(id)))
+	copy(b[2:], id)
+
+	return b, nil
+}
+
+// decodeBatchID reads a batch ID, prefixed by its length, from r.
+func decodeBatchID(r io.Reader) ([]byte, error) {
+	var idLen uint16
+	if err := binary.Read(r, binary.BigEndian, &idLen); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, idLen)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// apply applies a record that was read from the file to the in-memory state.
+func (rl *FileReplayLog) apply(recordType byte, payload []byte) error {
+	r := bytes.NewReader(payload)
+
+	switch recordType {
+	case recordPut:
+		var (
+			hashPrefix HashPrefix
+			cltv       uint32
+		)
+		if _, err := io.ReadFull(r, hashPrefix[:]); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.BigEndian, &cltv); err != nil {
+			return err
+		}
+
+		rl.entries[hashPrefix] = cltv
+
+	case recordDelete:
+		var hashPrefix HashPrefix
+		if _, err := io.ReadFull(r, hashPrefix[:]); err != nil {
+			return err
+		}
+
+		delete(rl.entries, hashPrefix)
+
+	case recordBatch:
+		id, err := decodeBatchID(r)
+		if err != nil {
+			return err
+		}
+
+		var expiry, numEntries uint32
+		err = binary.Read(r, binary.BigEndian, &expiry)
+		if err != nil {
+			return err
+		}
+		err = binary.Read(r, binary.BigEndian, &numEntries)
+		if err != nil {
+			return err
+		}
+		var added []HashPrefix
+		for i := uint32(0); i < numEntries; i++ {
+			var (
+				hashPrefix HashPrefix
+				cltv       uint32
+			)
+			if _, err := io.ReadFull(r, hashPrefix[:]); err != nil {
+				return err
+			}
+			err := binary.Read(r, binary.BigEndian, &cltv)
+			if err != nil {
+				return err
+			}
+
+			rl.entries[hashPrefix] = cltv
+			added = append(added, hashPrefix)
+		}
+
+		replays := NewReplaySet()
+		if err := replays.Decode(r); err != nil {
+			return err
+		}
+		rl.batches[string(id)] = replays
+		rl.batchExpiry[string(id)] = expiry
+		rl.batchEntries[string(id)] = added
+
+	case recordExpire:
+		var height uint32
+		err := binary.Read(r, binary.BigEndian, &height)
+		if err != nil {
+			return err
+		}
+
+		rl.expire(height)
+
+	case recordDeleteBatch:
+		id, err := decodeBatchID(r)
+		if err != nil {
+			return err
+		}
+
+		rl.deleteBatch(id)
+
+	default:
+		return ErrCorruptReplayLog
+	}
+
+	return nil
+}
+
+// encodeLogRecord appends a record of the file of a FileReplayLog with the
+// passed type and payload to b, preceded by the checksum of its header.
+func encodeLogRecord(b []byte, recordType byte, payload []byte) []byte {
+	start := len(b)
+	b = append(b, make([]byte, recordHeaderChecksumSize)...)
+	b = encodeRecord(b, recordType, payload)
+
+	header := b[start+recordHeaderChecksumSize:][:recordHeaderSize]
+	binary.BigEndian.PutUint32(
+		b[start:], crc32.Checksum(header, crc32cTable),
+	)
+
+	return b
+}
+
+// appendRecord durably appends a record to the file. If the write fails, the
+// file is truncated back to its previous size, so that no partial record is
+// followed by later ones.
+func (rl *FileReplayLog) appendRecord(recordType byte, payload []byte) error {
+	record := encodeLogRecord(nil, recordType, payload)
+
+	_, err := rl.file.Write(record)
+	if err == nil {
+		err = rl.file.Sync()
+	}
+	if err != nil {
+		if truncErr := rl.file.Truncate(rl.size); truncErr == nil {
+			rl.file.Seek(rl.size, io.SeekStart)
+		}
+
+		return err
+	}
+
+	rl.size += int64(len(record))
+	rl.numRecords++
+
+	return nil
+}
+
+// maybeCompact compacts the file once it holds many more records than are
+// needed to represent the current state. Failing to compact isn't fatal, as
+// the records already written are still valid.
+func (rl *FileReplayLog) maybeCompact() {
+	live := len(rl.entries) + len(rl.batches)
+	if rl.numRecords < compactMinRecords ||
+		rl.numRecords < compactRatio*live {
+
+		return
+	}
+
+	if err := rl.compact(); err != nil {
+		sphxLog.Errorf("Unable to compact replay log %v: %v", rl.path,
+			err)
+	}
+}
+
+// Compact rewrites the file backing the log so that it only holds the records
+// needed to represent the current state. The new file atomically replaces the
+// previous one.
+func (rl *FileReplayLog) Compact() error {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	return rl.compact()
+}
+
+// compact performs the compaction of the file.
+//
+// NOTE: The mutex of the log must be held.
+func (rl *FileReplayLog) compact() error {
+	data := []byte(fileReplayLogMagic)
+
+	// The batches are written along with the entries they added that are
+	// still live, so that they can still be deleted after compaction.
+	// The remaining entries are written on their own.
+	inBatch := make(map[HashPrefix]struct{})
+	for id, replays := range rl.batches {
+		var entries []batchEntry
+		for _, hashPrefix := range rl.batchEntries[id] {
+			cltv, ok := rl.entries[hashPrefix]
+			if !ok {
+				continue
+			}
+			if _, ok := inBatch[hashPrefix]; ok {
+				continue
+			}
+
+			entries = append(entries, batchEntry{
+				hashPrefix: hashPrefix,
+				cltv:       cltv,
+			})
+			inBatch[hashPrefix] = struct{}{}
+		}
+
+		payload, err := encodeBatch(
+			[]byte(id), rl.batchExpiry[id], entries, replays,
+		)
+		if err != nil {
+			return err
+		}
+		data = encodeLogRecord(data, recordBatch, payload)
+	}
+	numRecords := len(rl.batches)
+	for hashPrefix, cltv := range rl.entries {
+		if _, ok := inBatch[hashPrefix]; ok {
+			continue
+		}
+
+		hashPrefix, cltv := hashPrefix, cltv
+		data = encodeLogRecord(
+			data, recordPut, encodeEntry(&hashPrefix, &cltv),
+		)
+		numRecords++
+	}
+
+	tmpPath := rl.path + ".tmp"
+	tmpFile, err := os.OpenFile(
+		tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, rl.path); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Sync the directory, so that the rename itself is durable.
+	if dir, err := os.Open(filepath.Dir(rl.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	rl.file.Close()
+	rl.file = tmpFile
+	rl.size = int64(len(data))
+	rl.numRecords = numRecords
+
+	return nil
+}
+
+// Stop closes the file backing the log and wipes the in-memory state.
+func (rl *FileReplayLog) Stop() error {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	err := rl.file.Close()
+
+	rl.file = nil
+	rl.batches = nil
+	rl.batchExpiry = nil
+	rl.batchEntries = nil
+	rl.entries = nil
+
+	return err
+}
+
+// Get retrieves an entry from the log given its hash prefix. It returns the
+// value stored and an error if one occurs. It returns ErrLogEntryNotFound
+// if the entry is not in the log.
+func (rl *FileReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if rl.file == nil {
+		return 0, errReplayLogNotStarted
+	}
+
+	cltv, exists := rl.entries[*hash]
+	if !exists {
+		return 0, ErrLogEntryNotFound
+	}
+
+	return cltv, nil
+}
+
+// Put stores an entry into the log given its hash prefix and an accompanying
+// purposefully general type. It returns ErrReplayedPacket if the provided hash
+// prefix already exists in the log.
+func (rl *FileReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	if _, exists := rl.entries[*hash]; exists {
+		return ErrReplayedPacket
+	}
+
+	err := rl.appendRecord(recordPut, encodeEntry(hash, &cltv))
+	if err != nil {
+		return err
+	}
+	rl.entries[*hash] = cltv
+
+	rl.maybeCompact()
+
+	return nil
+}
+
+// Delete deletes an entry from the log given its hash prefix.
+func (rl *FileReplayLog) Delete(hash *HashPrefix) error {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	if _, exists := rl.entries[*hash]; !exists {
+		return nil
+	}
+
+	err := rl.appendRecord(recordDelete, encodeEntry(hash, nil))
+	if err != nil {
+		return err
+	}
+	delete(rl.entries, *hash)
+
+	rl.maybeCompact()
+
+	return nil
+}
+
+// PutBatch stores a batch of sphinx packets into the log given their hash
+// prefixes and accompanying values. Returns the set of entries in the batch
+// that are replays and an error if one occurs. The entries of the batch and
+// its replay set are written as a single record, so the batch is either
+// persisted in full or not at all.
+func (rl *FileReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if rl.file == nil {
+		return nil, errReplayLogNotStarted
+	}
+
+	// Return the result when the batch was first processed to provide
+	// idempotence.
+	replays, exists := rl.batches[string(batch.ID)]
+
+	if !exists {
+		replays = NewReplaySet()
+
+		var entries []batchEntry
+		err := batch.ForEach(func(seqNum uint32, hashPrefix *HashPrefix,
+			cltv uint32) error {
+
+			if _, ok := rl.entries[*hashPrefix]; ok {
+				replays.Add(seqNum)
+				return nil
+			}
+
+			entries = append(entries, batchEntry{
+				hashPrefix: *hashPrefix,
+				cltv:       cltv,
+			})
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		replays.Merge(batch.ReplaySet)
+
+		expiry := batch.expiry()
+		payload, err := encodeBatch(batch.ID, expiry, entries, replays)
+		if err != nil {
+			return nil, err
+		}
+		if err := rl.appendRecord(recordBatch, payload); err != nil {
+			return nil, err
+		}
+
+		added := make([]HashPrefix, 0, len(entries))
+		for _, entry := range entries {
+			rl.entries[entry.hashPrefix] = entry.cltv
+			added = append(added, entry.hashPrefix)
+		}
+		rl.batches[string(batch.ID)] = replays
+		rl.batchExpiry[string(batch.ID)] = expiry
+		rl.batchEntries[string(batch.ID)] = added
+
+		rl.maybeCompact()
+	}
+
+	batch.ReplaySet = replays
+	batch.IsCommitted = true
+
+	return replays, nil
+}
+
+// Expire removes all entries stored with a CLTV below the passed block height,
+// along with the batches whose entries have all expired. The expiry is written
+// as a single record, which removes the same entries when the file is loaded.
+func (rl *FileReplayLog) Expire(height uint32) error {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], height)
+	if err := rl.appendRecord(recordExpire, payload[:]); err != nil {
+		return err
+	}
+	rl.expire(height)
+
+	rl.maybeCompact()
+
+	return nil
+}
+
+// expire removes the entries and batches that expired below the passed block
+// height from the in-memory state.
+//
+// NOTE: The mutex of the log must be held.
+func (rl *FileReplayLog) expire(height uint32) {
+	for hash, cltv := range rl.entries {
+		if cltv < height {
+			delete(rl.entries, hash)
+		}
+	}
+	for id, expiry := range rl.batchExpiry {
+		if expiry < height {
+			delete(rl.batches, id)
+			delete(rl.batchExpiry, id)
+			delete(rl.batchEntries, id)
+		}
+	}
+}
+
+// DeleteBatch atomically removes the entries added by the batch with the
+// given ID, along with the record of the batch. The deletion is written as a
+// single record, so the batch is either removed in full or not at all.
+func (rl *FileReplayLog) DeleteBatch(id []byte) error {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	if _, exists := rl.batches[string(id)]; !exists {
+		return nil
+	}
+
+	payload, err := encodeBatchID(id)
+	if err != nil {
+		return err
+	}
+	if err := rl.appendRecord(recordDeleteBatch, payload); err != nil {
+		return err
+	}
+	rl.deleteBatch(id)
+
+	rl.maybeCompact()
+
+	return nil
+}
+
+// deleteBatch removes the batch with the given ID, along with the entries it
+// added, from the in-memory state.
+//
+// NOTE: The mutex of the log must be held.
+func (rl *FileReplayLog) deleteBatch(id []byte) {
+	for _, hashPrefix := range rl.batchEntries[string(id)] {
+		delete(rl.entries, hashPrefix)
+	}
+	delete(rl.batches, string(id))
+	delete(rl.batchExpiry, string(id))
+	delete(rl.batchEntries, string(id))
+}
+
+// ForEachEntry calls the passed function for each entry of the log, with its
+// hash prefix and CLTV. The function must not call back into the log.
+func (rl *FileReplayLog) ForEachEntry(
+	fn func(hashPrefix *HashPrefix, cltv uint32) error) error {
+
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	for hash, cltv := range rl.entries {
+		hash := hash
+		if err := fn(&hash, cltv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ForEachBatch calls the passed function for each batch of the log, with its
+// ID, replay set, expiry and the entries it added that are still in the log.
+// The function must not call back into the log, modify the replay set or
+// retain the entries.
+func (rl *FileReplayLog) ForEachBatch(fn func(id []byte, replays *ReplaySet,
+	expiry uint32, entries []LogEntry) error) error {
+
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if rl.file == nil {
+		return errReplayLogNotStarted
+	}
+
+	var entries []LogEntry
+	for id, replays := range rl.batches {
+		entries = entries[:0]
+		for _, hashPrefix := range rl.batchEntries[id] {
+			cltv, ok := rl.entries[hashPrefix]
+			if !ok {
+				continue
+			}
+			entries = append(entries, LogEntry{hashPrefix, cltv})
+		}
+
+		err := fn([]byte(id), replays, rl.batchExpiry[id], entries)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A compile time asserting *FileReplayLog implements the ExpiringReplayLog
+// and IterableReplayLog interfaces.
+var (
+	_ ExpiringReplayLog = (*FileReplayLog)(nil)
+	_ IterableReplayLog = (*FileReplayLog)(nil)
+)
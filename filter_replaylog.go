@@ -0,0 +1,483 @@
+package sphinx
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+const (
+	// DefaultFilterCapacity is the default number of entries each
+	// generation of the filter of a FilteredReplayLog is sized for.
+	DefaultFilterCapacity = 100000
+
+	// DefaultFilterFalsePositiveRate is the default false positive rate
+	// targeted by each generation of the filter of a FilteredReplayLog.
+	DefaultFilterFalsePositiveRate = 0.001
+
+	// DefaultFilterWindow is the default number of blocks worth of CLTVs
+	// covered by each generation of the filter of a FilteredReplayLog.
+	DefaultFilterWindow = 144
+)
+
+// IterableReplayLog is a ReplayLog whose entries and batches can be
+// enumerated, which allows state derived from the log to be rebuilt, and the
+// log to be exported.
+type IterableReplayLog interface {
+	ReplayLog
+
+	// ForEachEntry calls the passed function for each entry of the log,
+	// with its hash prefix and CLTV. The function must not call back into
+	// the log.
+	ForEachEntry(fn func(hashPrefix *HashPrefix, cltv uint32) error) error
+
+	// ForEachBatch calls the passed function for each batch of the log,
+	// with its ID, replay set and expiry, which is the highest CLTV of its
+	// entries, along with the entries it added that are still in the log.
+	// The function must not call back into the log, modify the replay set
+	// or retain the entries.
+	ForEachBatch(fn func(id []byte, replays *ReplaySet, expiry uint32,
+		entries []LogEntry) error) error
+}
+
+// LogEntry is an entry of a replay log.
+type LogEntry struct {
+	// HashPrefix is the hash prefix of the shared secret of the packet.
+	HashPrefix HashPrefix
+
+	// Cltv is the CLTV the entry is stored with.
+	Cltv uint32
+}
+
+// FilterStats are the statistics of the filter of a FilteredReplayLog.
+type FilterStats struct {
+	// Lookups is the number of lookups of hash prefixes that were
+	// answered, either by Get or when adding entries.
+	Lookups uint64
+
+	// DefiniteMisses is the number of lookups that the filter determined
+	// to be misses.
+	DefiniteMisses uint64
+
+	// FalsePositives is the number of lookups that the filter reported as
+	// possible hits, which turned out to be misses.
+	FalsePositives uint64
+
+	// EstimatedFalsePositiveRate is the probability that the filter
+	// reports a possible hit for a hash prefix that isn't in the log,
+	// estimated from the current fill of the filter.
+	EstimatedFalsePositiveRate float64
+}
+
+// FalsePositiveRate returns the observed rate at which the filter reported a
+// possible hit for a hash prefix that wasn't in the log.
+func (s *FilterStats) FalsePositiveRate() float64 {
+	misses := s.DefiniteMisses + s.FalsePositives
+	if misses == 0 {
+		return 0
+	}
+
+	return float64(s.FalsePositives) / float64(misses)
+}
+
+// FilterOpt is a functional option that can be used to modify the filter of a
+// FilteredReplayLog.
+type FilterOpt func(*FilteredReplayLog)
+
+// WithFilterCapacity is a functional option that sets the number of entries
+// each generation of the filter is sized for.
+func WithFilterCapacity(capacity int) FilterOpt {
+	return func(l *FilteredReplayLog) {
+		l.capacity = capacity
+	}
+}
+
+// WithFilterFalsePositiveRate is a functional option that sets the false
+// positive rate targeted by each generation of the filter. The rate must lie
+// strictly between 0 and 1, otherwise DefaultFilterFalsePositiveRate is used.
+func WithFilterFalsePositiveRate(rate float64) FilterOpt {
+	return func(l *FilteredReplayLog) {
+		l.falsePositiveRate = rate
+	}
+}
+
+// WithFilterWindow is a functional option that sets the number of blocks
+// worth of CLTVs covered by each generation of the filter.
+func WithFilterWindow(blocks uint32) FilterOpt {
+	return func(l *FilteredReplayLog) {
+		l.window = blocks
+	}
+}
+
+// FilteredReplayLog is a ReplayLog that keeps a Bloom filter of the hash
+// prefixes held by a backing log. Lookups of hash prefixes that the filter
+// determines to be missing are answered without touching the backing log.
+// Writes always reach the backing log, as they must be persisted.
+//
+// Entries can't be removed from a Bloom filter, so the filter is split into
+// generations, each covering a window of CLTVs. Once the backing log expires
+// all the entries of a window, the generation covering it is dropped, which
+// keeps the filter from filling up without ever yielding a false negative.
+// The filter is rebuilt from the backing log on Start.
+type FilteredReplayLog struct {
+	log IterableReplayLog
+
+	capacity          int
+	falsePositiveRate float64
+	window            uint32
+
+	// mtx guards the filter and its statistics.
+	mtx sync.Mutex
+
+	// generations holds the generations of the filter, keyed by the index
+	// of the window of CLTVs they cover.
+	generations map[uint32]*bloomFilter
+
+	stats FilterStats
+}
+
+// NewFilteredReplayLog creates a FilteredReplayLog in front of the passed
+// backing log.
+func NewFilteredReplayLog(log IterableReplayLog,
+	opts ...FilterOpt) *FilteredReplayLog {
+
+	l := &FilteredReplayLog{
+		log:               log,
+		capacity:          DefaultFilterCapacity,
+		falsePositiveRate: DefaultFilterFalsePositiveRate,
+		window:            DefaultFilterWindow,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.window == 0 {
+		l.window = 1
+	}
+
+	// A rate of 0 or below would size the filter infinitely, while a rate
+	// of 1 or above makes it useless. NaN is rejected as well.
+	if !(l.falsePositiveRate > 0 && l.falsePositiveRate < 1) {
+		l.falsePositiveRate = DefaultFilterFalsePositiveRate
+	}
+
+	return l
+}
+
+// Start starts the backing log, and rebuilds the filter from its entries.
+func (l *FilteredReplayLog) Start() error {
+	if err := l.log.Start(); err != nil {
+		return err
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.generations = make(map[uint32]*bloomFilter)
+	l.stats = FilterStats{}
+
+	err := l.log.ForEachEntry(func(hashPrefix *HashPrefix,
+		cltv uint32) error {
+
+		l.add(hashPrefix, cltv)
+		return nil
+	})
+	if err != nil {
+		l.generations = nil
+		l.log.Stop()
+		return err
+	}
+
+	return nil
+}
+
+// Stop stops the backing log and discards the filter.
+func (l *FilteredReplayLog) Stop() error {
+	l.mtx.Lock()
+	l.generations = nil
+	l.mtx.Unlock()
+
+	return l.log.Stop()
+}
+
+// Get retrieves an entry from the log given its hash prefix. If the filter
+// determines that the entry is missing, ErrLogEntryNotFound is returned
+// without consulting the backing log.
+func (l *FilteredReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	l.mtx.Lock()
+	if l.generations == nil {
+		l.mtx.Unlock()
+		return 0, errReplayLogNotStarted
+	}
+
+	l.stats.Lookups++
+	if !l.mayContain(hash) {
+		l.stats.DefiniteMisses++
+		l.mtx.Unlock()
+
+		return 0, ErrLogEntryNotFound
+	}
+	l.mtx.Unlock()
+
+	cltv, err := l.log.Get(hash)
+	if err == ErrLogEntryNotFound {
+		l.mtx.Lock()
+		l.stats.FalsePositives++
+		l.mtx.Unlock()
+	}
+
+	return cltv, err
+}
+
+// Put stores an entry into the backing log, and adds it to the filter.
+func (l *FilteredReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	l.mtx.Lock()
+	if l.generations == nil {
+		l.mtx.Unlock()
+		return errReplayLogNotStarted
+	}
+	mayContain := l.mayContain(hash)
+	l.mtx.Unlock()
+
+	err := l.log.Put(hash, cltv)
+	if err != nil && err != ErrReplayedPacket {
+		return err
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.recordLookup(mayContain, err == nil)
+	if err == nil && l.generations != nil {
+		l.add(hash, cltv)
+	}
+
+	return err
+}
+
+// Delete deletes an entry from the backing log. The entry stays within the
+// filter, until the generation it was added to is dropped.
+func (l *FilteredReplayLog) Delete(hash *HashPrefix) error {
+	return l.log.Delete(hash)
+}
+
+// PutBatch stores a batch of sphinx packets into the backing log, and adds
+// them to the filter.
+func (l *FilteredReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	replays, err := l.log.PutBatch(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.generations == nil {
+		return replays, nil
+	}
+
+	err = batch.ForEach(func(seqNum uint32, hashPrefix *HashPrefix,
+		cltv uint32) error {
+
+		l.add(hashPrefix, cltv)
+		return nil
+	})
+
+	return replays, err
+}
+
+// DeleteBatch deletes a batch from the backing log. The filter is left as is,
+// so the entries of the batch are only reported as false positives until their
+// generation is dropped.
+func (l *FilteredReplayLog) DeleteBatch(id []byte) error {
+	return l.log.DeleteBatch(id)
+}
+
+// Expire expires the entries of the backing log, which must implement
+// ExpiringReplayLog, and drops the generations of the filter whose window of
+// CLTVs lies entirely below the passed height.
+func (l *FilteredReplayLog) Expire(height uint32) error {
+	expiringLog, ok := l.log.(ExpiringReplayLog)
+	if !ok {
+		return ErrReplayLogNotExpiring
+	}
+
+	if err := expiringLog.Expire(height); err != nil {
+		return err
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for idx := range l.generations {
+		if uint64(idx+1)*uint64(l.window) <= uint64(height) {
+			delete(l.generations, idx)
+		}
+	}
+
+	return nil
+}
+
+// ForEachEntry calls the passed function for each entry of the backing log.
+func (l *FilteredReplayLog) ForEachEntry(
+	fn func(hashPrefix *HashPrefix, cltv uint32) error) error {
+
+	return l.log.ForEachEntry(fn)
+}
+
+// ForEachBatch calls the passed function for each batch of the backing log.
+func (l *FilteredReplayLog) ForEachBatch(fn func(id []byte,
+	replays *ReplaySet, expiry uint32, entries []LogEntry) error) error {
+
+	return l.log.ForEachBatch(fn)
+}
+
+// Stats returns the statistics of the filter.
+func (l *FilteredReplayLog) Stats() FilterStats {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	stats := l.stats
+
+	// A lookup is a false positive if any of the generations reports a
+	// possible hit.
+	trueNegativeRate := 1.0
+	for _, filter := range l.generations {
+		trueNegativeRate *= 1 - filter.falsePositiveRate()
+	}
+	stats.EstimatedFalsePositiveRate = 1 - trueNegativeRate
+
+	return stats
+}
+
+// recordLookup records the outcome of a lookup that was resolved by the
+// backing log.
+//
+// NOTE: The mutex of the log must be held.
+func (l *FilteredReplayLog) recordLookup(mayContain, missing bool) {
+	l.stats.Lookups++
+
+	switch {
+	case !mayContain:
+		l.stats.DefiniteMisses++
+
+	case missing:
+		l.stats.FalsePositives++
+	}
+}
+
+// mayContain returns false if the hash prefix is definitely not held by the
+// backing log.
+//
+// NOTE: The mutex of the log must be held.
+func (l *FilteredReplayLog) mayContain(hash *HashPrefix) bool {
+	for _, filter := range l.generations {
+		if filter.mayContain(hash) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// add adds a hash prefix to the generation of the filter covering its CLTV.
+//
+// NOTE: The mutex of the log must be held.
+func (l *FilteredReplayLog) add(hash *HashPrefix, cltv uint32) {
+	idx := cltv / l.window
+
+	filter, ok := l.generations[idx]
+	if !ok {
+		filter = newBloomFilter(l.capacity, l.falsePositiveRate)
+		l.generations[idx] = filter
+	}
+
+	filter.add(hash)
+}
+
+// A compile time asserting *FilteredReplayLog implements the
+// ExpiringReplayLog and IterableReplayLog interfaces.
+var (
+	_ ExpiringReplayLog = (*FilteredReplayLog)(nil)
+	_ IterableReplayLog = (*FilteredReplayLog)(nil)
+)
+
+// bloomFilter is a Bloom filter of hash prefixes.
+type bloomFilter struct {
+	bits    []uint64
+	numBits uint64
+	numHash uint64
+}
+
+// newBloomFilter creates a Bloom filter sized to hold the passed number of
+// hash prefixes at the passed false positive rate.
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	numBits := uint64(math.Ceil(
+		-float64(capacity) * math.Log(falsePositiveRate) /
+			(math.Ln2 * math.Ln2),
+	))
+	if numBits < 64 {
+		numBits = 64
+	}
+
+	numHash := uint64(math.Round(
+		float64(numBits) / float64(capacity) * math.Ln2,
+	))
+	if numHash < 1 {
+		numHash = 1
+	}
+
+	return &bloomFilter{
+		bits:    make([]uint64, (numBits+63)/64),
+		numBits: numBits,
+		numHash: numHash,
+	}
+}
+
+// positions returns the two hashes from which the bit positions of a hash
+// prefix are derived. Hash prefixes are already uniformly distributed, so
+// they're taken from the prefix itself.
+func (f *bloomFilter) positions(hash *HashPrefix) (uint64, uint64) {
+	h1 := binary.LittleEndian.Uint64(hash[0:8])
+	h2 := binary.LittleEndian.Uint64(hash[8:16]) | 1
+
+	return h1, h2
+}
+
+// add adds a hash prefix to the filter.
+func (f *bloomFilter) add(hash *HashPrefix) {
+	h1, h2 := f.positions(hash)
+	for i := uint64(0); i < f.numHash; i++ {
+		bit := (h1 + i*h2) % f.numBits
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain returns false if the hash prefix was definitely not added to the
+// filter.
+func (f *bloomFilter) mayContain(hash *HashPrefix) bool {
+	h1, h2 := f.positions(hash)
+	for i := uint64(0); i < f.numHash; i++ {
+		bit := (h1 + i*h2) % f.numBits
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// falsePositiveRate estimates the false positive rate of the filter from the
+// fraction of its bits that are set.
+func (f *bloomFilter) falsePositiveRate() float64 {
+	var set int
+	for _, word := range f.bits {
+		set += bits.OnesCount64(word)
+	}
+
+	return math.Pow(float64(set)/float64(f.numBits), float64(f.numHash))
+}
@@ -0,0 +1,215 @@
+package sphinx
+
+import (
+	"crypto/rand"
+	"math"
+	"testing"
+)
+
+// countingReplayLog is an IterableReplayLog that counts the lookups made
+// against it.
+type countingReplayLog struct {
+	IterableReplayLog
+
+	gets int
+}
+
+// Get retrieves an entry from the log, counting the lookup.
+func (l *countingReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	l.gets++
+	return l.IterableReplayLog.Get(hash)
+}
+
+// Expire expires the entries of the log.
+func (l *countingReplayLog) Expire(height uint32) error {
+	return l.IterableReplayLog.(ExpiringReplayLog).Expire(height)
+}
+
+// randHashPrefix returns a random hash prefix.
+func randHashPrefix(t *testing.T) *HashPrefix {
+	var hashPrefix HashPrefix
+	if _, err := rand.Read(hashPrefix[:]); err != nil {
+		t.Fatalf("unable to read random bytes: %v", err)
+	}
+
+	return &hashPrefix
+}
+
+// TestFilteredReplayLogStorageAndRetrieval tests that the non-batch methods on
+// FilteredReplayLog work as expected.
+func TestFilteredReplayLogStorageAndRetrieval(t *testing.T) {
+	testReplayLogStorageAndRetrieval(
+		t, NewFilteredReplayLog(NewMemoryReplayLog()),
+	)
+}
+
+// TestFilteredReplayLogPutBatch tests that the batch adding of packets to a
+// FilteredReplayLog works as expected.
+func TestFilteredReplayLogPutBatch(t *testing.T) {
+	testReplayLogPutBatch(t, NewFilteredReplayLog(NewMemoryReplayLog()))
+}
+
+// TestFilteredReplayLogExpire tests the expiry of the entries and batches of a
+// FilteredReplayLog, which must drop the generations of its filter that only
+// cover expired entries.
+func TestFilteredReplayLogExpire(t *testing.T) {
+	rl := NewFilteredReplayLog(NewMemoryReplayLog(), WithFilterWindow(5))
+	testReplayLogExpire(t, rl)
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	var hashPrefix HashPrefix
+	if err := rl.Put(&hashPrefix, 12); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if len(rl.generations) != 1 {
+		t.Fatalf("expected 1 generation, got %d", len(rl.generations))
+	}
+
+	// The window of CLTVs 10 to 14 is only dropped once all of them have
+	// expired.
+	if err := rl.Expire(14); err != nil {
+		t.Fatalf("unable to expire entries: %v", err)
+	}
+	if len(rl.generations) != 1 {
+		t.Fatalf("expected 1 generation, got %d", len(rl.generations))
+	}
+	if err := rl.Expire(15); err != nil {
+		t.Fatalf("unable to expire entries: %v", err)
+	}
+	if len(rl.generations) != 0 {
+		t.Fatalf("expected no generations, got %d", len(rl.generations))
+	}
+}
+
+// TestFilteredReplayLogRebuild tests that the filter is rebuilt from the
+// backing log on Start, and that definite misses don't reach the backing
+// log.
+func TestFilteredReplayLogRebuild(t *testing.T) {
+	t.Parallel()
+
+	fileLog := newTestFileReplayLog(t)
+	backing := &countingReplayLog{IterableReplayLog: fileLog}
+	rl := NewFilteredReplayLog(backing)
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+
+	const numEntries = 100
+	hashPrefixes := make([]*HashPrefix, numEntries)
+	for i := range hashPrefixes {
+		hashPrefixes[i] = randHashPrefix(t)
+		if err := rl.Put(hashPrefixes[i], uint32(i+1)); err != nil {
+			t.Fatalf("unable to put entry: %v", err)
+		}
+	}
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+
+	// After a restart, the entries held by the backing log are still
+	// found, and replays are still rejected.
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	for i, hashPrefix := range hashPrefixes {
+		assertReplayLogEntry(t, rl, hashPrefix, uint32(i+1))
+	}
+	if err := rl.Put(hashPrefixes[0], 1); err != ErrReplayedPacket {
+		t.Fatalf("expected error %v, got %v", ErrReplayedPacket, err)
+	}
+
+	// Lookups of entries that aren't held by the log only reach the
+	// backing log if they're false positives.
+	backing.gets = 0
+	const numLookups = 1000
+	for i := 0; i < numLookups; i++ {
+		assertReplayLogEntry(t, rl, randHashPrefix(t), 0)
+	}
+
+	stats := rl.Stats()
+	if stats.FalsePositives != uint64(backing.gets) {
+		t.Fatalf("expected %d false positives, got %d", backing.gets,
+			stats.FalsePositives)
+	}
+	if stats.DefiniteMisses+stats.FalsePositives != numLookups {
+		t.Fatalf("expected %d misses, got %d", numLookups,
+			stats.DefiniteMisses+stats.FalsePositives)
+	}
+}
+
+// TestFilteredReplayLogFalsePositiveRate tests that the observed false
+// positive rate of a filter filled to capacity is close to its target.
+func TestFilteredReplayLogFalsePositiveRate(t *testing.T) {
+	t.Parallel()
+
+	const (
+		capacity = 10000
+		rate     = 0.01
+	)
+	rl := NewFilteredReplayLog(
+		NewMemoryReplayLog(), WithFilterCapacity(capacity),
+		WithFilterFalsePositiveRate(rate),
+	)
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	for i := 0; i < capacity; i++ {
+		if err := rl.Put(randHashPrefix(t), 1); err != nil {
+			t.Fatalf("unable to put entry: %v", err)
+		}
+	}
+
+	for i := 0; i < 10*capacity; i++ {
+		rl.Get(randHashPrefix(t))
+	}
+
+	stats := rl.Stats()
+	observed := stats.FalsePositiveRate()
+	if observed > 2*rate {
+		t.Fatalf("observed false positive rate %v exceeds target %v",
+			observed, rate)
+	}
+	if stats.EstimatedFalsePositiveRate > 2*rate {
+		t.Fatalf("estimated false positive rate %v exceeds target %v",
+			stats.EstimatedFalsePositiveRate, rate)
+	}
+}
+
+// TestFilteredReplayLogInvalidFalsePositiveRate tests that a false positive
+// rate outside of the range the filter can be sized for is replaced by the
+// default.
+func TestFilteredReplayLogInvalidFalsePositiveRate(t *testing.T) {
+	t.Parallel()
+
+	for _, rate := range []float64{0, -0.5, 1, 2, math.NaN()} {
+		rl := NewFilteredReplayLog(
+			NewMemoryReplayLog(), WithFilterFalsePositiveRate(rate),
+		)
+		if rl.falsePositiveRate != DefaultFilterFalsePositiveRate {
+			t.Fatalf("rate %v: expected default rate, got %v",
+				rate, rl.falsePositiveRate)
+		}
+
+		if err := rl.Start(); err != nil {
+			t.Fatalf("unable to start replay log: %v", err)
+		}
+
+		hashPrefix := randHashPrefix(t)
+		if err := rl.Put(hashPrefix, 1); err != nil {
+			t.Fatalf("unable to put entry: %v", err)
+		}
+		if _, err := rl.Get(hashPrefix); err != nil {
+			t.Fatalf("unable to get entry: %v", err)
+		}
+
+		rl.Stop()
+	}
+}
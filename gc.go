@@ -0,0 +1,109 @@
+package sphinx
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrReplayLogNotExpiring is returned when a router is given a block height
+// notifier, while its replay log doesn't implement ExpiringReplayLog.
+var ErrReplayLogNotExpiring = errors.New("replay log doesn't support expiry")
+
+// BlockHeightNotifier notifies the garbage collector of the replay log of new
+// blocks.
+type BlockHeightNotifier interface {
+	// RegisterBlockHeights returns a channel over which the height of the
+	// best block is sent, first upon registration and then whenever a new
+	// block is connected. Calling the returned function cancels the
+	// registration.
+	RegisterBlockHeights() (<-chan uint32, func(), error)
+}
+
+// GarbageCollector removes the entries of a replay log whose CLTV has passed,
+// along with the batches whose entries have all expired, as new blocks are
+// connected.
+type GarbageCollector struct {
+	log      ExpiringReplayLog
+	notifier BlockHeightNotifier
+
+	// cancel cancels the registration for block heights.
+	cancel func()
+
+	wg   sync.WaitGroup
+	quit chan struct{}
+}
+
+// NewGarbageCollector creates a garbage collector for the passed replay log,
+// which is run whenever the notifier reports a new block height.
+func NewGarbageCollector(log ExpiringReplayLog,
+	notifier BlockHeightNotifier) *GarbageCollector {
+
+	return &GarbageCollector{
+		log:      log,
+		notifier: notifier,
+	}
+}
+
+// Start registers for block heights and launches the goroutine that expires
+// the entries of the replay log.
+func (gc *GarbageCollector) Start() error {
+	heights, cancel, err := gc.notifier.RegisterBlockHeights()
+	if err != nil {
+		return err
+	}
+
+	gc.cancel = cancel
+	gc.quit = make(chan struct{})
+
+	gc.wg.Add(1)
+	go gc.collect(heights)
+
+	return nil
+}
+
+// Stop cancels the registration for block heights and waits for the garbage
+// collector to exit.
+func (gc *GarbageCollector) Stop() {
+	close(gc.quit)
+	gc.wg.Wait()
+
+	gc.cancel()
+}
+
+// collect expires the entries of the replay log for each new block height
+// until the garbage collector is stopped.
+//
+// NOTE: This method MUST be run as a goroutine.
+func (gc *GarbageCollector) collect(heights <-chan uint32) {
+	defer gc.wg.Done()
+
+	for {
+		select {
+		case height, ok := <-heights:
+			if !ok {
+				return
+			}
+
+			if err := gc.log.Expire(height); err != nil {
+				sphxLog.Errorf("Unable to expire replay log "+
+					"entries at height %d: %v", height, err)
+				continue
+			}
+
+			sphxLog.Debugf("Expired replay log entries below "+
+				"height %d", height)
+
+		case <-gc.quit:
+			return
+		}
+	}
+}
+
+// WithBlockHeightNotifier is a functional option that enables the garbage
+// collection of the replay log of the router, using the passed notifier to be
+// informed of new blocks. The replay log must implement ExpiringReplayLog.
+func WithBlockHeightNotifier(notifier BlockHeightNotifier) RouterOpt {
+	return func(r *Router) {
+		r.notifier = notifier
+	}
+}
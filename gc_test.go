@@ -0,0 +1,94 @@
+package sphinx
+
+import (
+	"testing"
+
+	"github.com/brsuite/brond/btcec"
+	"github.com/brsuite/brond/chaincfg"
+)
+
+// mockBlockHeightNotifier is a BlockHeightNotifier that delivers the heights
+// sent over its channel.
+type mockBlockHeightNotifier struct {
+	heights  chan uint32
+	canceled chan struct{}
+}
+
+// newMockBlockHeightNotifier creates a new mock block height notifier.
+func newMockBlockHeightNotifier() *mockBlockHeightNotifier {
+	return &mockBlockHeightNotifier{
+		heights:  make(chan uint32),
+		canceled: make(chan struct{}),
+	}
+}
+
+// RegisterBlockHeights returns the channel of the notifier.
+func (n *mockBlockHeightNotifier) RegisterBlockHeights() (<-chan uint32,
+	func(), error) {
+
+	return n.heights, func() { close(n.canceled) }, nil
+}
+
+// connectBlock notifies the garbage collector of a new block. The height is
+// sent twice, so that the garbage collector is known to have processed it
+// once the second send returns.
+func (n *mockBlockHeightNotifier) connectBlock(height uint32) {
+	n.heights <- height
+	n.heights <- height
+}
+
+// TestRouterGarbageCollection tests that a router started with a block height
+// notifier expires the entries of its replay log as blocks are connected.
+func TestRouterGarbageCollection(t *testing.T) {
+	t.Parallel()
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	// A log that can't expire its entries is rejected.
+	notifier := newMockBlockHeightNotifier()
+	router := NewRouter(
+		&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+		struct{ ReplayLog }{NewMemoryReplayLog()},
+		WithBlockHeightNotifier(notifier),
+	)
+	if err := router.Start(); err != ErrReplayLogNotExpiring {
+		t.Fatalf("expected error %v, got %v", ErrReplayLogNotExpiring,
+			err)
+	}
+
+	router = NewRouter(
+		&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(), WithBlockHeightNotifier(notifier),
+	)
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+
+	pkt, _ := newSingleHopOnion(t, privKey.PubKey())
+	if _, err := router.ProcessOnionPacket(pkt, nil, 100); err != nil {
+		t.Fatalf("unable to process onion: %v", err)
+	}
+
+	// The packet is still rejected as a replay until its CLTV has passed.
+	notifier.connectBlock(100)
+	_, err = router.ProcessOnionPacket(pkt, nil, 100)
+	if err != ErrReplayedPacket {
+		t.Fatalf("expected error %v, got %v", ErrReplayedPacket, err)
+	}
+
+	notifier.connectBlock(101)
+	if _, err := router.ProcessOnionPacket(pkt, nil, 100); err != nil {
+		t.Fatalf("unable to process onion: %v", err)
+	}
+
+	// Stopping the router cancels the registration.
+	router.Stop()
+	select {
+	case <-notifier.canceled:
+	default:
+		t.Fatalf("expected registration to be canceled")
+	}
+}
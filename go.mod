@@ -9,10 +9,8 @@ require (
 	github.com/brsuite/bronutil v0.0.0-20220711115931-9f939268c1af
 	github.com/btcsuite/btclog v0.0.0-20170628155309-84c8d2346e9f
 	github.com/davecgh/go-spew v1.1.1
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1
 	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
 )
 
-require (
-	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
-	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
-)
+require golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
@@ -0,0 +1,260 @@
+package sphinx
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// minLatencyBucket is the upper bound of the first bucket of a
+	// LatencyHistogram. The bound of each following bucket doubles.
+	minLatencyBucket = time.Microsecond
+
+	// NumLatencyBuckets is the number of buckets of a LatencyHistogram.
+	// The bound of the last bounded bucket is a little over a second, and
+	// the final bucket holds all larger samples.
+	NumLatencyBuckets = 22
+)
+
+// LatencyBucketBound returns the inclusive upper bound of the i-th bucket of a
+// LatencyHistogram. The bound of the final bucket is the maximum duration.
+func LatencyBucketBound(i int) time.Duration {
+	if i >= NumLatencyBuckets-1 {
+		return time.Duration(1<<63 - 1)
+	}
+
+	return minLatencyBucket << uint(i)
+}
+
+// LatencyHistogram is a histogram of latencies, whose buckets grow
+// exponentially from a microsecond.
+type LatencyHistogram struct {
+	// Buckets holds the number of samples in each bucket, the i-th of
+	// which counts the samples above the bound of the previous bucket, up
+	// to LatencyBucketBound(i).
+	Buckets [NumLatencyBuckets]uint64
+
+	// Count is the total number of samples.
+	Count uint64
+
+	// Sum is the sum of all samples.
+	Sum time.Duration
+
+	// Max is the largest sample.
+	Max time.Duration
+}
+
+// observe adds a sample to the histogram.
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < NumLatencyBuckets-1 && d > LatencyBucketBound(i) {
+		i++
+	}
+
+	h.Buckets[i]++
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// Mean returns the mean of the samples, or zero if there are none.
+func (h *LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns an upper bound of the q-th quantile of the samples, with q
+// between 0 and 1, which is the bound of the bucket the quantile falls in. It
+// never exceeds the largest sample, and is zero if there are none.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := uint64(q * float64(h.Count))
+	if rank >= h.Count {
+		rank = h.Count - 1
+	}
+
+	var seen uint64
+	for i, n := range h.Buckets {
+		seen += n
+		if seen > rank {
+			if bound := LatencyBucketBound(i); bound < h.Max {
+				return bound
+			}
+			break
+		}
+	}
+
+	return h.Max
+}
+
+// Metrics is a snapshot of the metrics gathered by a MetricsObserver.
+type Metrics struct {
+	// Actions counts the packets processed successfully, by the action to
+	// be taken for them.
+	Actions map[ProcessCode]uint64
+
+	// Failures counts the packets that failed to be processed, by the
+	// reason of the failure. Replays of batched packets aren't counted,
+	// as they're only detected when the batch is committed.
+	Failures map[FailureReason]uint64
+
+	// Replays is the number of replayed packets detected, both on their
+	// own and within batches.
+	Replays uint64
+
+	// Batches is the number of batches committed successfully.
+	Batches uint64
+
+	// BatchFailures is the number of batches that failed to be committed.
+	BatchFailures uint64
+
+	// ReplayLogErrors counts the replay log operations that failed, by
+	// operation.
+	ReplayLogErrors map[ReplayLogOp]uint64
+
+	// ECDHLatency is the histogram of the time spent deriving the shared
+	// secrets of packets.
+	ECDHLatency LatencyHistogram
+
+	// PacketLatency is the histogram of the time spent processing
+	// packets.
+	PacketLatency LatencyHistogram
+
+	// BatchLatency is the histogram of the time spent committing batches.
+	BatchLatency LatencyHistogram
+
+	// ReplayLogLatency holds the histogram of the time spent performing
+	// each replay log operation.
+	ReplayLogLatency map[ReplayLogOp]LatencyHistogram
+}
+
+// MetricsObserver is an Observer that counts the events it is notified of,
+// and keeps histograms of their latencies. Its metrics can be exported to any
+// monitoring system by taking snapshots.
+type MetricsObserver struct {
+	mtx sync.Mutex
+
+	actions          [Failure + 1]uint64
+	failures         [numFailureReasons]uint64
+	replays          uint64
+	batches          uint64
+	batchFailures    uint64
+	replayLogErrors  [numReplayLogOps]uint64
+	ecdhLatency      LatencyHistogram
+	packetLatency    LatencyHistogram
+	batchLatency     LatencyHistogram
+	replayLogLatency [numReplayLogOps]LatencyHistogram
+}
+
+// NewMetricsObserver creates a MetricsObserver with all metrics set to zero.
+func NewMetricsObserver() *MetricsObserver {
+	return &MetricsObserver{}
+}
+
+// PacketProcessed counts the outcome of processing a packet.
+func (m *MetricsObserver) PacketProcessed(event PacketEvent) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if event.Failure != FailureNone {
+		if event.Failure < numFailureReasons {
+			m.failures[event.Failure]++
+		}
+	} else if event.Action >= 0 && event.Action < Failure {
+		m.actions[event.Action]++
+	}
+
+	m.ecdhLatency.observe(event.ECDHLatency)
+	m.packetLatency.observe(event.Latency)
+}
+
+// ReplayDetected counts a replayed packet.
+func (m *MetricsObserver) ReplayDetected(ReplayEvent) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.replays++
+}
+
+// BatchCommitted counts the commitment of a batch.
+func (m *MetricsObserver) BatchCommitted(event BatchEvent) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if event.Err != nil {
+		m.batchFailures++
+	} else {
+		m.batches++
+	}
+
+	m.batchLatency.observe(event.Latency)
+}
+
+// ReplayLogOp counts an operation on a replay log.
+func (m *MetricsObserver) ReplayLogOp(event ReplayLogEvent) {
+	if event.Op >= numReplayLogOps {
+		return
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if event.Err != nil {
+		m.replayLogErrors[event.Op]++
+	}
+
+	m.replayLogLatency[event.Op].observe(event.Latency)
+}
+
+// Snapshot returns a copy of the current metrics.
+func (m *MetricsObserver) Snapshot() *Metrics {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	metrics := &Metrics{
+		Actions:          make(map[ProcessCode]uint64),
+		Failures:         make(map[FailureReason]uint64),
+		Replays:          m.replays,
+		Batches:          m.batches,
+		BatchFailures:    m.batchFailures,
+		ReplayLogErrors:  make(map[ReplayLogOp]uint64),
+		ECDHLatency:      m.ecdhLatency,
+		PacketLatency:    m.packetLatency,
+		BatchLatency:     m.batchLatency,
+		ReplayLogLatency: make(map[ReplayLogOp]LatencyHistogram),
+	}
+	for action, n := range m.actions {
+		if n > 0 {
+			metrics.Actions[ProcessCode(action)] = n
+		}
+	}
+	for reason, n := range m.failures {
+		if n > 0 {
+			metrics.Failures[FailureReason(reason)] = n
+		}
+	}
+	for op := range m.replayLogLatency {
+		if m.replayLogErrors[op] > 0 {
+			metrics.ReplayLogErrors[ReplayLogOp(op)] =
+				m.replayLogErrors[op]
+		}
+		if m.replayLogLatency[op].Count > 0 {
+			metrics.ReplayLogLatency[ReplayLogOp(op)] =
+				m.replayLogLatency[op]
+		}
+	}
+
+	return metrics
+}
+
+// A compile time assertion that *MetricsObserver implements the Observer
+// interface.
+var _ Observer = (*MetricsObserver)(nil)
@@ -1,6 +1,7 @@
 package sphinx
 
 import (
+	"crypto/sha256"
 	"io"
 
 	"github.com/brsuite/brond/btcec"
@@ -10,15 +11,33 @@ import (
 // encryption as defined within BOLT0004.
 type OnionErrorEncrypter struct {
 	sharedSecret Hash256
+
+	// trampolineSecret is the shared secret of the trampoline onion that
+	// was carried within the onion, if we're acting as a trampoline node.
+	trampolineSecret *Hash256
 }
 
 // NewOnionErrorEncrypter creates new instance of the onion encrypter backed by
 // the passed router, with encryption to be doing using the passed
-// ephemeralKey.
-func NewOnionErrorEncrypter(router *Router,
-	ephemeralKey *btcec.PublicKey) (*OnionErrorEncrypter, error) {
+// ephemeralKey. If the onion was received as part of a blinded route, the same
+// WithBlindingPoint option used to process it must be passed here. Likewise,
+// if the router holds multiple onion keys, the key the onion was processed
+// with, as reported by ProcessedPacket.OnionKey, must be passed using
+// WithOnionKey, otherwise ErrOnionKeyRequired is returned.
+func NewOnionErrorEncrypter(router *Router, ephemeralKey *btcec.PublicKey,
+	opts ...ProcessOnionOpt) (*OnionErrorEncrypter, error) {
+
+	cfg := newProcessOnionCfg(opts)
+
+	onionKey, err := router.encrypterKey(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	sharedSecret, err := router.generateSharedSecret(ephemeralKey)
+	sharedSecret, err := onionSharedSecret(
+		ephemeralKey, cfg.blindingPoint,
+		newSecretGenerator(cfg.ctx, onionKey),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -28,16 +47,93 @@ func NewOnionErrorEncrypter(router *Router,
 	}, nil
 }
 
-// Encode writes the encrypter's shared secret to the provided io.Writer.
+// NewTrampolineErrorEncrypter creates a new onion error encrypter for a
+// trampoline node. Errors are first encrypted using the shared secret of the
+// trampoline onion with the passed trampolineEphemeralKey, and then using the
+// shared secret of the outer onion with the passed ephemeralKey. Apart from
+// WithContext and WithOnionKey, the options apply to the outer onion only. As
+// with NewOnionErrorEncrypter, the onion key must be selected using
+// WithOnionKey if the router holds multiple keys.
+func NewTrampolineErrorEncrypter(router *Router, ephemeralKey,
+	trampolineEphemeralKey *btcec.PublicKey,
+	opts ...ProcessOnionOpt) (*OnionErrorEncrypter, error) {
+
+	encrypter, err := NewOnionErrorEncrypter(router, ephemeralKey, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := newProcessOnionCfg(opts)
+	onionKey, err := router.encrypterKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	trampolineSecret, err := newSecretGenerator(cfg.ctx, onionKey).
+		generateSharedSecret(trampolineEphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	encrypter.trampolineSecret = &trampolineSecret
+
+	return encrypter, nil
+}
+
+// trampolineEncrypterMarker precedes the shared secrets of an encrypter of a
+// trampoline node within its encoding. An encrypter of a regular hop is encoded
+// as its shared secret alone, which can't collide with the marker, as that
+// would require a preimage of the hash from which the secret is derived.
+var trampolineEncrypterMarker = Hash256(
+	sha256.Sum256([]byte("sphinx trampoline error encrypter")),
+)
+
+// Encode writes the encrypter's shared secret to the provided io.Writer. The
+// encrypter of a trampoline node is written as trampolineEncrypterMarker,
+// followed by the shared secret and the shared secret of the trampoline onion.
 func (o *OnionErrorEncrypter) Encode(w io.Writer) error {
-	_, err := w.Write(o.sharedSecret[:])
+	if o.trampolineSecret == nil {
+		_, err := w.Write(o.sharedSecret[:])
+		return err
+	}
+
+	if _, err := w.Write(trampolineEncrypterMarker[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(o.sharedSecret[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(o.trampolineSecret[:])
 	return err
 }
 
 // Decode restores the encrypter's share secret from the provided io.Reader.
+// The shared secret of the trampoline onion is restored as well, if the
+// encrypter is that of a trampoline node.
 func (o *OnionErrorEncrypter) Decode(r io.Reader) error {
-	_, err := io.ReadFull(r, o.sharedSecret[:])
-	return err
+	if _, err := io.ReadFull(r, o.sharedSecret[:]); err != nil {
+		return err
+	}
+
+	if o.sharedSecret != trampolineEncrypterMarker {
+		o.trampolineSecret = nil
+		return nil
+	}
+
+	var secrets [2 * sha256.Size]byte
+	_, err := io.ReadFull(r, secrets[:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+
+	var trampolineSecret Hash256
+	copy(o.sharedSecret[:], secrets[:sha256.Size])
+	copy(trampolineSecret[:], secrets[sha256.Size:])
+	o.trampolineSecret = &trampolineSecret
+
+	return nil
 }
 
 // Circuit is used encapsulate the data which is needed for data deobfuscation.
@@ -116,6 +212,10 @@ func (c *Circuit) Encode(w io.Writer) error {
 // response to failed HTLC routing attempts according to BOLT#4.
 type OnionErrorDecrypter struct {
 	circuit *Circuit
+
+	// trampolineCircuit is the circuit of the trampoline onion that was
+	// embedded within the final hop of circuit, if any.
+	trampolineCircuit *Circuit
 }
 
 // NewOnionErrorDecrypter creates new instance of onion decrypter.
@@ -124,3 +224,58 @@ func NewOnionErrorDecrypter(circuit *Circuit) *OnionErrorDecrypter {
 		circuit: circuit,
 	}
 }
+
+// NewTrampolineErrorDecrypter creates a new onion decrypter for a payment that
+// was sent using a trampoline onion. The circuit is that of the outer onion
+// leading to the first trampoline node, while the trampolineCircuit is that of
+// the trampoline onion embedded within it. Errors are decrypted using the
+// shared secrets of the outer circuit, followed by those of the trampoline
+// circuit, so the SenderIdx of a decrypted error counts the hops of both.
+func NewTrampolineErrorDecrypter(circuit,
+	trampolineCircuit *Circuit) *OnionErrorDecrypter {
+
+	return &OnionErrorDecrypter{
+		circuit:           circuit,
+		trampolineCircuit: trampolineCircuit,
+	}
+}
+
+// errorPath returns the shared secrets to decrypt an error with, along with
+// the public keys of the nodes they belong to.
+func (o *OnionErrorDecrypter) errorPath() ([]Hash256, []*btcec.PublicKey) {
+	sharedSecrets := generateSharedSecrets(
+		o.circuit.PaymentPath, o.circuit.SessionKey,
+	)
+	if o.trampolineCircuit == nil {
+		return sharedSecrets, o.circuit.PaymentPath
+	}
+
+	trampolineSecrets := generateSharedSecrets(
+		o.trampolineCircuit.PaymentPath,
+		o.trampolineCircuit.SessionKey,
+	)
+
+	path := make(
+		[]*btcec.PublicKey, 0,
+		len(o.circuit.PaymentPath)+len(o.trampolineCircuit.PaymentPath),
+	)
+	path = append(path, o.circuit.PaymentPath...)
+	path = append(path, o.trampolineCircuit.PaymentPath...)
+
+	return append(sharedSecrets, trampolineSecrets...), path
+}
+
+// UnwrapError strips the encryption layers of all hops of the circuit off the
+// passed encrypted error. A trampoline node uses this to recover an error that
+// was returned by the next trampoline node, which is still encrypted by the
+// trampoline onion of that node, before passing it back to the sender using
+// EncryptError. Errors that originate from an intermediate hop of the circuit
+// should be decrypted using DecryptError instead.
+func (o *OnionErrorDecrypter) UnwrapError(encryptedData []byte) []byte {
+	sharedSecrets, _ := o.errorPath()
+	for i := range sharedSecrets {
+		encryptedData = onionEncrypt(&sharedSecrets[i], encryptedData)
+	}
+
+	return encryptedData
+}
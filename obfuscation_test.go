@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"io"
 	"reflect"
 	"testing"
 
@@ -283,3 +284,157 @@ func TestOnionFailureSpecVector(t *testing.T) {
 			"the path we received an error")
 	}
 }
+
+// TestOnionFailureVariableLength checks that failure messages of any length
+// above the minimum can be encrypted and decrypted, and that the lengths of the
+// failure message and its padding are reported.
+func TestOnionFailureVariableLength(t *testing.T) {
+	t.Parallel()
+
+	paymentPath := make([]*btcec.PublicKey, 3)
+	for i := 0; i < len(paymentPath); i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		paymentPath[i] = privKey.PubKey()
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(),
+		bytes.Repeat([]byte{'A'}, 32))
+	sharedSecrets := generateSharedSecrets(paymentPath, sessionKey)
+
+	deobfuscator := NewOnionErrorDecrypter(&Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath,
+	})
+
+	testCases := []struct {
+		failureLen     int
+		expectedPadLen int
+	}{
+		{failureLen: 2, expectedPadLen: 254},
+		{failureLen: 256, expectedPadLen: 0},
+		{failureLen: 600, expectedPadLen: 0},
+	}
+
+	for _, testCase := range testCases {
+		failure := bytes.Repeat([]byte{'F'}, testCase.failureLen)
+		body, err := PadFailureMessage(failure)
+		if err != nil {
+			t.Fatalf("unable to pad failure message: %v", err)
+		}
+
+		obfuscator := &OnionErrorEncrypter{
+			sharedSecret: sharedSecrets[len(paymentPath)-1],
+		}
+		obfuscatedData := obfuscator.EncryptError(true, body)
+		for i := len(paymentPath) - 2; i >= 0; i-- {
+			obfuscator = &OnionErrorEncrypter{
+				sharedSecret: sharedSecrets[i],
+			}
+			obfuscatedData = obfuscator.EncryptError(
+				false, obfuscatedData,
+			)
+		}
+
+		decryptedError, err := deobfuscator.DecryptError(obfuscatedData)
+		if err != nil {
+			t.Fatalf("unable to decrypt %d byte failure: %v",
+				testCase.failureLen, err)
+		}
+
+		if decryptedError.SenderIdx != len(paymentPath) {
+			t.Fatalf("expected sender %d, got %d", len(paymentPath),
+				decryptedError.SenderIdx)
+		}
+		if decryptedError.FailureLength != testCase.failureLen {
+			t.Fatalf("expected failure length %d, got %d",
+				testCase.failureLen,
+				decryptedError.FailureLength)
+		}
+		if decryptedError.PaddingLength != testCase.expectedPadLen {
+			t.Fatalf("expected padding length %d, got %d",
+				testCase.expectedPadLen,
+				decryptedError.PaddingLength)
+		}
+
+		msg := decryptedError.Message
+		if !bytes.Equal(msg[2:2+testCase.failureLen], failure) {
+			t.Fatalf("failure message mismatch")
+		}
+	}
+
+	// Errors below the minimum length are still rejected.
+	_, err := deobfuscator.DecryptError(make([]byte, onionErrorLength-1))
+	if err == nil {
+		t.Fatalf("expected short error to be rejected")
+	}
+}
+
+// TestOnionErrorEncrypterEncoding tests that encrypters, with and without the
+// shared secret of a trampoline onion, can be decoded when they're followed by
+// other data, and that encrypters written before the trampoline secret was
+// added can still be decoded.
+func TestOnionErrorEncrypterEncoding(t *testing.T) {
+	trampolineSecret := Hash256{2}
+	encrypters := []*OnionErrorEncrypter{
+		{sharedSecret: Hash256{1}, trampolineSecret: &trampolineSecret},
+		{sharedSecret: Hash256{3}},
+	}
+
+	var b bytes.Buffer
+	for _, encrypter := range encrypters {
+		if err := encrypter.Encode(&b); err != nil {
+			t.Fatalf("unable to encode encrypter: %v", err)
+		}
+	}
+	trailer := bytes.Repeat([]byte{0xaa}, 40)
+	b.Write(trailer)
+
+	for i, encrypter := range encrypters {
+		var decoded OnionErrorEncrypter
+		if err := decoded.Decode(&b); err != nil {
+			t.Fatalf("unable to decode encrypter %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(&decoded, encrypter) {
+			t.Fatalf("encrypter %d doesn't match: expected %v, "+
+				"got %v", i, encrypter, &decoded)
+		}
+	}
+	if !bytes.Equal(b.Bytes(), trailer) {
+		t.Fatalf("trailing data was consumed")
+	}
+
+	// An encrypter of a regular hop is encoded as its shared secret
+	// alone, so that encrypters persisted before trampoline support was
+	// added can still be decoded, even when followed by further data.
+	legacy := Hash256{4}
+	legacyEncrypter := &OnionErrorEncrypter{sharedSecret: legacy}
+	b.Reset()
+	if err := legacyEncrypter.Encode(&b); err != nil {
+		t.Fatalf("unable to encode encrypter: %v", err)
+	}
+	if !bytes.Equal(b.Bytes(), legacy[:]) {
+		t.Fatalf("expected legacy encoding, got %x", b.Bytes())
+	}
+
+	legacyTrailer := []byte{1, 2, 3}
+	r := bytes.NewReader(append(legacy[:], legacyTrailer...))
+	var decoded OnionErrorEncrypter
+	if err := decoded.Decode(r); err != nil {
+		t.Fatalf("unable to decode encrypter: %v", err)
+	}
+	if decoded.sharedSecret != legacy || decoded.trampolineSecret != nil {
+		t.Fatalf("unexpected encrypter: %v", decoded)
+	}
+	if r.Len() != len(legacyTrailer) {
+		t.Fatalf("trailing data was consumed")
+	}
+
+	// An encrypter of a trampoline node that was cut short is rejected.
+	truncated := append(trampolineEncrypterMarker[:], legacy[:]...)
+	err := decoded.Decode(bytes.NewReader(truncated))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
@@ -0,0 +1,403 @@
+package sphinx
+
+import (
+	"errors"
+	"time"
+)
+
+// FailureReason is the reason an onion packet failed to be processed, as
+// reported to an Observer.
+type FailureReason uint8
+
+const (
+	// FailureNone indicates that the packet was processed successfully.
+	FailureNone FailureReason = iota
+
+	// FailureInvalidVersion indicates that the version of the packet is
+	// unknown.
+	FailureInvalidVersion
+
+	// FailureInvalidHMAC indicates that the HMAC of the packet doesn't
+	// match, under any of the onion keys of the router.
+	FailureInvalidHMAC
+
+	// FailureInvalidKey indicates that the ephemeral key of the packet
+	// isn't on the curve.
+	FailureInvalidKey
+
+	// FailureReplay indicates that the packet was detected as a replay.
+	FailureReplay
+
+	// FailureOther indicates any other failure, such as an invalid
+	// payload.
+	FailureOther
+
+	// numFailureReasons is the number of failure reasons.
+	numFailureReasons
+)
+
+// String returns a human readable string for each of the FailureReasons.
+func (r FailureReason) String() string {
+	switch r {
+	case FailureNone:
+		return "None"
+	case FailureInvalidVersion:
+		return "InvalidVersion"
+	case FailureInvalidHMAC:
+		return "InvalidHMAC"
+	case FailureInvalidKey:
+		return "InvalidKey"
+	case FailureReplay:
+		return "Replay"
+	case FailureOther:
+		return "Other"
+	default:
+		return "Unknown"
+	}
+}
+
+// failureReason returns the FailureReason matching the error returned when
+// processing an onion packet.
+func failureReason(err error) FailureReason {
+	switch {
+	case err == nil:
+		return FailureNone
+	case errors.Is(err, ErrInvalidOnionVersion):
+		return FailureInvalidVersion
+	case errors.Is(err, ErrInvalidOnionHMAC):
+		return FailureInvalidHMAC
+	case errors.Is(err, ErrInvalidOnionKey):
+		return FailureInvalidKey
+	case errors.Is(err, ErrReplayedPacket):
+		return FailureReplay
+	default:
+		return FailureOther
+	}
+}
+
+// ReplayLogOp is an operation performed on a replay log, as reported to an
+// Observer.
+type ReplayLogOp uint8
+
+const (
+	// ReplayLogGet is a call to ReplayLog.Get.
+	ReplayLogGet ReplayLogOp = iota
+
+	// ReplayLogPut is a call to ReplayLog.Put.
+	ReplayLogPut
+
+	// ReplayLogDelete is a call to ReplayLog.Delete.
+	ReplayLogDelete
+
+	// ReplayLogPutBatch is a call to ReplayLog.PutBatch.
+	ReplayLogPutBatch
+
+	// ReplayLogExpire is a call to ExpiringReplayLog.Expire.
+	ReplayLogExpire
+
+	// ReplayLogDeleteBatch is a call to ReplayLog.DeleteBatch.
+	ReplayLogDeleteBatch
+
+	// numReplayLogOps is the number of replay log operations.
+	numReplayLogOps
+)
+
+// String returns a human readable string for each of the ReplayLogOps.
+func (op ReplayLogOp) String() string {
+	switch op {
+	case ReplayLogGet:
+		return "Get"
+	case ReplayLogPut:
+		return "Put"
+	case ReplayLogDelete:
+		return "Delete"
+	case ReplayLogPutBatch:
+		return "PutBatch"
+	case ReplayLogExpire:
+		return "Expire"
+	case ReplayLogDeleteBatch:
+		return "DeleteBatch"
+	default:
+		return "Unknown"
+	}
+}
+
+// PacketEvent is reported to an Observer once an onion packet has been
+// processed.
+type PacketEvent struct {
+	// Batched is true if the packet was processed as part of a Tx. The
+	// replay log isn't consulted until the Tx is committed, so replays of
+	// batched packets are only reported by ReplayDetected.
+	Batched bool
+
+	// Action is the action to be taken for the packet, which is Failure
+	// if the packet failed to be processed.
+	Action ProcessCode
+
+	// Failure is the reason the packet failed to be processed.
+	Failure FailureReason
+
+	// ECDHLatency is the time spent deriving the shared secret of the
+	// packet, across all of the onion keys that were tried.
+	ECDHLatency time.Duration
+
+	// Latency is the time spent processing the packet.
+	Latency time.Duration
+}
+
+// ReplayEvent is reported to an Observer when a replayed packet is detected.
+type ReplayEvent struct {
+	// Batched is true if the replay was detected when committing a Tx.
+	Batched bool
+
+	// SeqNum is the sequence number of the replayed packet within its
+	// batch. It is only set for batched packets.
+	SeqNum uint32
+}
+
+// BatchEvent is reported to an Observer once a Tx has been committed to the
+// replay log.
+type BatchEvent struct {
+	// NumPackets is the number of packets added to the batch.
+	NumPackets int
+
+	// NumReplays is the number of packets of the batch that were detected
+	// as replays.
+	NumReplays int
+
+	// Latency is the time spent writing the batch to the replay log.
+	Latency time.Duration
+
+	// Err is the error returned by the replay log, if any.
+	Err error
+}
+
+// ReplayLogEvent is reported to an Observer by an ObservedReplayLog once an
+// operation on its replay log has completed.
+type ReplayLogEvent struct {
+	// Op is the operation that was performed.
+	Op ReplayLogOp
+
+	// Latency is the time spent performing the operation.
+	Latency time.Duration
+
+	// Err is the error returned by the operation, if any. The expected
+	// outcomes ErrLogEntryNotFound and ErrReplayedPacket aren't reported
+	// as errors.
+	Err error
+}
+
+// Observer is notified of the events that occur while processing onion
+// packets, which allows them to be monitored. It can be passed to a Router
+// using WithObserver, and to a replay log using NewObservedReplayLog. All
+// methods must be safe for concurrent access, and must not block.
+type Observer interface {
+	// PacketProcessed is called once an onion packet has been processed.
+	PacketProcessed(PacketEvent)
+
+	// ReplayDetected is called when a replayed packet is detected.
+	ReplayDetected(ReplayEvent)
+
+	// BatchCommitted is called once a Tx has been committed.
+	BatchCommitted(BatchEvent)
+
+	// ReplayLogOp is called once an operation on a replay log wrapped by
+	// an ObservedReplayLog has completed.
+	ReplayLogOp(ReplayLogEvent)
+}
+
+// multiObserver is an Observer that passes the events on to several
+// observers.
+type multiObserver []Observer
+
+// PacketProcessed passes the event on to each observer.
+func (m multiObserver) PacketProcessed(event PacketEvent) {
+	for _, o := range m {
+		o.PacketProcessed(event)
+	}
+}
+
+// ReplayDetected passes the event on to each observer.
+func (m multiObserver) ReplayDetected(event ReplayEvent) {
+	for _, o := range m {
+		o.ReplayDetected(event)
+	}
+}
+
+// BatchCommitted passes the event on to each observer.
+func (m multiObserver) BatchCommitted(event BatchEvent) {
+	for _, o := range m {
+		o.BatchCommitted(event)
+	}
+}
+
+// ReplayLogOp passes the event on to each observer.
+func (m multiObserver) ReplayLogOp(event ReplayLogEvent) {
+	for _, o := range m {
+		o.ReplayLogOp(event)
+	}
+}
+
+// logObserver is an Observer that traces the events using the package logger.
+// Events carry no secrets, hash prefixes, payloads or batch IDs, so the traces
+// don't reveal anything about the packets beyond their outcome.
+type logObserver struct{}
+
+// PacketProcessed traces the outcome of processing a packet.
+func (logObserver) PacketProcessed(event PacketEvent) {
+	sphxLog.Tracef("Processed onion packet: batched=%v, action=%v, "+
+		"failure=%v, ecdh=%v, latency=%v", event.Batched, event.Action,
+		event.Failure, event.ECDHLatency, event.Latency)
+}
+
+// ReplayDetected traces the detection of a replayed packet.
+func (logObserver) ReplayDetected(event ReplayEvent) {
+	if event.Batched {
+		sphxLog.Debugf("Detected replayed onion packet with sequence "+
+			"number %d in batch", event.SeqNum)
+		return
+	}
+
+	sphxLog.Debugf("Detected replayed onion packet")
+}
+
+// BatchCommitted traces the commitment of a batch.
+func (logObserver) BatchCommitted(event BatchEvent) {
+	if event.Err != nil {
+		sphxLog.Debugf("Unable to commit batch of %d onion packets: %v",
+			event.NumPackets, event.Err)
+		return
+	}
+
+	sphxLog.Debugf("Committed batch of %d onion packets with %d replays "+
+		"in %v", event.NumPackets, event.NumReplays, event.Latency)
+}
+
+// ReplayLogOp traces an operation on a replay log.
+func (logObserver) ReplayLogOp(event ReplayLogEvent) {
+	if event.Err != nil {
+		sphxLog.Debugf("Replay log %v failed after %v: %v", event.Op,
+			event.Latency, event.Err)
+		return
+	}
+
+	sphxLog.Tracef("Replay log %v completed in %v", event.Op,
+		event.Latency)
+}
+
+// WithObserver is a functional option that adds an observer to be notified of
+// the packets processed and the batches committed by the router. It can be
+// passed more than once to add several observers.
+func WithObserver(observer Observer) RouterOpt {
+	return func(r *Router) {
+		r.observer = append(r.observer, observer)
+	}
+}
+
+// ObservedReplayLog is a ReplayLog that reports the operations performed on
+// the log it wraps to an Observer.
+type ObservedReplayLog struct {
+	log      ReplayLog
+	observer Observer
+}
+
+// NewObservedReplayLog wraps the passed replay log, reporting the operations
+// performed on it to the passed observer.
+func NewObservedReplayLog(log ReplayLog,
+	observer Observer) *ObservedReplayLog {
+
+	return &ObservedReplayLog{
+		log:      log,
+		observer: multiObserver{logObserver{}, observer},
+	}
+}
+
+// observe reports an operation on the replay log that started at the passed
+// time.
+func (l *ObservedReplayLog) observe(op ReplayLogOp, start time.Time,
+	err error) {
+
+	if err == ErrLogEntryNotFound || err == ErrReplayedPacket {
+		err = nil
+	}
+
+	l.observer.ReplayLogOp(ReplayLogEvent{
+		Op:      op,
+		Latency: time.Since(start),
+		Err:     err,
+	})
+}
+
+// Start starts up the wrapped log.
+func (l *ObservedReplayLog) Start() error {
+	return l.log.Start()
+}
+
+// Stop stops the wrapped log.
+func (l *ObservedReplayLog) Stop() error {
+	return l.log.Stop()
+}
+
+// Get retrieves an entry from the wrapped log given its hash prefix.
+func (l *ObservedReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	start := time.Now()
+	cltv, err := l.log.Get(hash)
+	l.observe(ReplayLogGet, start, err)
+
+	return cltv, err
+}
+
+// Put stores an entry into the wrapped log given its hash prefix.
+func (l *ObservedReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	start := time.Now()
+	err := l.log.Put(hash, cltv)
+	l.observe(ReplayLogPut, start, err)
+
+	return err
+}
+
+// Delete deletes an entry from the wrapped log given its hash prefix.
+func (l *ObservedReplayLog) Delete(hash *HashPrefix) error {
+	start := time.Now()
+	err := l.log.Delete(hash)
+	l.observe(ReplayLogDelete, start, err)
+
+	return err
+}
+
+// PutBatch stores a batch of sphinx packets into the wrapped log.
+func (l *ObservedReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	start := time.Now()
+	replays, err := l.log.PutBatch(batch)
+	l.observe(ReplayLogPutBatch, start, err)
+
+	return replays, err
+}
+
+// DeleteBatch deletes a batch from the wrapped log.
+func (l *ObservedReplayLog) DeleteBatch(id []byte) error {
+	start := time.Now()
+	err := l.log.DeleteBatch(id)
+	l.observe(ReplayLogDeleteBatch, start, err)
+
+	return err
+}
+
+// Expire expires the entries of the wrapped log, which must implement
+// ExpiringReplayLog.
+func (l *ObservedReplayLog) Expire(height uint32) error {
+	expiringLog, ok := l.log.(ExpiringReplayLog)
+	if !ok {
+		return ErrReplayLogNotExpiring
+	}
+
+	start := time.Now()
+	err := expiringLog.Expire(height)
+	l.observe(ReplayLogExpire, start, err)
+
+	return err
+}
+
+// A compile time assertion that *ObservedReplayLog implements the
+// ExpiringReplayLog interface.
+var _ ExpiringReplayLog = (*ObservedReplayLog)(nil)
@@ -0,0 +1,244 @@
+package sphinx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brsuite/brond/btcec"
+	"github.com/brsuite/brond/chaincfg"
+	"github.com/btcsuite/btclog"
+)
+
+// TestRouterObserver tests that the packets processed and the batches
+// committed by a router, along with the operations on its replay log, are
+// reported to its observer.
+func TestRouterObserver(t *testing.T) {
+	t.Parallel()
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	metrics := NewMetricsObserver()
+	router := NewRouter(
+		&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+		NewObservedReplayLog(NewMemoryReplayLog(), metrics),
+		WithObserver(metrics),
+	)
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+	defer router.Stop()
+
+	// Process a packet, followed by a replay of it, a packet with
+	// mismatched associated data and a packet of an unknown version.
+	pkt, _ := newSingleHopOnion(t, privKey.PubKey())
+	if _, err := router.ProcessOnionPacket(pkt, nil, 1); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	_, err = router.ProcessOnionPacket(pkt, nil, 1)
+	if err != ErrReplayedPacket {
+		t.Fatalf("expected error %v, got %v", ErrReplayedPacket, err)
+	}
+
+	pkt, _ = newSingleHopOnion(t, privKey.PubKey())
+	_, err = router.ProcessOnionPacket(pkt, []byte("assoc"), 1)
+	if err == nil {
+		t.Fatalf("expected packet with invalid hmac to be rejected")
+	}
+
+	badVersion := *pkt
+	badVersion.Version = 1
+	_, err = router.ProcessOnionPacket(&badVersion, nil, 1)
+	if err == nil {
+		t.Fatalf("expected packet with invalid version to be rejected")
+	}
+
+	// Then commit a batch holding a packet twice.
+	tx := router.BeginTxn([]byte("batch"), 2)
+	for seqNum := uint32(0); seqNum < 2; seqNum++ {
+		err := tx.ProcessOnionPacket(seqNum, pkt, nil, 1)
+		if err != nil {
+			t.Fatalf("unable to process packet: %v", err)
+		}
+	}
+	if _, _, err := tx.Commit(); err != nil {
+		t.Fatalf("unable to commit batch: %v", err)
+	}
+
+	m := metrics.Snapshot()
+	if m.Actions[ExitNode] != 3 {
+		t.Fatalf("expected 3 exit packets, got %d", m.Actions[ExitNode])
+	}
+	expectedFailures := map[FailureReason]uint64{
+		FailureReplay:         1,
+		FailureInvalidHMAC:    1,
+		FailureInvalidVersion: 1,
+	}
+	for reason, n := range expectedFailures {
+		if m.Failures[reason] != n {
+			t.Fatalf("expected %d failures with reason %v, got %d",
+				n, reason, m.Failures[reason])
+		}
+	}
+	if m.Replays != 2 {
+		t.Fatalf("expected 2 replays, got %d", m.Replays)
+	}
+	if m.Batches != 1 || m.BatchFailures != 0 {
+		t.Fatalf("expected 1 batch, got %d with %d failures",
+			m.Batches, m.BatchFailures)
+	}
+	if m.PacketLatency.Count != 6 {
+		t.Fatalf("expected 6 packet latencies, got %d",
+			m.PacketLatency.Count)
+	}
+	if m.BatchLatency.Count != 1 {
+		t.Fatalf("expected 1 batch latency, got %d",
+			m.BatchLatency.Count)
+	}
+
+	// The packets that were processed, rather than rejected for their
+	// version, spent some time deriving their shared secret.
+	if m.ECDHLatency.Sum == 0 {
+		t.Fatalf("expected ecdh latency to be recorded")
+	}
+
+	// The replay log was written to twice by the packets processed on
+	// their own, and once by the batch, none of which failed.
+	if m.ReplayLogLatency[ReplayLogPut].Count != 2 {
+		t.Fatalf("expected 2 puts, got %d",
+			m.ReplayLogLatency[ReplayLogPut].Count)
+	}
+	if m.ReplayLogLatency[ReplayLogPutBatch].Count != 1 {
+		t.Fatalf("expected 1 batch put, got %d",
+			m.ReplayLogLatency[ReplayLogPutBatch].Count)
+	}
+	if len(m.ReplayLogErrors) != 0 {
+		t.Fatalf("expected no replay log errors, got %v",
+			m.ReplayLogErrors)
+	}
+}
+
+// TestLatencyHistogram tests the bucketing of the samples of a latency
+// histogram, along with the statistics derived from them.
+func TestLatencyHistogram(t *testing.T) {
+	t.Parallel()
+
+	var h LatencyHistogram
+	if h.Mean() != 0 || h.Quantile(0.5) != 0 {
+		t.Fatalf("expected empty histogram to have zero statistics")
+	}
+
+	// Add 90 samples of a microsecond, 9 of 3 microseconds and one of a
+	// minute.
+	for i := 0; i < 90; i++ {
+		h.observe(time.Microsecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.observe(3 * time.Microsecond)
+	}
+	h.observe(time.Minute)
+
+	if h.Buckets[0] != 90 || h.Buckets[2] != 9 {
+		t.Fatalf("unexpected buckets: %v", h.Buckets)
+	}
+	if h.Buckets[NumLatencyBuckets-1] != 1 {
+		t.Fatalf("expected large sample in last bucket, got %v",
+			h.Buckets)
+	}
+	if h.Count != 100 || h.Max != time.Minute {
+		t.Fatalf("unexpected count %d or max %v", h.Count, h.Max)
+	}
+
+	expectedMean := (90*time.Microsecond + 27*time.Microsecond +
+		time.Minute) / 100
+	if h.Mean() != expectedMean {
+		t.Fatalf("expected mean %v, got %v", expectedMean, h.Mean())
+	}
+
+	quantiles := []struct {
+		q        float64
+		expected time.Duration
+	}{
+		{0, time.Microsecond},
+		{0.5, time.Microsecond},
+		{0.95, 4 * time.Microsecond},
+		{0.999, time.Minute},
+		{1, time.Minute},
+	}
+	for _, test := range quantiles {
+		if q := h.Quantile(test.q); q != test.expected {
+			t.Fatalf("expected quantile %v to be %v, got %v",
+				test.q, test.expected, q)
+		}
+	}
+}
+
+// TestLogObserverRedacted tests that the events of a router are traced using
+// the package logger, without revealing the batch IDs or keys of the packets.
+func TestLogObserverRedacted(t *testing.T) {
+	var b bytes.Buffer
+	logger := btclog.NewBackend(&b).Logger("SPHX")
+	logger.SetLevel(btclog.LevelTrace)
+	UseLogger(logger)
+	defer DisableLog()
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	replayLog := NewObservedReplayLog(
+		NewMemoryReplayLog(), NewMetricsObserver(),
+	)
+	router := NewRouter(
+		&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+		replayLog,
+	)
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+	defer router.Stop()
+
+	pkt, _ := newSingleHopOnion(t, privKey.PubKey())
+	if _, err := router.ProcessOnionPacket(pkt, nil, 1); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+
+	batchID := []byte("secret batch id")
+	tx := router.BeginTxn(batchID, 1)
+	if err := tx.ProcessOnionPacket(0, pkt, nil, 1); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	if _, _, err := tx.Commit(); err != nil {
+		t.Fatalf("unable to commit batch: %v", err)
+	}
+
+	traces := b.String()
+	for _, expected := range []string{
+		"Processed onion packet", "Detected replayed onion packet",
+		"Committed batch of 1 onion packets with 1 replays",
+		"Replay log Put completed",
+	} {
+		if !strings.Contains(traces, expected) {
+			t.Fatalf("expected %q to be traced, got %v", expected,
+				traces)
+		}
+	}
+
+	ephemeralKey := hex.EncodeToString(
+		pkt.EphemeralKey.SerializeCompressed(),
+	)
+	for _, secret := range []string{
+		string(batchID), hex.EncodeToString(batchID), ephemeralKey,
+	} {
+		if strings.Contains(traces, secret) {
+			t.Fatalf("expected %q to be redacted, got %v", secret,
+				traces)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package sphinx
+
+import (
+	"errors"
+	"time"
+
+	"github.com/brsuite/brond/btcec"
+)
+
+var (
+	// ErrNoOnionKeys is returned when a router is created without any
+	// onion keys.
+	ErrNoOnionKeys = errors.New("router requires at least one onion key")
+
+	// ErrNoActiveOnionKey is returned when an onion is received while none
+	// of the onion keys of the router are within their active window.
+	ErrNoActiveOnionKey = errors.New("no active onion key")
+
+	// ErrUnknownOnionKey is returned when an onion key is requested using
+	// WithOnionKey that isn't held by the router.
+	ErrUnknownOnionKey = errors.New("onion key not held by router")
+
+	// ErrOnionKeyRequired is returned when an error encrypter is created
+	// for a router holding multiple onion keys, without selecting the key
+	// the onion was processed with using WithOnionKey.
+	ErrOnionKeyRequired = errors.New("onion key must be selected when " +
+		"router holds multiple keys")
+)
+
+// OnionKey is one of the onion keys held by a Router, along with the window
+// in which onions that were built against it are accepted. Holding multiple
+// keys allows a node to rotate its onion key, while still accepting onions
+// built against the previous key during a grace period.
+type OnionKey struct {
+	// Key is the onion key itself.
+	Key SingleKeyECDH
+
+	// ActiveFrom is the time from which onions built against the key are
+	// accepted. If zero, the key is active from the start.
+	ActiveFrom time.Time
+
+	// RetireAt is the time from which onions built against the key are
+	// no longer accepted. If zero, the key never retires.
+	RetireAt time.Time
+}
+
+// isActive returns true if the key is within its active window at the given
+// time.
+func (k *OnionKey) isActive(now time.Time) bool {
+	if !k.ActiveFrom.IsZero() && now.Before(k.ActiveFrom) {
+		return false
+	}
+
+	return k.RetireAt.IsZero() || now.Before(k.RetireAt)
+}
+
+// RouterOpt is a functional option that can be used to modify the behavior of
+// a Router.
+type RouterOpt func(*Router)
+
+// WithClock is a functional option that sets the function used by the router
+// to obtain the current time, which determines the onion keys that are
+// active. By default, time.Now is used.
+func WithClock(now func() time.Time) RouterOpt {
+	return func(r *Router) {
+		r.now = now
+	}
+}
+
+// WithTxWorkers is a functional option that sets the maximum number of
+// packets processed concurrently by Tx.ProcessOnionPackets. By default, the
+// number of CPUs is used.
+func WithTxWorkers(numWorkers int) RouterOpt {
+	return func(r *Router) {
+		r.txWorkers = numWorkers
+	}
+}
+
+// WithTxMaxSeqNum is a functional option that sets the highest sequence number
+// accepted by the transactions of the router. The processed packets of a
+// transaction are indexed by their sequence number, so this bounds the memory
+// a transaction can use. By default, DefaultTxMaxSeqNum is used. A FileReplayLog
+// can't hold batches much larger than this default, and rejects them with
+// ErrBatchTooLarge.
+func WithTxMaxSeqNum(maxSeqNum uint32) RouterOpt {
+	return func(r *Router) {
+		r.txMaxSeqNum = maxSeqNum
+	}
+}
+
+// WithOnionKey is a functional option that selects the onion key of the
+// router to be used, identified by its public key. It should be used to
+// create the error encrypter for an onion that was processed using a key
+// other than the primary one, as reported by ProcessedPacket.OnionKey. The
+// active window of the key isn't checked when it is selected explicitly.
+func WithOnionKey(pubKey *btcec.PublicKey) ProcessOnionOpt {
+	return func(cfg *processOnionCfg) {
+		cfg.onionKey = pubKey
+	}
+}
+
+// maxStackOnionKeys is the number of candidate onion keys that fit in the
+// buffer on the stack used when processing an onion. Routers rarely hold more
+// than a couple of keys at once, and more keys merely cause an allocation.
+const maxStackOnionKeys = 4
+
+// candidateKeys appends the onion keys to be tried for an incoming onion to
+// the passed slice, in the order in which they are held by the router. Passing
+// a slice backed by an array on the stack avoids an allocation per onion.
+func (r *Router) candidateKeys(cfg *processOnionCfg,
+	keys []SingleKeyECDH) ([]SingleKeyECDH, error) {
+
+	if cfg.onionKey != nil {
+		for _, key := range r.onionKeys {
+			if key.Key.PubKey().IsEqual(cfg.onionKey) {
+				return append(keys, key.Key), nil
+			}
+		}
+
+		return nil, ErrUnknownOnionKey
+	}
+
+	now := r.now()
+
+	for _, key := range r.onionKeys {
+		if key.isActive(now) {
+			keys = append(keys, key.Key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoActiveOnionKey
+	}
+
+	return keys, nil
+}
+
+// encrypterKey returns the onion key used to derive the shared secret of an
+// error encrypter, where there's no HMAC to determine the key the onion was
+// built against. If the router holds multiple keys, the key must have been
+// selected using WithOnionKey, as an error encrypted using any other key can't
+// be decrypted by the sender.
+func (r *Router) encrypterKey(cfg *processOnionCfg) (SingleKeyECDH, error) {
+	if cfg.onionKey == nil && len(r.onionKeys) > 1 {
+		return nil, ErrOnionKeyRequired
+	}
+
+	var buf [maxStackOnionKeys]SingleKeyECDH
+	keys, err := r.candidateKeys(cfg, buf[:0])
+	if err != nil {
+		return nil, err
+	}
+
+	return keys[0], nil
+}
+
+// peelOnion peels a layer off the passed onion, trying each of the candidate
+// onion keys in turn until one of them yields a valid HMAC. The shared secret
+// derived using the matching key is returned alongside the processed packet,
+// so that the replay log is always consulted with the secret of the key the
+// onion was built against.
+func (r *Router) peelOnion(onionPkt *OnionPacket, assocData []byte,
+	cfg *processOnionCfg) (*ProcessedPacket, Hash256, error) {
+
+	var buf [maxStackOnionKeys]SingleKeyECDH
+	keys, err := r.candidateKeys(cfg, buf[:0])
+	if err != nil {
+		return nil, Hash256{}, err
+	}
+
+	for _, key := range keys {
+		gen := newSecretGenerator(cfg.ctx, key)
+
+		start := time.Now()
+		sharedSecret, err := onionSharedSecret(
+			onionPkt.EphemeralKey, cfg.blindingPoint, gen,
+		)
+		cfg.ecdhLatency += time.Since(start)
+		if err != nil {
+			return nil, Hash256{}, err
+		}
+
+		packet, err := processOnionPacket(
+			onionPkt, &sharedSecret, assocData, cfg.blindingPoint,
+			gen,
+		)
+		switch {
+		// The onion wasn't built against this key, so we'll move on
+		// to the next one.
+		case err == ErrInvalidOnionHMAC:
+			continue
+
+		case err != nil:
+			return nil, Hash256{}, err
+		}
+
+		packet.OnionKey = key.PubKey()
+
+		return packet, sharedSecret, nil
+	}
+
+	return nil, Hash256{}, ErrInvalidOnionHMAC
+}
@@ -0,0 +1,176 @@
+package sphinx
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/brsuite/brond/btcec"
+	"github.com/brsuite/brond/chaincfg"
+)
+
+// newSingleHopOnion creates an onion packet to the node with the passed onion
+// key, along with the circuit needed to decrypt errors sent back by the node.
+func newSingleHopOnion(t *testing.T, nodeKey *btcec.PublicKey) (*OnionPacket,
+	*Circuit) {
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	var route PaymentPath
+	route[0] = OnionHop{
+		NodePub: *nodeKey,
+		HopPayload: HopPayload{
+			Type:    PayloadTLV,
+			Payload: []byte{2, 1, 1},
+		},
+	}
+
+	pkt, err := NewOnionPacket(
+		&route, sessionKey, nil, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	return pkt, &Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: []*btcec.PublicKey{nodeKey},
+	}
+}
+
+// TestOnionKeyRotation tests that a router holding multiple onion keys
+// accepts onions built against each of them within their active window, and
+// reports the key that matched.
+func TestOnionKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	oldKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	newKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	// The new key becomes active at the rotation time, while the old key
+	// is still accepted during a grace period of an hour.
+	rotation := time.Unix(1_700_000_000, 0)
+	now := rotation.Add(30 * time.Minute)
+
+	_, err = NewMultiKeyRouter(nil, &chaincfg.MainNetParams, nil)
+	if err != ErrNoOnionKeys {
+		t.Fatalf("expected error %v, got %v", ErrNoOnionKeys, err)
+	}
+
+	router, err := NewMultiKeyRouter(
+		[]OnionKey{
+			{
+				Key:        &PrivKeyECDH{PrivKey: newKey},
+				ActiveFrom: rotation,
+			},
+			{
+				Key:      &PrivKeyECDH{PrivKey: oldKey},
+				RetireAt: rotation.Add(time.Hour),
+			},
+		},
+		&chaincfg.MainNetParams, NewMemoryReplayLog(),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatalf("unable to create router: %v", err)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+	defer router.Stop()
+
+	// Onions built against either key are accepted during the grace
+	// period, and the matching key is reported.
+	for _, key := range []*btcec.PrivateKey{newKey, oldKey} {
+		pkt, circuit := newSingleHopOnion(t, key.PubKey())
+
+		processed, err := router.ProcessOnionPacket(pkt, nil, 1)
+		if err != nil {
+			t.Fatalf("unable to process onion: %v", err)
+		}
+		if !processed.OnionKey.IsEqual(key.PubKey()) {
+			t.Fatalf("onion key mismatch")
+		}
+
+		// Replays are detected no matter the key that matched.
+		_, err = router.ProcessOnionPacket(pkt, nil, 1)
+		if err != ErrReplayedPacket {
+			t.Fatalf("expected error %v, got %v",
+				ErrReplayedPacket, err)
+		}
+
+		// Errors are encrypted using the key the onion was built
+		// against, so the sender is able to decrypt them.
+		encrypter, err := NewOnionErrorEncrypter(
+			router, pkt.EphemeralKey,
+			WithOnionKey(processed.OnionKey),
+		)
+		if err != nil {
+			t.Fatalf("unable to create encrypter: %v", err)
+		}
+
+		failure := bytes.Repeat([]byte{'F'}, minFailureMessageLength)
+		body, err := PadFailureMessage(failure)
+		if err != nil {
+			t.Fatalf("unable to pad failure: %v", err)
+		}
+
+		decrypted, err := NewOnionErrorDecrypter(circuit).DecryptError(
+			encrypter.EncryptError(true, body),
+		)
+		if err != nil {
+			t.Fatalf("unable to decrypt error: %v", err)
+		}
+		if !bytes.Equal(decrypted.Message, body) {
+			t.Fatalf("error message mismatch")
+		}
+	}
+
+	// Once the grace period is over, onions built against the old key
+	// are rejected as if their HMAC is invalid.
+	now = rotation.Add(2 * time.Hour)
+	pkt, _ := newSingleHopOnion(t, oldKey.PubKey())
+	_, err = router.ProcessOnionPacket(pkt, nil, 1)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidOnionHMAC, err)
+	}
+
+	// Before the rotation, only the old key is active.
+	now = rotation.Add(-time.Minute)
+	pkt, _ = newSingleHopOnion(t, newKey.PubKey())
+	_, err = router.ProcessOnionPacket(pkt, nil, 1)
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidOnionHMAC, err)
+	}
+
+	// As the router holds multiple keys, the key must be selected when
+	// creating an error encrypter, rather than guessed.
+	_, err = NewOnionErrorEncrypter(router, pkt.EphemeralKey)
+	if err != ErrOnionKeyRequired {
+		t.Fatalf("expected error %v, got %v", ErrOnionKeyRequired, err)
+	}
+	_, err = NewTrampolineErrorEncrypter(
+		router, pkt.EphemeralKey, pkt.EphemeralKey,
+	)
+	if err != ErrOnionKeyRequired {
+		t.Fatalf("expected error %v, got %v", ErrOnionKeyRequired, err)
+	}
+
+	// Keys that aren't held by the router can't be selected.
+	_, err = NewOnionErrorEncrypter(
+		router, pkt.EphemeralKey, WithOnionKey(pkt.EphemeralKey),
+	)
+	if err != ErrUnknownOnionKey {
+		t.Fatalf("expected error %v, got %v", ErrUnknownOnionKey, err)
+	}
+}
@@ -0,0 +1,547 @@
+package sphinx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/brsuite/brond/btcec"
+)
+
+const (
+	// onionMessageReplyPathType is the TLV type of the onion message
+	// payload record that carries a reply path for the recipient.
+	onionMessageReplyPathType = 2
+
+	// onionMessageEncryptedDataType is the TLV type of the onion message
+	// payload record that carries the encrypted_recipient_data.
+	onionMessageEncryptedDataType = 4
+
+	// MinOnionMessageCustomType is the smallest TLV type that may be used
+	// for the application records carried to the final hop of an onion
+	// message.
+	MinOnionMessageCustomType = 64
+
+	// encryptedDataPaddingType is the TLV type of the padding record
+	// within the encrypted data of a blinded hop.
+	encryptedDataPaddingType = 1
+
+	// encryptedDataShortChannelIDType is the TLV type of the
+	// short_channel_id record within the encrypted data of a blinded hop.
+	encryptedDataShortChannelIDType = 2
+
+	// encryptedDataNextNodeIDType is the TLV type of the next_node_id
+	// record within the encrypted data of a blinded hop.
+	encryptedDataNextNodeIDType = 4
+
+	// encryptedDataPathIDType is the TLV type of the path_id record within
+	// the encrypted data of a blinded hop.
+	encryptedDataPathIDType = 6
+
+	// encryptedDataNextBlindingOverrideType is the TLV type of the
+	// next_blinding_override record within the encrypted data of a blinded
+	// hop.
+	encryptedDataNextBlindingOverrideType = 8
+)
+
+// ErrMissingNextNode is returned when an onion message is to be forwarded,
+// but the encrypted data of the hop doesn't specify the next node.
+var ErrMissingNextNode = errors.New("onion message hop has no next node")
+
+// BlindedRouteData is the decrypted content of the encrypted_recipient_data
+// of a hop within a blinded route.
+type BlindedRouteData struct {
+	// ShortChannelID is the channel that should be used to reach the next
+	// hop, if any.
+	ShortChannelID *uint64
+
+	// NextNodeID is the node ID of the next hop, if any.
+	NextNodeID *btcec.PublicKey
+
+	// PathID is an identifier chosen by the recipient, allowing it to
+	// verify that the route was built by itself. It is only set for the
+	// final hop.
+	PathID []byte
+
+	// NextBlindingOverride, if set, replaces the blinding point that
+	// would otherwise be derived for the next hop. This allows a sender to
+	// concatenate its own blinded route with one provided by the
+	// recipient.
+	NextBlindingOverride *btcec.PublicKey
+
+	// Padding is the number of zero bytes to add to the encoded data, so
+	// that all hops of a route can be made to look alike.
+	Padding int
+}
+
+// Encode serializes the route data as a TLV stream.
+func (d *BlindedRouteData) Encode() []byte {
+	records := make(map[uint64][]byte)
+	if d.Padding > 0 {
+		records[encryptedDataPaddingType] = make([]byte, d.Padding)
+	}
+	if d.ShortChannelID != nil {
+		var scid [8]byte
+		binary.BigEndian.PutUint64(scid[:], *d.ShortChannelID)
+		records[encryptedDataShortChannelIDType] = scid[:]
+	}
+	if d.NextNodeID != nil {
+		records[encryptedDataNextNodeIDType] =
+			d.NextNodeID.SerializeCompressed()
+	}
+	if d.PathID != nil {
+		records[encryptedDataPathIDType] = d.PathID
+	}
+	if d.NextBlindingOverride != nil {
+		records[encryptedDataNextBlindingOverrideType] =
+			d.NextBlindingOverride.SerializeCompressed()
+	}
+
+	return EncodeTLVStream(records)
+}
+
+// DecodeBlindedRouteData parses the decrypted encrypted_recipient_data of a
+// blinded hop.
+func DecodeBlindedRouteData(b []byte) (*BlindedRouteData, error) {
+	records, err := DecodeTLVStream(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var data BlindedRouteData
+	if padding, ok := records[encryptedDataPaddingType]; ok {
+		data.Padding = len(padding)
+	}
+	if scid, ok := records[encryptedDataShortChannelIDType]; ok {
+		if len(scid) != 8 {
+			return nil, fmt.Errorf("invalid short channel id "+
+				"length: %d", len(scid))
+		}
+
+		shortChanID := binary.BigEndian.Uint64(scid)
+		data.ShortChannelID = &shortChanID
+	}
+	if rawKey, ok := records[encryptedDataNextNodeIDType]; ok {
+		data.NextNodeID, err = btcec.ParsePubKey(rawKey, btcec.S256())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pathID, ok := records[encryptedDataPathIDType]; ok {
+		data.PathID = pathID
+	}
+	if rawKey, ok := records[encryptedDataNextBlindingOverrideType]; ok {
+		data.NextBlindingOverride, err = btcec.ParsePubKey(
+			rawKey, btcec.S256(),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &data, nil
+}
+
+// BuildOnionMessagePath builds a blinded route for an onion message through
+// the passed nodes. Each hop is told the node ID of the next hop. If a
+// destination path is given, the final node of the route is instructed to
+// forward the message to its introduction node, overriding the blinding
+// point with that of the destination, and the hops of the destination path
+// are appended to the route. Otherwise, the final node of the route is the
+// recipient, and receives the passed path ID.
+func BuildOnionMessagePath(blindingKey *btcec.PrivateKey,
+	nodes []*btcec.PublicKey, pathID []byte,
+	destination *BlindedPath) (*BlindedPath, error) {
+
+	if len(nodes) == 0 {
+		return nil, errors.New("onion message path must contain at " +
+			"least one hop")
+	}
+
+	hops := make([]*HopInfo, len(nodes))
+	for i, node := range nodes {
+		var data BlindedRouteData
+		switch {
+		case i < len(nodes)-1:
+			data.NextNodeID = nodes[i+1]
+
+		case destination != nil:
+			data.NextNodeID = destination.IntroductionPoint
+			data.NextBlindingOverride = destination.BlindingPoint
+
+		default:
+			data.PathID = pathID
+		}
+
+		hops[i] = &HopInfo{
+			NodePub:   node,
+			PlainText: data.Encode(),
+		}
+	}
+
+	path, err := BuildBlindedPath(blindingKey, hops)
+	if err != nil {
+		return nil, err
+	}
+
+	if destination != nil {
+		path.BlindedHops = append(
+			path.BlindedHops, destination.BlindedHops...,
+		)
+	}
+
+	return path, nil
+}
+
+// OnionMessagePayload houses the contents of the payload that is delivered to
+// the final hop of an onion message.
+type OnionMessagePayload struct {
+	// ReplyPath is an optional blinded path that the recipient can use to
+	// reply to the message.
+	ReplyPath *BlindedPath
+
+	// CustomRecords holds the application records of the message, keyed
+	// by their TLV type. All types must be at least
+	// MinOnionMessageCustomType.
+	CustomRecords map[uint64][]byte
+}
+
+// OnionMessage is an onion_message as defined in BOLT 04. Unlike a payment
+// onion, every hop of an onion message is blinded, so the blinding point for
+// the receiving hop is transmitted alongside the onion packet.
+type OnionMessage struct {
+	// BlindingPoint is the blinding point of the receiving hop.
+	BlindingPoint *btcec.PublicKey
+
+	// Packet is the onion packet carrying the message.
+	Packet *OnionPacket
+}
+
+// NewOnionMessage creates a new onion message that travels along the passed
+// blinded path, delivering the payload to its final hop. The message must be
+// sent to the introduction node of the path. The routing info of the packet is
+// 1300 bytes if the payloads fit, and MaxRoutingInfoSize bytes otherwise.
+func NewOnionMessage(path *BlindedPath, sessionKey *btcec.PrivateKey,
+	payload *OnionMessagePayload,
+	pktFiller PacketFiller) (*OnionMessage, error) {
+
+	if len(path.BlindedHops) > NumMaxHops {
+		return nil, fmt.Errorf("onion message path of %d hops "+
+			"exceeds the maximum of %d", len(path.BlindedHops),
+			NumMaxHops)
+	}
+
+	var route PaymentPath
+	for i, hop := range path.BlindedHops {
+		records := map[uint64][]byte{
+			onionMessageEncryptedDataType: hop.CipherText,
+		}
+
+		if i == len(path.BlindedHops)-1 && payload != nil {
+			for recordType, value := range payload.CustomRecords {
+				if recordType < MinOnionMessageCustomType {
+					return nil, fmt.Errorf("invalid onion "+
+						"message record type: %d",
+						recordType)
+				}
+
+				records[recordType] = value
+			}
+
+			if payload.ReplyPath != nil {
+				var b bytes.Buffer
+				err := payload.ReplyPath.Encode(&b)
+				if err != nil {
+					return nil, err
+				}
+
+				records[onionMessageReplyPathType] = b.Bytes()
+			}
+		}
+
+		hopPayload, err := NewHopPayload(nil, EncodeTLVStream(records))
+		if err != nil {
+			return nil, err
+		}
+
+		route[i] = OnionHop{
+			NodePub:    *hop.BlindedNodePub,
+			HopPayload: hopPayload,
+		}
+	}
+
+	routingInfoLen := routingInfoSize
+	if route.TotalPayloadSize() > routingInfoLen {
+		routingInfoLen = MaxRoutingInfoSize
+	}
+
+	pkt, err := NewOnionPacket(
+		&route, sessionKey, nil, pktFiller,
+		WithRoutingInfoSize(routingInfoLen),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OnionMessage{
+		BlindingPoint: path.BlindingPoint,
+		Packet:        pkt,
+	}, nil
+}
+
+// Encode serializes the onion message into the passed io.Writer. The encoding
+// consists of the blinding point, followed by the u16 length prefixed onion
+// packet.
+func (m *OnionMessage) Encode(w io.Writer) error {
+	_, err := w.Write(m.BlindingPoint.SerializeCompressed())
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	if err := m.Packet.Encode(&b); err != nil {
+		return err
+	}
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(b.Len()))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// Decode populates the onion message from the serialized form written by
+// Encode. The size of the routing info is derived from the length prefix of
+// the onion packet.
+func (m *OnionMessage) Decode(r io.Reader) error {
+	var err error
+	m.BlindingPoint, err = readPubKey(r)
+	if err != nil {
+		return err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+
+	m.Packet, err = decodeSizedOnionPacket(
+		r, int(binary.BigEndian.Uint16(length[:])),
+	)
+
+	return err
+}
+
+// ProcessedOnionMessage encapsulates the resulting state generated after
+// processing an OnionMessage.
+type ProcessedOnionMessage struct {
+	// Action is MoreHops if the message should be forwarded, or ExitNode
+	// if we're the recipient of the message.
+	Action ProcessCode
+
+	// RouteData is the decrypted data that the creator of the blinded
+	// route left for us.
+	RouteData *BlindedRouteData
+
+	// NextNodeID is the node that NextMessage should be sent to.
+	//
+	// NOTE: This field will only be populated iff the above Action is
+	// MoreHops.
+	NextNodeID *btcec.PublicKey
+
+	// NextMessage is the onion message to forward to the next hop.
+	//
+	// NOTE: This field will only be populated iff the above Action is
+	// MoreHops.
+	NextMessage *OnionMessage
+
+	// Payload is the payload that was delivered to the final hop.
+	//
+	// NOTE: This field will only be populated iff the above Action is
+	// ExitNode.
+	Payload *OnionMessagePayload
+
+	// OnionKey is the public key of the router's onion key that the
+	// message was built against.
+	OnionKey *btcec.PublicKey
+}
+
+// ProcessOnionMessage processes an incoming onion message. The onion key of
+// the router is tweaked using the blinding point of the message, after which a
+// layer of the onion is peeled off, and the encrypted data left by the creator
+// of the route is decrypted. If we're not the final hop, the message to
+// forward to the next node is returned.
+//
+// As onion messages carry no CLTV, they aren't checked against the replay log
+// unless the WithReplayProtection option is passed. Otherwise, they're checked
+// against the timed replay log set using WithTimedReplayLog, if any.
+func (r *Router) ProcessOnionMessage(msg *OnionMessage,
+	opts ...ProcessOnionOpt) (*ProcessedOnionMessage, error) {
+
+	cfg := newProcessOnionCfg(opts)
+
+	var buf [maxStackOnionKeys]SingleKeyECDH
+	keys, err := r.candidateKeys(cfg, buf[:0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Try each of our onion keys in turn, until we find the one the
+	// message was built against.
+	var (
+		onionKey                     SingleKeyECDH
+		blindingSecret, sharedSecret Hash256
+		nextPkt                      *OnionPacket
+		hopPayload                   HopPayload
+	)
+	for _, key := range keys {
+		gen := newSecretGenerator(cfg.ctx, key)
+		blindingSecret, err = gen.generateSharedSecret(
+			msg.BlindingPoint,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sharedSecret, err = tweakedOnionSharedSecret(
+			msg.Packet.EphemeralKey, &blindingSecret, gen,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		nextPkt, hopPayload, err = unwrapPacket(
+			msg.Packet, &sharedSecret, nil,
+		)
+		if err == ErrInvalidOnionHMAC {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		onionKey = key
+		break
+	}
+	if onionKey == nil {
+		return nil, ErrInvalidOnionHMAC
+	}
+
+	if hopPayload.Type != PayloadTLV {
+		return nil, errors.New("onion message payload must be a " +
+			"TLV payload")
+	}
+
+	records, err := DecodeTLVStream(hopPayload.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherText, ok := records[onionMessageEncryptedDataType]
+	if !ok {
+		return nil, ErrMissingRecipientData
+	}
+
+	plainText, err := decryptBlindedHopData(&blindingSecret, cipherText)
+	if err != nil {
+		return nil, err
+	}
+
+	routeData, err := DecodeBlindedRouteData(plainText)
+	if err != nil {
+		return nil, err
+	}
+
+	processed := &ProcessedOnionMessage{
+		Action:    MoreHops,
+		RouteData: routeData,
+		OnionKey:  onionKey.PubKey(),
+	}
+	if bytes.Equal(zeroHMAC[:], hopPayload.HMAC[:]) {
+		processed.Action = ExitNode
+	}
+
+	switch processed.Action {
+	case ExitNode:
+		processed.Payload, err = parseOnionMessagePayload(records)
+		if err != nil {
+			return nil, err
+		}
+
+	case MoreHops:
+		if routeData.NextNodeID == nil {
+			return nil, ErrMissingNextNode
+		}
+
+		nextBlinding := routeData.NextBlindingOverride
+		if nextBlinding == nil {
+			nextBlinding = nextBlindingPoint(
+				msg.BlindingPoint, &blindingSecret,
+			)
+		}
+
+		processed.NextNodeID = routeData.NextNodeID
+		processed.NextMessage = &OnionMessage{
+			BlindingPoint: nextBlinding,
+			Packet:        nextPkt,
+		}
+	}
+
+	// Only once the message has been fully processed do we consult the
+	// replay log, if the caller asked us to, or the timed replay log.
+	switch {
+	case cfg.replayValue != nil:
+		hashPrefix := hashSharedSecret(&sharedSecret)
+		if err := r.log.Put(hashPrefix, *cfg.replayValue); err != nil {
+			return nil, err
+		}
+
+	case r.timedLog != nil:
+		hashPrefix := hashSharedSecret(&sharedSecret)
+		if err := r.timedLog.put(hashPrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	return processed, nil
+}
+
+// parseOnionMessagePayload extracts the reply path and application records
+// from the payload records of the final hop of an onion message. An error
+// wrapping ErrUnknownRequiredType is returned if the payload contains a record
+// of an unknown even type.
+func parseOnionMessagePayload(
+	records map[uint64][]byte) (*OnionMessagePayload, error) {
+
+	payload := &OnionMessagePayload{
+		CustomRecords: make(map[uint64][]byte),
+	}
+	for recordType, value := range records {
+		switch {
+		case recordType == onionMessageReplyPathType:
+			payload.ReplyPath = &BlindedPath{}
+			err := payload.ReplyPath.Decode(bytes.NewReader(value))
+			if err != nil {
+				return nil, err
+			}
+
+		// The encrypted data has already been consumed while
+		// processing the message.
+		case recordType == onionMessageEncryptedDataType:
+
+		case recordType >= MinOnionMessageCustomType:
+			payload.CustomRecords[recordType] = value
+
+		case recordType%2 == 0:
+			return nil, fmt.Errorf("%w: %d",
+				ErrUnknownRequiredType, recordType)
+		}
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,310 @@
+package sphinx
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/brsuite/brond/btcec"
+	"github.com/brsuite/brond/chaincfg"
+)
+
+// newTestRouters creates and starts a set of routers to process onion
+// packets, returning them along with their public keys.
+func newTestRouters(t *testing.T, numNodes int) ([]*Router,
+	[]*btcec.PublicKey) {
+
+	nodes := make([]*Router, numNodes)
+	nodeKeys := make([]*btcec.PublicKey, numNodes)
+	for i := 0; i < numNodes; i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+
+		nodes[i] = NewRouter(
+			&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+			NewMemoryReplayLog(),
+		)
+		nodeKeys[i] = privKey.PubKey()
+
+		if err := nodes[i].Start(); err != nil {
+			t.Fatalf("unable to start router: %v", err)
+		}
+	}
+
+	return nodes, nodeKeys
+}
+
+// relayOnionMessage sends the onion message through the passed routers in
+// order, asserting that each forwards it to the next, and returns the message
+// as processed by the final router.
+func relayOnionMessage(t *testing.T, msg *OnionMessage, nodes []*Router,
+	nodeKeys []*btcec.PublicKey) *ProcessedOnionMessage {
+
+	for i, node := range nodes {
+		// Each hop receives the message over the wire.
+		var b bytes.Buffer
+		if err := msg.Encode(&b); err != nil {
+			t.Fatalf("hop %d: unable to encode message: %v", i, err)
+		}
+		msg = &OnionMessage{}
+		if err := msg.Decode(&b); err != nil {
+			t.Fatalf("hop %d: unable to decode message: %v", i, err)
+		}
+
+		processed, err := node.ProcessOnionMessage(msg)
+		if err != nil {
+			t.Fatalf("hop %d: unable to process message: %v", i, err)
+		}
+
+		if i == len(nodes)-1 {
+			if processed.Action != ExitNode {
+				t.Fatalf("expected exit node, got %v",
+					processed.Action)
+			}
+
+			return processed
+		}
+
+		if processed.Action != MoreHops {
+			t.Fatalf("hop %d: expected more hops, got %v", i,
+				processed.Action)
+		}
+		if !processed.NextNodeID.IsEqual(nodeKeys[i+1]) {
+			t.Fatalf("hop %d: next node mismatch", i)
+		}
+
+		msg = processed.NextMessage
+	}
+
+	return nil
+}
+
+// TestOnionMessageReplyPath tests that an onion message can be sent along a
+// route that is concatenated with a blinded path built by the recipient, and
+// that the recipient can answer using the reply path carried in the message.
+func TestOnionMessageReplyPath(t *testing.T) {
+	t.Parallel()
+
+	const numNodes = 5
+
+	nodes, nodeKeys := newTestRouters(t, numNodes)
+	for _, node := range nodes {
+		defer node.Stop()
+	}
+
+	newKey := func() *btcec.PrivateKey {
+		key, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		return key
+	}
+
+	// The recipient publishes a blinded path from node 2 to itself, while
+	// the sender reaches its introduction node through nodes 0 and 1.
+	recipientPathID := []byte("recipient path")
+	recipientPath, err := BuildOnionMessagePath(
+		newKey(), nodeKeys[2:], recipientPathID, nil,
+	)
+	if err != nil {
+		t.Fatalf("unable to build recipient path: %v", err)
+	}
+
+	path, err := BuildOnionMessagePath(
+		newKey(), nodeKeys[:2], nil, recipientPath,
+	)
+	if err != nil {
+		t.Fatalf("unable to build path: %v", err)
+	}
+	if len(path.BlindedHops) != numNodes {
+		t.Fatalf("expected %d hops, got %d", numNodes,
+			len(path.BlindedHops))
+	}
+
+	// The sender includes a reply path leading back from node 4 to node
+	// 0 through node 1.
+	senderPathID := []byte("sender path")
+	replyPath, err := BuildOnionMessagePath(
+		newKey(), []*btcec.PublicKey{nodeKeys[1], nodeKeys[0]},
+		senderPathID, nil,
+	)
+	if err != nil {
+		t.Fatalf("unable to build reply path: %v", err)
+	}
+
+	payload := &OnionMessagePayload{
+		ReplyPath: replyPath,
+		CustomRecords: map[uint64][]byte{
+			64: []byte("invoice_request"),
+		},
+	}
+	msg, err := NewOnionMessage(
+		path, newKey(), payload, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion message: %v", err)
+	}
+	if len(msg.Packet.RoutingInfo) != routingInfoSize {
+		t.Fatalf("expected routing info of %d bytes, got %d",
+			routingInfoSize, len(msg.Packet.RoutingInfo))
+	}
+
+	processed := relayOnionMessage(t, msg, nodes, nodeKeys)
+	if !bytes.Equal(processed.RouteData.PathID, recipientPathID) {
+		t.Fatalf("recipient path id mismatch")
+	}
+	if !bytes.Equal(processed.Payload.CustomRecords[64],
+		payload.CustomRecords[64]) {
+
+		t.Fatalf("custom record mismatch")
+	}
+
+	// The recipient now answers through the reply path it received.
+	reply, err := NewOnionMessage(
+		processed.Payload.ReplyPath, newKey(),
+		&OnionMessagePayload{
+			CustomRecords: map[uint64][]byte{66: []byte("invoice")},
+		},
+		DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create reply: %v", err)
+	}
+
+	processed = relayOnionMessage(
+		t, reply, []*Router{nodes[1], nodes[0]},
+		[]*btcec.PublicKey{nodeKeys[1], nodeKeys[0]},
+	)
+	if !bytes.Equal(processed.RouteData.PathID, senderPathID) {
+		t.Fatalf("sender path id mismatch")
+	}
+	if !bytes.Equal(processed.Payload.CustomRecords[66],
+		[]byte("invoice")) {
+
+		t.Fatalf("reply record mismatch")
+	}
+}
+
+// TestOnionMessageLargePayload tests that an onion message whose payloads
+// don't fit within the regular routing info uses the large packet size.
+func TestOnionMessageLargePayload(t *testing.T) {
+	t.Parallel()
+
+	nodes, nodeKeys := newTestRouters(t, 2)
+	for _, node := range nodes {
+		defer node.Stop()
+	}
+
+	blindingKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'B'}, 32),
+	)
+	path, err := BuildOnionMessagePath(blindingKey, nodeKeys, nil, nil)
+	if err != nil {
+		t.Fatalf("unable to build path: %v", err)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	largeRecord := bytes.Repeat([]byte{0x42}, 2000)
+	msg, err := NewOnionMessage(path, sessionKey, &OnionMessagePayload{
+		CustomRecords: map[uint64][]byte{100: largeRecord},
+	}, DeterministicPacketFiller)
+	if err != nil {
+		t.Fatalf("unable to create onion message: %v", err)
+	}
+	if len(msg.Packet.RoutingInfo) != MaxRoutingInfoSize {
+		t.Fatalf("expected routing info of %d bytes, got %d",
+			MaxRoutingInfoSize, len(msg.Packet.RoutingInfo))
+	}
+
+	processed := relayOnionMessage(t, msg, nodes, nodeKeys)
+	if !bytes.Equal(processed.Payload.CustomRecords[100], largeRecord) {
+		t.Fatalf("large record mismatch")
+	}
+
+	// Application records must not collide with the types reserved by
+	// the protocol.
+	_, err = NewOnionMessage(path, sessionKey, &OnionMessagePayload{
+		CustomRecords: map[uint64][]byte{10: {1}},
+	}, DeterministicPacketFiller)
+	if err == nil {
+		t.Fatalf("expected reserved record type to be rejected")
+	}
+}
+
+// TestOnionMessageReplayProtection asserts that onion messages are only
+// checked against the replay log when replay protection is requested.
+func TestOnionMessageReplayProtection(t *testing.T) {
+	t.Parallel()
+
+	nodes, nodeKeys := newTestRouters(t, 1)
+	defer nodes[0].Stop()
+
+	blindingKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'B'}, 32),
+	)
+	path, err := BuildOnionMessagePath(blindingKey, nodeKeys, nil, nil)
+	if err != nil {
+		t.Fatalf("unable to build path: %v", err)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	msg, err := NewOnionMessage(
+		path, sessionKey, nil, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion message: %v", err)
+	}
+
+	// Without replay protection, the same message can be processed any
+	// number of times.
+	for i := 0; i < 2; i++ {
+		if _, err := nodes[0].ProcessOnionMessage(msg); err != nil {
+			t.Fatalf("unable to process message: %v", err)
+		}
+	}
+
+	_, err = nodes[0].ProcessOnionMessage(msg, WithReplayProtection(100))
+	if err != nil {
+		t.Fatalf("unable to process message: %v", err)
+	}
+
+	_, err = nodes[0].ProcessOnionMessage(msg, WithReplayProtection(100))
+	if err != ErrReplayedPacket {
+		t.Fatalf("expected ErrReplayedPacket, got %v", err)
+	}
+}
+
+// TestOnionMessagePayloadUnknownTypes tests that the payload of the final hop
+// of an onion message is rejected if it contains a record of an unknown even
+// type, while unknown odd types are ignored.
+func TestOnionMessagePayloadUnknownTypes(t *testing.T) {
+	t.Parallel()
+
+	records := map[uint64][]byte{
+		onionMessageEncryptedDataType: []byte("encrypted data"),
+		7:                             []byte("odd"),
+		64:                            []byte("custom"),
+	}
+	payload, err := parseOnionMessagePayload(records)
+	if err != nil {
+		t.Fatalf("unable to parse payload: %v", err)
+	}
+	if len(payload.CustomRecords) != 1 ||
+		!bytes.Equal(payload.CustomRecords[64], records[64]) {
+
+		t.Fatalf("unexpected custom records: %v",
+			payload.CustomRecords)
+	}
+
+	records[6] = []byte("even")
+	_, err = parseOnionMessagePayload(records)
+	if !errors.Is(err, ErrUnknownRequiredType) {
+		t.Fatalf("expected ErrUnknownRequiredType, got %v", err)
+	}
+}
@@ -11,17 +11,18 @@ import (
 // stream of random bytes derived from a CSPRNG to fill out the starting packet
 // in order to ensure we don't leak information on the true route length to the
 // receiver. The packet filler may also use the session key to generate a set
-// of filler bytes if it wishes to be deterministic.
-type PacketFiller func(*btcec.PrivateKey, *[routingInfoSize]byte) error
+// of filler bytes if it wishes to be deterministic. The passed mix header has
+// the routing info size selected for the packet under construction.
+type PacketFiller func(*btcec.PrivateKey, []byte) error
 
 // RandPacketFiller is a packet filler that reads a set of random bytes from a
 // CSPRNG.
-func RandPacketFiller(_ *btcec.PrivateKey, mixHeader *[routingInfoSize]byte) error {
+func RandPacketFiller(_ *btcec.PrivateKey, mixHeader []byte) error {
 	// Read out random bytes to fill out the rest of the starting packet
 	// after the hop payload for the final node. This mitigates a privacy
 	// leak that may reveal a lower bound on the true path length to the
 	// receiver.
-	if _, err := rand.Read(mixHeader[:]); err != nil {
+	if _, err := rand.Read(mixHeader); err != nil {
 		return err
 	}
 
@@ -31,7 +32,7 @@ func RandPacketFiller(_ *btcec.PrivateKey, mixHeader *[routingInfoSize]byte) err
 // BlankPacketFiller is a packet filler that doesn't attempt to fill out the
 // packet at all. It should ONLY be used for generating test vectors or other
 // instances that required deterministic packet generation.
-func BlankPacketFiller(_ *btcec.PrivateKey, _ *[routingInfoSize]byte) error {
+func BlankPacketFiller(_ *btcec.PrivateKey, _ []byte) error {
 	return nil
 }
 
@@ -39,7 +40,7 @@ func BlankPacketFiller(_ *btcec.PrivateKey, _ *[routingInfoSize]byte) error {
 // set of filler bytes by using chacha20 with a key derived from the session
 // key.
 func DeterministicPacketFiller(sessionKey *btcec.PrivateKey,
-	mixHeader *[routingInfoSize]byte) error {
+	mixHeader []byte) error {
 
 	// First, we'll generate a new key that'll be used to generate some
 	// random bytes for our padding purposes. To derive this new key, we
@@ -55,7 +56,7 @@ func DeterministicPacketFiller(sessionKey *btcec.PrivateKey,
 	if err != nil {
 		return err
 	}
-	padCipher.XORKeyStream(mixHeader[:], mixHeader[:])
+	padCipher.XORKeyStream(mixHeader, mixHeader)
 
 	return nil
 }
@@ -96,6 +96,30 @@ func (hd *HopData) Decode(r io.Reader) error {
 	return err
 }
 
+// decodeBytes deserializes the HopData from the start of the passed slice. It
+// behaves exactly like Decode, without the need for an intermediate reader.
+func (hd *HopData) decodeBytes(b []byte) error {
+	var (
+		amt  [8]byte
+		cltv [4]byte
+		err  error
+	)
+	for _, field := range [][]byte{
+		hd.Realm[:], hd.NextAddress[:], amt[:], cltv[:],
+		hd.ExtraBytes[:],
+	} {
+		b, err = readBytes(field, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	hd.ForwardAmount = binary.BigEndian.Uint64(amt[:])
+	hd.OutgoingCltv = binary.BigEndian.Uint32(cltv[:])
+
+	return nil
+}
+
 // PayloadType denotes the type of the payload included in the onion packet.
 // Serialization of a raw HopPayload will depend on the payload type, as some
 // include a varint length prefix, while others just encode the raw payload.
@@ -131,16 +155,57 @@ type HopPayload struct {
 	HMAC [HMACSize]byte
 }
 
+// HopPayloadOpt is a functional option that can be used to modify the
+// construction of a hop payload.
+type HopPayloadOpt func(*hopPayloadCfg)
+
+// hopPayloadCfg houses the set of optional arguments that can be passed in
+// when constructing a hop payload.
+type hopPayloadCfg struct {
+	// tlvPayload is the typed TLV payload to encode for the hop.
+	tlvPayload *TLVPayload
+}
+
+// WithTLVPayload is a functional option that builds a TLV hop payload from the
+// passed typed payload, rather than from a raw EOB. It can't be combined with
+// either hop data or an EOB.
+func WithTLVPayload(payload *TLVPayload) HopPayloadOpt {
+	return func(cfg *hopPayloadCfg) {
+		cfg.tlvPayload = payload
+	}
+}
+
 // NewHopPayload creates a new hop payload given an optional set of forwarding
 // instructions for a hop, and a set of optional opaque extra onion bytes to
 // drop off at the target hop. If both values are not specified, then an error
-// is returned.
-func NewHopPayload(hopData *HopData, eob []byte) (HopPayload, error) {
+// is returned. Alternatively, a typed TLV payload may be passed using
+// WithTLVPayload.
+func NewHopPayload(hopData *HopData, eob []byte,
+	opts ...HopPayloadOpt) (HopPayload, error) {
+
 	var (
 		h HopPayload
 		b bytes.Buffer
 	)
 
+	cfg := &hopPayloadCfg{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if cfg.tlvPayload != nil {
+		if hopData != nil || len(eob) > 0 {
+			return h, fmt.Errorf("cannot provide a tlv payload " +
+				"along with hop data or an eob")
+		}
+
+		var err error
+		eob, err = cfg.tlvPayload.Encode()
+		if err != nil {
+			return h, err
+		}
+	}
+
 	// We can't proceed if neither the hop data or the EOB has been
 	// specified by the caller.
 	switch {
@@ -280,14 +345,83 @@ func (hp *HopPayload) Decode(r io.Reader) error {
 	return nil
 }
 
+// decodeBytes unpacks an encoded HopPayload from the start of the passed slice
+// into the target HopPayload. It behaves exactly like Decode, but reads
+// straight from the slice rather than through a buffered reader. The payload
+// is copied, so the slice may be reused afterwards.
+func (hp *HopPayload) decodeBytes(b []byte) error {
+	if len(b) == 0 {
+		return io.EOF
+	}
+
+	var payloadSize uint32
+
+	switch int(b[0]) {
+	// If the first byte is a zero (the realm), then this is the normal
+	// payload.
+	case 0x00:
+		payloadSize = LegacyHopDataSize - HMACSize
+		hp.Type = PayloadLegacy
+
+	// Otherwise, this is the TLV based payload type, prefixed by its
+	// length encoded as a var-int.
+	default:
+		varInt, n, err := decodeVarInt(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+
+		payloadSize = uint32(varInt)
+		hp.Type = PayloadTLV
+	}
+
+	// The size is chosen by the sender, so it's checked against the
+	// remaining bytes before the payload is allocated.
+	if uint64(payloadSize) > uint64(len(b)) {
+		if len(b) == 0 {
+			return io.EOF
+		}
+
+		return io.ErrUnexpectedEOF
+	}
+
+	hp.Payload = make([]byte, payloadSize)
+	b, err := readBytes(hp.Payload, b)
+	if err != nil {
+		return err
+	}
+	_, err = readBytes(hp.HMAC[:], b)
+
+	return err
+}
+
+// readBytes fills dst from the start of b, returning the remainder of b. Like
+// io.ReadFull, it returns io.EOF if b is empty, and io.ErrUnexpectedEOF if b
+// is too short to fill dst.
+func readBytes(dst, b []byte) ([]byte, error) {
+	switch {
+	case len(dst) == 0:
+		return b, nil
+
+	case len(b) == 0:
+		return nil, io.EOF
+
+	case len(b) < len(dst):
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	copy(dst, b)
+
+	return b[len(dst):], nil
+}
+
 // HopData attempts to extract a set of forwarding instructions from the target
 // HopPayload. If the realm isn't what we expect, then an error is returned.
 // This method also returns the left over EOB that remain after the hop data
 // has been parsed. Callers may want to map this blob into something more
 // concrete.
 func (hp *HopPayload) HopData() (*HopData, error) {
-	payloadReader := bytes.NewBuffer(hp.Payload)
-
 	// If this isn't the "base" realm, then we can't extract the expected
 	// hop payload structure from the payload.
 	if hp.Type != PayloadLegacy {
@@ -297,7 +431,7 @@ func (hp *HopPayload) HopData() (*HopData, error) {
 	// Now that we know the payload has the structure we expect, we'll
 	// decode the payload into the HopData.
 	var hd HopData
-	if err := hd.Decode(payloadReader); err != nil {
+	if err := hd.decodeBytes(hp.Payload); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,238 @@
+package sphinx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/brsuite/brond/btcec"
+)
+
+const (
+	// amtToForwardType is the TLV type of the amt_to_forward record.
+	amtToForwardType = 2
+
+	// outgoingCltvType is the TLV type of the outgoing_cltv_value record.
+	outgoingCltvType = 4
+
+	// shortChannelIDType is the TLV type of the short_channel_id record.
+	shortChannelIDType = 6
+
+	// paymentDataType is the TLV type of the payment_data record.
+	paymentDataType = 8
+
+	// paymentMetadataType is the TLV type of the payment_metadata record.
+	paymentMetadataType = 16
+
+	// totalAmountType is the TLV type of the total_amount_msat record.
+	totalAmountType = 18
+
+	// MinCustomRecordType is the smallest TLV type that may be used for
+	// the custom records of a hop payload. Records of these types are
+	// passed to the application as is, no matter whether they are even
+	// or odd.
+	MinCustomRecordType = 65536
+
+	// paymentSecretSize is the size of the payment secret carried within
+	// the payment_data record.
+	paymentSecretSize = 32
+)
+
+// ErrUnknownRequiredType is returned when a TLV payload contains a record of
+// an unknown even type. Following the "it's ok to be odd" rule, unknown odd
+// types are ignored instead.
+var ErrUnknownRequiredType = errors.New("unknown required tlv type")
+
+// PaymentData is the content of the payment_data record, which is included in
+// the payload of the final hop of a payment.
+type PaymentData struct {
+	// PaymentSecret is the secret of the invoice being paid.
+	PaymentSecret [paymentSecretSize]byte
+
+	// TotalMsat is the total amount of the payment, which may be split
+	// over several HTLCs.
+	TotalMsat uint64
+}
+
+// TLVPayload is a typed representation of a BOLT 04 TLV hop payload. Each of
+// the pointer and slice fields is optional, and only encoded if set.
+type TLVPayload struct {
+	// AmtToForward is the amount in millisatoshi to forward to the next
+	// hop, or to pay to the final hop.
+	AmtToForward *uint64
+
+	// OutgoingCltv is the CLTV value that the outgoing HTLC should carry.
+	OutgoingCltv *uint32
+
+	// ShortChannelID is the channel that should be used to forward the
+	// HTLC to the next hop.
+	ShortChannelID *uint64
+
+	// PaymentData carries the payment secret and the total amount of the
+	// payment to the final hop.
+	PaymentData *PaymentData
+
+	// EncryptedRecipientData is the encrypted data of a hop within a
+	// blinded route.
+	EncryptedRecipientData []byte
+
+	// CurrentBlindingPoint is the blinding point handed to the
+	// introduction node of a blinded route.
+	CurrentBlindingPoint *btcec.PublicKey
+
+	// PaymentMetadata is the metadata of the invoice being paid.
+	PaymentMetadata []byte
+
+	// TotalAmount is the total amount of a payment to a blinded route.
+	TotalAmount *uint64
+
+	// CustomRecords holds the records with a type of at least
+	// MinCustomRecordType, keyed by their type.
+	CustomRecords map[uint64][]byte
+}
+
+// Encode serializes the payload as a canonical TLV stream. An error is
+// returned if any of the custom records collides with the types defined by
+// BOLT 04.
+func (p *TLVPayload) Encode() ([]byte, error) {
+	records := make(map[uint64][]byte, len(p.CustomRecords))
+	for recordType, value := range p.CustomRecords {
+		if recordType < MinCustomRecordType {
+			return nil, fmt.Errorf("custom record type %d is below "+
+				"%d", recordType, MinCustomRecordType)
+		}
+
+		records[recordType] = value
+	}
+
+	if p.AmtToForward != nil {
+		records[amtToForwardType] = encodeTruncatedInt(*p.AmtToForward)
+	}
+	if p.OutgoingCltv != nil {
+		records[outgoingCltvType] = encodeTruncatedInt(
+			uint64(*p.OutgoingCltv),
+		)
+	}
+	if p.ShortChannelID != nil {
+		var scid [8]byte
+		binary.BigEndian.PutUint64(scid[:], *p.ShortChannelID)
+		records[shortChannelIDType] = scid[:]
+	}
+	if p.PaymentData != nil {
+		paymentData := make([]byte, 0, paymentSecretSize+8)
+		paymentData = append(
+			paymentData, p.PaymentData.PaymentSecret[:]...,
+		)
+		paymentData = append(
+			paymentData,
+			encodeTruncatedInt(p.PaymentData.TotalMsat)...,
+		)
+		records[paymentDataType] = paymentData
+	}
+	if p.EncryptedRecipientData != nil {
+		records[encryptedRecipientDataType] = p.EncryptedRecipientData
+	}
+	if p.CurrentBlindingPoint != nil {
+		records[currentBlindingPointType] =
+			p.CurrentBlindingPoint.SerializeCompressed()
+	}
+	if p.PaymentMetadata != nil {
+		records[paymentMetadataType] = p.PaymentMetadata
+	}
+	if p.TotalAmount != nil {
+		records[totalAmountType] = encodeTruncatedInt(*p.TotalAmount)
+	}
+
+	return EncodeTLVStream(records), nil
+}
+
+// DecodeTLVPayload parses a BOLT 04 TLV hop payload. The records of the stream
+// must be in canonical order, and the payload is rejected if it contains a
+// record of an unknown even type.
+func DecodeTLVPayload(b []byte) (*TLVPayload, error) {
+	records, err := DecodeTLVStream(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var p TLVPayload
+	for recordType, value := range records {
+		switch recordType {
+		case amtToForwardType:
+			amt, err := decodeTruncatedInt(value, 8)
+			if err != nil {
+				return nil, err
+			}
+			p.AmtToForward = &amt
+
+		case outgoingCltvType:
+			cltv, err := decodeTruncatedInt(value, 4)
+			if err != nil {
+				return nil, err
+			}
+			outgoingCltv := uint32(cltv)
+			p.OutgoingCltv = &outgoingCltv
+
+		case shortChannelIDType:
+			if len(value) != 8 {
+				return nil, fmt.Errorf("invalid short channel "+
+					"id length: %d", len(value))
+			}
+			scid := binary.BigEndian.Uint64(value)
+			p.ShortChannelID = &scid
+
+		case paymentDataType:
+			if len(value) < paymentSecretSize {
+				return nil, fmt.Errorf("invalid payment data "+
+					"length: %d", len(value))
+			}
+
+			var paymentData PaymentData
+			copy(paymentData.PaymentSecret[:], value)
+			paymentData.TotalMsat, err = decodeTruncatedInt(
+				value[paymentSecretSize:], 8,
+			)
+			if err != nil {
+				return nil, err
+			}
+			p.PaymentData = &paymentData
+
+		case encryptedRecipientDataType:
+			p.EncryptedRecipientData = value
+
+		case currentBlindingPointType:
+			p.CurrentBlindingPoint, err = btcec.ParsePubKey(
+				value, btcec.S256(),
+			)
+			if err != nil {
+				return nil, err
+			}
+
+		case paymentMetadataType:
+			p.PaymentMetadata = value
+
+		case totalAmountType:
+			total, err := decodeTruncatedInt(value, 8)
+			if err != nil {
+				return nil, err
+			}
+			p.TotalAmount = &total
+
+		default:
+			if recordType >= MinCustomRecordType {
+				if p.CustomRecords == nil {
+					p.CustomRecords = make(map[uint64][]byte)
+				}
+				p.CustomRecords[recordType] = value
+				continue
+			}
+
+			if recordType%2 == 0 {
+				return nil, fmt.Errorf("%w: %d",
+					ErrUnknownRequiredType, recordType)
+			}
+		}
+	}
+
+	return &p, nil
+}
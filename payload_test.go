@@ -0,0 +1,192 @@
+package sphinx
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/brsuite/brond/btcec"
+)
+
+// TestTLVPayloadEncodeDecode tests that a typed TLV payload survives a round
+// trip through its encoding, as well as through a processed onion packet.
+func TestTLVPayloadEncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	blindingKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'B'}, 32),
+	)
+
+	var (
+		amt         uint64 = 1000
+		cltv        uint32 = 144
+		scid        uint64 = 0x0102030405060708
+		totalAmount uint64 = 5000
+		zeroAmount  uint64
+		paymentData = &PaymentData{TotalMsat: 1 << 40}
+	)
+	copy(paymentData.PaymentSecret[:], bytes.Repeat([]byte{'S'}, 32))
+
+	payloads := []*TLVPayload{
+		{
+			AmtToForward:   &amt,
+			OutgoingCltv:   &cltv,
+			ShortChannelID: &scid,
+		},
+		{
+			AmtToForward:    &zeroAmount,
+			OutgoingCltv:    &cltv,
+			PaymentData:     paymentData,
+			PaymentMetadata: []byte("metadata"),
+			CustomRecords: map[uint64][]byte{
+				MinCustomRecordType:     []byte("custom"),
+				MinCustomRecordType + 1: {},
+			},
+		},
+	}
+
+	// The route blinding records are only exercised through the
+	// encoding, as the recipient data can't be decrypted by the hop.
+	blindedPayload := &TLVPayload{
+		EncryptedRecipientData: []byte("recipient data"),
+		CurrentBlindingPoint:   blindingKey.PubKey(),
+		TotalAmount:            &totalAmount,
+	}
+	for _, payload := range append(payloads, blindedPayload) {
+		b, err := payload.Encode()
+		if err != nil {
+			t.Fatalf("unable to encode payload: %v", err)
+		}
+
+		decoded, err := DecodeTLVPayload(b)
+		if err != nil {
+			t.Fatalf("unable to decode payload: %v", err)
+		}
+
+		if !reflect.DeepEqual(decoded, payload) {
+			t.Fatalf("payload mismatch: expected %v, got %v",
+				payload, decoded)
+		}
+	}
+
+	nodes, nodeKeys := newTestRouters(t, len(payloads))
+	for _, node := range nodes {
+		defer node.Stop()
+	}
+
+	var route PaymentPath
+	for i, payload := range payloads {
+		hopPayload, err := NewHopPayload(
+			nil, nil, WithTLVPayload(payload),
+		)
+		if err != nil {
+			t.Fatalf("unable to create hop payload: %v", err)
+		}
+
+		route[i] = OnionHop{
+			NodePub:    *nodeKeys[i],
+			HopPayload: hopPayload,
+		}
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	pkt, err := NewOnionPacket(
+		&route, sessionKey, nil, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	for i, node := range nodes {
+		processed, err := node.ProcessOnionPacket(pkt, nil, uint32(i))
+		if err != nil {
+			t.Fatalf("hop %d: unable to process packet: %v", i, err)
+		}
+
+		parsed, err := processed.ParsedPayload()
+		if err != nil {
+			t.Fatalf("hop %d: unable to parse payload: %v", i, err)
+		}
+
+		if !reflect.DeepEqual(parsed, payloads[i]) {
+			t.Fatalf("hop %d: payload mismatch: expected %v, got %v",
+				i, payloads[i], parsed)
+		}
+
+		pkt = processed.NextPacket
+	}
+
+	// Legacy payloads can't be parsed as a TLV payload.
+	legacy := &ProcessedPacket{Payload: HopPayload{Type: PayloadLegacy}}
+	if _, err := legacy.ParsedPayload(); err == nil {
+		t.Fatalf("expected legacy payload to be rejected")
+	}
+}
+
+// TestDecodeTLVPayloadErrors asserts that invalid TLV payloads are rejected.
+func TestDecodeTLVPayloadErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name        string
+		payload     []byte
+		expectedErr error
+	}{
+		{
+			name:        "unsorted records",
+			payload:     []byte{4, 1, 1, 2, 1, 1},
+			expectedErr: ErrTLVNotSorted,
+		},
+		{
+			name:        "duplicate records",
+			payload:     []byte{2, 1, 1, 2, 1, 1},
+			expectedErr: ErrTLVNotSorted,
+		},
+		{
+			name:        "unknown even type",
+			payload:     []byte{20, 1, 1},
+			expectedErr: ErrUnknownRequiredType,
+		},
+		{
+			name:    "unknown odd type",
+			payload: []byte{21, 1, 1},
+		},
+		{
+			name:        "non-minimal amount",
+			payload:     []byte{2, 2, 0, 1},
+			expectedErr: ErrNonCanonicalTruncatedInt,
+		},
+		{
+			name:        "oversized cltv",
+			payload:     []byte{4, 5, 1, 1, 1, 1, 1},
+			expectedErr: ErrNonCanonicalTruncatedInt,
+		},
+	}
+
+	for _, testCase := range testCases {
+		_, err := DecodeTLVPayload(testCase.payload)
+		if !errors.Is(err, testCase.expectedErr) {
+			t.Fatalf("%s: expected error %v, got %v",
+				testCase.name, testCase.expectedErr, err)
+		}
+	}
+
+	// Custom records may not shadow the types defined by the spec.
+	_, err := NewHopPayload(nil, nil, WithTLVPayload(&TLVPayload{
+		CustomRecords: map[uint64][]byte{2: {1}},
+	}))
+	if err == nil {
+		t.Fatalf("expected invalid custom record type to be rejected")
+	}
+
+	// Nor can a typed payload be combined with a raw one.
+	_, err = NewHopPayload(nil, []byte{2, 1, 1}, WithTLVPayload(
+		&TLVPayload{},
+	))
+	if err == nil {
+		t.Fatalf("expected tlv payload and eob to be rejected")
+	}
+}
@@ -2,21 +2,31 @@ package sphinx
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
+	"math"
 )
 
+// replaySet32Marker is the first byte of the encoding of a replay set holding
+// sequence numbers that don't fit in 16 bits.
+const replaySet32Marker byte = 0xff
+
+// ErrInvalidReplaySet is returned when decoding a replay set that is
+// malformed.
+var ErrInvalidReplaySet = errors.New("invalid replay set encoding")
+
 // ReplaySet is a data structure used to efficiently record the occurrence of
 // replays, identified by sequence number, when processing a Batch. Its primary
 // functionality includes set construction, membership queries, and merging of
 // replay sets.
 type ReplaySet struct {
-	replays map[uint16]struct{}
+	replays map[uint32]struct{}
 }
 
 // NewReplaySet initializes an empty replay set.
 func NewReplaySet() *ReplaySet {
 	return &ReplaySet{
-		replays: make(map[uint16]struct{}),
+		replays: make(map[uint32]struct{}),
 	}
 }
 
@@ -26,13 +36,13 @@ func (rs *ReplaySet) Size() int {
 }
 
 // Add inserts the provided index into the replay set.
-func (rs *ReplaySet) Add(idx uint16) {
+func (rs *ReplaySet) Add(idx uint32) {
 	rs.replays[idx] = struct{}{}
 }
 
 // Contains queries the contents of the replay set for membership of a
 // particular index.
-func (rs *ReplaySet) Contains(idx uint16) bool {
+func (rs *ReplaySet) Contains(idx uint32) bool {
 	_, ok := rs.replays[idx]
 	return ok
 }
@@ -46,36 +56,67 @@ func (rs *ReplaySet) Merge(rs2 *ReplaySet) {
 
 // Encode serializes the replay set into an io.Writer suitable for storage. The
 // replay set can be recovered using Decode.
+//
+// If all of the sequence numbers fit in 16 bits, the set is encoded as the
+// list of its 16-bit sequence numbers, which is what earlier versions wrote.
+// Otherwise, the marker byte replaySet32Marker is written, followed by the list
+// of its 32-bit sequence numbers. As the former encoding always has an even
+// length and the latter an odd one, they can be told apart when decoding.
 func (rs *ReplaySet) Encode(w io.Writer) error {
+	wide := false
 	for seqNum := range rs.replays {
-		err := binary.Write(w, binary.BigEndian, seqNum)
-		if err != nil {
-			return err
+		if seqNum > math.MaxUint16 {
+			wide = true
+			break
 		}
 	}
 
-	return nil
+	var b []byte
+	if wide {
+		b = make([]byte, 1+4*len(rs.replays))
+		b[0] = replaySet32Marker
+		i := 1
+		for seqNum := range rs.replays {
+			binary.BigEndian.PutUint32(b[i:], seqNum)
+			i += 4
+		}
+	} else {
+		b = make([]byte, 2*len(rs.replays))
+		i := 0
+		for seqNum := range rs.replays {
+			binary.BigEndian.PutUint16(b[i:], uint16(seqNum))
+			i += 2
+		}
+	}
+
+	_, err := w.Write(b)
+	return err
 }
 
-// Decode reconstructs a replay set given a io.Reader. The byte
-// slice is assumed to be even in length, otherwise resulting in failure.
+// Decode reconstructs a replay set given a io.Reader, reading it until EOF.
+// Both encodings written by Encode are accepted, an error being returned if
+// the data matches neither.
 func (rs *ReplaySet) Decode(r io.Reader) error {
-	for {
-		// seqNum provides to buffer to read the next uint16 index.
-		var seqNum uint16
-
-		err := binary.Read(r, binary.BigEndian, &seqNum)
-		switch err {
-		case nil:
-			// Successful read, proceed.
-		case io.EOF:
-			return nil
-		default:
-			// Can return ErrShortBuffer or ErrUnexpectedEOF.
-			return err
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// A set of 16-bit sequence numbers has an even length.
+	if len(b)%2 == 0 {
+		for ; len(b) > 0; b = b[2:] {
+			rs.Add(uint32(binary.BigEndian.Uint16(b)))
 		}
 
-		// Add this decoded sequence number to the set.
-		rs.Add(seqNum)
+		return nil
+	}
+
+	if b[0] != replaySet32Marker || (len(b)-1)%4 != 0 {
+		return ErrInvalidReplaySet
 	}
+	for b = b[1:]; len(b) > 0; b = b[4:] {
+		rs.Add(binary.BigEndian.Uint32(b))
+	}
+
+	return nil
 }
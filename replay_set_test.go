@@ -0,0 +1,74 @@
+package sphinx
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestReplaySetEncoding tests that replay sets whose sequence numbers fit in
+// 16 bits keep their original encoding, while those that don't are encoded
+// using 32-bit sequence numbers, both of which decode to the original set.
+func TestReplaySetEncoding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		seqNums []uint32
+		size    int
+	}{
+		{"empty", nil, 0},
+		{"narrow", []uint32{0, 1, 0xffff}, 6},
+		{"wide", []uint32{0, 0x10000, 0xffffffff}, 13},
+	}
+	for _, test := range tests {
+		rs := NewReplaySet()
+		for _, seqNum := range test.seqNums {
+			rs.Add(seqNum)
+		}
+
+		var b bytes.Buffer
+		if err := rs.Encode(&b); err != nil {
+			t.Fatalf("%s: unable to encode replay set: %v",
+				test.name, err)
+		}
+		if b.Len() != test.size {
+			t.Fatalf("%s: expected %d bytes, got %d", test.name,
+				test.size, b.Len())
+		}
+
+		decoded := NewReplaySet()
+		if err := decoded.Decode(&b); err != nil {
+			t.Fatalf("%s: unable to decode replay set: %v",
+				test.name, err)
+		}
+		if !replaySetsEqual(rs, decoded) {
+			t.Fatalf("%s: decoded replay set doesn't match",
+				test.name)
+		}
+	}
+
+	// A set written using 16-bit sequence numbers by an earlier version
+	// still decodes.
+	decoded := NewReplaySet()
+	err := decoded.Decode(bytes.NewReader([]byte{0x00, 0x07, 0x01, 0x00}))
+	if err != nil {
+		t.Fatalf("unable to decode replay set: %v", err)
+	}
+	if decoded.Size() != 2 || !decoded.Contains(7) ||
+		!decoded.Contains(0x100) {
+
+		t.Fatalf("unexpected replay set: %v", decoded.replays)
+	}
+
+	for _, invalid := range [][]byte{
+		{0x00},
+		{0x00, 0x00, 0x00, 0x00, 0x01},
+		{replaySet32Marker, 0x00, 0x00},
+	} {
+		err := NewReplaySet().Decode(bytes.NewReader(invalid))
+		if err != ErrInvalidReplaySet {
+			t.Fatalf("expected error %v for %x, got %v",
+				ErrInvalidReplaySet, invalid, err)
+		}
+	}
+}
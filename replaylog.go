@@ -3,6 +3,7 @@ package sphinx
 import (
 	"crypto/sha256"
 	"errors"
+	"sync"
 )
 
 const (
@@ -30,13 +31,12 @@ var errReplayLogNotStarted error = errors.New(
 // HashPrefixSize bytes of the hash.
 func hashSharedSecret(sharedSecret *Hash256) *HashPrefix {
 	// Sha256 hash of sharedSecret
-	h := sha256.New()
-	h.Write(sharedSecret[:])
+	h := sha256.Sum256(sharedSecret[:])
 
 	var sharedHash HashPrefix
 
 	// Copy bytes to sharedHash
-	copy(sharedHash[:], h.Sum(nil))
+	copy(sharedHash[:], h[:])
 	return &sharedHash
 }
 
@@ -68,15 +68,57 @@ type ReplayLog interface {
 	// prefixes and accompanying values. Returns the set of entries in the batch
 	// that are replays and an error if one occurs.
 	PutBatch(*Batch) (*ReplaySet, error)
+
+	// DeleteBatch atomically removes the entries added to the log by the
+	// batch with the given ID, along with the record of the batch that
+	// makes PutBatch idempotent. This allows the packets of a committed
+	// batch to be processed anew, e.g. if the update carrying them failed.
+	// Deleting an unknown batch is not an error.
+	DeleteBatch(id []byte) error
+}
+
+// ExpiringReplayLog is a ReplayLog whose entries can be garbage collected
+// once the CLTV they were stored with has passed, as an HTLC carrying a
+// replayed packet can no longer be accepted by then.
+type ExpiringReplayLog interface {
+	ReplayLog
+
+	// Expire removes all entries stored with a CLTV below the passed block
+	// height, along with the batches whose entries have all expired.
+	Expire(height uint32) error
+}
+
+// numMemoryReplayLogShards is the number of shards the entries of a
+// MemoryReplayLog are split across. Each shard is guarded by its own mutex, so
+// that packets whose hash prefixes fall in distinct shards can be logged
+// concurrently.
+const numMemoryReplayLogShards = 32
+
+// memoryReplayLogShard holds the entries of a MemoryReplayLog whose hash
+// prefixes map to the shard.
+type memoryReplayLogShard struct {
+	mtx     sync.Mutex
+	entries map[HashPrefix]uint32
 }
 
 // MemoryReplayLog is a simple ReplayLog implementation that stores all added
-// sphinx packets and processed batches in memory with no persistence.
-//
-// This is designed for use just in testing.
+// sphinx packets and processed batches in memory with no persistence. All of
+// its methods are safe for concurrent access.
 type MemoryReplayLog struct {
-	batches map[string]*ReplaySet
-	entries map[HashPrefix]uint32
+	// mtx guards the lifecycle of the log. Start and Stop hold it
+	// exclusively, while the other methods hold it shared, so that the
+	// state of the log isn't replaced from under them.
+	mtx     sync.RWMutex
+	started bool
+
+	// batchMtx guards the processed batches. It is held for the whole of
+	// PutBatch, so that a batch is only ever applied once.
+	batchMtx     sync.Mutex
+	batches      map[string]*ReplaySet
+	batchExpiry  map[string]uint32
+	batchEntries map[string][]HashPrefix
+
+	shards [numMemoryReplayLogShards]memoryReplayLogShard
 }
 
 // NewMemoryReplayLog constructs a new MemoryReplayLog.
@@ -86,31 +128,63 @@ func NewMemoryReplayLog() *MemoryReplayLog {
 
 // Start initializes the log and must be called before any other methods.
 func (rl *MemoryReplayLog) Start() error {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
 	rl.batches = make(map[string]*ReplaySet)
-	rl.entries = make(map[HashPrefix]uint32)
+	rl.batchExpiry = make(map[string]uint32)
+	rl.batchEntries = make(map[string][]HashPrefix)
+	for i := range rl.shards {
+		rl.shards[i].entries = make(map[HashPrefix]uint32)
+	}
+	rl.started = true
+
 	return nil
 }
 
 // Stop wipes the state of the log.
 func (rl *MemoryReplayLog) Stop() error {
-	if rl.entries == nil || rl.batches == nil {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if !rl.started {
 		return errReplayLogNotStarted
 	}
 
 	rl.batches = nil
-	rl.entries = nil
+	rl.batchExpiry = nil
+	rl.batchEntries = nil
+	for i := range rl.shards {
+		rl.shards[i].entries = nil
+	}
+	rl.started = false
+
 	return nil
 }
 
+// shard returns the shard holding the entry with the passed hash prefix. As
+// hash prefixes are the output of a hash function, their first byte is enough
+// to spread the entries evenly.
+func (rl *MemoryReplayLog) shard(hash *HashPrefix) *memoryReplayLogShard {
+	return &rl.shards[int(hash[0])%numMemoryReplayLogShards]
+}
+
 // Get retrieves an entry from the log given its hash prefix. It returns the
 // value stored and an error if one occurs. It returns ErrLogEntryNotFound
 // if the entry is not in the log.
 func (rl *MemoryReplayLog) Get(hash *HashPrefix) (uint32, error) {
-	if rl.entries == nil || rl.batches == nil {
+	rl.mtx.RLock()
+	defer rl.mtx.RUnlock()
+
+	if !rl.started {
 		return 0, errReplayLogNotStarted
 	}
 
-	cltv, exists := rl.entries[*hash]
+	shard := rl.shard(hash)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	cltv, exists := shard.entries[*hash]
 	if !exists {
 		return 0, ErrLogEntryNotFound
 	}
@@ -122,26 +196,46 @@ func (rl *MemoryReplayLog) Get(hash *HashPrefix) (uint32, error) {
 // purposefully general type. It returns ErrReplayedPacket if the provided hash
 // prefix already exists in the log.
 func (rl *MemoryReplayLog) Put(hash *HashPrefix, cltv uint32) error {
-	if rl.entries == nil || rl.batches == nil {
+	rl.mtx.RLock()
+	defer rl.mtx.RUnlock()
+
+	if !rl.started {
 		return errReplayLogNotStarted
 	}
 
-	_, exists := rl.entries[*hash]
-	if exists {
+	return rl.put(hash, cltv)
+}
+
+// put stores an entry into the shard of the log it maps to.
+//
+// NOTE: The mutex of the log must be held.
+func (rl *MemoryReplayLog) put(hash *HashPrefix, cltv uint32) error {
+	shard := rl.shard(hash)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	if _, exists := shard.entries[*hash]; exists {
 		return ErrReplayedPacket
 	}
 
-	rl.entries[*hash] = cltv
+	shard.entries[*hash] = cltv
 	return nil
 }
 
 // Delete deletes an entry from the log given its hash prefix.
 func (rl *MemoryReplayLog) Delete(hash *HashPrefix) error {
-	if rl.entries == nil || rl.batches == nil {
+	rl.mtx.RLock()
+	defer rl.mtx.RUnlock()
+
+	if !rl.started {
 		return errReplayLogNotStarted
 	}
 
-	delete(rl.entries, *hash)
+	shard := rl.shard(hash)
+	shard.mtx.Lock()
+	delete(shard.entries, *hash)
+	shard.mtx.Unlock()
+
 	return nil
 }
 
@@ -149,22 +243,32 @@ func (rl *MemoryReplayLog) Delete(hash *HashPrefix) error {
 // prefixes and accompanying values. Returns the set of entries in the batch
 // that are replays and an error if one occurs.
 func (rl *MemoryReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
-	if rl.entries == nil || rl.batches == nil {
+	rl.mtx.RLock()
+	defer rl.mtx.RUnlock()
+
+	if !rl.started {
 		return nil, errReplayLogNotStarted
 	}
 
+	rl.batchMtx.Lock()
+	defer rl.batchMtx.Unlock()
+
 	// Return the result when the batch was first processed to provide
 	// idempotence.
 	replays, exists := rl.batches[string(batch.ID)]
 
 	if !exists {
 		replays = NewReplaySet()
-		err := batch.ForEach(func(seqNum uint16, hashPrefix *HashPrefix, cltv uint32) error {
-			err := rl.Put(hashPrefix, cltv)
+		var added []HashPrefix
+		err := batch.ForEach(func(seqNum uint32, hashPrefix *HashPrefix, cltv uint32) error {
+			err := rl.put(hashPrefix, cltv)
 			if err == ErrReplayedPacket {
 				replays.Add(seqNum)
 				return nil
 			}
+			if err == nil {
+				added = append(added, *hashPrefix)
+			}
 
 			// An error would be bad because we have already updated the entries
 			// map, but no errors other than ErrReplayedPacket should occur.
@@ -176,6 +280,8 @@ func (rl *MemoryReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
 
 		replays.Merge(batch.ReplaySet)
 		rl.batches[string(batch.ID)] = replays
+		rl.batchExpiry[string(batch.ID)] = batch.expiry()
+		rl.batchEntries[string(batch.ID)] = added
 	}
 
 	batch.ReplaySet = replays
@@ -184,5 +290,153 @@ func (rl *MemoryReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
 	return replays, nil
 }
 
-// A compile time asserting *MemoryReplayLog implements the RelayLog interface.
-var _ ReplayLog = (*MemoryReplayLog)(nil)
+// Expire removes all entries stored with a CLTV below the passed block height,
+// along with the batches whose entries have all expired.
+func (rl *MemoryReplayLog) Expire(height uint32) error {
+	rl.mtx.RLock()
+	defer rl.mtx.RUnlock()
+
+	if !rl.started {
+		return errReplayLogNotStarted
+	}
+
+	for i := range rl.shards {
+		shard := &rl.shards[i]
+
+		shard.mtx.Lock()
+		for hash, cltv := range shard.entries {
+			if cltv < height {
+				delete(shard.entries, hash)
+			}
+		}
+		shard.mtx.Unlock()
+	}
+
+	rl.batchMtx.Lock()
+	defer rl.batchMtx.Unlock()
+
+	for id, expiry := range rl.batchExpiry {
+		if expiry < height {
+			delete(rl.batches, id)
+			delete(rl.batchExpiry, id)
+			delete(rl.batchEntries, id)
+		}
+	}
+
+	return nil
+}
+
+// DeleteBatch atomically removes the entries added by the batch with the
+// given ID, along with the record of the batch. The log is locked exclusively
+// while doing so, so no other call observes the batch partially removed.
+func (rl *MemoryReplayLog) DeleteBatch(id []byte) error {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if !rl.started {
+		return errReplayLogNotStarted
+	}
+
+	for i := range rl.batchEntries[string(id)] {
+		hash := &rl.batchEntries[string(id)][i]
+		delete(rl.shard(hash).entries, *hash)
+	}
+	delete(rl.batches, string(id))
+	delete(rl.batchExpiry, string(id))
+	delete(rl.batchEntries, string(id))
+
+	return nil
+}
+
+// ForEachEntry calls the passed function for each entry of the log, with its
+// hash prefix and CLTV. The function must not call back into the log.
+func (rl *MemoryReplayLog) ForEachEntry(
+	fn func(hashPrefix *HashPrefix, cltv uint32) error) error {
+
+	rl.mtx.RLock()
+	defer rl.mtx.RUnlock()
+
+	if !rl.started {
+		return errReplayLogNotStarted
+	}
+
+	for i := range rl.shards {
+		if err := rl.shards[i].forEach(fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ForEachBatch calls the passed function for each batch of the log, with its
+// ID, replay set, expiry and the entries it added that are still in the log.
+// The function must not call back into the log, modify the replay set or
+// retain the entries.
+func (rl *MemoryReplayLog) ForEachBatch(fn func(id []byte, replays *ReplaySet,
+	expiry uint32, entries []LogEntry) error) error {
+
+	rl.mtx.RLock()
+	defer rl.mtx.RUnlock()
+
+	if !rl.started {
+		return errReplayLogNotStarted
+	}
+
+	rl.batchMtx.Lock()
+	defer rl.batchMtx.Unlock()
+
+	var entries []LogEntry
+	for id, replays := range rl.batches {
+		entries = entries[:0]
+		for i := range rl.batchEntries[id] {
+			hash := &rl.batchEntries[id][i]
+			cltv, ok := rl.shard(hash).get(hash)
+			if !ok {
+				continue
+			}
+			entries = append(entries, LogEntry{*hash, cltv})
+		}
+
+		err := fn([]byte(id), replays, rl.batchExpiry[id], entries)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// get returns the CLTV of the entry of the shard with the passed hash prefix,
+// and whether the shard holds it.
+func (s *memoryReplayLogShard) get(hash *HashPrefix) (uint32, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	cltv, ok := s.entries[*hash]
+	return cltv, ok
+}
+
+// forEach calls the passed function for each entry of the shard.
+func (s *memoryReplayLogShard) forEach(
+	fn func(hashPrefix *HashPrefix, cltv uint32) error) error {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for hash, cltv := range s.entries {
+		hash := hash
+		if err := fn(&hash, cltv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A compile time asserting *MemoryReplayLog implements the ExpiringReplayLog
+// and IterableReplayLog interfaces.
+var (
+	_ ExpiringReplayLog = (*MemoryReplayLog)(nil)
+	_ IterableReplayLog = (*MemoryReplayLog)(nil)
+)
@@ -1,13 +1,34 @@
 package sphinx
 
 import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+
+	"github.com/brsuite/brond/btcec"
+	"github.com/brsuite/brond/chaincfg"
 )
 
 // TestMemoryReplayLogStorageAndRetrieval tests that the non-batch methods on
 // MemoryReplayLog work as expected.
 func TestMemoryReplayLogStorageAndRetrieval(t *testing.T) {
-	rl := NewMemoryReplayLog()
+	testReplayLogStorageAndRetrieval(t, NewMemoryReplayLog())
+}
+
+// TestFileReplayLogStorageAndRetrieval tests that the non-batch methods on
+// FileReplayLog work as expected.
+func TestFileReplayLogStorageAndRetrieval(t *testing.T) {
+	testReplayLogStorageAndRetrieval(t, newTestFileReplayLog(t))
+}
+
+// testReplayLogStorageAndRetrieval tests that the non-batch methods on the
+// passed log work as expected.
+func testReplayLogStorageAndRetrieval(t *testing.T, rl ReplayLog) {
 	rl.Start()
 	defer rl.Stop()
 
@@ -84,7 +105,18 @@ func TestMemoryReplayLogStorageAndRetrieval(t *testing.T) {
 // TestMemoryReplayLogPutBatch tests that the batch adding of packets to a log
 // works as expected.
 func TestMemoryReplayLogPutBatch(t *testing.T) {
-	rl := NewMemoryReplayLog()
+	testReplayLogPutBatch(t, NewMemoryReplayLog())
+}
+
+// TestFileReplayLogPutBatch tests that the batch adding of packets to a
+// FileReplayLog works as expected.
+func TestFileReplayLogPutBatch(t *testing.T) {
+	testReplayLogPutBatch(t, newTestFileReplayLog(t))
+}
+
+// testReplayLogPutBatch tests that the batch adding of packets to the passed
+// log works as expected.
+func testReplayLogPutBatch(t *testing.T, rl ReplayLog) {
 	rl.Start()
 	defer rl.Stop()
 
@@ -130,3 +162,1008 @@ func TestMemoryReplayLogPutBatch(t *testing.T) {
 		t.Fatalf("Unexpected replay set after adding batch 2 to log: %v", err)
 	}
 }
+
+// newTestFileReplayLog creates a FileReplayLog backed by a file within a
+// temporary directory.
+func newTestFileReplayLog(t *testing.T) *FileReplayLog {
+	return NewFileReplayLog(filepath.Join(t.TempDir(), "replay.log"))
+}
+
+// startFileReplayLog starts the passed log, failing the test on error.
+func startFileReplayLog(t *testing.T, rl *FileReplayLog) {
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+}
+
+// assertReplayLogEntry asserts that the log holds the entry with the passed
+// hash prefix and CLTV, or doesn't hold it if the CLTV is zero.
+func assertReplayLogEntry(t *testing.T, rl ReplayLog, hashPrefix *HashPrefix,
+	cltv uint32) {
+
+	t.Helper()
+
+	storedCltv, err := rl.Get(hashPrefix)
+	switch {
+	case cltv == 0 && err != ErrLogEntryNotFound:
+		t.Fatalf("expected error %v, got %v", ErrLogEntryNotFound, err)
+
+	case cltv == 0:
+
+	case err != nil:
+		t.Fatalf("unable to get entry: %v", err)
+
+	case storedCltv != cltv:
+		t.Fatalf("expected cltv %d, got %d", cltv, storedCltv)
+	}
+}
+
+// TestFileReplayLogRestart tests that the entries and batches of a
+// FileReplayLog survive a restart.
+func TestFileReplayLogRestart(t *testing.T) {
+	t.Parallel()
+
+	rl := newTestFileReplayLog(t)
+	startFileReplayLog(t, rl)
+
+	var hashPrefix1, hashPrefix2, hashPrefix3 HashPrefix
+	hashPrefix1[0] = 1
+	hashPrefix2[0] = 2
+	hashPrefix3[0] = 3
+
+	if err := rl.Put(&hashPrefix1, 1); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if err := rl.Put(&hashPrefix2, 2); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if err := rl.Delete(&hashPrefix2); err != nil {
+		t.Fatalf("unable to delete entry: %v", err)
+	}
+
+	batch := NewBatch([]byte("batch"))
+	if err := batch.Put(1, &hashPrefix1, 10); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	if err := batch.Put(2, &hashPrefix3, 3); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	replays, err := rl.PutBatch(batch)
+	if err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(1) {
+		t.Fatalf("unexpected replay set: %v", replays)
+	}
+
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+	startFileReplayLog(t, rl)
+	defer rl.Stop()
+
+	assertReplayLogEntry(t, rl, &hashPrefix1, 1)
+	assertReplayLogEntry(t, rl, &hashPrefix2, 0)
+	assertReplayLogEntry(t, rl, &hashPrefix3, 3)
+
+	// The batch is still idempotent after the restart, even though all of
+	// its entries are in the log by now.
+	batch = NewBatch([]byte("batch"))
+	if err := batch.Put(1, &hashPrefix1, 10); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	if err := batch.Put(2, &hashPrefix3, 3); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	replays, err = rl.PutBatch(batch)
+	if err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(1) {
+		t.Fatalf("unexpected replay set: %v", replays)
+	}
+}
+
+// TestFileReplayLogTornWrite tests that a FileReplayLog recovers from a torn
+// final write, discarding only the damaged record, while a damaged record in
+// the middle of the file is reported.
+func TestFileReplayLogTornWrite(t *testing.T) {
+	t.Parallel()
+
+	rl := newTestFileReplayLog(t)
+	startFileReplayLog(t, rl)
+
+	var hashPrefix1, hashPrefix2 HashPrefix
+	hashPrefix1[0] = 1
+	hashPrefix2[0] = 2
+
+	if err := rl.Put(&hashPrefix1, 1); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if err := rl.Put(&hashPrefix2, 2); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+
+	data, err := os.ReadFile(rl.path)
+	if err != nil {
+		t.Fatalf("unable to read log: %v", err)
+	}
+	recordSize := (len(data) - len(fileReplayLogMagic)) / 2
+
+	// Every possible tear of the last record only loses that record.
+	for size := len(data) - recordSize; size < len(data); size++ {
+		err := os.WriteFile(rl.path, data[:size], 0600)
+		if err != nil {
+			t.Fatalf("unable to write log: %v", err)
+		}
+
+		startFileReplayLog(t, rl)
+		assertReplayLogEntry(t, rl, &hashPrefix1, 1)
+		assertReplayLogEntry(t, rl, &hashPrefix2, 0)
+
+		// The log can be appended to once the torn record is
+		// discarded.
+		if err := rl.Put(&hashPrefix2, 3); err != nil {
+			t.Fatalf("unable to put entry: %v", err)
+		}
+		if err := rl.Stop(); err != nil {
+			t.Fatalf("unable to stop replay log: %v", err)
+		}
+
+		startFileReplayLog(t, rl)
+		assertReplayLogEntry(t, rl, &hashPrefix2, 3)
+		if err := rl.Stop(); err != nil {
+			t.Fatalf("unable to stop replay log: %v", err)
+		}
+	}
+
+	// A record whose checksum is damaged is discarded if it is the last
+	// one, but reported otherwise.
+	damaged := append([]byte(nil), data...)
+	damaged[len(damaged)-1] ^= 1
+	if err := os.WriteFile(rl.path, damaged, 0600); err != nil {
+		t.Fatalf("unable to write log: %v", err)
+	}
+	startFileReplayLog(t, rl)
+	assertReplayLogEntry(t, rl, &hashPrefix2, 0)
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+
+	damaged = append([]byte(nil), data...)
+	damaged[len(fileReplayLogMagic)+recordHeaderChecksumSize+
+		recordHeaderSize] ^= 1
+	if err := os.WriteFile(rl.path, damaged, 0600); err != nil {
+		t.Fatalf("unable to write log: %v", err)
+	}
+	if err := rl.Start(); err != ErrCorruptReplayLog {
+		t.Fatalf("expected error %v, got %v", ErrCorruptReplayLog, err)
+	}
+}
+
+// TestFileReplayLogCorruptLength tests that a record in the middle of the file
+// of a FileReplayLog whose length is damaged is reported as corrupt, rather
+// than being mistaken for a torn record, which would discard the records that
+// follow it.
+func TestFileReplayLogCorruptLength(t *testing.T) {
+	t.Parallel()
+
+	rl := newTestFileReplayLog(t)
+	startFileReplayLog(t, rl)
+
+	var hashPrefixes [3]HashPrefix
+	for i := range hashPrefixes {
+		hashPrefixes[i][0] = byte(i + 1)
+		if err := rl.Put(&hashPrefixes[i], uint32(i+1)); err != nil {
+			t.Fatalf("unable to put entry: %v", err)
+		}
+	}
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+
+	data, err := os.ReadFile(rl.path)
+	if err != nil {
+		t.Fatalf("unable to read log: %v", err)
+	}
+	recordSize := (len(data) - len(fileReplayLogMagic)) / 3
+	lengthOffset := len(fileReplayLogMagic) + recordSize +
+		recordHeaderChecksumSize + 1
+
+	// The length of the second record is set to a value above the
+	// maximum, or to one reaching past the end of the file.
+	for _, length := range []uint32{
+		maxRecordPayloadSize + 1, uint32(len(data)),
+	} {
+		damaged := append([]byte(nil), data...)
+		binary.BigEndian.PutUint32(damaged[lengthOffset:], length)
+		if err := os.WriteFile(rl.path, damaged, 0600); err != nil {
+			t.Fatalf("unable to write log: %v", err)
+		}
+
+		if err := rl.Start(); err != ErrCorruptReplayLog {
+			t.Fatalf("length %d: expected error %v, got %v", length,
+				ErrCorruptReplayLog, err)
+		}
+
+		// The file must be left untouched.
+		stored, err := os.ReadFile(rl.path)
+		if err != nil {
+			t.Fatalf("unable to read log: %v", err)
+		}
+		if !bytes.Equal(stored, damaged) {
+			t.Fatalf("length %d: corrupt log was modified", length)
+		}
+	}
+}
+
+// TestFileReplayLogLegacyFormat tests that a file of the legacy format, whose
+// records lack a header checksum, is loaded and rewritten in the current
+// format on Start.
+func TestFileReplayLogLegacyFormat(t *testing.T) {
+	t.Parallel()
+
+	var hashPrefix1, hashPrefix2 HashPrefix
+	hashPrefix1[0] = 1
+	hashPrefix2[0] = 2
+	cltv1, cltv2 := uint32(1), uint32(2)
+
+	data := []byte(legacyFileReplayLogMagic)
+	data = encodeRecord(
+		data, recordPut, encodeEntry(&hashPrefix1, &cltv1),
+	)
+	data = encodeRecord(
+		data, recordPut, encodeEntry(&hashPrefix2, &cltv2),
+	)
+
+	rl := newTestFileReplayLog(t)
+
+	// A length above the maximum can't be the result of a torn write, so
+	// it is reported even in the legacy format.
+	damaged := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(
+		damaged[len(legacyFileReplayLogMagic)+1:],
+		maxRecordPayloadSize+1,
+	)
+	if err := os.WriteFile(rl.path, damaged, 0600); err != nil {
+		t.Fatalf("unable to write log: %v", err)
+	}
+	if err := rl.Start(); err != ErrCorruptReplayLog {
+		t.Fatalf("expected error %v, got %v", ErrCorruptReplayLog, err)
+	}
+
+	if err := os.WriteFile(rl.path, data, 0600); err != nil {
+		t.Fatalf("unable to write log: %v", err)
+	}
+	startFileReplayLog(t, rl)
+	assertReplayLogEntry(t, rl, &hashPrefix1, cltv1)
+	assertReplayLogEntry(t, rl, &hashPrefix2, cltv2)
+
+	var hashPrefix3 HashPrefix
+	hashPrefix3[0] = 3
+	if err := rl.Put(&hashPrefix3, 3); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+
+	stored, err := os.ReadFile(rl.path)
+	if err != nil {
+		t.Fatalf("unable to read log: %v", err)
+	}
+	if !bytes.HasPrefix(stored, []byte(fileReplayLogMagic)) {
+		t.Fatalf("expected log to be rewritten in the current format")
+	}
+
+	startFileReplayLog(t, rl)
+	assertReplayLogEntry(t, rl, &hashPrefix1, cltv1)
+	assertReplayLogEntry(t, rl, &hashPrefix2, cltv2)
+	assertReplayLogEntry(t, rl, &hashPrefix3, 3)
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+}
+
+// TestFileReplayLogCompaction tests that compacting a FileReplayLog shrinks
+// its file while preserving its state.
+func TestFileReplayLogCompaction(t *testing.T) {
+	t.Parallel()
+
+	rl := newTestFileReplayLog(t)
+	startFileReplayLog(t, rl)
+
+	// Add and remove enough entries to trigger an automatic compaction,
+	// keeping every tenth one.
+	const numEntries = compactMinRecords
+	for i := 0; i < numEntries; i++ {
+		var hashPrefix HashPrefix
+		hashPrefix[0], hashPrefix[1] = byte(i), byte(i>>8)
+
+		if err := rl.Put(&hashPrefix, uint32(i+1)); err != nil {
+			t.Fatalf("unable to put entry: %v", err)
+		}
+		if i%10 == 0 {
+			continue
+		}
+		if err := rl.Delete(&hashPrefix); err != nil {
+			t.Fatalf("unable to delete entry: %v", err)
+		}
+	}
+	if rl.numRecords >= compactMinRecords {
+		t.Fatalf("expected log to be compacted, got %d records",
+			rl.numRecords)
+	}
+
+	batch := NewBatch([]byte("batch"))
+	var hashPrefix HashPrefix
+	hashPrefix[HashPrefixSize-1] = 1
+	if err := batch.Put(7, &hashPrefix, 1); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	if _, err := rl.PutBatch(batch); err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+
+	// Only the entries that were kept and the batch, holding its entry,
+	// remain after compacting.
+	if err := rl.Compact(); err != nil {
+		t.Fatalf("unable to compact log: %v", err)
+	}
+	numRecords := (numEntries+9)/10 + 1
+	if rl.numRecords != numRecords {
+		t.Fatalf("expected %d records, got %d", numRecords,
+			rl.numRecords)
+	}
+
+	// The compacted state survives a restart.
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+	startFileReplayLog(t, rl)
+	defer rl.Stop()
+
+	for i := 0; i < numEntries; i++ {
+		var hashPrefix HashPrefix
+		hashPrefix[0], hashPrefix[1] = byte(i), byte(i>>8)
+
+		var cltv uint32
+		if i%10 == 0 {
+			cltv = uint32(i + 1)
+		}
+		assertReplayLogEntry(t, rl, &hashPrefix, cltv)
+	}
+	assertReplayLogEntry(t, rl, &hashPrefix, 1)
+
+	// Committing the batch again yields its original replay set, rather
+	// than reporting its entry as replayed.
+	batch = NewBatch([]byte("batch"))
+	if err := batch.Put(7, &hashPrefix, 1); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	replays, err := rl.PutBatch(batch)
+	if err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+	if replays.Size() != 0 {
+		t.Fatalf("unexpected replay set: %v", replays)
+	}
+}
+
+// TestFileReplayLogRouter tests that a router backed by a FileReplayLog still
+// rejects replayed packets after a restart.
+func TestFileReplayLogRouter(t *testing.T) {
+	t.Parallel()
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "replay.log")
+
+	pkt, _ := newSingleHopOnion(t, privKey.PubKey())
+
+	for i := 0; i < 2; i++ {
+		router := NewRouter(
+			&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+			NewFileReplayLog(path),
+		)
+		if err := router.Start(); err != nil {
+			t.Fatalf("unable to start router: %v", err)
+		}
+
+		_, err := router.ProcessOnionPacket(pkt, nil, 1)
+		switch {
+		case i == 0 && err != nil:
+			t.Fatalf("unable to process onion: %v", err)
+
+		case i == 1 && err != ErrReplayedPacket:
+			t.Fatalf("expected error %v, got %v",
+				ErrReplayedPacket, err)
+		}
+
+		router.Stop()
+	}
+}
+
+// TestMemoryReplayLogExpire tests the expiry of the entries and batches of a
+// MemoryReplayLog.
+func TestMemoryReplayLogExpire(t *testing.T) {
+	testReplayLogExpire(t, NewMemoryReplayLog())
+}
+
+// TestFileReplayLogExpire tests the expiry of the entries and batches of a
+// FileReplayLog, which must also hold across a restart.
+func TestFileReplayLogExpire(t *testing.T) {
+	rl := newTestFileReplayLog(t)
+	testReplayLogExpire(t, rl)
+
+	startFileReplayLog(t, rl)
+	defer rl.Stop()
+
+	var hashPrefix HashPrefix
+	for i := 1; i <= 3; i++ {
+		hashPrefix[0] = byte(i)
+		assertReplayLogEntry(t, rl, &hashPrefix, 0)
+	}
+	hashPrefix[0] = 4
+	assertReplayLogEntry(t, rl, &hashPrefix, 20)
+}
+
+// testReplayLogExpire tests that expiring the passed log removes the entries
+// and batches whose CLTV has passed. The log is stopped on return.
+func testReplayLogExpire(t *testing.T, rl ExpiringReplayLog) {
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	var hashPrefix1, hashPrefix2, hashPrefix3, hashPrefix4 HashPrefix
+	hashPrefix1[0] = 1
+	hashPrefix2[0] = 2
+	hashPrefix3[0] = 3
+	hashPrefix4[0] = 4
+
+	if err := rl.Put(&hashPrefix1, 10); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+
+	// The first batch expires once both of its entries have, while the
+	// second one holds an entry that doesn't expire yet.
+	batch1 := NewBatch([]byte{1})
+	if err := batch1.Put(0, &hashPrefix2, 10); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	if err := batch1.Put(1, &hashPrefix3, 11); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	if _, err := rl.PutBatch(batch1); err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+
+	batch2 := NewBatch([]byte{2})
+	if err := batch2.Put(0, &hashPrefix1, 10); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	if err := batch2.Put(1, &hashPrefix4, 20); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	if _, err := rl.PutBatch(batch2); err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+
+	// Entries are only expired once the height is past their CLTV.
+	if err := rl.Expire(10); err != nil {
+		t.Fatalf("unable to expire entries: %v", err)
+	}
+	assertReplayLogEntry(t, rl, &hashPrefix1, 10)
+	assertReplayLogEntry(t, rl, &hashPrefix2, 10)
+
+	if err := rl.Expire(12); err != nil {
+		t.Fatalf("unable to expire entries: %v", err)
+	}
+	assertReplayLogEntry(t, rl, &hashPrefix1, 0)
+	assertReplayLogEntry(t, rl, &hashPrefix2, 0)
+	assertReplayLogEntry(t, rl, &hashPrefix3, 0)
+	assertReplayLogEntry(t, rl, &hashPrefix4, 20)
+
+	// The first batch is now processed anew, while the second one still
+	// yields its original replay set.
+	batch1 = NewBatch([]byte{1})
+	if err := batch1.Put(0, &hashPrefix4, 20); err != nil {
+		t.Fatalf("unable to add entry to batch: %v", err)
+	}
+	replays, err := rl.PutBatch(batch1)
+	if err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(0) {
+		t.Fatalf("expected expired batch to be processed anew, got "+
+			"replay set %v", replays)
+	}
+
+	replays, err = rl.PutBatch(NewBatch([]byte{2}))
+	if err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(0) {
+		t.Fatalf("unexpected replay set %v", replays)
+	}
+}
+
+// TestMemoryReplayLogConcurrency tests that concurrent calls to the methods of
+// a MemoryReplayLog accept each hash prefix exactly once, and that batches
+// committed concurrently are only applied once.
+func TestMemoryReplayLogConcurrency(t *testing.T) {
+	t.Parallel()
+
+	rl := NewMemoryReplayLog()
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	const (
+		numGoroutines = 16
+		numEntries    = 256
+	)
+	hashPrefixes := make([]*HashPrefix, numEntries)
+	for i := range hashPrefixes {
+		hashPrefixes[i] = randHashPrefix(t)
+	}
+
+	// Every goroutine attempts to put all entries, while also looking them
+	// up, and commits the same batch of entries that are never put on
+	// their own.
+	batchPrefixes := make([]*HashPrefix, numEntries)
+	for i := range batchPrefixes {
+		batchPrefixes[i] = randHashPrefix(t)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		accepted [numEntries]int32
+		replays  = make([]*ReplaySet, numGoroutines)
+		errs     = make(chan error, numGoroutines)
+	)
+	for g := 0; g < numGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for i, hashPrefix := range hashPrefixes {
+				err := rl.Put(hashPrefix, uint32(i+1))
+				switch err {
+				case nil:
+					atomic.AddInt32(&accepted[i], 1)
+
+				case ErrReplayedPacket:
+
+				default:
+					errs <- err
+					return
+				}
+
+				_, err = rl.Get(hashPrefix)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+
+			batch := NewBatch([]byte("batch"))
+			for i, hashPrefix := range batchPrefixes {
+				err := batch.Put(
+					uint32(i), hashPrefix, uint32(i+1),
+				)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+
+			rs, err := rl.PutBatch(batch)
+			if err != nil {
+				errs <- err
+				return
+			}
+			replays[g] = rs
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, n := range accepted {
+		if n != 1 {
+			t.Fatalf("entry %d accepted %d times", i, n)
+		}
+	}
+	for g, rs := range replays {
+		if rs.Size() != 0 {
+			t.Fatalf("goroutine %d: expected no replays, got %d", g,
+				rs.Size())
+		}
+	}
+
+	// Deleting the entries concurrently with their lookups leaves the log
+	// with only the entries of the batch.
+	for g := 0; g < numGoroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for _, hashPrefix := range hashPrefixes {
+				rl.Delete(hashPrefix)
+				rl.Get(hashPrefix)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var numStored int
+	err := rl.ForEachEntry(func(*HashPrefix, uint32) error {
+		numStored++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to iterate entries: %v", err)
+	}
+	if numStored != numEntries {
+		t.Fatalf("expected %d entries, got %d", numEntries, numStored)
+	}
+}
+
+// TestMemoryReplayLogConcurrentStop tests that stopping a MemoryReplayLog
+// while it is in use makes the calls that follow fail, rather than operating on
+// wiped state.
+func TestMemoryReplayLogConcurrentStop(t *testing.T) {
+	t.Parallel()
+
+	rl := NewMemoryReplayLog()
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+
+	const numGoroutines = 8
+	hashPrefixes := make([]*HashPrefix, 1000)
+	for i := range hashPrefixes {
+		hashPrefixes[i] = randHashPrefix(t)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numGoroutines)
+	for g := 0; g < numGoroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for _, hashPrefix := range hashPrefixes {
+				err := rl.Put(hashPrefix, 1)
+				if err == ErrReplayedPacket {
+					continue
+				}
+				if err == errReplayLogNotStarted {
+					return
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := rl.Get(randHashPrefix(t)); err != errReplayLogNotStarted {
+		t.Fatalf("expected error %v, got %v", errReplayLogNotStarted,
+			err)
+	}
+}
+
+// TestMemoryReplayLogRouterConcurrency tests that many goroutines processing
+// the same packets through one router, both on their own and within
+// transactions, accept each packet exactly once.
+func TestMemoryReplayLogRouterConcurrency(t *testing.T) {
+	t.Parallel()
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	router := NewRouter(
+		&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+		NewMemoryReplayLog(),
+	)
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+	defer router.Stop()
+
+	const (
+		numGoroutines = 8
+		numPackets    = 8
+	)
+	packets := make([]*OnionPacket, numPackets)
+	for i := range packets {
+		packets[i], _ = newSingleHopOnion(t, privKey.PubKey())
+	}
+
+	var (
+		wg       sync.WaitGroup
+		accepted [numPackets]int32
+		errs     = make(chan error, numGoroutines)
+	)
+	for g := 0; g < numGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			// Half of the goroutines process the packets one at a
+			// time, while the other half process them within a
+			// transaction of their own.
+			if g%2 == 0 {
+				for i, pkt := range packets {
+					_, err := router.ProcessOnionPacket(
+						pkt, nil, 1,
+					)
+					switch err {
+					case nil:
+						atomic.AddInt32(&accepted[i], 1)
+
+					case ErrReplayedPacket:
+
+					default:
+						errs <- err
+						return
+					}
+				}
+
+				return
+			}
+
+			tx := router.BeginTxn([]byte{byte(g)}, numPackets)
+			for i, pkt := range packets {
+				err := tx.ProcessOnionPacket(
+					uint32(i), pkt, nil, 1,
+				)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+
+			_, replays, err := tx.Commit()
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := range packets {
+				if !replays.Contains(uint32(i)) {
+					atomic.AddInt32(&accepted[i], 1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, n := range accepted {
+		if n != 1 {
+			t.Fatalf("packet %d accepted %d times", i, n)
+		}
+	}
+}
+
+// TestMemoryReplayLogDeleteBatch tests the deletion of the batches of a
+// MemoryReplayLog.
+func TestMemoryReplayLogDeleteBatch(t *testing.T) {
+	testReplayLogDeleteBatch(t, NewMemoryReplayLog())
+}
+
+// TestFileReplayLogDeleteBatch tests the deletion of the batches of a
+// FileReplayLog, which must also hold across a restart and a compaction.
+func TestFileReplayLogDeleteBatch(t *testing.T) {
+	rl := newTestFileReplayLog(t)
+	testReplayLogDeleteBatch(t, rl)
+
+	var hashPrefix1, hashPrefix2, hashPrefix3 HashPrefix
+	hashPrefix1[0] = 1
+	hashPrefix2[0] = 2
+	hashPrefix3[0] = 3
+
+	for i := 0; i < 2; i++ {
+		startFileReplayLog(t, rl)
+
+		assertReplayLogEntry(t, rl, &hashPrefix1, 5)
+		assertReplayLogEntry(t, rl, &hashPrefix2, 0)
+		assertReplayLogEntry(t, rl, &hashPrefix3, 0)
+
+		var numBatches int
+		err := rl.ForEachBatch(func([]byte, *ReplaySet, uint32,
+			[]LogEntry) error {
+
+			numBatches++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unable to iterate batches: %v", err)
+		}
+		if numBatches != 0 {
+			t.Fatalf("expected no batches, got %d", numBatches)
+		}
+
+		if i == 0 {
+			if err := rl.Compact(); err != nil {
+				t.Fatalf("unable to compact log: %v", err)
+			}
+		}
+		if err := rl.Stop(); err != nil {
+			t.Fatalf("unable to stop replay log: %v", err)
+		}
+	}
+}
+
+// testReplayLogDeleteBatch tests that deleting a batch from the passed log
+// removes the entries it added along with its record, so that committing it
+// again accepts its packets anew. The log is stopped on return, with the batch
+// deleted.
+func testReplayLogDeleteBatch(t *testing.T, rl ReplayLog) {
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	var hashPrefix1, hashPrefix2, hashPrefix3 HashPrefix
+	hashPrefix1[0] = 1
+	hashPrefix2[0] = 2
+	hashPrefix3[0] = 3
+
+	// The first packet of the batch replays an entry that was added on its
+	// own, which must survive the deletion of the batch.
+	if err := rl.Put(&hashPrefix1, 5); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+
+	putBatch := func() {
+		t.Helper()
+
+		batch := NewBatch([]byte("batch"))
+		entries := []*HashPrefix{
+			&hashPrefix1, &hashPrefix2, &hashPrefix3,
+		}
+		for seqNum, hashPrefix := range entries {
+			err := batch.Put(uint32(seqNum), hashPrefix, 10)
+			if err != nil {
+				t.Fatalf("unable to add entry to batch: %v",
+					err)
+			}
+		}
+
+		replays, err := rl.PutBatch(batch)
+		if err != nil {
+			t.Fatalf("unable to put batch: %v", err)
+		}
+		if replays.Size() != 1 || !replays.Contains(0) {
+			t.Fatalf("unexpected replay set: %v", replays)
+		}
+	}
+	deleteBatch := func(id []byte) {
+		t.Helper()
+
+		if err := rl.DeleteBatch(id); err != nil {
+			t.Fatalf("unable to delete batch: %v", err)
+		}
+	}
+
+	putBatch()
+	assertReplayLogEntry(t, rl, &hashPrefix2, 10)
+	assertReplayLogEntry(t, rl, &hashPrefix3, 10)
+
+	// Deleting the batch, more than once, only removes its own entries.
+	// Deleting an unknown batch is harmless.
+	for i := 0; i < 2; i++ {
+		deleteBatch([]byte("batch"))
+	}
+	deleteBatch([]byte("unknown"))
+
+	assertReplayLogEntry(t, rl, &hashPrefix1, 5)
+	assertReplayLogEntry(t, rl, &hashPrefix2, 0)
+	assertReplayLogEntry(t, rl, &hashPrefix3, 0)
+
+	// Committing the batch again accepts its packets anew, rather than
+	// returning the replay set it was first committed with.
+	putBatch()
+	assertReplayLogEntry(t, rl, &hashPrefix2, 10)
+	assertReplayLogEntry(t, rl, &hashPrefix3, 10)
+
+	deleteBatch([]byte("batch"))
+	assertReplayLogEntry(t, rl, &hashPrefix2, 0)
+	assertReplayLogEntry(t, rl, &hashPrefix3, 0)
+}
+
+// TestFileReplayLogLargeBatch tests that a batch using every sequence number
+// up to DefaultTxMaxSeqNum survives a restart of a FileReplayLog, while a batch
+// whose record would be too large to be read back is rejected.
+func TestFileReplayLogLargeBatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large batch in short mode")
+	}
+
+	rl := newTestFileReplayLog(t)
+	startFileReplayLog(t, rl)
+
+	// Every sequence number holds a distinct entry, apart from the last,
+	// which replays the first.
+	hashPrefix := func(i uint32) *HashPrefix {
+		var hashPrefix HashPrefix
+		binary.BigEndian.PutUint32(hashPrefix[:], i)
+		return &hashPrefix
+	}
+	newBatch := func() *Batch {
+		batch := NewBatch(bytes.Repeat([]byte{1}, math.MaxUint16))
+		for i := uint32(0); i < DefaultTxMaxSeqNum; i++ {
+			err := batch.Put(i, hashPrefix(i), 1)
+			if err != nil {
+				t.Fatalf("unable to add entry to batch: %v",
+					err)
+			}
+		}
+		err := batch.Put(DefaultTxMaxSeqNum, hashPrefix(0), 1)
+		if err != nil {
+			t.Fatalf("unable to add entry to batch: %v", err)
+		}
+
+		return batch
+	}
+
+	replays, err := rl.PutBatch(newBatch())
+	if err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(DefaultTxMaxSeqNum) {
+		t.Fatalf("unexpected replay set: %v", replays.replays)
+	}
+
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+	startFileReplayLog(t, rl)
+	defer rl.Stop()
+
+	assertReplayLogEntry(t, rl, hashPrefix(0), 1)
+	assertReplayLogEntry(t, rl, hashPrefix(DefaultTxMaxSeqNum-1), 1)
+
+	replays, err = rl.PutBatch(newBatch())
+	if err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(DefaultTxMaxSeqNum) {
+		t.Fatalf("unexpected replay set: %v", replays.replays)
+	}
+
+	// A batch with more entries than fit in a record isn't written.
+	numEntries := maxRecordPayloadSize/(HashPrefixSize+4) + 1
+	entries := make([]batchEntry, numEntries)
+	_, err = encodeBatch(nil, 1, entries, NewReplaySet())
+	if err != ErrBatchTooLarge {
+		t.Fatalf("expected error %v, got %v", ErrBatchTooLarge, err)
+	}
+}
@@ -0,0 +1,234 @@
+package sphinx
+
+import (
+	"crypto/subtle"
+
+	"github.com/brsuite/brond/btcec"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// The scalar multiplication below runs in constant time with respect to the
+// scalar, since the onion key of the router and the blinding factors derived
+// from the shared secrets must not leak through timing. The point is kept in
+// homogeneous projective coordinates and points are added using the complete
+// formulas of Renes, Costello and Batina ("Complete addition formulas for
+// prime order elliptic curves", algorithm 7), which handle doubling and the
+// point at infinity without branching. Every field element is normalized
+// after each operation, so that the magnitude preconditions of FieldVal are
+// always met.
+
+const (
+	// scalarWindowSize is the number of bits of the scalar that are
+	// processed for each addition.
+	scalarWindowSize = 4
+
+	// scalarTableSize is the number of multiples of the point that are
+	// precomputed for the fixed window.
+	scalarTableSize = 1 << scalarWindowSize
+
+	// curveB3 is three times the b parameter of the secp256k1 curve
+	// equation y² = x³ + 7.
+	curveB3 = 21
+)
+
+// projectivePoint is a point of the secp256k1 curve in homogeneous projective
+// coordinates, representing the affine point (x/z, y/z). The point at
+// infinity is (0, 1, 0).
+type projectivePoint struct {
+	x, y, z secp256k1.FieldVal
+}
+
+// setIdentity sets the point to the point at infinity.
+func (p *projectivePoint) setIdentity() {
+	p.x.SetInt(0)
+	p.y.SetInt(1)
+	p.z.SetInt(0)
+}
+
+// setPubKey sets the point to the passed public key.
+func (p *projectivePoint) setPubKey(pubKey *btcec.PublicKey) {
+	var coord [32]byte
+	pubKey.X.FillBytes(coord[:])
+	p.x.SetBytes(&coord)
+	pubKey.Y.FillBytes(coord[:])
+	p.y.SetBytes(&coord)
+	p.z.SetInt(1)
+}
+
+// isOnCurve returns true if the passed public key is a point on the secp256k1
+// curve, using field arithmetic rather than big integers.
+func isOnCurve(pubKey *btcec.PublicKey) bool {
+	// Coordinates that aren't reduced modulo the field prime aren't
+	// valid.
+	if pubKey.X.Sign() < 0 || pubKey.Y.Sign() < 0 ||
+		pubKey.X.BitLen() > 256 || pubKey.Y.BitLen() > 256 {
+
+		return false
+	}
+
+	var (
+		coord          [32]byte
+		x, y, lhs, rhs secp256k1.FieldVal
+	)
+	pubKey.X.FillBytes(coord[:])
+	if x.SetBytes(&coord) != 0 {
+		return false
+	}
+	pubKey.Y.FillBytes(coord[:])
+	if y.SetBytes(&coord) != 0 {
+		return false
+	}
+
+	// Check that y² = x³ + 7.
+	lhs.SquareVal(&y).Normalize()
+	rhs.SquareVal(&x).Mul(&x).AddInt(7).Normalize()
+
+	return lhs.Equals(&rhs)
+}
+
+// fieldAdd sets r = a + b, normalized.
+func fieldAdd(r, a, b *secp256k1.FieldVal) {
+	r.Add2(a, b).Normalize()
+}
+
+// fieldSub sets r = a - b, normalized.
+func fieldSub(r, a, b *secp256k1.FieldVal) {
+	var negB secp256k1.FieldVal
+	negB.NegateVal(b, 1)
+	r.Add2(a, &negB).Normalize()
+}
+
+// fieldMul sets r = a * b, normalized.
+func fieldMul(r, a, b *secp256k1.FieldVal) {
+	r.Mul2(a, b).Normalize()
+}
+
+// fieldMulB3 sets r = 3b * a, normalized.
+func fieldMulB3(r, a *secp256k1.FieldVal) {
+	r.Set(a).MulInt(curveB3).Normalize()
+}
+
+// add sets the point to p + q. The formulas are complete, so p and q may be
+// equal, or either of them the point at infinity. The receiver may alias p or
+// q.
+func (r *projectivePoint) add(p, q *projectivePoint) {
+	var t0, t1, t2, t3, t4, x3, y3, z3, a, b secp256k1.FieldVal
+
+	fieldMul(&t0, &p.x, &q.x)
+	fieldMul(&t1, &p.y, &q.y)
+	fieldMul(&t2, &p.z, &q.z)
+
+	fieldAdd(&a, &p.x, &p.y)
+	fieldAdd(&b, &q.x, &q.y)
+	fieldMul(&t3, &a, &b)
+	fieldAdd(&t4, &t0, &t1)
+	fieldSub(&t3, &t3, &t4)
+
+	fieldAdd(&a, &p.y, &p.z)
+	fieldAdd(&b, &q.y, &q.z)
+	fieldMul(&t4, &a, &b)
+	fieldAdd(&x3, &t1, &t2)
+	fieldSub(&t4, &t4, &x3)
+
+	fieldAdd(&a, &p.x, &p.z)
+	fieldAdd(&b, &q.x, &q.z)
+	fieldMul(&x3, &a, &b)
+	fieldAdd(&y3, &t0, &t2)
+	fieldSub(&y3, &x3, &y3)
+
+	fieldAdd(&x3, &t0, &t0)
+	fieldAdd(&t0, &x3, &t0)
+	fieldMulB3(&t2, &t2)
+
+	fieldAdd(&z3, &t1, &t2)
+	fieldSub(&t1, &t1, &t2)
+	fieldMulB3(&y3, &y3)
+
+	fieldMul(&x3, &t4, &y3)
+	fieldMul(&t2, &t3, &t1)
+	fieldSub(&x3, &t2, &x3)
+
+	fieldMul(&y3, &y3, &t0)
+	fieldMul(&t1, &t1, &z3)
+	fieldAdd(&y3, &t1, &y3)
+
+	fieldMul(&t0, &t0, &t3)
+	fieldMul(&z3, &z3, &t4)
+	fieldAdd(&z3, &z3, &t0)
+
+	r.x, r.y, r.z = x3, y3, z3
+}
+
+// projectiveTable holds the serialized multiples 0*P through 15*P of a point,
+// from which entries are selected in constant time.
+type projectiveTable [scalarTableSize][96]byte
+
+// set fills the table with the multiples of the passed point.
+func (t *projectiveTable) set(p *projectivePoint) {
+	var multiple projectivePoint
+	multiple.setIdentity()
+
+	for i := range t {
+		multiple.x.PutBytesUnchecked(t[i][0:32])
+		multiple.y.PutBytesUnchecked(t[i][32:64])
+		multiple.z.PutBytesUnchecked(t[i][64:96])
+
+		multiple.add(&multiple, p)
+	}
+}
+
+// lookup sets result to the multiple of the point at the passed index. Every
+// entry of the table is read, so the memory access pattern doesn't depend on
+// the index.
+func (t *projectiveTable) lookup(index byte, result *projectivePoint) {
+	var entry [96]byte
+	for i := range t {
+		subtle.ConstantTimeCopy(
+			subtle.ConstantTimeByteEq(byte(i), index), entry[:],
+			t[i][:],
+		)
+	}
+
+	var coord [32]byte
+	copy(coord[:], entry[0:32])
+	result.x.SetBytes(&coord)
+	copy(coord[:], entry[32:64])
+	result.y.SetBytes(&coord)
+	copy(coord[:], entry[64:96])
+	result.z.SetBytes(&coord)
+}
+
+// scalarMultConstTime computes k*P in constant time with respect to the
+// big-endian scalar k, returning the normalized affine coordinates of the
+// result. The result is (0, 0) if it is the point at infinity.
+func scalarMultConstTime(pubKey *btcec.PublicKey,
+	k *[32]byte) (secp256k1.FieldVal, secp256k1.FieldVal) {
+
+	var p projectivePoint
+	p.setPubKey(pubKey)
+
+	var table projectiveTable
+	table.set(&p)
+
+	var result, multiple projectivePoint
+	result.setIdentity()
+	for _, b := range k {
+		for _, window := range [2]byte{b >> 4, b & 0x0f} {
+			for i := 0; i < scalarWindowSize; i++ {
+				result.add(&result, &result)
+			}
+
+			table.lookup(window, &multiple)
+			result.add(&result, &multiple)
+		}
+	}
+
+	// Convert the result back to affine coordinates. The inverse of zero
+	// is zero, so the point at infinity maps to (0, 0).
+	var zInv, x, y secp256k1.FieldVal
+	zInv.Set(&result.z).Inverse()
+	fieldMul(&x, &result.x, &zInv)
+	fieldMul(&y, &result.y, &zInv)
+
+	return x, y
+}
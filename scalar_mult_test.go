@@ -0,0 +1,146 @@
+package sphinx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/brsuite/brond/btcec"
+)
+
+// testScalars returns the scalars used to test the constant time scalar
+// multiplication, covering edge cases as well as random values.
+func testScalars(t *testing.T) [][32]byte {
+	var scalars [][32]byte
+
+	addScalar := func(k *big.Int) {
+		var scalar [32]byte
+		k.FillBytes(scalar[:])
+		scalars = append(scalars, scalar)
+	}
+
+	n := btcec.S256().N
+	addScalar(big.NewInt(1))
+	addScalar(big.NewInt(2))
+	addScalar(big.NewInt(15))
+	addScalar(big.NewInt(16))
+	addScalar(new(big.Int).Sub(n, big.NewInt(1)))
+	addScalar(new(big.Int).Rsh(n, 1))
+	addScalar(new(big.Int).Lsh(big.NewInt(1), 255))
+
+	// Scalars that aren't reduced modulo the group order are used as
+	// blinding factors as well.
+	addScalar(new(big.Int).Add(n, big.NewInt(5)))
+	addScalar(new(big.Int).SetBytes(bytes.Repeat([]byte{0xff}, 32)))
+
+	for i := 0; i < 20; i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		addScalar(privKey.D)
+	}
+
+	return scalars
+}
+
+// TestScalarMultConstTime tests that the constant time scalar multiplication
+// matches the result of the variable time implementation of btcec.
+func TestScalarMultConstTime(t *testing.T) {
+	t.Parallel()
+
+	pointKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	for _, point := range []*btcec.PublicKey{
+		pointKey.PubKey(),
+		{Curve: btcec.S256(), X: btcec.S256().Gx, Y: btcec.S256().Gy},
+	} {
+		for _, k := range testScalars(t) {
+			k := k
+
+			expX, expY := btcec.S256().ScalarMult(
+				point.X, point.Y, k[:],
+			)
+
+			x, y := scalarMultConstTime(point, &k)
+			if !bytes.Equal(x.Bytes()[:], expX.FillBytes(
+				make([]byte, 32),
+			)) || !bytes.Equal(y.Bytes()[:], expY.FillBytes(
+				make([]byte, 32),
+			)) {
+
+				t.Fatalf("scalar multiplication mismatch for "+
+					"scalar %x", k)
+			}
+
+			blinded := blindGroupElement(point, k[:])
+			if blinded.X.Cmp(expX) != 0 ||
+				blinded.Y.Cmp(expY) != 0 {
+
+				t.Fatalf("blinded element mismatch for "+
+					"scalar %x", k)
+			}
+		}
+	}
+
+	// A multiple of the group order yields the point at infinity.
+	var k [32]byte
+	btcec.S256().N.FillBytes(k[:])
+	x, y := scalarMultConstTime(pointKey.PubKey(), &k)
+	if !x.IsZero() || !y.IsZero() {
+		t.Fatalf("expected point at infinity")
+	}
+}
+
+// TestGenerateSharedSecretConstTime tests that the router side ECDH matches
+// the shared secret derived using the variable time implementation of btcec.
+func TestGenerateSharedSecretConstTime(t *testing.T) {
+	t.Parallel()
+
+	for i := 0; i < 20; i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		ephemeralKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		pub := ephemeralKey.PubKey()
+
+		s := &btcec.PublicKey{}
+		s.X, s.Y = btcec.S256().ScalarMult(
+			pub.X, pub.Y, privKey.D.Bytes(),
+		)
+		expected := sha256.Sum256(s.SerializeCompressed())
+
+		sharedSecret := generateSharedSecret(pub, privKey)
+		if sharedSecret != expected {
+			t.Fatalf("shared secret mismatch: expected %x, got %x",
+				expected, sharedSecret)
+		}
+	}
+}
+
+// BenchmarkScalarMultConstTime benchmarks the constant time scalar
+// multiplication.
+func BenchmarkScalarMultConstTime(b *testing.B) {
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		b.Fatalf("unable to generate key: %v", err)
+	}
+	pub := privKey.PubKey()
+
+	var k [32]byte
+	privKey.D.FillBytes(k[:])
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		scalarMultConstTime(pub, &k)
+	}
+}
@@ -0,0 +1,120 @@
+package sphinx
+
+import (
+	"crypto/sha256"
+	"hash"
+	"sync"
+
+	"github.com/aead/chacha20"
+	"github.com/brsuite/brond/btcec"
+)
+
+// unwrapScratch holds the buffers needed to peel a layer off an onion. They're
+// as large as the routing info, so they're taken from unwrapScratchPool and
+// reused across packets, rather than allocated for each of them.
+type unwrapScratch struct {
+	// hopInfo holds the decrypted routing info, followed by the decrypted
+	// padding that is shifted in for the next hop.
+	hopInfo [2 * MaxRoutingInfoSize]byte
+
+	// digest is used to compute the HMACs and hashes of the packet.
+	digest hash.Hash
+
+	// pad holds the inner or outer padded key of an HMAC.
+	pad [sha256.BlockSize]byte
+
+	// sum holds the output of the digest.
+	sum [sha256.Size]byte
+
+	// pubKey holds a compressed public key.
+	pubKey [33]byte
+}
+
+// unwrapScratchPool is the pool of scratch buffers used to unwrap onions.
+var unwrapScratchPool = sync.Pool{
+	New: func() interface{} {
+		return &unwrapScratch{
+			digest: sha256.New(),
+		}
+	},
+}
+
+// getUnwrapScratch takes a set of scratch buffers from the pool. They must be
+// returned using putUnwrapScratch once they're no longer used.
+func getUnwrapScratch() *unwrapScratch {
+	return unwrapScratchPool.Get().(*unwrapScratch)
+}
+
+// putUnwrapScratch returns a set of scratch buffers to the pool.
+func putUnwrapScratch(s *unwrapScratch) {
+	unwrapScratchPool.Put(s)
+}
+
+// hmac computes the HMAC-SHA-256 of the concatenation of the passed messages
+// using the passed key, which must not be longer than the block size of
+// SHA-256. The result matches that of crypto/hmac, without its allocations.
+func (s *unwrapScratch) hmac(key []byte, msgs ...[]byte) [sha256.Size]byte {
+	const (
+		innerPad = 0x36
+		outerPad = 0x5c
+	)
+
+	for i := range s.pad {
+		s.pad[i] = innerPad
+	}
+	xor(s.pad[:], s.pad[:], key)
+
+	s.digest.Reset()
+	s.digest.Write(s.pad[:])
+	for _, msg := range msgs {
+		s.digest.Write(msg)
+	}
+	s.digest.Sum(s.sum[:0])
+
+	for i := range s.pad {
+		s.pad[i] = outerPad
+	}
+	xor(s.pad[:], s.pad[:], key)
+
+	s.digest.Reset()
+	s.digest.Write(s.pad[:])
+	s.digest.Write(s.sum[:])
+	s.digest.Sum(s.sum[:0])
+
+	return s.sum
+}
+
+// generateKey is the equivalent of generateKey using the scratch buffers.
+func (s *unwrapScratch) generateKey(keyType string,
+	sharedKey *Hash256) [keyLen]byte {
+
+	mac := s.hmac([]byte(keyType), sharedKey[:])
+
+	var key [keyLen]byte
+	copy(key[:], mac[:keyLen])
+
+	return key
+}
+
+// xorCipherStream encrypts or decrypts the data in place using the cipher
+// stream of generateCipherStream.
+func xorCipherStream(key [keyLen]byte, data []byte) {
+	var nonce [8]byte
+	chacha20.XORKeyStream(data, data, nonce[:], key[:])
+}
+
+// computeBlindingFactor is the equivalent of computeBlindingFactor using the
+// scratch buffers.
+func (s *unwrapScratch) computeBlindingFactor(hopPubKey *btcec.PublicKey,
+	hopSharedSecret []byte) Hash256 {
+
+	s.pubKey[0] = 0x02 | byte(hopPubKey.Y.Bit(0))
+	hopPubKey.X.FillBytes(s.pubKey[1:])
+
+	s.digest.Reset()
+	s.digest.Write(s.pubKey[:])
+	s.digest.Write(hopSharedSecret)
+	s.digest.Sum(s.sum[:0])
+
+	return s.sum
+}
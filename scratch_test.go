@@ -0,0 +1,138 @@
+package sphinx
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/brsuite/brond/btcec"
+)
+
+// TestUnwrapScratch tests that the primitives using the scratch buffers match
+// the ones that allocate.
+func TestUnwrapScratch(t *testing.T) {
+	t.Parallel()
+
+	scratch := getUnwrapScratch()
+	defer putUnwrapScratch(scratch)
+
+	var sharedSecret Hash256
+	if _, err := rand.Read(sharedSecret[:]); err != nil {
+		t.Fatalf("unable to read random bytes: %v", err)
+	}
+
+	for _, keyType := range []string{"mu", "rho", "um", "ammag", "pad"} {
+		key := scratch.generateKey(keyType, &sharedSecret)
+		if key != generateKey(keyType, &sharedSecret) {
+			t.Fatalf("%s: key mismatch", keyType)
+		}
+
+		msg := bytes.Repeat([]byte{'M'}, 1300)
+		assocData := []byte("assoc")
+		mac := scratch.hmac(key[:], msg, assocData)
+		expected := calcMac(key, append(msg, assocData...))
+		if !bytes.Equal(mac[:HMACSize], expected[:]) {
+			t.Fatalf("%s: mac mismatch", keyType)
+		}
+
+		stream := make([]byte, 2*MaxRoutingInfoSize)
+		xorCipherStream(key, stream)
+		if !bytes.Equal(stream, generateCipherStream(
+			key, uint(len(stream)),
+		)) {
+
+			t.Fatalf("%s: cipher stream mismatch", keyType)
+		}
+	}
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	blindingFactor := scratch.computeBlindingFactor(
+		privKey.PubKey(), sharedSecret[:],
+	)
+	if blindingFactor != computeBlindingFactor(
+		privKey.PubKey(), sharedSecret[:],
+	) {
+
+		t.Fatalf("blinding factor mismatch")
+	}
+}
+
+// TestHopPayloadDecodeBytes tests that decoding a hop payload straight from a
+// slice yields the same payload and errors as decoding it from a reader.
+func TestHopPayloadDecodeBytes(t *testing.T) {
+	t.Parallel()
+
+	legacy := append(
+		[]byte{0}, bytes.Repeat([]byte{1}, LegacyHopDataSize-1)...,
+	)
+	tlv := append([]byte{3, 2, 1, 1}, bytes.Repeat([]byte{2}, 40)...)
+
+	testCases := []struct {
+		name string
+		b    []byte
+	}{
+		{name: "legacy", b: legacy},
+		{name: "legacy trailing", b: append(legacy, 1, 2, 3)},
+		{name: "legacy truncated", b: legacy[:40]},
+		{name: "tlv", b: tlv},
+		{name: "tlv empty", b: append([]byte{0x01}, tlv[4:]...)},
+		{name: "tlv truncated payload", b: tlv[:2]},
+		{name: "tlv missing payload", b: tlv[:1]},
+		{name: "tlv missing hmac", b: tlv[:4]},
+		{name: "tlv truncated hmac", b: tlv[:10]},
+		{name: "tlv large", b: append(
+			[]byte{0xfd, 0x01, 0x00}, bytes.Repeat([]byte{3}, 300)...,
+		)},
+		{name: "non canonical varint", b: []byte{0xfd, 0x00, 0x01}},
+		{name: "truncated varint", b: []byte{0xfe, 0x00}},
+		{name: "empty", b: nil},
+	}
+
+	for _, testCase := range testCases {
+		var expected HopPayload
+		expErr := expected.Decode(bytes.NewReader(testCase.b))
+
+		var payload HopPayload
+		err := payload.decodeBytes(testCase.b)
+		if err != expErr {
+			t.Fatalf("%s: expected error %v, got %v", testCase.name,
+				expErr, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		if !reflect.DeepEqual(payload, expected) {
+			t.Fatalf("%s: expected payload %v, got %v",
+				testCase.name, expected, payload)
+		}
+
+		expHopData, expErr := expected.HopData()
+		hopData, err := payload.HopData()
+		if err != expErr || !reflect.DeepEqual(hopData, expHopData) {
+			t.Fatalf("%s: hop data mismatch", testCase.name)
+		}
+	}
+}
+
+// TestHopPayloadDecodeBytesOversized tests that a payload claiming to be larger
+// than the remaining bytes is rejected without being allocated.
+func TestHopPayloadDecodeBytesOversized(t *testing.T) {
+	oversized := []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 1, 2, 3}
+	allocs := testing.AllocsPerRun(10, func() {
+		var payload HopPayload
+		err := payload.decodeBytes(oversized)
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected error %v, got %v",
+				io.ErrUnexpectedEOF, err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+}
@@ -0,0 +1,475 @@
+package sphinx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// snapshotMagic is written at the start of a snapshot, followed by its
+	// version.
+	snapshotMagic = "SPHXSNAP"
+
+	// SnapshotVersion is the version of the snapshots written by
+	// ExportSnapshot. Version 1 snapshots, whose batches don't record the
+	// entries they added, can still be read.
+	SnapshotVersion uint16 = 2
+
+	// snapshotVersionNoBatchEntries is the version of the snapshots whose
+	// batches don't record the entries they added.
+	snapshotVersionNoBatchEntries uint16 = 1
+
+	// snapshotHeaderSize is the size of the magic and version of a
+	// snapshot.
+	snapshotHeaderSize = len(snapshotMagic) + 2
+)
+
+// The types of the records of a snapshot. Records are framed and checksummed
+// in the same way as those of a FileReplayLog.
+const (
+	// snapshotRecordEntry holds the hash prefix and CLTV of an entry.
+	snapshotRecordEntry byte = 1
+
+	// snapshotRecordBatch holds the ID, expiry and replay set of a batch,
+	// along with the entries it added that are still in the log, encoded
+	// like the batch records of a FileReplayLog. The entries are also
+	// written as entry records.
+	snapshotRecordBatch byte = 2
+
+	// snapshotRecordEnd ends a snapshot, holding the number of entries and
+	// batches that precede it.
+	snapshotRecordEnd byte = 3
+)
+
+var (
+	// ErrInvalidSnapshot is returned when a snapshot is malformed,
+	// truncated or damaged.
+	ErrInvalidSnapshot = errors.New("invalid replay log snapshot")
+
+	// ErrUnsupportedSnapshotVersion is returned when a snapshot was written
+	// using a version of the format that isn't known.
+	ErrUnsupportedSnapshotVersion = errors.New("unsupported replay log " +
+		"snapshot version")
+
+	// ErrSnapshotMismatch is returned by VerifySnapshot when the replay
+	// log doesn't hold an entry or batch of the snapshot.
+	ErrSnapshotMismatch = errors.New("replay log doesn't match snapshot")
+)
+
+// ExportSnapshot writes a snapshot of the batches and entries of the passed
+// replay log to w, which can be imported into a log of any type using
+// ImportSnapshot. The snapshot is written as a stream, so the log doesn't need
+// to fit in memory twice.
+//
+// The batches are written before the entries, so that the entries of every
+// batch in the snapshot are always included. Each batch records the entries it
+// added, so that it can still be deleted using DeleteBatch once imported. For
+// the snapshot to be exact, no packets should be processed while it is taken.
+func ExportSnapshot(w io.Writer, log IterableReplayLog) error {
+	bw := bufio.NewWriter(w)
+
+	var header [snapshotHeaderSize]byte
+	copy(header[:], snapshotMagic)
+	binary.BigEndian.PutUint16(header[len(snapshotMagic):], SnapshotVersion)
+	if _, err := bw.Write(header[:]); err != nil {
+		return err
+	}
+
+	var (
+		record                 []byte
+		numBatches, numEntries uint64
+	)
+	var batchEntries []batchEntry
+	err := log.ForEachBatch(func(id []byte, replays *ReplaySet,
+		expiry uint32, entries []LogEntry) error {
+
+		batchEntries = batchEntries[:0]
+		for _, entry := range entries {
+			batchEntries = append(batchEntries, batchEntry{
+				hashPrefix: entry.HashPrefix,
+				cltv:       entry.Cltv,
+			})
+		}
+
+		payload, err := encodeBatch(id, expiry, batchEntries, replays)
+		if err != nil {
+			return err
+		}
+
+		record = encodeRecord(record[:0], snapshotRecordBatch, payload)
+		numBatches++
+
+		_, err = bw.Write(record)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = log.ForEachEntry(func(hashPrefix *HashPrefix, cltv uint32) error {
+		record = encodeRecord(
+			record[:0], snapshotRecordEntry,
+			encodeEntry(hashPrefix, &cltv),
+		)
+		numEntries++
+
+		_, err := bw.Write(record)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var end [16]byte
+	binary.BigEndian.PutUint64(end[:8], numBatches)
+	binary.BigEndian.PutUint64(end[8:], numEntries)
+	record = encodeRecord(record[:0], snapshotRecordEnd, end[:])
+	if _, err := bw.Write(record); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// ImportSnapshot reads a snapshot written by ExportSnapshot from r, adding its
+// batches and entries to the passed replay log, which must be started. Those
+// the log already holds are left as is, so importing a snapshot more than once
+// is harmless. The snapshot is applied as it is read, so a damaged snapshot may
+// be partially imported before ErrInvalidSnapshot is returned.
+//
+// The batches of a version 1 snapshot don't record the entries they added, so
+// these are imported on their own, and aren't removed when the batch is
+// deleted using DeleteBatch.
+func ImportSnapshot(r io.Reader, log ReplayLog) error {
+	return readSnapshot(r,
+		func(id []byte, replays *ReplaySet, expiry uint32,
+			entries []LogEntry) error {
+
+			batch, err := importedBatch(
+				log, id, replays, expiry, entries,
+			)
+			if err != nil {
+				return err
+			}
+
+			_, err = log.PutBatch(batch)
+			return err
+		},
+		func(hashPrefix *HashPrefix, cltv uint32) error {
+			err := log.Put(hashPrefix, cltv)
+			if err == ErrReplayedPacket {
+				return nil
+			}
+
+			return err
+		},
+	)
+}
+
+// VerifySnapshot reads a snapshot written by ExportSnapshot from r, checking
+// that the passed replay log holds each of its batches and entries unchanged.
+// The log may hold further batches and entries. If it doesn't match the
+// snapshot, an error wrapping ErrSnapshotMismatch is returned.
+func VerifySnapshot(r io.Reader, log IterableReplayLog) error {
+	type batchState struct {
+		replays *ReplaySet
+		expiry  uint32
+		entries map[HashPrefix]uint32
+	}
+	batches := make(map[string]batchState)
+	err := log.ForEachBatch(func(id []byte, replays *ReplaySet,
+		expiry uint32, entries []LogEntry) error {
+
+		replaysCopy := NewReplaySet()
+		replaysCopy.Merge(replays)
+
+		entriesCopy := make(map[HashPrefix]uint32, len(entries))
+		for _, entry := range entries {
+			entriesCopy[entry.HashPrefix] = entry.Cltv
+		}
+
+		batches[string(id)] = batchState{
+			replays: replaysCopy,
+			expiry:  expiry,
+			entries: entriesCopy,
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return readSnapshot(r,
+		func(id []byte, replays *ReplaySet, expiry uint32,
+			entries []LogEntry) error {
+
+			batch, ok := batches[string(id)]
+			switch {
+			case !ok:
+				return fmt.Errorf("%w: batch %x is missing",
+					ErrSnapshotMismatch, id)
+
+			case batch.expiry != expiry:
+				return fmt.Errorf("%w: batch %x expires at "+
+					"%d, expected %d", ErrSnapshotMismatch,
+					id, batch.expiry, expiry)
+
+			case !replaySetsEqual(batch.replays, replays):
+				return fmt.Errorf("%w: batch %x has different "+
+					"replays", ErrSnapshotMismatch, id)
+			}
+
+			for _, entry := range entries {
+				cltv, ok := batch.entries[entry.HashPrefix]
+				if !ok || cltv != entry.Cltv {
+					return fmt.Errorf("%w: batch %x is "+
+						"missing entry %x",
+						ErrSnapshotMismatch, id,
+						entry.HashPrefix[:])
+				}
+			}
+
+			return nil
+		},
+		func(hashPrefix *HashPrefix, cltv uint32) error {
+			storedCltv, err := log.Get(hashPrefix)
+			switch {
+			case err == ErrLogEntryNotFound:
+				return fmt.Errorf("%w: entry %x is missing",
+					ErrSnapshotMismatch, hashPrefix[:])
+
+			case err != nil:
+				return err
+
+			case storedCltv != cltv:
+				return fmt.Errorf("%w: entry %x has cltv %d, "+
+					"expected %d", ErrSnapshotMismatch,
+					hashPrefix[:], storedCltv, cltv)
+			}
+
+			return nil
+		},
+	)
+}
+
+// importedBatch returns a batch that adds the passed entries of a batch read
+// from a snapshot to the log, along with its replay set and expiry. The log
+// doesn't record the original sequence numbers of the entries, so they're
+// added using sequence numbers that aren't in the replay set. Entries the log
+// already holds weren't added by the batch, and so are left out.
+func importedBatch(log ReplayLog, id []byte, replays *ReplaySet,
+	expiry uint32, entries []LogEntry) (*Batch, error) {
+
+	batch := NewBatch(id)
+	batch.ReplaySet = replays
+	batch.minExpiry = expiry
+
+	var seqNum uint32
+	for i := range entries {
+		entry := &entries[i]
+
+		_, err := log.Get(&entry.HashPrefix)
+		switch {
+		case err == nil:
+			continue
+
+		case err != ErrLogEntryNotFound:
+			return nil, err
+		}
+
+		for replays.Contains(seqNum) {
+			seqNum++
+		}
+		err = batch.Put(seqNum, &entry.HashPrefix, entry.Cltv)
+		if err != nil {
+			return nil, err
+		}
+		seqNum++
+	}
+
+	return batch, nil
+}
+
+// readSnapshot reads a snapshot from r, calling the passed functions for each
+// of its batches and entries in turn.
+func readSnapshot(r io.Reader,
+	onBatch func(id []byte, replays *ReplaySet, expiry uint32,
+		entries []LogEntry) error,
+	onEntry func(hashPrefix *HashPrefix, cltv uint32) error) error {
+
+	br := bufio.NewReader(r)
+
+	var header [snapshotHeaderSize]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return snapshotReadError(err)
+	}
+	if !bytes.Equal(header[:len(snapshotMagic)], []byte(snapshotMagic)) {
+		return ErrInvalidSnapshot
+	}
+	version := binary.BigEndian.Uint16(header[len(snapshotMagic):])
+	if version != SnapshotVersion &&
+		version != snapshotVersionNoBatchEntries {
+
+		return ErrUnsupportedSnapshotVersion
+	}
+
+	var numBatches, numEntries uint64
+	for {
+		recordType, payload, err := readSnapshotRecord(br)
+		if err != nil {
+			return err
+		}
+
+		switch recordType {
+		case snapshotRecordBatch:
+			id, expiry, entries, replays, err :=
+				decodeSnapshotBatch(payload, version)
+			if err != nil {
+				return err
+			}
+			err = onBatch(id, replays, expiry, entries)
+			if err != nil {
+				return err
+			}
+			numBatches++
+
+		case snapshotRecordEntry:
+			if len(payload) != HashPrefixSize+4 {
+				return ErrInvalidSnapshot
+			}
+
+			var hashPrefix HashPrefix
+			copy(hashPrefix[:], payload)
+			cltv := binary.BigEndian.Uint32(
+				payload[HashPrefixSize:],
+			)
+			if err := onEntry(&hashPrefix, cltv); err != nil {
+				return err
+			}
+			numEntries++
+
+		// The counts held by the end record guard against records
+		// having been dropped as a whole.
+		case snapshotRecordEnd:
+			if len(payload) != 16 {
+				return ErrInvalidSnapshot
+			}
+
+			endBatches := binary.BigEndian.Uint64(payload[:8])
+			endEntries := binary.BigEndian.Uint64(payload[8:])
+			if endBatches != numBatches ||
+				endEntries != numEntries {
+
+				return ErrInvalidSnapshot
+			}
+
+			return nil
+
+		default:
+			return ErrInvalidSnapshot
+		}
+	}
+}
+
+// readSnapshotRecord reads the next record of a snapshot, returning its type
+// and payload.
+func readSnapshotRecord(r io.Reader) (byte, []byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, snapshotReadError(err)
+	}
+
+	payloadLen := binary.BigEndian.Uint32(header[1:])
+	if payloadLen > maxRecordPayloadSize {
+		return 0, nil, ErrInvalidSnapshot
+	}
+
+	record := make([]byte, recordHeaderSize+payloadLen+recordChecksumSize)
+	copy(record, header[:])
+	if _, err := io.ReadFull(r, record[recordHeaderSize:]); err != nil {
+		return 0, nil, snapshotReadError(err)
+	}
+
+	recordType, payload, _, ok := decodeRecord(record)
+	if !ok {
+		return 0, nil, ErrInvalidSnapshot
+	}
+
+	return recordType, payload, nil
+}
+
+// snapshotReadError maps the errors signaling that a snapshot ended early to
+// ErrInvalidSnapshot.
+func snapshotReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrInvalidSnapshot
+	}
+
+	return err
+}
+
+// decodeSnapshotBatch decodes the payload of a batch record of a snapshot of
+// the passed version.
+func decodeSnapshotBatch(payload []byte, version uint16) ([]byte, uint32,
+	[]LogEntry, *ReplaySet, error) {
+
+	if len(payload) < 2 {
+		return nil, 0, nil, nil, ErrInvalidSnapshot
+	}
+	idLen := int(binary.BigEndian.Uint16(payload[:2]))
+	payload = payload[2:]
+
+	// The ID is followed by the expiry and the number of entries, which is
+	// always zero in version 1 snapshots.
+	if len(payload) < idLen+8 {
+		return nil, 0, nil, nil, ErrInvalidSnapshot
+	}
+	id := append([]byte(nil), payload[:idLen]...)
+	expiry := binary.BigEndian.Uint32(payload[idLen:])
+	numEntries := binary.BigEndian.Uint32(payload[idLen+4:])
+	payload = payload[idLen+8:]
+
+	const entrySize = HashPrefixSize + 4
+	if (version == snapshotVersionNoBatchEntries && numEntries != 0) ||
+		uint64(len(payload)) < uint64(numEntries)*entrySize {
+
+		return nil, 0, nil, nil, ErrInvalidSnapshot
+	}
+
+	entries := make([]LogEntry, numEntries)
+	for i := range entries {
+		copy(entries[i].HashPrefix[:], payload)
+		entries[i].Cltv = binary.BigEndian.Uint32(
+			payload[HashPrefixSize:],
+		)
+		payload = payload[entrySize:]
+	}
+
+	replays := NewReplaySet()
+	if err := replays.Decode(bytes.NewReader(payload)); err != nil {
+		return nil, 0, nil, nil, ErrInvalidSnapshot
+	}
+
+	return id, expiry, entries, replays, nil
+}
+
+// replaySetsEqual returns true if the passed replay sets hold the same
+// sequence numbers.
+func replaySetsEqual(a, b *ReplaySet) bool {
+	if a.Size() != b.Size() {
+		return false
+	}
+
+	for seqNum := range a.replays {
+		if !b.Contains(seqNum) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,365 @@
+package sphinx
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// populateReplayLog adds a number of entries and batches to the passed replay
+// log, returning the batches that were added.
+func populateReplayLog(t *testing.T, rl ReplayLog) []*Batch {
+	for i := 0; i < 50; i++ {
+		if err := rl.Put(randHashPrefix(t), uint32(i+1)); err != nil {
+			t.Fatalf("unable to put entry: %v", err)
+		}
+	}
+
+	// Each batch holds a packet twice, along with a replay of an entry of
+	// the previous batch.
+	var (
+		batches []*Batch
+		prev    *HashPrefix
+	)
+	for i := 0; i < 5; i++ {
+		batch := NewBatch([]byte{byte(i)})
+		hashPrefix := randHashPrefix(t)
+		cltv := uint32(100 + i)
+		for seqNum := uint32(0); seqNum < 2; seqNum++ {
+			err := batch.Put(seqNum, hashPrefix, cltv)
+			if err != nil {
+				t.Fatalf("unable to add entry to batch: %v",
+					err)
+			}
+		}
+		if prev != nil {
+			if err := batch.Put(2, prev, cltv); err != nil {
+				t.Fatalf("unable to add entry to batch: %v",
+					err)
+			}
+		}
+		prev = hashPrefix
+
+		if _, err := rl.PutBatch(batch); err != nil {
+			t.Fatalf("unable to put batch: %v", err)
+		}
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+// TestSnapshotMigration tests that a snapshot of a MemoryReplayLog can be
+// imported into a FileReplayLog, which then provides the same replay
+// protection, along with the same results when batches are reprocessed.
+func TestSnapshotMigration(t *testing.T) {
+	t.Parallel()
+
+	memLog := NewMemoryReplayLog()
+	if err := memLog.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer memLog.Stop()
+
+	batches := populateReplayLog(t, memLog)
+
+	var snapshot bytes.Buffer
+	if err := ExportSnapshot(&snapshot, memLog); err != nil {
+		t.Fatalf("unable to export snapshot: %v", err)
+	}
+	if err := VerifySnapshot(bytes.NewReader(snapshot.Bytes()),
+		memLog); err != nil {
+
+		t.Fatalf("unable to verify snapshot: %v", err)
+	}
+
+	// Import the snapshot twice, which must be harmless, and verify it
+	// against the file log across a restart.
+	fileLog := newTestFileReplayLog(t)
+	startFileReplayLog(t, fileLog)
+	for i := 0; i < 2; i++ {
+		err := ImportSnapshot(
+			bytes.NewReader(snapshot.Bytes()), fileLog,
+		)
+		if err != nil {
+			t.Fatalf("unable to import snapshot: %v", err)
+		}
+	}
+	if err := fileLog.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+	startFileReplayLog(t, fileLog)
+	defer fileLog.Stop()
+
+	if err := VerifySnapshot(bytes.NewReader(snapshot.Bytes()),
+		fileLog); err != nil {
+
+		t.Fatalf("unable to verify snapshot: %v", err)
+	}
+
+	// Reprocessing each batch yields the replays it was first committed
+	// with.
+	for i, batch := range batches {
+		replays, err := fileLog.PutBatch(&Batch{
+			ID:          batch.ID,
+			ReplaySet:   NewReplaySet(),
+			entries:     batch.entries,
+			replayCache: batch.replayCache,
+		})
+		if err != nil {
+			t.Fatalf("unable to put batch: %v", err)
+		}
+		if !replaySetsEqual(replays, batch.ReplaySet) {
+			t.Fatalf("batch %d: replays don't match", i)
+		}
+	}
+
+	// The batches keep their expiry, so they're kept until all of their
+	// entries have expired.
+	if err := fileLog.Expire(104); err != nil {
+		t.Fatalf("unable to expire entries: %v", err)
+	}
+	var numBatches int
+	err := fileLog.ForEachBatch(func([]byte, *ReplaySet, uint32,
+		[]LogEntry) error {
+
+		numBatches++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to iterate batches: %v", err)
+	}
+	if numBatches != 1 {
+		t.Fatalf("expected 1 batch, got %d", numBatches)
+	}
+}
+
+// TestSnapshotDeleteBatch tests that the batches imported from a snapshot can
+// still be deleted along with the entries they added.
+func TestSnapshotDeleteBatch(t *testing.T) {
+	t.Parallel()
+
+	memLog := NewMemoryReplayLog()
+	if err := memLog.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer memLog.Stop()
+
+	batches := populateReplayLog(t, memLog)
+
+	var snapshot bytes.Buffer
+	if err := ExportSnapshot(&snapshot, memLog); err != nil {
+		t.Fatalf("unable to export snapshot: %v", err)
+	}
+
+	fileLog := newTestFileReplayLog(t)
+	for _, rl := range []IterableReplayLog{NewMemoryReplayLog(), fileLog} {
+		if err := rl.Start(); err != nil {
+			t.Fatalf("unable to start replay log: %v", err)
+		}
+
+		err := ImportSnapshot(bytes.NewReader(snapshot.Bytes()), rl)
+		if err != nil {
+			t.Fatalf("unable to import snapshot: %v", err)
+		}
+		if err := VerifySnapshot(bytes.NewReader(snapshot.Bytes()),
+			rl); err != nil {
+
+			t.Fatalf("unable to verify snapshot: %v", err)
+		}
+
+		// Deleting a batch removes the entry it added, but not the
+		// one it replayed, which was added by the previous batch.
+		batch := batches[2]
+		hashPrefix := batch.entries[0].hashPrefix
+		prevHashPrefix := batches[1].entries[0].hashPrefix
+		if err := rl.DeleteBatch(batch.ID); err != nil {
+			t.Fatalf("unable to delete batch: %v", err)
+		}
+		assertReplayLogEntry(t, rl, &hashPrefix, 0)
+		assertReplayLogEntry(t, rl, &prevHashPrefix, 101)
+
+		// The deletion holds across a restart of the file log, after
+		// which the entry of the batch is accepted anew, while the
+		// replay of the previous batch is still detected.
+		if rl == fileLog {
+			if err := fileLog.Stop(); err != nil {
+				t.Fatalf("unable to stop replay log: %v", err)
+			}
+			startFileReplayLog(t, fileLog)
+			assertReplayLogEntry(t, rl, &hashPrefix, 0)
+		}
+
+		replays, err := rl.PutBatch(&Batch{
+			ID:          batch.ID,
+			ReplaySet:   NewReplaySet(),
+			entries:     batch.entries,
+			replayCache: batch.replayCache,
+		})
+		if err != nil {
+			t.Fatalf("unable to put batch: %v", err)
+		}
+		if replays.Size() != 1 || !replays.Contains(2) {
+			t.Fatalf("unexpected replay set: %v", replays.replays)
+		}
+		assertReplayLogEntry(t, rl, &hashPrefix, 102)
+
+		if err := rl.Stop(); err != nil {
+			t.Fatalf("unable to stop replay log: %v", err)
+		}
+	}
+}
+
+// TestSnapshotVersion1 tests that a version 1 snapshot, whose batches don't
+// record the entries they added, can still be imported.
+func TestSnapshotVersion1(t *testing.T) {
+	t.Parallel()
+
+	batchID := []byte("batch")
+	hashPrefix := randHashPrefix(t)
+	cltv := uint32(7)
+
+	replays := NewReplaySet()
+	replays.Add(1)
+	batchPayload, err := encodeBatch(batchID, cltv, nil, replays)
+	if err != nil {
+		t.Fatalf("unable to encode batch: %v", err)
+	}
+
+	snapshot := []byte(snapshotMagic)
+	snapshot = append(snapshot, 0, 1)
+	snapshot = encodeRecord(snapshot, snapshotRecordBatch, batchPayload)
+	snapshot = encodeRecord(
+		snapshot, snapshotRecordEntry, encodeEntry(hashPrefix, &cltv),
+	)
+	end := make([]byte, 16)
+	end[7], end[15] = 1, 1
+	snapshot = encodeRecord(snapshot, snapshotRecordEnd, end)
+
+	rl := NewMemoryReplayLog()
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	if err := ImportSnapshot(bytes.NewReader(snapshot), rl); err != nil {
+		t.Fatalf("unable to import snapshot: %v", err)
+	}
+	if err := VerifySnapshot(bytes.NewReader(snapshot), rl); err != nil {
+		t.Fatalf("unable to verify snapshot: %v", err)
+	}
+	assertReplayLogEntry(t, rl, hashPrefix, cltv)
+
+	storedReplays, err := rl.PutBatch(NewBatch(batchID))
+	if err != nil {
+		t.Fatalf("unable to put batch: %v", err)
+	}
+	if !replaySetsEqual(storedReplays, replays) {
+		t.Fatalf("replays don't match")
+	}
+}
+
+// TestSnapshotVerifyMismatch tests that verifying a snapshot against a log
+// that lost some of its contents fails.
+func TestSnapshotVerifyMismatch(t *testing.T) {
+	t.Parallel()
+
+	rl := NewMemoryReplayLog()
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	hashPrefix := randHashPrefix(t)
+	if err := rl.Put(hashPrefix, 1); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	batches := populateReplayLog(t, rl)
+
+	var snapshot bytes.Buffer
+	if err := ExportSnapshot(&snapshot, rl); err != nil {
+		t.Fatalf("unable to export snapshot: %v", err)
+	}
+
+	// Entries added after the snapshot was taken don't matter.
+	if err := rl.Put(randHashPrefix(t), 1); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if err := VerifySnapshot(bytes.NewReader(snapshot.Bytes()),
+		rl); err != nil {
+
+		t.Fatalf("unable to verify snapshot: %v", err)
+	}
+
+	// An entry that was modified or removed does.
+	if err := rl.Delete(hashPrefix); err != nil {
+		t.Fatalf("unable to delete entry: %v", err)
+	}
+	if err := rl.Put(hashPrefix, 2); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	err := VerifySnapshot(bytes.NewReader(snapshot.Bytes()), rl)
+	if !errors.Is(err, ErrSnapshotMismatch) {
+		t.Fatalf("expected error %v, got %v", ErrSnapshotMismatch, err)
+	}
+
+	if err := rl.Delete(hashPrefix); err != nil {
+		t.Fatalf("unable to delete entry: %v", err)
+	}
+	err = VerifySnapshot(bytes.NewReader(snapshot.Bytes()), rl)
+	if !errors.Is(err, ErrSnapshotMismatch) {
+		t.Fatalf("expected error %v, got %v", ErrSnapshotMismatch, err)
+	}
+
+	// So do missing batches, which are verified before the entries.
+	if err := rl.Expire(uint32(100 + len(batches))); err != nil {
+		t.Fatalf("unable to expire entries: %v", err)
+	}
+	err = VerifySnapshot(bytes.NewReader(snapshot.Bytes()), rl)
+	if !errors.Is(err, ErrSnapshotMismatch) {
+		t.Fatalf("expected error %v, got %v", ErrSnapshotMismatch, err)
+	}
+}
+
+// TestSnapshotInvalid tests that truncated, damaged and unknown snapshots are
+// rejected.
+func TestSnapshotInvalid(t *testing.T) {
+	t.Parallel()
+
+	rl := NewMemoryReplayLog()
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	populateReplayLog(t, rl)
+
+	var b bytes.Buffer
+	if err := ExportSnapshot(&b, rl); err != nil {
+		t.Fatalf("unable to export snapshot: %v", err)
+	}
+	snapshot := b.Bytes()
+
+	for n := 0; n < len(snapshot); n++ {
+		err := VerifySnapshot(bytes.NewReader(snapshot[:n]), rl)
+		if err != ErrInvalidSnapshot {
+			t.Fatalf("snapshot truncated to %d bytes: expected "+
+				"error %v, got %v", n, ErrInvalidSnapshot, err)
+		}
+	}
+
+	damaged := append([]byte(nil), snapshot...)
+	damaged[len(damaged)/2] ^= 1
+	err := VerifySnapshot(bytes.NewReader(damaged), rl)
+	if err != ErrInvalidSnapshot {
+		t.Fatalf("expected error %v, got %v", ErrInvalidSnapshot, err)
+	}
+
+	unknown := append([]byte(nil), snapshot...)
+	unknown[len(snapshotMagic)+1]++
+	err = ImportSnapshot(bytes.NewReader(unknown), NewMemoryReplayLog())
+	if err != ErrUnsupportedSnapshotVersion {
+		t.Fatalf("expected error %v, got %v",
+			ErrUnsupportedSnapshotVersion, err)
+	}
+}
@@ -2,16 +2,19 @@ package sphinx
 
 import (
 	"bytes"
-	"crypto/ecdsa"
 	"crypto/hmac"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
-	"math/big"
+	"runtime"
+	"sync"
+	"time"
 
 	"github.com/brsuite/brond/btcec"
 	"github.com/brsuite/brond/chaincfg"
 	"github.com/brsuite/bronutil"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 )
 
 const (
@@ -44,26 +47,30 @@ const (
 	LegacyHopDataSize = (RealmByteSize + AddressSize + AmtForwardSize +
 		OutgoingCLTVSize + NumPaddingBytes + HMACSize)
 
-	// MaxPayloadSize is the maximum size a payload for a single hop can be.
-	// This is the worst case scenario of a single hop, consuming all
-	// available space. We need to know this in order to generate a
-	// sufficiently long stream of pseudo-random bytes when
-	// encrypting/decrypting the payload.
+	// MaxPayloadSize is the maximum size a payload for a single hop can be
+	// within a regular payment onion. This is the worst case scenario of a
+	// single hop, consuming all available space. We need to know this in
+	// order to generate a sufficiently long stream of pseudo-random bytes
+	// when encrypting/decrypting the payload.
 	MaxPayloadSize = routingInfoSize
 
-	// routingInfoSize is the fixed size of the the routing info. This
-	// consists of a addressSize byte address and a HMACSize byte HMAC for
-	// each hop of the route, the first pair in cleartext and the following
-	// pairs increasingly obfuscated. If not all space is used up, the
-	// remainder is padded with null-bytes, also obfuscated.
+	// routingInfoSize is the size of the the routing info of a BOLT 04
+	// payment onion. This consists of a addressSize byte address and a
+	// HMACSize byte HMAC for each hop of the route, the first pair in
+	// cleartext and the following pairs increasingly obfuscated. If not
+	// all space is used up, the remainder is padded with null-bytes, also
+	// obfuscated.
 	routingInfoSize = 1300
 
-	// numStreamBytes is the number of bytes produced by our CSPRG for the
-	// key stream implementing our stream cipher to encrypt/decrypt the mix
-	// header. The MaxPayloadSize bytes at the end are used to
-	// encrypt/decrypt the fillers when processing the packet of generating
-	// the HMACs when creating the packet.
-	numStreamBytes = routingInfoSize * 2
+	// MaxRoutingInfoSize is the largest routing info size that can be
+	// selected for an onion packet. This is the size used by the largest
+	// onion messages.
+	MaxRoutingInfoSize = 32768
+
+	// onionPacketOverhead is the number of bytes of an encoded onion
+	// packet that aren't part of its routing info: the version byte, the
+	// ephemeral key and the HMAC.
+	onionPacketOverhead = 1 + btcec.PubKeyBytesLenCompressed + HMACSize
 
 	// keyLen is the length of the keys used to generate cipher streams and
 	// encrypt payloads. Since we use SHA256 to generate the keys, the
@@ -75,8 +82,16 @@ const (
 )
 
 var (
+	// ErrMaxRoutingInfoSizeExceeded is returned when the payloads of a
+	// payment path don't fit into the routing info of the onion packet.
 	ErrMaxRoutingInfoSizeExceeded = fmt.Errorf(
-		"max routing info size of %v bytes exceeded", routingInfoSize)
+		"max routing info size exceeded")
+
+	// ErrInvalidRoutingInfoSize is returned when an onion packet is
+	// constructed with a routing info size that is either non-positive,
+	// or exceeds MaxRoutingInfoSize.
+	ErrInvalidRoutingInfoSize = fmt.Errorf("routing info size must be "+
+		"between 1 and %v bytes", MaxRoutingInfoSize)
 )
 
 // OnionPacket is the onion wrapped hop-to-hop routing information necessary to
@@ -104,8 +119,11 @@ type OnionPacket struct {
 
 	// RoutingInfo is the full routing information for this onion packet.
 	// This encodes all the forwarding instructions for this current hop
-	// and all the hops in the route.
-	RoutingInfo [routingInfoSize]byte
+	// and all the hops in the route. For a regular payment onion, this is
+	// 1300 bytes long, though other applications such as trampoline
+	// onions or onion messages may select a different size when
+	// constructing the packet.
+	RoutingInfo []byte
 
 	// HeaderMAC is an HMAC computed with the shared secret of the routing
 	// data and the associated data for this route. Including the
@@ -127,13 +145,6 @@ func generateSharedSecrets(paymentPath []*btcec.PublicKey,
 	numHops := len(paymentPath)
 	hopSharedSecrets := make([]Hash256, numHops)
 
-	// Compute the triplet for the first hop outside of the main loop.
-	// Within the loop each new triplet will be computed recursively based
-	// off of the blinding factor of the last hop.
-	lastEphemeralPubKey := sessionKey.PubKey()
-	hopSharedSecrets[0] = generateSharedSecret(paymentPath[0], sessionKey)
-	lastBlindingFactor := computeBlindingFactor(lastEphemeralPubKey, hopSharedSecrets[0][:])
-
 	// The cached blinding factor will contain the running product of the
 	// session private key x and blinding factors b_i, computed as
 	//   c_0 = x
@@ -141,37 +152,48 @@ func generateSharedSecrets(paymentPath []*btcec.PublicKey,
 	//       = x * b_0 * b_1 * ... * b_{i-1} (mod |F(G)|).
 	//
 	// We begin with just the session private key x, so that base case
-	// c_0 = x. At the beginning of each iteration, the previous blinding
-	// factor is aggregated into the modular product, and used as the scalar
-	// value in deriving the hop ephemeral keys and shared secrets.
-	var cachedBlindingFactor big.Int
-	cachedBlindingFactor.SetBytes(sessionKey.D.Bytes())
-
-	// Now recursively compute the cached blinding factor, ephemeral ECDH
-	// pub keys, and shared secret for each hop.
-	var nextBlindingFactor big.Int
-	for i := 1; i <= numHops-1; i++ {
-		// Update the cached blinding factor with b_{i-1}.
-		nextBlindingFactor.SetBytes(lastBlindingFactor[:])
-		cachedBlindingFactor.Mul(&cachedBlindingFactor, &nextBlindingFactor)
-		cachedBlindingFactor.Mod(&cachedBlindingFactor, btcec.S256().Params().N)
-
+	// c_0 = x. At the end of each iteration, the blinding factor of the
+	// hop is aggregated into the modular product, and used as the scalar
+	// value in deriving the ephemeral key and shared secret of the next
+	// hop.
+	//
+	// All of the arithmetic is carried out using the field and scalar
+	// types of the secp256k1 package, in Jacobian coordinates, so that
+	// points are only converted to affine coordinates when they need to
+	// be serialized.
+	var cachedBlindingFactor, blindingFactor secp256k1.ModNScalar
+	cachedBlindingFactor.SetByteSlice(sessionKey.D.Bytes())
+
+	// The ephemeral key of the first hop is our session key, for which we
+	// already know the public key.
+	lastEphemeralPubKey := sessionKey.PubKey().SerializeCompressed()
+
+	var hopPubKey, ephemeralKey, hopBlindedPubKey secp256k1.JacobianPoint
+	for i := 0; i < numHops; i++ {
 		// a_i = g ^ c_i
 		//     = g^( x * b_0 * ... * b_{i-1} )
 		//     = X^( b_0 * ... * b_{i-1} )
 		// X_our_session_pub_key x all prev blinding factors
-		lastEphemeralPubKey = blindBaseElement(cachedBlindingFactor.Bytes())
+		if i > 0 {
+			secp256k1.ScalarBaseMultNonConst(
+				&cachedBlindingFactor, &ephemeralKey,
+			)
+			lastEphemeralPubKey = serializeJacobian(&ephemeralKey)
+		}
 
 		// e_i = Y_i ^ c_i
 		//     = ( Y_i ^ x )^( b_0 * ... * b_{i-1} )
 		// (Y_their_pub_key x x_our_priv) x all prev blinding factors
-		hopBlindedPubKey := blindGroupElement(
-			paymentPath[i], cachedBlindingFactor.Bytes(),
+		pubKeyToJacobian(paymentPath[i], &hopPubKey)
+		secp256k1.ScalarMultNonConst(
+			&cachedBlindingFactor, &hopPubKey, &hopBlindedPubKey,
 		)
 
 		// s_i = sha256( e_i )
 		//     = sha256( Y_i ^ (x * b_0 * ... * b_{i-1} )
-		hopSharedSecrets[i] = sha256.Sum256(hopBlindedPubKey.SerializeCompressed())
+		hopSharedSecrets[i] = sha256.Sum256(
+			serializeJacobian(&hopBlindedPubKey),
+		)
 
 		// Only need to evaluate up to the penultimate blinding factor.
 		if i >= numHops-1 {
@@ -179,21 +201,58 @@ func generateSharedSecrets(paymentPath []*btcec.PublicKey,
 		}
 
 		// b_i = sha256( a_i || s_i )
-		lastBlindingFactor = computeBlindingFactor(
+		hopBlindingFactor := computeBlindingFactorBytes(
 			lastEphemeralPubKey, hopSharedSecrets[i][:],
 		)
+
+		// Update the cached blinding factor with b_i.
+		blindingFactor.SetBytes((*[32]byte)(&hopBlindingFactor))
+		cachedBlindingFactor.Mul(&blindingFactor)
 	}
 
 	return hopSharedSecrets
 }
 
+// OnionPacketOpt is a functional option that can be used to modify how a new
+// onion packet is constructed.
+type OnionPacketOpt func(*onionPacketCfg)
+
+// onionPacketCfg houses the set of optional arguments that can be passed in
+// when constructing an onion packet.
+type onionPacketCfg struct {
+	// routingInfoSize is the size of the routing info of the packet.
+	routingInfoSize int
+}
+
+// WithRoutingInfoSize is a functional option that sets the size of the routing
+// info of the onion packet, in place of the 1300 bytes used by BOLT 04
+// payment onions. The packet will keep this size throughout its transit, so
+// all nodes along the route must know to expect it.
+func WithRoutingInfoSize(size int) OnionPacketOpt {
+	return func(cfg *onionPacketCfg) {
+		cfg.routingInfoSize = size
+	}
+}
+
 // NewOnionPacket creates a new onion packet which is capable of obliviously
 // routing a message through the mix-net path outline by 'paymentPath'.
 func NewOnionPacket(paymentPath *PaymentPath, sessionKey *btcec.PrivateKey,
-	assocData []byte, pktFiller PacketFiller) (*OnionPacket, error) {
+	assocData []byte, pktFiller PacketFiller,
+	opts ...OnionPacketOpt) (*OnionPacket, error) {
+
+	cfg := &onionPacketCfg{
+		routingInfoSize: routingInfoSize,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if cfg.routingInfoSize <= 0 || cfg.routingInfoSize > MaxRoutingInfoSize {
+		return nil, ErrInvalidRoutingInfoSize
+	}
 
 	// Check whether total payload size doesn't exceed the hard maximum.
-	if paymentPath.TotalPayloadSize() > routingInfoSize {
+	if paymentPath.TotalPayloadSize() > cfg.routingInfoSize {
 		return nil, ErrMaxRoutingInfoSizeExceeded
 	}
 
@@ -216,18 +275,20 @@ func NewOnionPacket(paymentPath *PaymentPath, sessionKey *btcec.PrivateKey,
 	)
 
 	// Generate the padding, called "filler strings" in the paper.
-	filler := generateHeaderPadding("rho", paymentPath, hopSharedSecrets)
+	filler := generateHeaderPadding(
+		"rho", paymentPath, hopSharedSecrets, cfg.routingInfoSize,
+	)
 
 	// Allocate zero'd out byte slices to store the final mix header packet
 	// and the hmac for each hop.
 	var (
-		mixHeader     [routingInfoSize]byte
+		mixHeader     = make([]byte, cfg.routingInfoSize)
 		nextHmac      [HMACSize]byte
 		hopPayloadBuf bytes.Buffer
 	)
 
 	// Fill the packet using the caller specified methodology.
-	if err := pktFiller(sessionKey, &mixHeader); err != nil {
+	if err := pktFiller(sessionKey, mixHeader); err != nil {
 		return nil, err
 	}
 
@@ -248,26 +309,28 @@ func NewOnionPacket(paymentPath *PaymentPath, sessionKey *btcec.PrivateKey,
 		// Next, using the key dedicated for our stream cipher, we'll
 		// generate enough bytes to obfuscate this layer of the onion
 		// packet.
-		streamBytes := generateCipherStream(rhoKey, routingInfoSize)
+		streamBytes := generateCipherStream(
+			rhoKey, uint(cfg.routingInfoSize),
+		)
 		payload := paymentPath[i].HopPayload
 
 		// Before we assemble the packet, we'll shift the current
 		// mix-header to the right in order to make room for this next
 		// per-hop data.
 		shiftSize := payload.NumBytes()
-		rightShift(mixHeader[:], shiftSize)
+		rightShift(mixHeader, shiftSize)
 
 		err := payload.Encode(&hopPayloadBuf)
 		if err != nil {
 			return nil, err
 		}
 
-		copy(mixHeader[:], hopPayloadBuf.Bytes())
+		copy(mixHeader, hopPayloadBuf.Bytes())
 
 		// Once the packet for this hop has been assembled, we'll
 		// re-encrypt the packet by XOR'ing with a stream of bytes
 		// generated using our shared secret.
-		xor(mixHeader[:], mixHeader[:], streamBytes[:])
+		xor(mixHeader, mixHeader, streamBytes)
 
 		// If this is the "last" hop, then we'll override the tail of
 		// the hop data.
@@ -279,7 +342,8 @@ func NewOnionPacket(paymentPath *PaymentPath, sessionKey *btcec.PrivateKey,
 		// calculating the MAC, we'll also include the optional
 		// associated data which can allow higher level applications to
 		// prevent replay attacks.
-		packet := append(mixHeader[:], assocData...)
+		packet := append(mixHeader[:len(mixHeader):len(mixHeader)],
+			assocData...)
 		nextHmac = calcMac(muKey, packet)
 
 		hopPayloadBuf.Reset()
@@ -315,8 +379,11 @@ func rightShift(slice []byte, num int) {
 // order to check the MAC and decrypt the next routing information eventually
 // leaving only the original "filler" bytes produced by this function at the
 // last hop.  Using this methodology, the size of the field stays constant at
-// each hop.
-func generateHeaderPadding(key string, path *PaymentPath, sharedSecrets []Hash256) []byte {
+// each hop. The routingInfoLen is the size of the routing info of the packet
+// under construction.
+func generateHeaderPadding(key string, path *PaymentPath,
+	sharedSecrets []Hash256, routingInfoLen int) []byte {
+
 	numHops := path.TrueRouteLength()
 
 	// We have to generate a filler that matches all but the last hop (the
@@ -326,7 +393,7 @@ func generateHeaderPadding(key string, path *PaymentPath, sharedSecrets []Hash25
 
 	for i := 0; i < numHops-1; i++ {
 		// Sum up how many frames were used by prior hops.
-		fillerStart := routingInfoSize
+		fillerStart := routingInfoLen
 		for _, p := range path[:i] {
 			fillerStart -= p.HopPayload.NumBytes()
 		}
@@ -334,10 +401,12 @@ func generateHeaderPadding(key string, path *PaymentPath, sharedSecrets []Hash25
 		// The filler is the part dangling off of the end of the
 		// routingInfo, so offset it from there, and use the current
 		// hop's frame count as its size.
-		fillerEnd := routingInfoSize + path[i].HopPayload.NumBytes()
+		fillerEnd := routingInfoLen + path[i].HopPayload.NumBytes()
 
 		streamKey := generateKey(key, &sharedSecrets[i])
-		streamBytes := generateCipherStream(streamKey, numStreamBytes)
+		streamBytes := generateCipherStream(
+			streamKey, uint(2*routingInfoLen),
+		)
 
 		xor(filler, filler, streamBytes[fillerStart:fillerEnd])
 	}
@@ -374,6 +443,10 @@ func (f *OnionPacket) Encode(w io.Writer) error {
 // encoded within the io.Reader. In the case of any decoding errors, an error
 // will be returned. If the method success, then the new OnionPacket is ready
 // to be processed by an instance of SphinxNode.
+//
+// By default, a routing info of 1300 bytes is expected. In order to decode a
+// packet with a different routing info size, the caller should allocate the
+// RoutingInfo slice with the expected length before calling Decode.
 func (f *OnionPacket) Decode(r io.Reader) error {
 	var err error
 
@@ -398,7 +471,10 @@ func (f *OnionPacket) Decode(r io.Reader) error {
 		return ErrInvalidOnionKey
 	}
 
-	if _, err := io.ReadFull(r, f.RoutingInfo[:]); err != nil {
+	if len(f.RoutingInfo) == 0 {
+		f.RoutingInfo = make([]byte, routingInfoSize)
+	}
+	if _, err := io.ReadFull(r, f.RoutingInfo); err != nil {
 		return err
 	}
 
@@ -409,6 +485,24 @@ func (f *OnionPacket) Decode(r io.Reader) error {
 	return nil
 }
 
+// decodeSizedOnionPacket decodes an onion packet whose total encoded length is
+// known up front, deriving the size of its routing info from it.
+func decodeSizedOnionPacket(r io.Reader, pktLen int) (*OnionPacket, error) {
+	routingInfoLen := pktLen - onionPacketOverhead
+	if routingInfoLen <= 0 || routingInfoLen > MaxRoutingInfoSize {
+		return nil, ErrInvalidRoutingInfoSize
+	}
+
+	pkt := &OnionPacket{
+		RoutingInfo: make([]byte, routingInfoLen),
+	}
+	if err := pkt.Decode(r); err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
+
 // ProcessCode is an enum-like type which describes to the high-level package
 // user which action should be taken after processing a Sphinx packet.
 type ProcessCode int
@@ -470,6 +564,50 @@ type ProcessedPacket struct {
 	// NOTE: This field will only be populated iff the above Action is
 	// MoreHops.
 	NextPacket *OnionPacket
+
+	// RecipientData is the decrypted encrypted_recipient_data carried
+	// within the payload of a hop that is part of a blinded route.
+	//
+	// NOTE: This field will only be populated if the hop is blinded.
+	RecipientData []byte
+
+	// NextBlindingPoint is the blinding point that should be handed to the
+	// next hop alongside the NextPacket.
+	//
+	// NOTE: This field will only be populated if the hop is blinded and
+	// the above Action is MoreHops.
+	NextBlindingPoint *btcec.PublicKey
+
+	// TrampolinePacket is the trampoline onion packet that was carried
+	// within the payload of this hop.
+	//
+	// NOTE: This field will only be populated if the above Action is
+	// ExitNode, and the payload contains a trampoline onion.
+	TrampolinePacket *OnionPacket
+
+	// Trampoline is the result of peeling a layer off the above
+	// TrampolinePacket. If its Action is MoreHops, its NextPacket should
+	// be embedded within a fresh outer onion to the next trampoline node.
+	// Otherwise, we're the final recipient of the payment.
+	//
+	// NOTE: This field will only be populated if the above Action is
+	// ExitNode, and the payload contains a trampoline onion.
+	Trampoline *ProcessedPacket
+
+	// OnionKey is the public key of the router's onion key that the
+	// packet was built against. It should be passed using WithOnionKey
+	// when creating an error encrypter for the packet.
+	OnionKey *btcec.PublicKey
+}
+
+// ParsedPayload parses the TLV payload of the processed packet into its typed
+// representation. An error is returned if the hop received a legacy payload.
+func (p *ProcessedPacket) ParsedPayload() (*TLVPayload, error) {
+	if p.Payload.Type != PayloadTLV {
+		return nil, errors.New("hop payload is not a tlv payload")
+	}
+
+	return DecodeTLVPayload(p.Payload.Payload)
 }
 
 // Router is an onion router within the Sphinx network. The router is capable
@@ -479,44 +617,149 @@ type Router struct {
 	nodeID   [AddressSize]byte
 	nodeAddr *bronutil.AddressPubKeyHash
 
-	onionKey *btcec.PrivateKey
+	// onionKeys are the onion keys of the router, in the order in which
+	// they're tried for incoming onions.
+	onionKeys []OnionKey
+
+	// now returns the current time, which determines the onion keys that
+	// are active.
+	now func() time.Time
+
+	// txWorkers is the maximum number of packets processed concurrently by
+	// Tx.ProcessOnionPackets.
+	txWorkers int
+
+	// txMaxSeqNum is the highest sequence number accepted by the
+	// transactions of the router.
+	txMaxSeqNum uint32
+
+	// notifier informs the garbage collector of the replay log of new
+	// blocks. If nil, the replay log isn't garbage collected.
+	notifier BlockHeightNotifier
+
+	// gc is the garbage collector of the replay log, which is running
+	// while the router is started.
+	gc *GarbageCollector
+
+	// observer is notified of the packets processed and the batches
+	// committed by the router. It always traces the events using the
+	// package logger, followed by the observers added using WithObserver.
+	observer multiObserver
 
 	log ReplayLog
+
+	// timedLog, if set, protects the packets that carry no CLTV against
+	// replays.
+	timedLog *TimedReplayLog
 }
 
 // NewRouter creates a new instance of a Sphinx onion Router given the node's
-// currently advertised onion private key, and the target Bitcoin network.
-func NewRouter(nodeKey *btcec.PrivateKey, net *chaincfg.Params, log ReplayLog) *Router {
+// currently advertised onion key, and the target Bitcoin network. A node
+// holding its onion private key in memory can use PrivKeyECDH.
+func NewRouter(nodeKey SingleKeyECDH, net *chaincfg.Params, log ReplayLog,
+	opts ...RouterOpt) *Router {
+
+	return newRouter([]OnionKey{{Key: nodeKey}}, net, log, opts)
+}
+
+// NewMultiKeyRouter creates a new instance of a Sphinx onion Router that holds
+// multiple onion keys, each with its own active window. Incoming onions are
+// processed using the keys that are active, in the order they're passed. The
+// node ID of the router is derived from the first key.
+func NewMultiKeyRouter(keys []OnionKey, net *chaincfg.Params, log ReplayLog,
+	opts ...RouterOpt) (*Router, error) {
+
+	if len(keys) == 0 {
+		return nil, ErrNoOnionKeys
+	}
+
+	return newRouter(keys, net, log, opts), nil
+}
+
+// newRouter creates a new Router holding the passed set of onion keys, which
+// must not be empty.
+func newRouter(keys []OnionKey, net *chaincfg.Params, log ReplayLog,
+	opts []RouterOpt) *Router {
+
+	nodeKey := keys[0].Key.PubKey()
+
 	var nodeID [AddressSize]byte
-	copy(nodeID[:], bronutil.Hash160(nodeKey.PubKey().SerializeCompressed()))
+	copy(nodeID[:], bronutil.Hash160(nodeKey.SerializeCompressed()))
 
 	// Safe to ignore the error here, nodeID is 20 bytes.
 	nodeAddr, _ := bronutil.NewAddressPubKeyHash(nodeID[:], net)
 
-	return &Router{
-		nodeID:   nodeID,
-		nodeAddr: nodeAddr,
-		onionKey: &btcec.PrivateKey{
-			PublicKey: ecdsa.PublicKey{
-				Curve: btcec.S256(),
-				X:     nodeKey.X,
-				Y:     nodeKey.Y,
-			},
-			D: nodeKey.D,
-		},
-		log: log,
+	r := &Router{
+		nodeID:      nodeID,
+		nodeAddr:    nodeAddr,
+		onionKeys:   append([]OnionKey(nil), keys...),
+		now:         time.Now,
+		txWorkers:   runtime.NumCPU(),
+		txMaxSeqNum: DefaultTxMaxSeqNum,
+		observer:    multiObserver{logObserver{}},
+		log:         log,
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
 }
 
 // Start starts / opens the ReplayLog's channeldb and its accompanying
-// garbage collector goroutine.
+// garbage collector goroutine. The garbage collector is only run if a block
+// height notifier was provided using WithBlockHeightNotifier. The timed replay
+// log set using WithTimedReplayLog, if any, is started as well.
 func (r *Router) Start() error {
-	return r.log.Start()
+	var expiringLog ExpiringReplayLog
+	if r.notifier != nil {
+		var ok bool
+		expiringLog, ok = r.log.(ExpiringReplayLog)
+		if !ok {
+			return ErrReplayLogNotExpiring
+		}
+	}
+
+	if err := r.log.Start(); err != nil {
+		return err
+	}
+
+	if r.timedLog != nil {
+		if err := r.timedLog.Start(); err != nil {
+			r.log.Stop()
+			return err
+		}
+	}
+
+	if expiringLog == nil {
+		return nil
+	}
+
+	gc := NewGarbageCollector(expiringLog, r.notifier)
+	if err := gc.Start(); err != nil {
+		if r.timedLog != nil {
+			r.timedLog.Stop()
+		}
+		r.log.Stop()
+		return err
+	}
+	r.gc = gc
+
+	return nil
 }
 
 // Stop stops / closes the ReplayLog's channeldb and its accompanying
 // garbage collector goroutine.
 func (r *Router) Stop() {
+	if r.gc != nil {
+		r.gc.Stop()
+		r.gc = nil
+	}
+
+	if r.timedLog != nil {
+		r.timedLog.Stop()
+	}
+
 	r.log.Stop()
 }
 
@@ -529,30 +772,54 @@ func (r *Router) Stop() {
 // In the case of a successful packet processing, and ProcessedPacket struct is
 // returned which houses the newly parsed packet, along with instructions on
 // what to do next.
+//
+// If the packet is destined for a hop within a blinded route, the blinding
+// point received alongside it should be passed using WithBlindingPoint.
+//
+// Packets that carry no CLTV, such as generic mix-net traffic, should be passed
+// an incomingCltv of zero. If a timed replay log was set using
+// WithTimedReplayLog, they're checked against it rather than the replay log.
 func (r *Router) ProcessOnionPacket(onionPkt *OnionPacket,
-	assocData []byte, incomingCltv uint32) (*ProcessedPacket, error) {
-
-	// Compute the shared secret for this onion packet.
-	sharedSecret, err := r.generateSharedSecret(onionPkt.EphemeralKey)
-	if err != nil {
-		return nil, err
+	assocData []byte, incomingCltv uint32,
+	opts ...ProcessOnionOpt) (packet *ProcessedPacket, err error) {
+
+	start := time.Now()
+	cfg := newProcessOnionCfg(opts)
+	defer func() {
+		r.observePacket(false, start, cfg, packet, err)
+	}()
+
+	if onionPkt.Version != baseVersion {
+		return nil, malformedOnionError(
+			onionPkt, ErrInvalidOnionVersion, cfg.blindingPoint,
+		)
 	}
 
-	// Additionally, compute the hash prefix of the shared secret, which
-	// will serve as an identifier for detecting replayed packets.
-	hashPrefix := hashSharedSecret(&sharedSecret)
-
 	// Continue to optimistically process this packet, deferring replay
 	// protection until the end to reduce the penalty of multiple IO
 	// operations.
-	packet, err := processOnionPacket(onionPkt, &sharedSecret, assocData, r)
+	packet, sharedSecret, err := r.peelOnion(onionPkt, assocData, cfg)
 	if err != nil {
-		return nil, err
+		return nil, malformedOnionError(
+			onionPkt, err, cfg.blindingPoint,
+		)
 	}
 
+	// Additionally, compute the hash prefix of the shared secret, which
+	// will serve as an identifier for detecting replayed packets. Only
+	// the secret of the key that the packet was built against is used,
+	// so the packet is identified the same way no matter the keys that
+	// are active.
+	hashPrefix := hashSharedSecret(&sharedSecret)
+
 	// Atomically compare this hash prefix with the contents of the on-disk
 	// log, persisting it only if this entry was not detected as a replay.
-	if err := r.log.Put(hashPrefix, incomingCltv); err != nil {
+	if incomingCltv == 0 && r.timedLog != nil {
+		err = r.timedLog.put(hashPrefix)
+	} else {
+		err = r.log.Put(hashPrefix, incomingCltv)
+	}
+	if err != nil {
 		return nil, err
 	}
 
@@ -564,15 +831,50 @@ func (r *Router) ProcessOnionPacket(onionPkt *OnionPacket,
 // NOTE: This method does not do any sort of replay protection, and should only
 // be used to reconstruct packets that were successfully processed previously.
 func (r *Router) ReconstructOnionPacket(onionPkt *OnionPacket,
-	assocData []byte) (*ProcessedPacket, error) {
+	assocData []byte, opts ...ProcessOnionOpt) (*ProcessedPacket, error) {
 
-	// Compute the shared secret for this onion packet.
-	sharedSecret, err := r.generateSharedSecret(onionPkt.EphemeralKey)
-	if err != nil {
-		return nil, err
+	cfg := newProcessOnionCfg(opts)
+
+	packet, _, err := r.peelOnion(onionPkt, assocData, cfg)
+
+	return packet, err
+}
+
+// onionSharedSecret computes the shared secret for an onion packet with the
+// given ephemeral key. If a blinding point is specified, the node's onion key
+// is tweaked accordingly before performing ECDH.
+func onionSharedSecret(dhKey, blindingPoint *btcec.PublicKey,
+	sharedSecretGen sharedSecretGenerator) (Hash256, error) {
+
+	if blindingPoint == nil {
+		return sharedSecretGen.generateSharedSecret(dhKey)
 	}
 
-	return processOnionPacket(onionPkt, &sharedSecret, assocData, r)
+	return blindedOnionSharedSecret(dhKey, blindingPoint, sharedSecretGen)
+}
+
+// malformedOnionError converts errors that signal a malformed onion into a
+// ProcessingError, to be reported to the upstream node. Any other error is
+// returned as is. If the onion was received within a blinded route, the
+// failure code is replaced so that it doesn't reveal the actual failure.
+func malformedOnionError(onionPkt *OnionPacket, err error,
+	blindingPoint *btcec.PublicKey) error {
+
+	var b bytes.Buffer
+	if encodeErr := onionPkt.Encode(&b); encodeErr != nil {
+		return err
+	}
+
+	procErr := NewProcessingError(b.Bytes(), err)
+	if procErr == nil {
+		return err
+	}
+
+	if blindingPoint != nil {
+		procErr.Code = CodeInvalidOnionBlinding
+	}
+
+	return procErr
 }
 
 // unwrapPacket wraps a layer of the passed onion packet using the specified
@@ -581,50 +883,63 @@ func (r *Router) ReconstructOnionPacket(onionPkt *OnionPacket,
 // packet. This function returns the next inner onion packet layer, along with
 // the hop data extracted from the outer onion packet.
 func unwrapPacket(onionPkt *OnionPacket, sharedSecret *Hash256,
-	assocData []byte) (*OnionPacket, *HopPayload, error) {
+	assocData []byte) (*OnionPacket, HopPayload, error) {
 
 	dhKey := onionPkt.EphemeralKey
 	routeInfo := onionPkt.RoutingInfo
 	headerMac := onionPkt.HeaderMAC
 
+	// The routing info of the inner packet will have the same size as the
+	// outer one. The worst case is a single hop consuming all of this
+	// space, so we'll need twice as many stream bytes in order to decrypt
+	// the padding that is shifted in.
+	routingInfoLen := len(routeInfo)
+	if routingInfoLen == 0 || routingInfoLen > MaxRoutingInfoSize {
+		return nil, HopPayload{}, ErrInvalidRoutingInfoSize
+	}
+	numStreamBytes := 2 * routingInfoLen
+
+	// The buffers used to unwrap the packet are taken from a pool, as
+	// they're only needed until the inner packet has been copied out.
+	scratch := getUnwrapScratch()
+	defer putUnwrapScratch(scratch)
+
 	// Using the derived shared secret, ensure the integrity of the routing
 	// information by checking the attached MAC without leaking timing
 	// information.
-	message := append(routeInfo[:], assocData...)
-	calculatedMac := calcMac(generateKey("mu", sharedSecret), message)
-	if !hmac.Equal(headerMac[:], calculatedMac[:]) {
-		return nil, nil, ErrInvalidOnionHMAC
+	muKey := scratch.generateKey("mu", sharedSecret)
+	calculatedMac := scratch.hmac(muKey[:], routeInfo, assocData)
+	if !hmac.Equal(headerMac[:], calculatedMac[:HMACSize]) {
+		return nil, HopPayload{}, ErrInvalidOnionHMAC
 	}
 
 	// Attach the padding zeroes in order to properly strip an encryption
 	// layer off the routing info revealing the routing information for the
 	// next hop.
-	streamBytes := generateCipherStream(
-		generateKey("rho", sharedSecret), numStreamBytes,
-	)
-	zeroBytes := bytes.Repeat([]byte{0}, MaxPayloadSize)
-	headerWithPadding := append(routeInfo[:], zeroBytes...)
-
-	var hopInfo [numStreamBytes]byte
-	xor(hopInfo[:], headerWithPadding, streamBytes)
+	hopInfo := scratch.hopInfo[:numStreamBytes]
+	copy(hopInfo, routeInfo)
+	for i := routingInfoLen; i < numStreamBytes; i++ {
+		hopInfo[i] = 0
+	}
+	xorCipherStream(scratch.generateKey("rho", sharedSecret), hopInfo)
 
 	// Randomize the DH group element for the next hop using the
 	// deterministic blinding factor.
-	blindingFactor := computeBlindingFactor(dhKey, sharedSecret[:])
+	blindingFactor := scratch.computeBlindingFactor(dhKey, sharedSecret[:])
 	nextDHKey := blindGroupElement(dhKey, blindingFactor[:])
 
 	// With the MAC checked, and the payload decrypted, we can now parse
 	// out the payload so we can derive the specified forwarding
 	// instructions.
 	var hopPayload HopPayload
-	if err := hopPayload.Decode(bytes.NewReader(hopInfo[:])); err != nil {
-		return nil, nil, err
+	if err := hopPayload.decodeBytes(hopInfo); err != nil {
+		return nil, HopPayload{}, err
 	}
 
 	// With the necessary items extracted, we'll copy of the onion packet
 	// for the next node, snipping off our per-hop data.
-	var nextMixHeader [routingInfoSize]byte
-	copy(nextMixHeader[:], hopInfo[hopPayload.NumBytes():])
+	nextMixHeader := make([]byte, routingInfoLen)
+	copy(nextMixHeader, hopInfo[hopPayload.NumBytes():])
 	innerPkt := &OnionPacket{
 		Version:      onionPkt.Version,
 		EphemeralKey: nextDHKey,
@@ -632,14 +947,16 @@ func unwrapPacket(onionPkt *OnionPacket, sharedSecret *Hash256,
 		HeaderMAC:    hopPayload.HMAC,
 	}
 
-	return innerPkt, &hopPayload, nil
+	return innerPkt, hopPayload, nil
 }
 
 // processOnionPacket performs the primary key derivation and handling of onion
 // packets. The processed packets returned from this method should only be used
-// if the packet was not flagged as a replayed packet.
+// if the packet was not flagged as a replayed packet. The optional blinding
+// point, along with the sharedSecretGen, is used to decrypt the recipient data
+// of blinded hops.
 func processOnionPacket(onionPkt *OnionPacket, sharedSecret *Hash256,
-	assocData []byte,
+	assocData []byte, blindingPoint *btcec.PublicKey,
 	sharedSecretGen sharedSecretGenerator) (*ProcessedPacket, error) {
 
 	// First, we'll unwrap an initial layer of the onion packet. Typically,
@@ -669,17 +986,37 @@ func processOnionPacket(onionPkt *OnionPacket, sharedSecret *Hash256,
 		return nil, err
 	}
 
-	// Finally, we'll return a fully processed packet with the outer most
-	// hop data (where the primary forwarding instructions lie) and the
-	// inner most onion packet that we unwrapped.
-	return &ProcessedPacket{
+	packet := &ProcessedPacket{
 		Action:                 action,
 		ForwardingInstructions: hopData,
-		Payload:                *outerHopPayload,
+		Payload:                outerHopPayload,
 		NextPacket:             innerPkt,
-	}, nil
+	}
+
+	// If this hop is part of a blinded route, we'll also need to decrypt
+	// the recipient data, and derive the next blinding point.
+	err = processBlindedPayload(packet, blindingPoint, sharedSecretGen)
+	if err != nil {
+		return nil, err
+	}
+
+	// If we're the final hop of the outer onion, the payload may carry a
+	// trampoline onion, which also needs to be processed.
+	err = processTrampolinePayload(packet, assocData, sharedSecretGen)
+	if err != nil {
+		return nil, err
+	}
+
+	// Finally, we'll return a fully processed packet with the outer most
+	// hop data (where the primary forwarding instructions lie) and the
+	// inner most onion packet that we unwrapped.
+	return packet, nil
 }
 
+// DefaultTxMaxSeqNum is the highest sequence number accepted by the
+// transactions of a router, unless set otherwise using WithTxMaxSeqNum.
+const DefaultTxMaxSeqNum uint32 = 1<<20 - 1
+
 // Tx is a transaction consisting of a number of sphinx packets to be atomically
 // written to the replay log. This structure helps to coordinate construction of
 // the underlying Batch object, and to ensure that the result of the processing
@@ -695,19 +1032,32 @@ type Tx struct {
 	router *Router
 
 	// packets contains a potentially sparse list of optimistically processed
-	// packets for this batch. The contents of a particular index should
-	// only be accessed if the index is *not* included in the replay set, or
-	// otherwise failed any other stage of the processing.
+	// packets for this batch, indexed by sequence number, which grows as
+	// packets with higher sequence numbers are added. The contents of a
+	// particular index should only be accessed if the index is *not*
+	// included in the replay set, or otherwise failed any other stage of
+	// the processing.
 	packets []ProcessedPacket
+
+	// aborted is true once the transaction has been aborted, after which
+	// it can no longer be used.
+	aborted bool
+
+	// mtx guards the batch and the processed packets, so that packets can
+	// be added and the transaction committed from multiple goroutines.
+	mtx sync.Mutex
 }
 
 // BeginTxn creates a new transaction that can later be committed back to the
-// sphinx router's replay log.
-//
-// NOTE: The nels parameter should represent the maximum number of that could
-// be added to the batch, using sequence numbers that match or exceed this
-// value could result in an out-of-bounds panic.
+// sphinx router's replay log. The nels parameter is the number of packets
+// expected to be added to the batch, for which space is reserved up front.
+// Packets with higher sequence numbers can still be added, up to the maximum
+// set by WithTxMaxSeqNum, beyond which an InvalidSeqNumError is returned.
 func (r *Router) BeginTxn(id []byte, nels int) *Tx {
+	if nels < 0 {
+		nels = 0
+	}
+
 	return &Tx{
 		batch:   NewBatch(id),
 		router:  r,
@@ -724,34 +1074,194 @@ func (r *Router) BeginTxn(id []byte, nels int) *Tx {
 // In the case of a successful packet processing, and ProcessedPacket struct is
 // returned which houses the newly parsed packet, along with instructions on
 // what to do next.
-func (t *Tx) ProcessOnionPacket(seqNum uint16, onionPkt *OnionPacket,
-	assocData []byte, incomingCltv uint32) error {
+func (t *Tx) ProcessOnionPacket(seqNum uint32, onionPkt *OnionPacket,
+	assocData []byte, incomingCltv uint32, opts ...ProcessOnionOpt) error {
 
-	// Compute the shared secret for this onion packet.
-	sharedSecret, err := t.router.generateSharedSecret(
-		onionPkt.EphemeralKey,
+	packet, hashPrefix, err := t.router.processTxPacket(
+		onionPkt, assocData, opts,
 	)
 	if err != nil {
 		return err
 	}
 
-	// Additionally, compute the hash prefix of the shared secret, which
-	// will serve as an identifier for detecting replayed packets.
-	hashPrefix := hashSharedSecret(&sharedSecret)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.addPacket(seqNum, packet, hashPrefix, incomingCltv)
+}
+
+// TxPacket is an incoming onion packet to be processed as part of a Tx using
+// ProcessOnionPackets, along with the arguments that would otherwise be passed
+// to ProcessOnionPacket.
+type TxPacket struct {
+	// SeqNum is the sequence number of the packet within the batch.
+	SeqNum uint32
+
+	// Packet is the onion packet to be processed.
+	Packet *OnionPacket
+
+	// AssocData is the associated data committed to by the HMAC of the
+	// packet.
+	AssocData []byte
+
+	// IncomingCltv is the CLTV expiry of the incoming HTLC carrying the
+	// packet.
+	IncomingCltv uint32
+
+	// Opts are the options used to process the packet.
+	Opts []ProcessOnionOpt
+}
+
+// ProcessOnionPackets processes a number of incoming onion packets at once,
+// such as all the packets of a commitment. The ECDH and HMAC checks of the
+// packets are independent, so they're performed on a bounded pool of workers,
+// whose size is set by WithTxWorkers. The packets are then added to the batch
+// in the order they're passed, so that the outcome is the same as if
+// ProcessOnionPacket had been called for each of them in turn. The returned
+// slice holds the error of each packet at the same index, which is nil if the
+// packet was added to the batch.
+func (t *Tx) ProcessOnionPackets(packets []TxPacket) []error {
+	errs := make([]error, len(packets))
+
+	// There's no need to process the packets if the transaction was
+	// already committed or aborted, as none of them could be added to the
+	// batch.
+	t.mtx.Lock()
+	var doneErr error
+	switch {
+	case t.aborted:
+		doneErr = ErrTxAborted
+	case t.batch.IsCommitted:
+		doneErr = ErrAlreadyCommitted
+	}
+	t.mtx.Unlock()
+	if doneErr != nil {
+		for i := range errs {
+			errs[i] = doneErr
+		}
+		return errs
+	}
+
+	type result struct {
+		packet     *ProcessedPacket
+		hashPrefix *HashPrefix
+		err        error
+	}
+	results := make([]result, len(packets))
+
+	numWorkers := t.router.txWorkers
+	if numWorkers > len(packets) {
+		numWorkers = len(packets)
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	// Each worker writes only to the results of the packets it picks up,
+	// so the results don't need any further synchronization.
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for idx := range indexes {
+				pkt := &packets[idx]
+				res := &results[idx]
+				res.packet, res.hashPrefix, res.err =
+					t.router.processTxPacket(
+						pkt.Packet, pkt.AssocData,
+						pkt.Opts,
+					)
+			}
+		}()
+	}
+	for i := range packets {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for i, res := range results {
+		if res.err != nil {
+			errs[i] = res.err
+			continue
+		}
+
+		errs[i] = t.addPacket(
+			packets[i].SeqNum, res.packet, res.hashPrefix,
+			packets[i].IncomingCltv,
+		)
+	}
+
+	return errs
+}
+
+// processTxPacket peels a layer off an onion packet that is part of a Tx,
+// returning the processed packet along with the hash prefix of its shared
+// secret. The replay log isn't consulted, so it is safe to call concurrently.
+func (r *Router) processTxPacket(onionPkt *OnionPacket, assocData []byte,
+	opts []ProcessOnionOpt) (packet *ProcessedPacket,
+	hashPrefix *HashPrefix, err error) {
+
+	start := time.Now()
+	cfg := newProcessOnionCfg(opts)
+	defer func() {
+		r.observePacket(true, start, cfg, packet, err)
+	}()
+
+	if onionPkt.Version != baseVersion {
+		return nil, nil, malformedOnionError(
+			onionPkt, ErrInvalidOnionVersion, cfg.blindingPoint,
+		)
+	}
 
 	// Continue to optimistically process this packet, deferring replay
 	// protection until the end to reduce the penalty of multiple IO
 	// operations.
-	packet, err := processOnionPacket(
-		onionPkt, &sharedSecret, assocData, t.router,
-	)
+	packet, sharedSecret, err := r.peelOnion(onionPkt, assocData, cfg)
 	if err != nil {
-		return err
+		return nil, nil, malformedOnionError(
+			onionPkt, err, cfg.blindingPoint,
+		)
+	}
+
+	// Additionally, compute the hash prefix of the shared secret, which
+	// will serve as an identifier for detecting replayed packets.
+	return packet, hashSharedSecret(&sharedSecret), nil
+}
+
+// addPacket adds a processed packet to the transaction.
+//
+// NOTE: The mutex of the transaction must be held.
+func (t *Tx) addPacket(seqNum uint32, packet *ProcessedPacket,
+	hashPrefix *HashPrefix, incomingCltv uint32) error {
+
+	if t.aborted {
+		return ErrTxAborted
+	}
+
+	// The entries of a batch expire by block height, so a packet without
+	// a CLTV would only be protected until the next block. It must be
+	// processed on its own instead, so that the timed log is used.
+	if incomingCltv == 0 && t.router.timedLog != nil {
+		return ErrTxMissingCltv
+	}
+
+	if seqNum > t.router.txMaxSeqNum {
+		return &InvalidSeqNumError{
+			SeqNum:    seqNum,
+			MaxSeqNum: t.router.txMaxSeqNum,
+		}
 	}
 
 	// Add the hash prefix to pending batch of shared secrets that will be
 	// written later via Commit().
-	err = t.batch.Put(seqNum, hashPrefix, incomingCltv)
+	err := t.batch.Put(seqNum, hashPrefix, incomingCltv)
 	if err != nil {
 		return err
 	}
@@ -760,6 +1270,11 @@ func (t *Tx) ProcessOnionPacket(seqNum uint16, onionPkt *OnionPacket,
 	// processed packet within the Tx which can be accessed after
 	// committing if this sequence number does not appear in the replay
 	// set.
+	if n := int(seqNum) + 1; n > len(t.packets) {
+		t.packets = append(
+			t.packets, make([]ProcessedPacket, n-len(t.packets))...,
+		)
+	}
 	t.packets[seqNum] = *packet
 
 	return nil
@@ -767,12 +1282,88 @@ func (t *Tx) ProcessOnionPacket(seqNum uint16, onionPkt *OnionPacket,
 
 // Commit writes this transaction's batch of sphinx packets to the replay log,
 // performing a final check against the log for replays.
+// Committing the same transaction more than once returns the result of the
+// first successful commit.
 func (t *Tx) Commit() ([]ProcessedPacket, *ReplaySet, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.aborted {
+		return nil, nil, ErrTxAborted
+	}
+
 	if t.batch.IsCommitted {
 		return t.packets, t.batch.ReplaySet, nil
 	}
 
+	numPackets := len(t.batch.entries) + t.batch.ReplaySet.Size()
+
+	start := time.Now()
 	rs, err := t.router.log.PutBatch(t.batch)
+	t.router.observeBatch(numPackets, rs, time.Since(start), err)
 
 	return t.packets, rs, err
 }
+
+// Abort discards a transaction that hasn't been committed. None of the packets
+// added to it are written to the replay log, and the transaction can no longer
+// be used. Aborting a transaction more than once is harmless. A committed
+// transaction can't be aborted, and ErrAlreadyCommitted is returned. Instead,
+// its batch can be removed from the replay log using ReplayLog.DeleteBatch.
+func (t *Tx) Abort() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.batch.IsCommitted {
+		return ErrAlreadyCommitted
+	}
+
+	t.aborted = true
+	t.packets = nil
+
+	return nil
+}
+
+// observePacket reports the outcome of processing an onion packet, which
+// started at the passed time, to the observer of the router.
+func (r *Router) observePacket(batched bool, start time.Time,
+	cfg *processOnionCfg, packet *ProcessedPacket, err error) {
+
+	event := PacketEvent{
+		Batched:     batched,
+		Action:      Failure,
+		Failure:     failureReason(err),
+		ECDHLatency: cfg.ecdhLatency,
+		Latency:     time.Since(start),
+	}
+	if err == nil {
+		event.Action = packet.Action
+	}
+	r.observer.PacketProcessed(event)
+
+	if event.Failure == FailureReplay {
+		r.observer.ReplayDetected(ReplayEvent{})
+	}
+}
+
+// observeBatch reports the commitment of a batch of packets to the observer
+// of the router, along with each of the replays that were detected.
+func (r *Router) observeBatch(numPackets int, replays *ReplaySet,
+	latency time.Duration, err error) {
+
+	event := BatchEvent{
+		NumPackets: numPackets,
+		Latency:    latency,
+		Err:        err,
+	}
+	if err == nil {
+		event.NumReplays = replays.Size()
+		for seqNum := range replays.replays {
+			r.observer.ReplayDetected(ReplayEvent{
+				Batched: true,
+				SeqNum:  seqNum,
+			})
+		}
+	}
+	r.observer.BatchCommitted(event)
+}
@@ -2,10 +2,15 @@ package sphinx
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -102,7 +107,8 @@ func newTestRoute(numHops int) ([]*Router, *PaymentPath, *[]HopData, *OnionPacke
 		}
 
 		nodes[i] = NewRouter(
-			privKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+			&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+			NewMemoryReplayLog(),
 		)
 	}
 
@@ -124,7 +130,7 @@ func newTestRoute(numHops int) ([]*Router, *PaymentPath, *[]HopData, *OnionPacke
 		}
 
 		route[i] = OnionHop{
-			NodePub:    *nodes[i].onionKey.PubKey(),
+			NodePub:    *nodes[i].onionKeys[0].Key.PubKey(),
 			HopPayload: hopPayload,
 		}
 	}
@@ -395,7 +401,7 @@ func TestSphinxNodeRelpayLaterBatch(t *testing.T) {
 
 	// Allow the node to process the initial packet, this should proceed
 	// without any failures.
-	if err := tx.ProcessOnionPacket(uint16(0), fwdMsg, nil, 1); err != nil {
+	if err := tx.ProcessOnionPacket(uint32(0), fwdMsg, nil, 1); err != nil {
 		t.Fatalf("unable to process sphinx packet: %v", err)
 	}
 
@@ -408,7 +414,7 @@ func TestSphinxNodeRelpayLaterBatch(t *testing.T) {
 
 	// Now, force the node to process the packet a second time, this should
 	// fail with a detected replay error.
-	err = tx2.ProcessOnionPacket(uint16(0), fwdMsg, nil, 1)
+	err = tx2.ProcessOnionPacket(uint32(0), fwdMsg, nil, 1)
 	if err != nil {
 		t.Fatalf("sphinx packet replay should not have been rejected, "+
 			"instead error is %v", err)
@@ -440,7 +446,7 @@ func TestSphinxNodeReplayBatchIdempotency(t *testing.T) {
 
 	// Allow the node to process the initial packet, this should proceed
 	// without any failures.
-	if err := tx.ProcessOnionPacket(uint16(0), fwdMsg, nil, 1); err != nil {
+	if err := tx.ProcessOnionPacket(uint32(0), fwdMsg, nil, 1); err != nil {
 		t.Fatalf("unable to process sphinx packet: %v", err)
 	}
 
@@ -453,7 +459,7 @@ func TestSphinxNodeReplayBatchIdempotency(t *testing.T) {
 
 	// Now, force the node to process the packet a second time, this should
 	// not fail with a detected replay error.
-	err = tx2.ProcessOnionPacket(uint16(0), fwdMsg, nil, 1)
+	err = tx2.ProcessOnionPacket(uint32(0), fwdMsg, nil, 1)
 	if err != nil {
 		t.Fatalf("sphinx packet replay should not have been rejected, "+
 			"instead error is %v", err)
@@ -475,6 +481,266 @@ func TestSphinxNodeReplayBatchIdempotency(t *testing.T) {
 	}
 }
 
+// TestTxAbort tests that an aborted transaction writes nothing to the replay
+// log and can no longer be used, while a committed one can't be aborted, but
+// can be rolled back by deleting its batch from the replay log.
+func TestTxAbort(t *testing.T) {
+	nodes, _, _, fwdMsg, err := newTestRoute(testLegacyRouteNumHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	nodes[0].log.Start()
+	defer nodes[0].log.Stop()
+
+	tx := nodes[0].BeginTxn([]byte("0"), 2)
+	if err := tx.ProcessOnionPacket(0, fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process sphinx packet: %v", err)
+	}
+
+	// Aborting the transaction more than once is harmless, after which it
+	// can't be used.
+	for i := 0; i < 2; i++ {
+		if err := tx.Abort(); err != nil {
+			t.Fatalf("unable to abort transaction: %v", err)
+		}
+	}
+	err = tx.ProcessOnionPacket(1, fwdMsg, nil, 1)
+	if err != ErrTxAborted {
+		t.Fatalf("expected error %v, got %v", ErrTxAborted, err)
+	}
+	errs := tx.ProcessOnionPackets([]TxPacket{{
+		SeqNum: 1, Packet: fwdMsg, IncomingCltv: 1,
+	}})
+	if errs[0] != ErrTxAborted {
+		t.Fatalf("expected error %v, got %v", ErrTxAborted, errs[0])
+	}
+	if _, _, err := tx.Commit(); err != ErrTxAborted {
+		t.Fatalf("expected error %v, got %v", ErrTxAborted, err)
+	}
+
+	// As nothing was written to the replay log, the packet is accepted by
+	// a new transaction with the same ID, which can't be aborted once it
+	// is committed.
+	tx = nodes[0].BeginTxn([]byte("0"), 1)
+	if err := tx.ProcessOnionPacket(0, fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process sphinx packet: %v", err)
+	}
+	_, replays, err := tx.Commit()
+	if err != nil {
+		t.Fatalf("unable to commit sphinx batch: %v", err)
+	}
+	if replays.Size() != 0 {
+		t.Fatalf("unexpected replay set: %v", replays)
+	}
+	if err := tx.Abort(); err != ErrAlreadyCommitted {
+		t.Fatalf("expected error %v, got %v", ErrAlreadyCommitted, err)
+	}
+
+	// Deleting the batch of the committed transaction rolls it back, so
+	// the packet is accepted once more.
+	if err := nodes[0].log.DeleteBatch([]byte("0")); err != nil {
+		t.Fatalf("unable to delete batch: %v", err)
+	}
+	if _, err := nodes[0].ProcessOnionPacket(fwdMsg, nil, 1); err != nil {
+		t.Fatalf("unable to process sphinx packet: %v", err)
+	}
+}
+
+// TestTxSeqNums tests that a transaction grows to hold packets with sequence
+// numbers beyond the number of packets it was created for, including those
+// that don't fit in 16 bits, whose replays survive a restart of a persistent
+// replay log. Sequence numbers above the maximum are rejected.
+func TestTxSeqNums(t *testing.T) {
+	t.Parallel()
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "replay.log")
+
+	pkt1, _ := newSingleHopOnion(t, privKey.PubKey())
+	pkt2, _ := newSingleHopOnion(t, privKey.PubKey())
+
+	const maxSeqNum = 1 << 17
+	var firstPackets []ProcessedPacket
+	for i := 0; i < 2; i++ {
+		router := NewRouter(
+			&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+			NewFileReplayLog(path), WithTxMaxSeqNum(maxSeqNum),
+		)
+		if err := router.Start(); err != nil {
+			t.Fatalf("unable to start router: %v", err)
+		}
+
+		// The second packet is added twice beyond the 16-bit range,
+		// the latter being a replay.
+		tx := router.BeginTxn([]byte("batch"), 1)
+		errs := tx.ProcessOnionPackets([]TxPacket{
+			{SeqNum: 0, Packet: pkt1, IncomingCltv: 1},
+			{SeqNum: 70000, Packet: pkt2, IncomingCltv: 1},
+			{SeqNum: 70001, Packet: pkt2, IncomingCltv: 1},
+		})
+		for seqNum, err := range errs {
+			if err != nil {
+				t.Fatalf("unable to process packet %d: %v",
+					seqNum, err)
+			}
+		}
+
+		err := tx.ProcessOnionPacket(maxSeqNum+1, pkt1, nil, 1)
+		var seqNumErr *InvalidSeqNumError
+		if !errors.As(err, &seqNumErr) ||
+			!errors.Is(err, ErrInvalidSeqNum) {
+
+			t.Fatalf("expected invalid sequence number, got %v",
+				err)
+		}
+		if seqNumErr.SeqNum != maxSeqNum+1 ||
+			seqNumErr.MaxSeqNum != maxSeqNum {
+
+			t.Fatalf("unexpected error: %v", seqNumErr)
+		}
+
+		// Committing the batch again after a restart yields the same
+		// outcome.
+		packets, replays, err := tx.Commit()
+		if err != nil {
+			t.Fatalf("unable to commit batch: %v", err)
+		}
+		if len(packets) != 70002 {
+			t.Fatalf("expected 70002 packets, got %d", len(packets))
+		}
+		if replays.Size() != 1 || !replays.Contains(70001) {
+			t.Fatalf("unexpected replay set: %v", replays.replays)
+		}
+		if i == 0 {
+			firstPackets = packets
+		} else if !reflect.DeepEqual(packets, firstPackets) {
+			t.Fatalf("packets don't match after restart")
+		}
+
+		router.Stop()
+	}
+}
+
+// TestTxProcessOnionPackets tests that processing a batch of packets on the
+// worker pool yields the same outcome as processing them one at a time, and
+// that committing the transaction more than once is safe.
+func TestTxProcessOnionPackets(t *testing.T) {
+	t.Parallel()
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	newTestRouter := func() *Router {
+		router := NewRouter(
+			&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+			NewMemoryReplayLog(), WithTxWorkers(3),
+		)
+		if err := router.Start(); err != nil {
+			t.Fatalf("unable to start router: %v", err)
+		}
+
+		return router
+	}
+	batchRouter := newTestRouter()
+	defer batchRouter.Stop()
+	seqRouter := newTestRouter()
+	defer seqRouter.Stop()
+
+	// Create a batch of distinct packets, along with a duplicate and
+	// packets that fail to be processed.
+	const numPackets = 10
+	var packets []TxPacket
+	for i := 0; i < numPackets; i++ {
+		pkt, _ := newSingleHopOnion(t, privKey.PubKey())
+		packets = append(packets, TxPacket{
+			SeqNum:       uint32(i),
+			Packet:       pkt,
+			IncomingCltv: uint32(i),
+		})
+	}
+	packets[4].Packet = packets[1].Packet
+	packets[6].AssocData = []byte("assoc")
+
+	badVersion := *packets[8].Packet
+	badVersion.Version = 1
+	packets[8].Packet = &badVersion
+
+	batchTx := batchRouter.BeginTxn([]byte("0"), numPackets)
+	errs := batchTx.ProcessOnionPackets(packets)
+
+	seqTx := seqRouter.BeginTxn([]byte("0"), numPackets)
+	for i, pkt := range packets {
+		err := seqTx.ProcessOnionPacket(
+			pkt.SeqNum, pkt.Packet, pkt.AssocData, pkt.IncomingCltv,
+		)
+		if !reflect.DeepEqual(err, errs[i]) {
+			t.Fatalf("packet %d: expected error %v, got %v", i,
+				err, errs[i])
+		}
+	}
+
+	if !errors.Is(errs[6], ErrInvalidOnionHMAC) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidOnionHMAC,
+			errs[6])
+	}
+	if !errors.Is(errs[8], ErrInvalidOnionVersion) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidOnionVersion,
+			errs[8])
+	}
+
+	// Commit the batch from multiple goroutines at once, all of which
+	// should observe the same result.
+	type commitResult struct {
+		packets []ProcessedPacket
+		replays *ReplaySet
+		err     error
+	}
+	const numCommits = 4
+	results := make(chan commitResult, numCommits)
+	for i := 0; i < numCommits; i++ {
+		go func() {
+			packets, replays, err := batchTx.Commit()
+			results <- commitResult{packets, replays, err}
+		}()
+	}
+
+	seqPackets, seqReplays, err := seqTx.Commit()
+	if err != nil {
+		t.Fatalf("unable to commit batch: %v", err)
+	}
+	if !seqReplays.Contains(4) || seqReplays.Size() != 1 {
+		t.Fatalf("expected only index 4 to be replayed, got %v",
+			seqReplays)
+	}
+
+	for i := 0; i < numCommits; i++ {
+		res := <-results
+		if res.err != nil {
+			t.Fatalf("unable to commit batch: %v", res.err)
+		}
+		if !reflect.DeepEqual(res.replays, seqReplays) {
+			t.Fatalf("expected replay set %v, got %v", seqReplays,
+				res.replays)
+		}
+		if !reflect.DeepEqual(res.packets, seqPackets) {
+			t.Fatalf("processed packets mismatch")
+		}
+	}
+
+	// Once committed, no more packets can be added.
+	errs = batchTx.ProcessOnionPackets(packets[:1])
+	if errs[0] != ErrAlreadyCommitted {
+		t.Fatalf("expected error %v, got %v", ErrAlreadyCommitted,
+			errs[0])
+	}
+}
+
 func TestSphinxAssocData(t *testing.T) {
 	// We want to make sure that the associated data is considered in the
 	// HMAC creation
@@ -494,6 +760,108 @@ func TestSphinxAssocData(t *testing.T) {
 
 }
 
+// TestProcessingError tests that malformed onions are rejected with a
+// ProcessingError, carrying the failure code and hash of the onion that are
+// reported to the upstream node.
+func TestProcessingError(t *testing.T) {
+	t.Parallel()
+
+	nodes, _, _, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create random onion packet: %v", err)
+	}
+
+	nodes[0].log.Start()
+	defer nodes[0].log.Stop()
+
+	blindingKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'B'}, 32),
+	)
+	badVersion := *fwdMsg
+	badVersion.Version = 1
+
+	testCases := []struct {
+		name         string
+		pkt          *OnionPacket
+		opts         []ProcessOnionOpt
+		expectedCode uint16
+		expectedErr  error
+	}{
+		{
+			name:         "invalid hmac",
+			pkt:          fwdMsg,
+			expectedCode: CodeInvalidOnionHMAC,
+			expectedErr:  ErrInvalidOnionHMAC,
+		},
+		{
+			name: "invalid hmac within blinded route",
+			pkt:  fwdMsg,
+			opts: []ProcessOnionOpt{
+				WithBlindingPoint(blindingKey.PubKey()),
+			},
+			expectedCode: CodeInvalidOnionBlinding,
+			expectedErr:  ErrInvalidOnionHMAC,
+		},
+		{
+			name:         "invalid version",
+			pkt:          &badVersion,
+			expectedCode: CodeInvalidOnionVersion,
+			expectedErr:  ErrInvalidOnionVersion,
+		},
+	}
+
+	for _, testCase := range testCases {
+		_, err := nodes[0].ProcessOnionPacket(
+			testCase.pkt, []byte("somethingelse"), 1,
+			testCase.opts...,
+		)
+
+		procErr, ok := err.(*ProcessingError)
+		if !ok {
+			t.Fatalf("%s: expected processing error, got %v",
+				testCase.name, err)
+		}
+		if !errors.Is(err, testCase.expectedErr) {
+			t.Fatalf("%s: expected error %v, got %v",
+				testCase.name, testCase.expectedErr, err)
+		}
+		if procErr.Code != testCase.expectedCode {
+			t.Fatalf("%s: expected code 0x%04x, got 0x%04x",
+				testCase.name, testCase.expectedCode,
+				procErr.Code)
+		}
+
+		// The hash covers the onion exactly as it was received.
+		var b bytes.Buffer
+		if err := testCase.pkt.Encode(&b); err != nil {
+			t.Fatalf("unable to encode onion: %v", err)
+		}
+		if procErr.OnionHash != sha256.Sum256(b.Bytes()) {
+			t.Fatalf("%s: onion hash mismatch", testCase.name)
+		}
+	}
+
+	// Errors that don't signal a malformed onion are returned as is.
+	if NewProcessingError(nil, ErrReplayedPacket) != nil {
+		t.Fatalf("expected replay not to be a processing error")
+	}
+
+	// Wrapped errors, such as those of a custom SingleKeyECDH, are matched
+	// as well.
+	wrappedErr := fmt.Errorf("ecdh failed: %w", ErrInvalidOnionKey)
+	procErr := NewProcessingError([]byte("onion"), wrappedErr)
+	if procErr == nil {
+		t.Fatalf("expected wrapped error to be a processing error")
+	}
+	if procErr.Code != CodeInvalidOnionKey {
+		t.Fatalf("expected code 0x%04x, got 0x%04x",
+			CodeInvalidOnionKey, procErr.Code)
+	}
+	if !errors.Is(procErr, wrappedErr) {
+		t.Fatalf("expected wrapped error to be retained")
+	}
+}
+
 func TestSphinxEncodeDecode(t *testing.T) {
 	// Create some test data with a randomly populated, yet valid onion
 	// forwarding message.
@@ -543,7 +911,8 @@ func newEOBRoute(numHops uint32,
 		}
 
 		nodes[i] = NewRouter(
-			privKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+			&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+			NewMemoryReplayLog(),
 		)
 	}
 
@@ -554,7 +923,7 @@ func newEOBRoute(numHops uint32,
 	)
 	for i := 0; i < len(nodes); i++ {
 		route[i] = OnionHop{
-			NodePub:    *nodes[i].onionKey.PubKey(),
+			NodePub:    *nodes[i].onionKeys[0].Key.PubKey(),
 			HopPayload: eobMapping[i],
 		}
 	}
@@ -944,3 +1313,299 @@ func TestVariablePayloadOnion(t *testing.T) {
 			hex.EncodeToString(b.Bytes()))
 	}
 }
+
+// TestVariableSizeOnionPacket tests that onion packets with a routing info
+// size other than the BOLT 04 default can be constructed, serialized and
+// processed by every hop in the route.
+func TestVariableSizeOnionPacket(t *testing.T) {
+	t.Parallel()
+
+	const (
+		numHops     = 3
+		routingSize = 400
+	)
+
+	var route PaymentPath
+	nodes := make([]*Router, numHops)
+	for i := 0; i < numHops; i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+
+		nodes[i] = NewRouter(
+			&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+			NewMemoryReplayLog(),
+		)
+		nodes[i].log.Start()
+		defer nodes[i].log.Stop()
+
+		route[i] = OnionHop{
+			NodePub: *privKey.PubKey(),
+			HopPayload: HopPayload{
+				Type:    PayloadTLV,
+				Payload: bytes.Repeat([]byte{byte(i + 1)}, 50),
+			},
+		}
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+
+	// Constructing a packet with an invalid size should fail.
+	for _, size := range []int{0, -1, MaxRoutingInfoSize + 1} {
+		_, err := NewOnionPacket(
+			&route, sessionKey, nil, BlankPacketFiller,
+			WithRoutingInfoSize(size),
+		)
+		if err != ErrInvalidRoutingInfoSize {
+			t.Fatalf("expected ErrInvalidRoutingInfoSize for size "+
+				"%d, got %v", size, err)
+		}
+	}
+
+	// The payloads don't fit into a tiny routing info.
+	_, err := NewOnionPacket(
+		&route, sessionKey, nil, BlankPacketFiller,
+		WithRoutingInfoSize(100),
+	)
+	if err != ErrMaxRoutingInfoSizeExceeded {
+		t.Fatalf("expected ErrMaxRoutingInfoSizeExceeded, got %v", err)
+	}
+
+	pkt, err := NewOnionPacket(
+		&route, sessionKey, nil, DeterministicPacketFiller,
+		WithRoutingInfoSize(routingSize),
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	for i := 0; i < numHops; i++ {
+		// Round trip the packet through its serialized form, which
+		// requires the receiver to know the routing info size.
+		var b bytes.Buffer
+		if err := pkt.Encode(&b); err != nil {
+			t.Fatalf("unable to encode packet: %v", err)
+		}
+		if b.Len() != 1+33+routingSize+HMACSize {
+			t.Fatalf("unexpected packet length: %v", b.Len())
+		}
+
+		decoded := &OnionPacket{
+			RoutingInfo: make([]byte, routingSize),
+		}
+		if err := decoded.Decode(&b); err != nil {
+			t.Fatalf("unable to decode packet: %v", err)
+		}
+		if !reflect.DeepEqual(pkt, decoded) {
+			t.Fatalf("packet mismatch: expected %v, got %v",
+				spew.Sdump(pkt), spew.Sdump(decoded))
+		}
+
+		processed, err := nodes[i].ProcessOnionPacket(
+			decoded, nil, uint32(i),
+		)
+		if err != nil {
+			t.Fatalf("hop %d: unable to process packet: %v", i, err)
+		}
+
+		if !bytes.Equal(processed.Payload.Payload,
+			route[i].HopPayload.Payload) {
+
+			t.Fatalf("hop %d: payload mismatch", i)
+		}
+
+		if i == numHops-1 {
+			if processed.Action != ExitNode {
+				t.Fatalf("expected exit node, got %v",
+					processed.Action)
+			}
+			break
+		}
+
+		if len(processed.NextPacket.RoutingInfo) != routingSize {
+			t.Fatalf("hop %d: next packet has routing info of "+
+				"%d bytes", i, len(processed.NextPacket.RoutingInfo))
+		}
+		pkt = processed.NextPacket
+	}
+}
+
+// splitKeyECDH is a SingleKeyECDH whose private key is split into two
+// additive shares, neither of which is ever combined in memory. It also
+// honors the cancellation of the passed context, as a remote signer would.
+type splitKeyECDH struct {
+	share1, share2 *btcec.PrivateKey
+}
+
+// PubKey returns the public key of the combined onion key.
+func (s *splitKeyECDH) PubKey() *btcec.PublicKey {
+	pub := &btcec.PublicKey{Curve: btcec.S256()}
+	pub.X, pub.Y = btcec.S256().Add(
+		s.share1.X, s.share1.Y, s.share2.X, s.share2.Y,
+	)
+
+	return pub
+}
+
+// ECDH performs ECDH with each of the shares, and combines the results.
+func (s *splitKeyECDH) ECDH(ctx context.Context,
+	pubKey *btcec.PublicKey) ([32]byte, error) {
+
+	if err := ctx.Err(); err != nil {
+		return [32]byte{}, err
+	}
+
+	curve := btcec.S256()
+	x1, y1 := curve.ScalarMult(pubKey.X, pubKey.Y, s.share1.D.Bytes())
+	x2, y2 := curve.ScalarMult(pubKey.X, pubKey.Y, s.share2.D.Bytes())
+
+	point := &btcec.PublicKey{Curve: btcec.S256()}
+	point.X, point.Y = curve.Add(x1, y1, x2, y2)
+
+	return sha256.Sum256(point.SerializeCompressed()), nil
+}
+
+// TestRouterExternalECDH tests that a router can process onions using an
+// onion key that isn't held in memory as a single private key.
+func TestRouterExternalECDH(t *testing.T) {
+	t.Parallel()
+
+	const numHops = 3
+
+	var route PaymentPath
+	nodes := make([]*Router, numHops)
+	for i := 0; i < numHops; i++ {
+		share1, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		share2, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		onionKey := &splitKeyECDH{share1: share1, share2: share2}
+
+		nodes[i] = NewRouter(
+			onionKey, &chaincfg.MainNetParams, NewMemoryReplayLog(),
+		)
+		nodes[i].log.Start()
+		defer nodes[i].log.Stop()
+
+		route[i] = OnionHop{
+			NodePub: *onionKey.PubKey(),
+			HopPayload: HopPayload{
+				Type:    PayloadTLV,
+				Payload: []byte{2, 1, byte(i + 1)},
+			},
+		}
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	pkt, err := NewOnionPacket(
+		&route, sessionKey, nil, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	// A canceled context aborts processing with the error of the onion
+	// key, which isn't reported as a malformed onion.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = nodes[0].ProcessOnionPacket(pkt, nil, 0, WithContext(ctx))
+	if err != context.Canceled {
+		t.Fatalf("expected error %v, got %v", context.Canceled, err)
+	}
+
+	for i, node := range nodes {
+		processed, err := node.ProcessOnionPacket(pkt, nil, uint32(i))
+		if err != nil {
+			t.Fatalf("hop %d: unable to process packet: %v", i, err)
+		}
+
+		if !bytes.Equal(
+			processed.Payload.Payload, route[i].HopPayload.Payload,
+		) {
+
+			t.Fatalf("hop %d: payload mismatch", i)
+		}
+
+		pkt = processed.NextPacket
+	}
+}
+
+// referenceSharedSecrets derives the shared secrets of the hops in the
+// passed path by performing ECDH with each ephemeral key directly, using the
+// big.Int arithmetic of btcec. It serves as a reference for the optimized
+// derivation of generateSharedSecrets.
+func referenceSharedSecrets(paymentPath []*btcec.PublicKey,
+	sessionKey *btcec.PrivateKey) []Hash256 {
+
+	sharedSecrets := make([]Hash256, len(paymentPath))
+	ephemeralKey := new(big.Int).Set(sessionKey.D)
+	for i, hopPubKey := range paymentPath {
+		x, y := btcec.S256().ScalarMult(
+			hopPubKey.X, hopPubKey.Y, ephemeralKey.Bytes(),
+		)
+		sharedPoint := &btcec.PublicKey{
+			Curve: btcec.S256(), X: x, Y: y,
+		}
+		sharedSecrets[i] = sha256.Sum256(
+			sharedPoint.SerializeCompressed(),
+		)
+
+		x, y = btcec.S256().ScalarBaseMult(ephemeralKey.Bytes())
+		ephemeralPubKey := &btcec.PublicKey{
+			Curve: btcec.S256(), X: x, Y: y,
+		}
+		blindingFactor := sha256.Sum256(append(
+			ephemeralPubKey.SerializeCompressed(),
+			sharedSecrets[i][:]...,
+		))
+
+		ephemeralKey.Mul(
+			ephemeralKey, new(big.Int).SetBytes(blindingFactor[:]),
+		)
+		ephemeralKey.Mod(ephemeralKey, btcec.S256().N)
+	}
+
+	return sharedSecrets
+}
+
+// TestGenerateSharedSecrets tests that the shared secrets derived by the
+// sender match the ones derived by the reference implementation, for paths of
+// all lengths.
+func TestGenerateSharedSecrets(t *testing.T) {
+	t.Parallel()
+
+	paymentPath := make([]*btcec.PublicKey, NumMaxHops)
+	for i := range paymentPath {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		paymentPath[i] = privKey.PubKey()
+	}
+
+	for numHops := 1; numHops <= NumMaxHops; numHops++ {
+		sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+
+		sharedSecrets := generateSharedSecrets(
+			paymentPath[:numHops], sessionKey,
+		)
+		expected := referenceSharedSecrets(
+			paymentPath[:numHops], sessionKey,
+		)
+		if !reflect.DeepEqual(sharedSecrets, expected) {
+			t.Fatalf("%d hops: shared secret mismatch", numHops)
+		}
+	}
+}
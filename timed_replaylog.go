@@ -0,0 +1,233 @@
+package sphinx
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTimedTTL is the default time for which the entries of a
+	// TimedReplayLog that are added by a router are kept.
+	defaultTimedTTL = time.Hour
+
+	// defaultTimedSweepInterval is the default interval at which the
+	// expired entries of a TimedReplayLog are swept.
+	defaultTimedSweepInterval = time.Minute
+)
+
+// TimedOpt is a functional option that can be used to modify the behavior of
+// a TimedReplayLog.
+type TimedOpt func(*TimedReplayLog)
+
+// WithTimedClock is a functional option that sets the function used by the
+// log to obtain the current time. By default, time.Now is used.
+func WithTimedClock(now func() time.Time) TimedOpt {
+	return func(l *TimedReplayLog) {
+		l.now = now
+	}
+}
+
+// WithTimedTTL is a functional option that sets the time for which the entries
+// added by a router are kept. By default, entries are kept for an hour.
+func WithTimedTTL(ttl time.Duration) TimedOpt {
+	return func(l *TimedReplayLog) {
+		l.ttl = ttl
+	}
+}
+
+// WithTimedSweepInterval is a functional option that sets the interval at
+// which expired entries are swept from the log. By default, they're swept
+// every minute, which is also used if the interval isn't positive.
+func WithTimedSweepInterval(interval time.Duration) TimedOpt {
+	return func(l *TimedReplayLog) {
+		l.sweepInterval = interval
+	}
+}
+
+// TimedReplayLog is a replay log whose entries expire at a point in time,
+// rather than at a block height. It protects packets that carry no CLTV, such
+// as onion messages or generic mix-net traffic. The entries are stored within
+// a backing ExpiringReplayLog, with their expiry as a Unix timestamp in
+// seconds in place of the CLTV, so any such log can be used, persistent or
+// not. Expired entries are swept from the backing log automatically while the
+// log is started.
+type TimedReplayLog struct {
+	log ExpiringReplayLog
+
+	now           func() time.Time
+	ttl           time.Duration
+	sweepInterval time.Duration
+
+	// mtx serializes the replacement of entries that have expired, but
+	// haven't been swept yet.
+	mtx sync.Mutex
+
+	wg   sync.WaitGroup
+	quit chan struct{}
+}
+
+// NewTimedReplayLog creates a TimedReplayLog storing its entries within the
+// passed log, which must not be used for anything else, as its entries are
+// expired by time.
+func NewTimedReplayLog(log ExpiringReplayLog,
+	opts ...TimedOpt) *TimedReplayLog {
+
+	l := &TimedReplayLog{
+		log:           log,
+		now:           time.Now,
+		ttl:           defaultTimedTTL,
+		sweepInterval: defaultTimedSweepInterval,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if l.sweepInterval <= 0 {
+		l.sweepInterval = defaultTimedSweepInterval
+	}
+
+	return l
+}
+
+// Start starts the backing log, along with the goroutine that sweeps expired
+// entries.
+func (l *TimedReplayLog) Start() error {
+	if err := l.log.Start(); err != nil {
+		return err
+	}
+
+	l.quit = make(chan struct{})
+
+	l.wg.Add(1)
+	go l.sweeper()
+
+	return nil
+}
+
+// Stop stops the sweeper goroutine, followed by the backing log.
+func (l *TimedReplayLog) Stop() error {
+	close(l.quit)
+	l.wg.Wait()
+
+	return l.log.Stop()
+}
+
+// timestamp returns the passed time as a Unix timestamp in seconds, rounded
+// up so that entries don't expire early, and clamped to fit a uint32.
+func timestamp(t time.Time) uint32 {
+	secs := t.Unix()
+	if t.Nanosecond() > 0 {
+		secs++
+	}
+
+	switch {
+	case secs < 0:
+		return 0
+	case secs > math.MaxUint32:
+		return math.MaxUint32
+	default:
+		return uint32(secs)
+	}
+}
+
+// Get returns the expiry of the entry with the passed hash prefix. It returns
+// ErrLogEntryNotFound if the entry isn't in the log, or has expired.
+func (l *TimedReplayLog) Get(hash *HashPrefix) (time.Time, error) {
+	expiry, err := l.log.Get(hash)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if expiry < timestamp(l.now()) {
+		return time.Time{}, ErrLogEntryNotFound
+	}
+
+	return time.Unix(int64(expiry), 0), nil
+}
+
+// Put stores an entry with the passed hash prefix into the log, which expires
+// at the passed time. It returns ErrReplayedPacket if the log already holds an
+// entry with the same hash prefix that hasn't expired.
+func (l *TimedReplayLog) Put(hash *HashPrefix, expiry time.Time) error {
+	err := l.log.Put(hash, timestamp(expiry))
+	if err != ErrReplayedPacket {
+		return err
+	}
+
+	// The log holds the hash prefix, but its entry may have expired
+	// without having been swept yet, in which case it is replaced.
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	storedExpiry, err := l.log.Get(hash)
+	switch {
+	case err == ErrLogEntryNotFound:
+
+	case err != nil:
+		return err
+
+	case storedExpiry >= timestamp(l.now()):
+		return ErrReplayedPacket
+
+	default:
+		if err := l.log.Delete(hash); err != nil {
+			return err
+		}
+	}
+
+	return l.log.Put(hash, timestamp(expiry))
+}
+
+// put stores an entry with the passed hash prefix into the log, which expires
+// once the TTL of the log has elapsed.
+func (l *TimedReplayLog) put(hash *HashPrefix) error {
+	return l.Put(hash, l.now().Add(l.ttl))
+}
+
+// Delete deletes the entry with the passed hash prefix from the log.
+func (l *TimedReplayLog) Delete(hash *HashPrefix) error {
+	return l.log.Delete(hash)
+}
+
+// Sweep removes all entries that have expired from the backing log.
+func (l *TimedReplayLog) Sweep() error {
+	return l.log.Expire(timestamp(l.now()))
+}
+
+// sweeper sweeps expired entries at the sweep interval of the log until it is
+// stopped.
+//
+// NOTE: This method MUST be run as a goroutine.
+func (l *TimedReplayLog) sweeper() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Sweep(); err != nil {
+				sphxLog.Errorf("Unable to sweep timed replay "+
+					"log: %v", err)
+			}
+
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+// WithTimedReplayLog is a functional option that sets the replay log used by
+// the router to protect packets that carry no CLTV: onion packets processed
+// with an incoming CLTV of zero, and onion messages processed without the
+// WithReplayProtection option. Their entries are kept for the TTL of the log.
+// The log is started and stopped along with the router. As batches are only
+// kept until their entries expire by block height, packets without a CLTV
+// can't be added to the transactions of the router, which return
+// ErrTxMissingCltv instead.
+func WithTimedReplayLog(log *TimedReplayLog) RouterOpt {
+	return func(r *Router) {
+		r.timedLog = log
+	}
+}
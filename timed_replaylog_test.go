@@ -0,0 +1,261 @@
+package sphinx
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brsuite/brond/btcec"
+	"github.com/brsuite/brond/chaincfg"
+)
+
+// testClock is a clock whose time only changes when it is advanced.
+type testClock struct {
+	mtx sync.Mutex
+	t   time.Time
+}
+
+// newTestClock creates a clock set to an arbitrary point in time.
+func newTestClock() *testClock {
+	return &testClock{t: time.Unix(1700000000, 0)}
+}
+
+// now returns the current time of the clock.
+func (c *testClock) now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.t
+}
+
+// advance moves the clock forward by the passed duration.
+func (c *testClock) advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.t = c.t.Add(d)
+}
+
+// TestTimedReplayLog tests that the entries of a TimedReplayLog reject replays
+// until they expire, even if they haven't been swept yet.
+func TestTimedReplayLog(t *testing.T) {
+	t.Parallel()
+
+	clock := newTestClock()
+	rl := NewTimedReplayLog(
+		NewMemoryReplayLog(), WithTimedClock(clock.now),
+		WithTimedSweepInterval(time.Hour),
+	)
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	hashPrefix := randHashPrefix(t)
+	if _, err := rl.Get(hashPrefix); err != ErrLogEntryNotFound {
+		t.Fatalf("expected error %v, got %v", ErrLogEntryNotFound, err)
+	}
+
+	// Expiries are rounded up to the next second.
+	expiry := clock.now().Add(10*time.Second + time.Millisecond)
+	if err := rl.Put(hashPrefix, expiry); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	storedExpiry, err := rl.Get(hashPrefix)
+	if err != nil {
+		t.Fatalf("unable to get entry: %v", err)
+	}
+	if !storedExpiry.Equal(clock.now().Add(11 * time.Second)) {
+		t.Fatalf("unexpected expiry %v", storedExpiry)
+	}
+
+	// The entry rejects replays up to and including its expiry.
+	clock.advance(11 * time.Second)
+	err = rl.Put(hashPrefix, clock.now().Add(time.Minute))
+	if err != ErrReplayedPacket {
+		t.Fatalf("expected error %v, got %v", ErrReplayedPacket, err)
+	}
+
+	// Once it has expired, the entry is no longer found, and is replaced
+	// when the hash prefix is added anew.
+	clock.advance(time.Second)
+	if _, err := rl.Get(hashPrefix); err != ErrLogEntryNotFound {
+		t.Fatalf("expected error %v, got %v", ErrLogEntryNotFound, err)
+	}
+
+	expiry = clock.now().Add(time.Minute)
+	if err := rl.Put(hashPrefix, expiry); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if err := rl.Put(hashPrefix, expiry); err != ErrReplayedPacket {
+		t.Fatalf("expected error %v, got %v", ErrReplayedPacket, err)
+	}
+
+	if err := rl.Delete(hashPrefix); err != nil {
+		t.Fatalf("unable to delete entry: %v", err)
+	}
+	if _, err := rl.Get(hashPrefix); err != ErrLogEntryNotFound {
+		t.Fatalf("expected error %v, got %v", ErrLogEntryNotFound, err)
+	}
+}
+
+// TestTimedReplayLogSweep tests that expired entries are swept from the
+// backing log automatically.
+func TestTimedReplayLogSweep(t *testing.T) {
+	t.Parallel()
+
+	clock := newTestClock()
+	backing := NewMemoryReplayLog()
+	rl := NewTimedReplayLog(
+		backing, WithTimedClock(clock.now),
+		WithTimedSweepInterval(time.Millisecond),
+	)
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	defer rl.Stop()
+
+	expired, live := randHashPrefix(t), randHashPrefix(t)
+	if err := rl.Put(expired, clock.now().Add(time.Minute)); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+	if err := rl.Put(live, clock.now().Add(time.Hour)); err != nil {
+		t.Fatalf("unable to put entry: %v", err)
+	}
+
+	clock.advance(2 * time.Minute)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := backing.Get(expired)
+		if err == ErrLogEntryNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired entry wasn't swept: %v", err)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := backing.Get(live); err != nil {
+		t.Fatalf("unable to get live entry: %v", err)
+	}
+}
+
+// TestTimedReplayLogZeroSweepInterval tests that a sweep interval that isn't
+// positive is replaced by the default one.
+func TestTimedReplayLogZeroSweepInterval(t *testing.T) {
+	t.Parallel()
+
+	rl := NewTimedReplayLog(
+		NewMemoryReplayLog(), WithTimedSweepInterval(0),
+	)
+	if rl.sweepInterval != defaultTimedSweepInterval {
+		t.Fatalf("expected sweep interval %v, got %v",
+			defaultTimedSweepInterval, rl.sweepInterval)
+	}
+
+	if err := rl.Start(); err != nil {
+		t.Fatalf("unable to start replay log: %v", err)
+	}
+	if err := rl.Stop(); err != nil {
+		t.Fatalf("unable to stop replay log: %v", err)
+	}
+}
+
+// TestRouterTimedReplayLog tests that a router checks the packets and onion
+// messages that carry no CLTV against its timed replay log.
+func TestRouterTimedReplayLog(t *testing.T) {
+	t.Parallel()
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	clock := newTestClock()
+	cltvLog := NewMemoryReplayLog()
+	router := NewRouter(
+		&PrivKeyECDH{PrivKey: privKey}, &chaincfg.MainNetParams,
+		cltvLog, WithTimedReplayLog(NewTimedReplayLog(
+			NewMemoryReplayLog(), WithTimedClock(clock.now),
+			WithTimedTTL(time.Minute),
+		)),
+	)
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+	defer router.Stop()
+
+	// A packet without a CLTV is rejected as a replay until its entry
+	// expires, without being stored in the CLTV replay log.
+	pkt, _ := newSingleHopOnion(t, privKey.PubKey())
+	if _, err := router.ProcessOnionPacket(pkt, nil, 0); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	_, err = router.ProcessOnionPacket(pkt, nil, 0)
+	if err != ErrReplayedPacket {
+		t.Fatalf("expected error %v, got %v", ErrReplayedPacket, err)
+	}
+
+	var numEntries int
+	err = cltvLog.ForEachEntry(func(*HashPrefix, uint32) error {
+		numEntries++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to iterate entries: %v", err)
+	}
+	if numEntries != 0 {
+		t.Fatalf("expected no entries in cltv log, got %d", numEntries)
+	}
+
+	// Packets without a CLTV can't be batched, as the batch would only
+	// protect them until the next block.
+	tx := router.BeginTxn([]byte("batch"), 1)
+	err = tx.ProcessOnionPacket(0, pkt, nil, 0)
+	if err != ErrTxMissingCltv {
+		t.Fatalf("expected error %v, got %v", ErrTxMissingCltv, err)
+	}
+	errs := tx.ProcessOnionPackets([]TxPacket{{SeqNum: 0, Packet: pkt}})
+	if errs[0] != ErrTxMissingCltv {
+		t.Fatalf("expected error %v, got %v", ErrTxMissingCltv, errs[0])
+	}
+
+	// The same goes for onion messages.
+	blindingKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'B'}, 32),
+	)
+	path, err := BuildOnionMessagePath(
+		blindingKey, []*btcec.PublicKey{privKey.PubKey()}, nil, nil,
+	)
+	if err != nil {
+		t.Fatalf("unable to build path: %v", err)
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	msg, err := NewOnionMessage(
+		path, sessionKey, nil, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion message: %v", err)
+	}
+	if _, err := router.ProcessOnionMessage(msg); err != nil {
+		t.Fatalf("unable to process message: %v", err)
+	}
+	if _, err := router.ProcessOnionMessage(msg); err != ErrReplayedPacket {
+		t.Fatalf("expected error %v, got %v", ErrReplayedPacket, err)
+	}
+
+	// Once the TTL has elapsed, both are accepted again.
+	clock.advance(2 * time.Minute)
+	if _, err := router.ProcessOnionPacket(pkt, nil, 0); err != nil {
+		t.Fatalf("unable to process packet: %v", err)
+	}
+	if _, err := router.ProcessOnionMessage(msg); err != nil {
+		t.Fatalf("unable to process message: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package sphinx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+var (
+	// ErrTLVNotSorted is returned when a TLV stream contains records that
+	// aren't strictly increasing in type.
+	ErrTLVNotSorted = errors.New("tlv stream records not in canonical " +
+		"order")
+
+	// ErrNonCanonicalTruncatedInt is returned when a truncated integer
+	// record has leading zero bytes, or exceeds the size of its type.
+	ErrNonCanonicalTruncatedInt = errors.New("truncated integer not " +
+		"minimally encoded")
+)
+
+// DecodeTLVStream splits the raw TLV stream contained in b into a mapping
+// from record type to record value. Both the type and the length of each
+// record are encoded as BigSize integers (the varints implemented in this
+// package). Records must appear in strictly increasing order of their type.
+func DecodeTLVStream(b []byte) (map[uint64][]byte, error) {
+	var (
+		r        = bytes.NewReader(b)
+		buf      [8]byte
+		records  = make(map[uint64][]byte)
+		lastType uint64
+	)
+	for i := 0; ; i++ {
+		recordType, err := ReadVarInt(r, &buf)
+		switch {
+		// A clean EOF before the type marks the end of the stream.
+		case err == io.EOF:
+			return records, nil
+
+		case err != nil:
+			return nil, err
+		}
+
+		if i > 0 && recordType <= lastType {
+			return nil, ErrTLVNotSorted
+		}
+		lastType = recordType
+
+		length, err := ReadVarInt(r, &buf)
+		switch {
+		case err == io.EOF:
+			return nil, io.ErrUnexpectedEOF
+		case err != nil:
+			return nil, err
+		}
+
+		if length > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		value := make([]byte, length)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+
+		records[recordType] = value
+	}
+}
+
+// EncodeTLVStream serializes the passed records as a TLV stream. The records
+// are written in increasing order of their type, as required for the stream
+// to be canonical.
+func EncodeTLVStream(records map[uint64][]byte) []byte {
+	types := make([]uint64, 0, len(records))
+	for recordType := range records {
+		types = append(types, recordType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+
+	var (
+		b   bytes.Buffer
+		buf [8]byte
+	)
+	for _, recordType := range types {
+		value := records[recordType]
+
+		// Writes to a bytes.Buffer never fail, so we can safely
+		// ignore the errors here.
+		_ = WriteVarInt(&b, recordType, &buf)
+		_ = WriteVarInt(&b, uint64(len(value)), &buf)
+		_, _ = b.Write(value)
+	}
+
+	return b.Bytes()
+}
+
+// encodeTruncatedInt encodes v as a truncated integer, i.e. in big-endian
+// byte order with all leading zero bytes omitted. Zero is encoded as an empty
+// value.
+func encodeTruncatedInt(v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+
+	i := 0
+	for i < len(b) && b[i] == 0 {
+		i++
+	}
+
+	return b[i:]
+}
+
+// decodeTruncatedInt decodes a truncated integer that is at most maxLen bytes
+// long. As with all TLV values, the encoding must be minimal.
+func decodeTruncatedInt(b []byte, maxLen int) (uint64, error) {
+	if len(b) > maxLen || (len(b) > 0 && b[0] == 0) {
+		return 0, ErrNonCanonicalTruncatedInt
+	}
+
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+
+	return v, nil
+}
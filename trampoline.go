@@ -0,0 +1,114 @@
+package sphinx
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/brsuite/brond/btcec"
+)
+
+const (
+	// TrampolineRoutingInfoSize is the size of the routing info of a
+	// trampoline onion. It is small enough for the trampoline onion to fit
+	// within the payload of a single hop of a regular payment onion.
+	TrampolineRoutingInfoSize = 400
+
+	// trampolineOnionPacketType is the TLV type of the hop payload record
+	// that carries the trampoline onion packet.
+	trampolineOnionPacketType = 66100
+)
+
+// NewTrampolineOnionPacket creates a new trampoline onion packet for the
+// passed path of trampoline nodes. The resulting packet should be embedded
+// within the payload of the first trampoline node of a regular payment onion,
+// see NewTrampolineHopPayload.
+func NewTrampolineOnionPacket(trampolinePath *PaymentPath,
+	sessionKey *btcec.PrivateKey, assocData []byte,
+	pktFiller PacketFiller) (*OnionPacket, error) {
+
+	return NewOnionPacket(
+		trampolinePath, sessionKey, assocData, pktFiller,
+		WithRoutingInfoSize(TrampolineRoutingInfoSize),
+	)
+}
+
+// NewTrampolineHopPayload creates the TLV payload for the final hop of a
+// regular payment onion that delivers the passed trampoline onion packet to
+// the next trampoline node. The records argument is an optional TLV stream of
+// additional records to include in the payload, such as the amount and CLTV
+// of the outer onion.
+func NewTrampolineHopPayload(records []byte,
+	trampolinePkt *OnionPacket) (HopPayload, error) {
+
+	tlvRecords, err := DecodeTLVStream(records)
+	if err != nil {
+		return HopPayload{}, err
+	}
+
+	if _, ok := tlvRecords[trampolineOnionPacketType]; ok {
+		return HopPayload{}, errors.New("records must not contain a " +
+			"trampoline onion packet")
+	}
+
+	var b bytes.Buffer
+	if err := trampolinePkt.Encode(&b); err != nil {
+		return HopPayload{}, err
+	}
+	tlvRecords[trampolineOnionPacketType] = b.Bytes()
+
+	return NewHopPayload(nil, EncodeTLVStream(tlvRecords))
+}
+
+// processTrampolinePayload inspects the payload of a packet that terminates
+// at our node for a trampoline onion. If one is found, we'll peel a layer off
+// it as well, and attach the result to the processed packet. The trampoline
+// onion is authenticated with the same associated data as the outer onion.
+func processTrampolinePayload(packet *ProcessedPacket, assocData []byte,
+	sharedSecretGen sharedSecretGenerator) error {
+
+	// Only the final hop of the outer onion can be a trampoline node.
+	if packet.Action != ExitNode || packet.Payload.Type != PayloadTLV {
+		return nil
+	}
+
+	// As with route blinding, a payload that doesn't parse as a TLV
+	// stream is left for the higher layers to interpret.
+	records, err := DecodeTLVStream(packet.Payload.Payload)
+	if err != nil {
+		return nil
+	}
+
+	rawPkt, ok := records[trampolineOnionPacketType]
+	if !ok {
+		return nil
+	}
+
+	// Errors of the trampoline onion are wrapped in a TrampolineError, as
+	// they must be reported to the sender within an encrypted failure,
+	// rather than being mistaken for a malformed outer onion.
+	trampolinePkt, err := decodeSizedOnionPacket(
+		bytes.NewReader(rawPkt), len(rawPkt),
+	)
+	if err != nil {
+		return &TrampolineError{Err: err}
+	}
+
+	sharedSecret, err := sharedSecretGen.generateSharedSecret(
+		trampolinePkt.EphemeralKey,
+	)
+	if err != nil {
+		return &TrampolineError{Err: err}
+	}
+
+	trampoline, err := processOnionPacket(
+		trampolinePkt, &sharedSecret, assocData, nil, sharedSecretGen,
+	)
+	if err != nil {
+		return &TrampolineError{Err: err}
+	}
+
+	packet.TrampolinePacket = trampolinePkt
+	packet.Trampoline = trampoline
+
+	return nil
+}
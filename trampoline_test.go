@@ -0,0 +1,341 @@
+package sphinx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/brsuite/brond/btcec"
+)
+
+// newTrampolineTestRoute builds a payment path of TLV hops to the passed
+// nodes, with the given payload for the final hop.
+func newTrampolineTestRoute(t *testing.T, nodeKeys []*btcec.PublicKey,
+	finalPayload HopPayload) *PaymentPath {
+
+	var route PaymentPath
+	for i, nodeKey := range nodeKeys {
+		hopPayload := finalPayload
+		if i < len(nodeKeys)-1 {
+			var err error
+			hopPayload, err = NewHopPayload(
+				nil, EncodeTLVStream(map[uint64][]byte{
+					2: {byte(i)},
+				}),
+			)
+			if err != nil {
+				t.Fatalf("unable to create hop payload: %v",
+					err)
+			}
+		}
+
+		route[i] = OnionHop{
+			NodePub:    *nodeKey,
+			HopPayload: hopPayload,
+		}
+	}
+
+	return &route
+}
+
+// TestTrampolineOnion tests that a payment can be sent through a pair of
+// trampoline nodes, where the first trampoline node peels its layer off the
+// trampoline onion and wraps the remainder in a fresh outer onion to the
+// second, and that errors originating from either of the trampoline nodes can
+// be decrypted by the sender.
+func TestTrampolineOnion(t *testing.T) {
+	t.Parallel()
+
+	// The sender reaches the first trampoline node T1 through node A, and
+	// T1 reaches the recipient trampoline node T2 through node B.
+	nodes, nodeKeys := newTestRouters(t, 4)
+	for _, node := range nodes {
+		defer node.Stop()
+	}
+	a, t1, b, t2 := nodes[0], nodes[1], nodes[2], nodes[3]
+	aKey, t1Key, bKey, t2Key := nodeKeys[0], nodeKeys[1], nodeKeys[2],
+		nodeKeys[3]
+
+	assocData := bytes.Repeat([]byte{'P'}, 32)
+	finalRecords := map[uint64][]byte{8: []byte("payment secret")}
+
+	// First, the sender builds the trampoline onion to T1 and T2.
+	trampolineSessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'T'}, 32),
+	)
+	finalPayload, err := NewHopPayload(nil, EncodeTLVStream(finalRecords))
+	if err != nil {
+		t.Fatalf("unable to create hop payload: %v", err)
+	}
+	trampolinePath := []*btcec.PublicKey{t1Key, t2Key}
+	trampolinePkt, err := NewTrampolineOnionPacket(
+		newTrampolineTestRoute(t, trampolinePath, finalPayload),
+		trampolineSessionKey, assocData, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create trampoline onion: %v", err)
+	}
+	if len(trampolinePkt.RoutingInfo) != TrampolineRoutingInfoSize {
+		t.Fatalf("expected routing info of %d bytes, got %d",
+			TrampolineRoutingInfoSize,
+			len(trampolinePkt.RoutingInfo))
+	}
+
+	// It is then embedded within the payload of T1 in the outer onion.
+	outerPath := []*btcec.PublicKey{aKey, t1Key}
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	t1Payload, err := NewTrampolineHopPayload(nil, trampolinePkt)
+	if err != nil {
+		t.Fatalf("unable to create trampoline hop payload: %v", err)
+	}
+	pkt, err := NewOnionPacket(
+		newTrampolineTestRoute(t, outerPath, t1Payload), sessionKey,
+		assocData, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	processedA, err := a.ProcessOnionPacket(pkt, assocData, 10)
+	if err != nil {
+		t.Fatalf("unable to process packet at A: %v", err)
+	}
+	if processedA.Trampoline != nil {
+		t.Fatalf("intermediate hop shouldn't process a trampoline " +
+			"onion")
+	}
+
+	processedT1, err := t1.ProcessOnionPacket(
+		processedA.NextPacket, assocData, 10,
+	)
+	if err != nil {
+		t.Fatalf("unable to process packet at T1: %v", err)
+	}
+	if processedT1.Action != ExitNode {
+		t.Fatalf("expected T1 to be the final outer hop, got %v",
+			processedT1.Action)
+	}
+	if processedT1.Trampoline == nil ||
+		processedT1.Trampoline.Action != MoreHops {
+
+		t.Fatalf("expected T1 to forward the trampoline onion")
+	}
+
+	// T1 wraps the remainder of the trampoline onion in a fresh outer
+	// onion to T2.
+	t1SessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'B'}, 32),
+	)
+	t2Payload, err := NewTrampolineHopPayload(
+		nil, processedT1.Trampoline.NextPacket,
+	)
+	if err != nil {
+		t.Fatalf("unable to create trampoline hop payload: %v", err)
+	}
+	t1OuterPath := []*btcec.PublicKey{bKey, t2Key}
+	t1Pkt, err := NewOnionPacket(
+		newTrampolineTestRoute(t, t1OuterPath, t2Payload), t1SessionKey,
+		assocData, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	processedB, err := b.ProcessOnionPacket(t1Pkt, assocData, 10)
+	if err != nil {
+		t.Fatalf("unable to process packet at B: %v", err)
+	}
+	processedT2, err := t2.ProcessOnionPacket(
+		processedB.NextPacket, assocData, 10,
+	)
+	if err != nil {
+		t.Fatalf("unable to process packet at T2: %v", err)
+	}
+	if processedT2.Trampoline == nil ||
+		processedT2.Trampoline.Action != ExitNode {
+
+		t.Fatalf("expected T2 to be the final trampoline hop")
+	}
+
+	records, err := DecodeTLVStream(
+		processedT2.Trampoline.Payload.Payload,
+	)
+	if err != nil {
+		t.Fatalf("unable to parse final payload: %v", err)
+	}
+	if !bytes.Equal(records[8], finalRecords[8]) {
+		t.Fatalf("final record mismatch")
+	}
+
+	// Now, we'll assert that errors can be decrypted by the sender, no
+	// matter which of the trampoline nodes they originate from.
+	newEncrypter := func(router *Router, ephemeralKey,
+		trampolineKey *btcec.PublicKey) *OnionErrorEncrypter {
+
+		var (
+			encrypter *OnionErrorEncrypter
+			err       error
+		)
+		if trampolineKey == nil {
+			encrypter, err = NewOnionErrorEncrypter(
+				router, ephemeralKey,
+			)
+		} else {
+			encrypter, err = NewTrampolineErrorEncrypter(
+				router, ephemeralKey, trampolineKey,
+			)
+		}
+		if err != nil {
+			t.Fatalf("unable to create encrypter: %v", err)
+		}
+
+		// The encrypter must survive a round trip to disk.
+		var buf bytes.Buffer
+		if err := encrypter.Encode(&buf); err != nil {
+			t.Fatalf("unable to encode encrypter: %v", err)
+		}
+		var decoded OnionErrorEncrypter
+		if err := decoded.Decode(&buf); err != nil {
+			t.Fatalf("unable to decode encrypter: %v", err)
+		}
+
+		return &decoded
+	}
+
+	encrypterA := newEncrypter(a, pkt.EphemeralKey, nil)
+	encrypterT1 := newEncrypter(
+		t1, processedA.NextPacket.EphemeralKey,
+		processedT1.TrampolinePacket.EphemeralKey,
+	)
+	encrypterB := newEncrypter(b, t1Pkt.EphemeralKey, nil)
+	encrypterT2 := newEncrypter(
+		t2, processedB.NextPacket.EphemeralKey,
+		processedT2.TrampolinePacket.EphemeralKey,
+	)
+
+	// backToSender relays an error from T1 back to the sender.
+	backToSender := func(data []byte) []byte {
+		return encrypterA.EncryptError(false, data)
+	}
+
+	decrypter := NewTrampolineErrorDecrypter(
+		&Circuit{SessionKey: sessionKey, PaymentPath: outerPath},
+		&Circuit{
+			SessionKey:  trampolineSessionKey,
+			PaymentPath: trampolinePath,
+		},
+	)
+
+	failureData := bytes.Repeat([]byte{'F'}, onionErrorLength-sha256.Size)
+
+	// An error from T1 is identified as coming from the first trampoline
+	// hop, which follows the two hops of the outer onion.
+	decrypted, err := decrypter.DecryptError(
+		backToSender(encrypterT1.EncryptError(true, failureData)),
+	)
+	if err != nil {
+		t.Fatalf("unable to decrypt error from T1: %v", err)
+	}
+	if decrypted.SenderIdx != 3 || !decrypted.Sender.IsEqual(t1Key) {
+		t.Fatalf("expected error from T1 at index 3, got index %d",
+			decrypted.SenderIdx)
+	}
+	if !bytes.Equal(decrypted.Message, failureData) {
+		t.Fatalf("error message mismatch")
+	}
+
+	// An error from T2 travels back through B to T1, which can't
+	// attribute it to a hop of its own outer onion. It unwraps the outer
+	// layers, and passes the error on to the sender.
+	errT2 := encrypterB.EncryptError(
+		false, encrypterT2.EncryptError(true, failureData),
+	)
+	t1Decrypter := NewOnionErrorDecrypter(&Circuit{
+		SessionKey: t1SessionKey, PaymentPath: t1OuterPath,
+	})
+	if _, err := t1Decrypter.DecryptError(errT2); err == nil {
+		t.Fatalf("expected T1 to be unable to decrypt the error")
+	}
+	errT2 = encrypterT1.EncryptError(false, t1Decrypter.UnwrapError(errT2))
+
+	decrypted, err = decrypter.DecryptError(backToSender(errT2))
+	if err != nil {
+		t.Fatalf("unable to decrypt error from T2: %v", err)
+	}
+	if decrypted.SenderIdx != 4 || !decrypted.Sender.IsEqual(t2Key) {
+		t.Fatalf("expected error from T2 at index 4, got index %d",
+			decrypted.SenderIdx)
+	}
+	if !bytes.Equal(decrypted.Message, failureData) {
+		t.Fatalf("error message mismatch")
+	}
+}
+
+// TestTrampolineOnionInvalidHMAC tests that a trampoline onion with an invalid
+// HMAC is rejected with a TrampolineError rather than a ProcessingError, as the
+// failure must be reported to the sender within an encrypted failure instead
+// of blaming the intact outer onion.
+func TestTrampolineOnionInvalidHMAC(t *testing.T) {
+	t.Parallel()
+
+	nodes, nodeKeys := newTestRouters(t, 1)
+	defer nodes[0].Stop()
+
+	assocData := bytes.Repeat([]byte{'P'}, 32)
+
+	trampolineSessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'T'}, 32),
+	)
+	finalPayload, err := NewHopPayload(
+		nil, EncodeTLVStream(map[uint64][]byte{2: {1}}),
+	)
+	if err != nil {
+		t.Fatalf("unable to create hop payload: %v", err)
+	}
+	trampolinePkt, err := NewTrampolineOnionPacket(
+		newTrampolineTestRoute(t, nodeKeys, finalPayload),
+		trampolineSessionKey, assocData, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create trampoline onion: %v", err)
+	}
+	trampolinePkt.HeaderMAC[0] ^= 1
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{'A'}, 32),
+	)
+	payload, err := NewTrampolineHopPayload(nil, trampolinePkt)
+	if err != nil {
+		t.Fatalf("unable to create trampoline hop payload: %v", err)
+	}
+	pkt, err := NewOnionPacket(
+		newTrampolineTestRoute(t, nodeKeys, payload), sessionKey,
+		assocData, DeterministicPacketFiller,
+	)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	_, err = nodes[0].ProcessOnionPacket(pkt, assocData, 10)
+
+	var trampolineErr *TrampolineError
+	if !errors.As(err, &trampolineErr) {
+		t.Fatalf("expected trampoline error, got %v", err)
+	}
+	if !errors.Is(err, ErrInvalidOnionHMAC) {
+		t.Fatalf("expected invalid hmac, got %v", err)
+	}
+
+	var procErr *ProcessingError
+	if errors.As(err, &procErr) {
+		t.Fatalf("trampoline error reported as processing error: %v",
+			err)
+	}
+	if NewProcessingError(nil, err) != nil {
+		t.Fatalf("expected trampoline error not to be a processing " +
+			"error")
+	}
+}
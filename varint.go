@@ -74,6 +74,50 @@ func ReadVarInt(r io.Reader, buf *[8]byte) (uint64, error) {
 	return rv, nil
 }
 
+// decodeVarInt decodes a var-int from the start of the passed slice, returning
+// its value along with the number of bytes it occupies. It returns the same
+// errors as ReadVarInt would when reading from the slice.
+func decodeVarInt(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, io.EOF
+	}
+
+	var (
+		length int
+		min    uint64
+	)
+	switch discriminant := b[0]; {
+	case discriminant < 0xfd:
+		return uint64(discriminant), 1, nil
+
+	case discriminant == 0xfd:
+		length, min = 2, 0xfd
+
+	case discriminant == 0xfe:
+		length, min = 4, 0x10000
+
+	default:
+		length, min = 8, 0x100000000
+	}
+
+	if len(b) < 1+length {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+
+	var rv uint64
+	for _, v := range b[1 : 1+length] {
+		rv = rv<<8 | uint64(v)
+	}
+
+	// The encoding is not canonical if the value could have been encoded
+	// using fewer bytes.
+	if rv < min {
+		return 0, 0, ErrVarIntNotCanonical
+	}
+
+	return rv, 1 + length, nil
+}
+
 // WriteVarInt serializes val to w using a variable number of bytes depending
 // on its value.
 func WriteVarInt(w io.Writer, val uint64, buf *[8]byte) error {